@@ -0,0 +1,157 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Format     string `usage:"Access log format: text, json or logfmt"`
+	Output     string `usage:"Access log output: stdout, stderr or a file path"`
+	MaxSize    int64  `usage:"Rotate the access log file when it reaches this size in bytes, 0 disables rotation"`
+	MaxBackups int    `usage:"Number of rotated access log files to keep"`
+}
+
+// Entry is a single request record.
+type Entry struct {
+	Time       time.Time     `json:"time"`
+	RequestId  string        `json:"request_id,omitempty"`
+	RemoteAddr string        `json:"remote_addr"`
+	User       string        `json:"user,omitempty"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Action     string        `json:"action,omitempty"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"-"`
+	Queue      string        `json:"queue,omitempty"`
+	Reads      int64         `json:"reads,omitempty"`
+	Writes     int64         `json:"writes,omitempty"`
+}
+
+type Logger struct {
+	Format string
+	Output io.Writer
+	mutex  sync.Mutex
+}
+
+// Open builds a logger from config, the returned closer releases the output.
+func Open(c Config) (*Logger, io.Closer, error) {
+
+	switch c.Format {
+	case "", "text", "json", "logfmt":
+	default:
+		return nil, nil, fmt.Errorf("unknown access log format '%s'", c.Format)
+	}
+
+	l := &Logger{
+		Format: c.Format,
+	}
+
+	switch c.Output {
+	case "", "stderr":
+		l.Output = os.Stderr
+		return l, nopCloser{}, nil
+	case "stdout":
+		l.Output = os.Stdout
+		return l, nopCloser{}, nil
+	}
+
+	f, err := OpenRotatingFile(c.Output, c.MaxSize, c.MaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.Output = f
+
+	return l, f, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func (l *Logger) Log(e *Entry) {
+
+	var line []byte
+	switch l.Format {
+	case "json":
+		line = formatJSON(e)
+	case "logfmt":
+		line = formatLogfmt(e)
+	default:
+		line = formatText(e)
+	}
+
+	l.mutex.Lock()
+	l.Output.Write(line)
+	l.mutex.Unlock()
+}
+
+func formatText(e *Entry) []byte {
+	return []byte(fmt.Sprintln(
+		e.Time.Format("2006/01/02 15:04:05"),
+		e.RemoteAddr, e.Method, e.URL, e.Duration, e.Action, e.Status, e.Bytes,
+		e.RequestId,
+	))
+}
+
+func formatJSON(e *Entry) []byte {
+	type entry Entry // avoid recursion
+	b, _ := json.Marshal(struct {
+		*entry
+		Duration float64 `json:"duration"`
+	}{
+		entry:    (*entry)(e),
+		Duration: e.Duration.Seconds(),
+	})
+	return append(b, '\n')
+}
+
+func formatLogfmt(e *Entry) []byte {
+
+	b := &strings.Builder{}
+
+	field := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(key)
+		b.WriteString("=")
+		if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+
+	field("time", e.Time.Format(time.RFC3339Nano))
+	if e.RequestId != "" {
+		field("request_id", e.RequestId)
+	}
+	field("remote_addr", e.RemoteAddr)
+	if e.User != "" {
+		field("user", e.User)
+	}
+	field("method", e.Method)
+	field("url", e.URL)
+	if e.Action != "" {
+		field("action", e.Action)
+	}
+	field("status", strconv.Itoa(e.Status))
+	field("bytes", strconv.FormatInt(e.Bytes, 10))
+	field("duration", strconv.FormatFloat(e.Duration.Seconds(), 'f', -1, 64))
+	if e.Queue != "" {
+		field("queue", e.Queue)
+		field("reads", strconv.FormatInt(e.Reads, 10))
+		field("writes", strconv.FormatInt(e.Writes, 10))
+	}
+
+	b.WriteString("\n")
+
+	return []byte(b.String())
+}
@@ -0,0 +1,94 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		Time:       time.Date(2022, 8, 15, 2, 8, 13, 0, time.UTC),
+		RequestId:  "abc",
+		RemoteAddr: "127.0.0.1",
+		User:       "CN=alice",
+		Method:     "GET",
+		URL:        "/v1/queues/my-queue:read",
+		Action:     "read",
+		Status:     200,
+		Bytes:      93,
+		Duration:   1500 * time.Millisecond,
+		Queue:      "my-queue",
+		Reads:      3,
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+
+	b := &strings.Builder{}
+	l := &Logger{Format: "json", Output: b}
+	l.Log(testEntry())
+
+	line := map[string]interface{}{}
+	biff.AssertNil(json.Unmarshal([]byte(b.String()), &line))
+	biff.AssertEqualJson(line, map[string]interface{}{
+		"time":        "2022-08-15T02:08:13Z",
+		"request_id":  "abc",
+		"remote_addr": "127.0.0.1",
+		"user":        "CN=alice",
+		"method":      "GET",
+		"url":         "/v1/queues/my-queue:read",
+		"action":      "read",
+		"status":      200,
+		"bytes":       93,
+		"duration":    1.5,
+		"queue":       "my-queue",
+		"reads":       3,
+	})
+}
+
+func TestLogger_Logfmt(t *testing.T) {
+
+	b := &strings.Builder{}
+	l := &Logger{Format: "logfmt", Output: b}
+	l.Log(testEntry())
+
+	biff.AssertEqual(b.String(), `time=2022-08-15T02:08:13Z request_id=abc remote_addr=127.0.0.1 `+
+		`user="CN=alice" method=GET url=/v1/queues/my-queue:read action=read status=200 bytes=93 `+
+		`duration=1.5 queue=my-queue reads=3 writes=0`+"\n")
+}
+
+func TestOpen_UnknownFormat(t *testing.T) {
+
+	_, _, err := Open(Config{Format: "xml"})
+	biff.AssertNotNil(err)
+}
+
+func TestRotatingFile(t *testing.T) {
+
+	filename := path.Join(t.TempDir(), "access.log")
+
+	f, err := OpenRotatingFile(filename, 10, 2)
+	biff.AssertNil(err)
+
+	f.Write([]byte("11111111\n"))
+	f.Write([]byte("22222222\n"))
+	f.Write([]byte("33333333\n"))
+	f.Write([]byte("44444444\n"))
+	biff.AssertNil(f.Close())
+
+	read := func(name string) string {
+		b, _ := os.ReadFile(name)
+		return string(b)
+	}
+
+	biff.AssertEqual(read(filename), "44444444\n")
+	biff.AssertEqual(read(filename+".1"), "33333333\n")
+	biff.AssertEqual(read(filename+".2"), "22222222\n")
+	biff.AssertEqual(read(filename+".3"), "")
+}
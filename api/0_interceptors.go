@@ -2,45 +2,38 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"runtime/debug"
 	"strings"
-	"time"
 
 	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/accesslog"
 )
 
+// RecoverFromPanic replies with a 500 error and prints the panic and its
+// stack to stderr.
 func RecoverFromPanic(next box.H) box.H {
-	return func(ctx context.Context) {
-		defer func() {
-			if err := recover(); err != nil {
-				debug.PrintStack()
-			}
-		}()
+	return recoverFromPanic(nil)(next)
+}
 
-		next(ctx)
-	}
+// RecoverFromPanicLog writes the panic and its stack as a JSON line to w.
+func RecoverFromPanicLog(w io.Writer) box.I {
+	return recoverFromPanic(w)
 }
 
 func AccessLog(l *log.Logger) box.I {
-	return func(next box.H) box.H {
-		return func(ctx context.Context) {
-			r := box.GetRequest(ctx)
-			action := ""
-			if boxAction := box.GetBoxContext(ctx).Action; boxAction != nil {
-				action = boxAction.Name
-			}
-			now := time.Now()
-			defer func() {
-				l.Println(formatRemoteAddr(r), r.Method, r.URL.String(), time.Since(now), action)
-			}()
+	return accessLog(func(e *accesslog.Entry) {
+		l.Println(e.RemoteAddr, e.Method, e.URL, e.Duration, e.Action, e.RequestId)
+	})
+}
 
-			next(ctx)
-		}
-	}
+// StructuredAccessLog logs status, size, user, request id and messages
+// read or written by streaming clients.
+func StructuredAccessLog(l *accesslog.Logger) box.I {
+	return accessLog(l.Log)
 }
 
 func formatRemoteAddr(r *http.Request) string {
@@ -62,48 +55,17 @@ func PrettyErrorInterceptor(next box.H) box.H {
 		if err == nil {
 			return
 		}
-		w := box.GetResponse(ctx)
 
-		if err == box.ErrResourceNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": map[string]interface{}{
-					"message":     err.Error(),
-					"description": fmt.Sprintf("resource '%s' not found", box.GetRequest(ctx).URL.String()),
-				},
-			})
-			return
-		}
+		r := box.GetRequest(ctx)
 
-		if err == box.ErrMethodNotAllowed {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": map[string]interface{}{
-					"message":     err.Error(),
-					"description": fmt.Sprintf("method '%s' not allowed", box.GetRequest(ctx).Method),
-				},
-			})
-			return
+		description := ""
+		switch err {
+		case box.ErrResourceNotFound:
+			description = fmt.Sprintf("resource '%s' not found", r.URL.String())
+		case box.ErrMethodNotAllowed:
+			description = fmt.Sprintf("method '%s' not allowed", r.Method)
 		}
 
-		if _, ok := err.(*json.SyntaxError); ok {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": map[string]interface{}{
-					"message":     err.Error(),
-					"description": "Malformed JSON",
-				},
-			})
-			return
-		}
-
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]interface{}{
-				"message":     err.Error(),
-				"description": "Unexpected error",
-			},
-		})
-
+		writeError(box.GetResponse(ctx), err, description)
 	}
 }
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/accesslog"
+	"github.com/fulldump/tailon/glueauth"
+)
+
+// responseRecorder keeps status and size of the response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is needed by websockets, the connection is logged as switching
+// protocols.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// accessRecord is shared through context so handlers can attach the
+// streaming client to the log entry
+type accessRecord struct {
+	entry  accesslog.Entry
+	client *Client
+}
+
+const accessRecordKey = "0c5e3a8a-9c0f-4d8e-8d2b-6a1f4e2b7c19"
+
+func setAccessClient(ctx context.Context, c *Client) {
+	if record, ok := ctx.Value(accessRecordKey).(*accessRecord); ok {
+		record.client = c
+	}
+}
+
+// quietActions are only logged when they fail, cluster members call them
+// several times a second
+var quietActions = map[string]bool{
+	"append": true,
+	"vote":   true,
+}
+
+func accessLog(write func(e *accesslog.Entry)) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			c := box.GetBoxContext(ctx)
+			r := c.Request
+
+			action := ""
+			if c.Action != nil {
+				action = c.Action.Name
+			}
+
+			recorder := &responseRecorder{ResponseWriter: c.Response}
+			c.Response = recorder
+
+			record := &accessRecord{
+				entry: accesslog.Entry{
+					Time:       time.Now(),
+					RequestId:  GetRequestId(ctx),
+					RemoteAddr: formatRemoteAddr(r),
+					User:       requestUser(r),
+					Method:     r.Method,
+					URL:        r.URL.String(),
+					Action:     action,
+				},
+			}
+
+			if record.entry.RequestId == "" {
+				record.entry.RequestId = r.Header.Get(RequestIdHeader)
+			}
+
+			defer func() {
+				e := &record.entry
+				e.Duration = time.Since(e.Time)
+				e.Status = recorder.status
+				if e.Status == 0 {
+					e.Status = http.StatusOK
+				}
+				e.Bytes = recorder.bytes
+				if client := record.client; client != nil {
+					e.Queue = client.Queue
+					e.Reads = client.Reads
+					e.Writes = client.Writes
+				}
+
+				httpRequestDuration.Observe(e.Duration.Seconds(), e.Method, e.Action, strconv.Itoa(e.Status))
+				if quietActions[e.Action] && e.Status < http.StatusBadRequest {
+					return
+				}
+				write(e)
+			}()
+
+			next(context.WithValue(ctx, accessRecordKey, record))
+		}
+	}
+}
+
+// requestUser identifies the user without requiring authentication
+func requestUser(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return glueauth.FromCertificate(r.TLS.VerifiedChains[0][0]).User.ID
+	}
+	if a, err := glueauth.Parse(r); err == nil {
+		return a.User.ID
+	}
+	return ""
+}
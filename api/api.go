@@ -3,8 +3,8 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"sync"
@@ -12,11 +12,14 @@ import (
 
 	"github.com/fulldump/box"
 	"github.com/fulldump/box/boxopenapi"
-	"github.com/google/uuid"
 
 	"github.com/fulldump/tailon/glueauth"
+	"github.com/fulldump/tailon/metrics"
 	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/ratelimit"
+	"github.com/fulldump/tailon/sharding"
 	"github.com/fulldump/tailon/statics"
+	"github.com/fulldump/tailon/tracing"
 )
 
 func InjectQueueService(qs queue.Service) box.I {
@@ -38,17 +41,68 @@ func GetQueueService(ctx context.Context) queue.Service {
 }
 
 type Client struct {
-	Id     string    `json:"id"`
-	Queue  string    `json:"queue"`
-	Start  time.Time `json:"start"`
-	IP     string    `json:"IP"`
-	Reads  int64     `json:"reads"`
-	Writes int64     `json:"writes"`
+	Id     string                            `json:"id"`
+	Queue  string                            `json:"queue"`
+	Action string                            `json:"action"`
+	Start  time.Time                         `json:"start"`
+	IP     string                            `json:"IP"`
+	Reads  int64                             `json:"reads"`
+	Writes int64                             `json:"writes"`
+	Limits map[string]ratelimit.LimiterState `json:"limits,omitempty"`
+
+	limits ratelimit.Set
+	cancel context.CancelFunc
 }
 
 var activeClients = map[string]*Client{}
 var activeClientsMutex = sync.RWMutex{}
 
+// NewClient is used by other front-ends to describe their streaming
+// clients, cancel is called by Drain.
+func NewClient(id, queueName, action, ip string, cancel context.CancelFunc) *Client {
+	return &Client{
+		Id:     id,
+		Queue:  queueName,
+		Action: action,
+		Start:  time.Now(),
+		IP:     ip,
+		cancel: cancel,
+	}
+}
+
+// newClient identifies the client by the request id, so it can be found in
+// logs, errors and /v1/clients
+func newClient(ctx context.Context, r *http.Request, queueName string, cancel context.CancelFunc) *Client {
+	c := NewClient(requestId(ctx, r), queueName, box.GetBoxContext(ctx).Action.Name, r.RemoteAddr, cancel)
+	c.limits = limitsFor(ctx, queueName, r)
+	return c
+}
+
+// TrackClient adds c to active clients until the returned function is
+// called. Repeated ids get a suffix to keep them apart.
+func TrackClient(c *Client) func() {
+
+	activeClientsMutex.Lock()
+	id := c.Id
+	for n := 2; activeClients[c.Id] != nil; n++ {
+		c.Id = id + "." + strconv.Itoa(n)
+	}
+	activeClients[c.Id] = c
+	activeClientsMutex.Unlock()
+
+	return func() {
+		activeClientsMutex.Lock()
+		delete(activeClients, c.Id)
+		activeClientsMutex.Unlock()
+	}
+}
+
+func trackClient(ctx context.Context, c *Client) func() {
+	untrack := TrackClient(c)
+	setAccessClient(ctx, c)
+	return untrack
+}
+
 func Build(version, staticsDir string, qs queue.Service) *box.B {
 
 	b := box.NewBox()
@@ -63,7 +117,11 @@ func Build(version, staticsDir string, qs queue.Service) *box.B {
 
 				activeClientsMutex.RLock()
 				for k, v := range activeClients {
-					response[k] = v
+					c := *v
+					if len(v.limits) > 0 {
+						c.Limits = v.limits.State()
+					}
+					response[k] = &c
 				}
 
 				defer func() {
@@ -77,6 +135,8 @@ func Build(version, staticsDir string, qs queue.Service) *box.B {
 	v1.Resource("/queues").
 		WithInterceptors(
 			InjectQueueService(qs),
+			glueauth.Optional,
+			RouteToOwner,
 		).
 		WithActions(
 			box.Get(ListQueues),
@@ -86,11 +146,79 @@ func Build(version, staticsDir string, qs queue.Service) *box.B {
 	v1.Resource("/queues/{queue_id}").
 		WithActions(
 			box.Get(RetrieveQueue),
-			box.Delete(func() string {
-				return "delete queue"
-			}).WithName("DeleteQueue"),
+			box.Delete(DeleteQueue),
 			box.Action(Read),
 			box.ActionPost(Write),
+			box.Action(Websocket),
+			box.Action(Peek),
+			box.ActionPost(Purge),
+			box.Action(Export),
+			box.ActionPost(Import),
+		)
+
+	v1.Resource("/snapshot").
+		WithInterceptors(InjectQueueService(qs)).
+		WithActions(
+			box.Post(Snapshot),
+		)
+
+	v1.Resource("/replication").
+		WithInterceptors(InjectQueueService(qs)).
+		WithActions(
+			box.Get(ReplicationStatus),
+			box.Action(ReplicationSnapshot).WithName("snapshot").WithInterceptors(RequirePeer),
+			box.Action(Stream).WithInterceptors(RequirePeer),
+			box.ActionPost(Promote).WithInterceptors(RequirePeer),
+		)
+
+	v1.Resource("/cluster").
+		WithInterceptors(InjectQueueService(qs)).
+		WithActions(
+			box.Get(ClusterStatus),
+			box.ActionPost(ClusterVote).WithName("vote").WithInterceptors(RequirePeer),
+			box.ActionPost(ClusterAppend).WithName("append").WithInterceptors(RequirePeer),
+			box.ActionPost(ClusterInstall).WithName("install").WithInterceptors(RequirePeer),
+			box.ActionPost(ClusterPropose).WithName("propose").WithInterceptors(RequirePeer),
+		)
+
+	v1.Resource("/cluster/members").
+		WithInterceptors(RequirePeer).
+		WithActions(
+			box.Post(AddMember),
+		)
+
+	v1.Resource("/cluster/members/{member_id}").
+		WithActions(
+			box.Delete(RemoveMember),
+		)
+
+	v1.Resource("/sharding").
+		WithInterceptors(InjectQueueService(qs)).
+		WithActions(
+			box.Get(ShardingStatus),
+			box.Put(SetMembership).WithInterceptors(RequirePeer),
+			box.ActionPost(AddNode).WithName("add").WithInterceptors(RequirePeer),
+			box.ActionPost(RemoveNode).WithName("remove").WithInterceptors(RequirePeer),
+		)
+
+	v1.Resource("/federation").
+		WithActions(
+			box.Get(FederationStatus),
+		)
+
+	// Every node reports the queues it keeps
+	metricsService := qs
+	if router, ok := qs.(*sharding.Router); ok {
+		metricsService = router.Local()
+	}
+
+	queueMetrics := newQueueMetrics(metricsService)
+	b.Resource("/metrics").
+		WithActions(box.Get(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", metrics.ContentType)
+			Metrics.WriteText(w)
+			queueMetrics.WriteText(w)
+		}).WithName("Metrics"),
 		)
 
 	b.Resource("/release").
@@ -131,18 +259,30 @@ type CreateQueueInput struct {
 	Name string `json:"name"`
 }
 
-func CreateQueue(ctx context.Context, input CreateQueueInput, w http.ResponseWriter) (queue.Queue, error) {
+// CreateQueue answers 201 with no body, the queue is at
+// /v1/queues/{name}. Queues of every backend are not the same type, their
+// fields are not part of the api.
+func CreateQueue(ctx context.Context, input CreateQueueInput, w http.ResponseWriter) error {
 
 	s := GetQueueService(ctx)
 
-	response, err := s.CreateQueue(input.Name)
+	_, err := s.CreateQueue(input.Name)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	w.WriteHeader(http.StatusCreated)
 
-	return response, nil
+	return nil
+}
+
+func DeleteQueue(ctx context.Context) error {
+
+	queueName := box.GetUrlParameter(ctx, "queue_id")
+
+	s := GetQueueService(ctx)
+
+	return s.DeleteQueue(queueName)
 }
 
 func RetrieveQueue(ctx context.Context, w http.ResponseWriter) (map[string]any, error) {
@@ -157,67 +297,122 @@ func RetrieveQueue(ctx context.Context, w http.ResponseWriter) (map[string]any,
 
 	q, err := s.GetQueue(queueName)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound) // todo: check required!!
 		return nil, err
 	}
 
-	if memq, ok := q.(*queue.MemoryQueue); ok {
-		result["len"] = len(memq.Queue)
-		result["reads"] = memq.Reads
-		result["writes"] = memq.Writes
-	}
+	stats := q.Stats()
+	result["len"] = stats.Len
+	result["reads"] = stats.Reads
+	result["writes"] = stats.Writes
 
 	return result, nil
 }
 
-func Write(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+// Peek returns the first messages with their envelope without removing
+// them, 10 unless the Limit header says otherwise
+func Peek(ctx context.Context, r *http.Request) ([]*queue.Message, error) {
 
 	queueName := box.GetUrlParameter(ctx, "queue_id")
 
-	c := &Client{
-		Id:     uuid.New().String(),
-		Queue:  queueName,
-		Start:  time.Now(),
-		IP:     r.RemoteAddr,
-		Reads:  0,
-		Writes: 0,
+	s := GetQueueService(ctx)
+	q, err := s.GetQueue(queueName)
+	if err != nil {
+		return nil, err
 	}
 
-	activeClientsMutex.Lock()
-	activeClients[c.Id] = c
-	activeClientsMutex.Unlock()
-	defer func() {
-		activeClientsMutex.Lock()
-		delete(activeClients, c.Id)
-		activeClientsMutex.Unlock()
-	}()
+	limit := 10
+	if l, err := strconv.Atoi(r.Header.Get("Limit")); err == nil && l >= 0 {
+		limit = l
+	}
+
+	return q.Peek(0, limit)
+}
+
+type PurgeOutput struct {
+	Purged int64 `json:"purged"`
+}
+
+func Purge(ctx context.Context) (*PurgeOutput, error) {
+
+	queueName := box.GetUrlParameter(ctx, "queue_id")
+
+	s := GetQueueService(ctx)
+	q, err := s.GetQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	purged, err := q.Purge()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PurgeOutput{Purged: purged}, nil
+}
+
+// WrittenHeader is the number of messages written by a :write request,
+// also when it fails
+const WrittenHeader = "Written"
+
+func Write(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+	queueName := box.GetUrlParameter(ctx, "queue_id")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := newClient(ctx, r, queueName, cancel)
+	defer trackClient(ctx, c)()
 
 	// duplicated code:
 	s := GetQueueService(ctx)
 	q, err := s.GetQueue(queueName)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound) // todo: check required!!
+		return err
+	}
+
+	parent, traced := requestTrace(r)
+
+	// Messages already written are kept, the producer should retry from
+	// the first rejected one, which is the Written header.
+	fail := func(err error) error {
+		w.Header().Set(WrittenHeader, strconv.FormatInt(c.Writes, 10))
 		return err
 	}
 
 	j := json.NewDecoder(r.Body)
 
 	for {
-		message := queue.JSON{}
+		payload := queue.JSON{}
 
-		err := j.Decode(&message)
+		err := j.Decode(&payload)
 		if err == io.EOF {
+			w.Header().Set(WrittenHeader, strconv.FormatInt(c.Writes, 10))
+			w.WriteHeader(http.StatusOK)
 			return nil // all is ok
 		}
 		if err != nil {
-			return err // some error decoding
+			return fail(err) // some error decoding
+		}
+
+		err = c.limits.Check(1, float64(len(payload)))
+		if err != nil {
+			return fail(err)
 		}
+		c.limits.Take(1, float64(len(payload)))
+
+		message := &queue.Message{Payload: payload}
+		span := startEnqueueSpan(ctx, message, queueName, parent, traced)
 
-		err = q.Write(message)
+		err = q.WriteMessage(message)
 		if err != nil {
-			return err // somme error writting to queue
+			span.Fail(err)
+			return fail(err) // somme error writting to queue
 		}
 
+		span.SetAttribute("messaging.message.id", strconv.FormatUint(message.Id, 10))
+		span.Finish()
+
 		c.Writes++
 	}
 
@@ -227,29 +422,16 @@ func Read(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 
 	queueName := box.GetUrlParameter(ctx, "queue_id")
 
-	c := &Client{
-		Id:     uuid.New().String(),
-		Queue:  queueName,
-		Start:  time.Now(),
-		IP:     r.RemoteAddr,
-		Reads:  0,
-		Writes: 0,
-	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	activeClientsMutex.Lock()
-	activeClients[c.Id] = c
-	activeClientsMutex.Unlock()
-	defer func() {
-		activeClientsMutex.Lock()
-		delete(activeClients, c.Id)
-		activeClientsMutex.Unlock()
-	}()
+	c := newClient(ctx, r, queueName, cancel)
+	defer trackClient(ctx, c)()
 
 	// duplicated code:
 	s := GetQueueService(ctx)
 	q, err := s.GetQueue(queueName)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound) // todo: check required!!
 		return err
 	}
 
@@ -258,38 +440,139 @@ func Read(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	if l, err := strconv.Atoi(r.Header.Get("Limit")); err == nil {
 		limit = l
 	}
+	single := limit == 1
+
+	// Envelope includes id, time and headers with every payload
+	envelope, _ := strconv.ParseBool(r.Header.Get("Envelope"))
 
 	// j := json.NewEncoder(w)
 
 	f, isFlusher := w.(http.Flusher)
+	flush := func() {
+		if isFlusher {
+			f.Flush()
+		}
+	}
+
+	// Server-Sent Events, headers are sent right away so the limits are
+	// checked first
+	sse := acceptsEventStream(r)
+	if sse {
+		if err := c.limits.Check(1, 0); err != nil {
+			return err
+		}
+		startEventStream(w)
+		flush()
+	}
+	heartbeat := func() error {
+		_, err := w.Write([]byte(": heartbeat\n\n"))
+		if err == nil {
+			flush()
+		}
+		return err
+	}
+	if sse {
+		if err := skipDelivered(ctx, q, lastEventId(r), heartbeat); err != nil {
+			return nil // client is gone
+		}
+	}
 
 	for limit > 0 {
 		limit--
 
 		if r.Close {
-			fmt.Println("CLOSED!!")
 			break
 		}
 
-		message, err := q.Read()
+		// Reject if no message has been sent yet, so the client gets a 429
+		if err := waitForLimits(ctx, c, c.Reads == 0 && !sse); err != nil {
+			return err
+		}
+
+		var message *queue.Message
+		if sse {
+			message, err = readWithHeartbeat(ctx, q, SSEHeartbeat, heartbeat)
+		} else {
+			message, err = q.ReadMessage(ctx)
+		}
+		if err != nil && ctx.Err() != nil {
+			return nil // client is gone or server is shutting down
+		}
+		if err != nil && sse {
+			writeErrorEvent(w, err)
+			return nil
+		}
 		if err != nil {
 			return err // some error reading queue
 		}
 
-		c.Reads++
+		span := startDequeueSpan(ctx, message, queueName)
+		delivered := deliveredMessage(message, span)
 
-		w.Write(message)
-		w.Write([]byte("\n"))
+		// A single message can carry its trace context in headers
+		if single && !sse {
+			for _, h := range []string{tracing.Traceparent, tracing.Tracestate} {
+				if v := delivered.Headers[h]; v != "" {
+					w.Header().Set(h, v)
+				}
+			}
+		}
+
+		line := delivered.Payload
+		if envelope {
+			line, _ = json.Marshal(delivered)
+		}
+
+		// Written in a single call, a message is either not sent at all or
+		// at least partly sent and not given back to be sent again
+		var n int
+		if sse {
+			n, err = writeEvent(w, "", message.Id, line)
+		} else {
+			n, err = w.Write(append(line[:len(line):len(line)], '\n'))
+		}
+		if err != nil && n == 0 {
+			// not delivered, give it back
+			if err := q.Unread(message); err != nil {
+				log.Println("Give back message", message.Id, "to", queueName+":", err)
+			}
+		}
+		if err != nil {
+			span.Fail(err)
+			return nil // client is gone
+		}
+
+		span.Finish()
+
+		c.limits.Take(1, float64(len(message.Payload)))
+		c.Reads++
 
 		// err = j.Encode(message)
 		// if err != nil {
 		// 	return err // some error encoding response
 		// }
 
-		if isFlusher {
-			f.Flush()
-		}
+		flush()
 	}
 
 	return nil
 }
+
+// waitForLimits throttles the stream until the limits allow one more
+// message, or fails right away if reject is true.
+func waitForLimits(ctx context.Context, c *Client, reject bool) error {
+	for {
+		err := c.limits.Check(1, 0)
+		if err == nil {
+			return nil
+		}
+		if reject {
+			return err
+		}
+		select {
+		case <-time.After(err.(*ratelimit.ErrLimitExceeded).RetryAfter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
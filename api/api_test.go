@@ -1,16 +1,37 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fulldump/apitest"
 	"github.com/fulldump/biff"
+	"github.com/fulldump/box"
 
+	"github.com/fulldump/tailon/accesslog"
+	"github.com/fulldump/tailon/cluster"
+	"github.com/fulldump/tailon/federation"
+	"github.com/fulldump/tailon/glueauth"
 	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/ratelimit"
+	"github.com/fulldump/tailon/replication"
+	"github.com/fulldump/tailon/sharding"
+	"github.com/fulldump/tailon/tracing"
+	"github.com/fulldump/tailon/websocket"
 )
 
 type JSON = map[string]interface{}
@@ -73,6 +94,29 @@ func TestAcceptance(t *testing.T) {
 				biff.AssertEqual(res.StatusCode, http.StatusOK)
 				biff.AssertEqual(res.BodyString(), "")
 
+				biff.Alternative("Metrics", func(a *biff.A) {
+					res := api.Request("GET", "/metrics").Do()
+
+					body := res.BodyString()
+					biff.AssertTrue(strings.Contains(body, `tailon_queue_messages{queue="my-queue"} 3`))
+					biff.AssertTrue(strings.Contains(body, `tailon_queue_writes_total{queue="my-queue"} 3`))
+					biff.AssertTrue(strings.Contains(body, `tailon_queue_bytes{queue="my-queue"} 90`))
+				})
+
+				biff.Alternative("Peek messages", func(a *biff.A) {
+					res := api.Request("GET", "/v1/queues/my-queue:peek").
+						WithHeader("Limit", "2").Do()
+					Save(res, "Peek messages", ``)
+
+					biff.AssertEqual(res.StatusCode, http.StatusOK)
+					messages := res.BodyJson().([]interface{})
+					biff.AssertEqual(len(messages), 2)
+					biff.AssertEqualJson(messages[1].(JSON)["payload"], JSON{"id": 2, "message": "element 2"})
+
+					res = api.Request("GET", "/v1/queues/my-queue").Do()
+					biff.AssertEqualJson(res.BodyJson().(JSON)["len"], 3)
+				})
+
 				biff.Alternative("Read messages", func(a *biff.A) {
 					res := api.Request("GET", "/v1/queues/my-queue:read").
 						WithHeader("Limit", "3").Do()
@@ -86,10 +130,1286 @@ func TestAcceptance(t *testing.T) {
 						biff.AssertEqualJson(m, JSON{"id": i, "message": "element " + strconv.Itoa(i)})
 					}
 				})
+
+				biff.Alternative("Purge messages", func(a *biff.A) {
+					api.Request("POST", "/v1/queues/my-queue:write").
+						WithBodyString(`1 2`).Do()
+
+					res := api.Request("POST", "/v1/queues/my-queue:purge").Do()
+					Save(res, "Purge messages", ``)
+
+					biff.AssertEqual(res.StatusCode, http.StatusOK)
+					biff.AssertEqualJson(res.BodyJson(), JSON{"purged": 2})
+
+					res = api.Request("GET", "/v1/queues/my-queue").Do()
+					biff.AssertEqualJson(res.BodyJson().(JSON)["len"], 0)
+				})
+
+			})
+
+		})
+
+	})
+
+}
+
+func TestRateLimit(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		qs.CreateQueue("my-queue")
+
+		h := Build("test version", "", qs)
+		h.WithInterceptors(
+			PrettyErrorInterceptor,
+			InjectRateLimiter(ratelimit.New(ratelimit.Config{
+				Queue: ratelimit.Limit{Messages: 2},
+			})),
+		)
+
+		api := apitest.NewWithHandler(h)
+
+		biff.Alternative("Write over the limit", func(a *biff.A) {
+
+			body := strings.Join([]string{
+				`{"id":1}`,
+				`{"id":2}`,
+				`{"id":3}`,
+			}, "\n")
+
+			res := api.Request("POST", "/v1/queues/my-queue:write").
+				WithBodyString(body).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusTooManyRequests)
+			biff.AssertEqual(res.Header.Get("Retry-After"), "1")
+			biff.AssertEqual(res.Header.Get("Written"), "2")
+
+			biff.Alternative("Read is also limited", func(a *biff.A) {
+				res := api.Request("GET", "/v1/queues/my-queue:read").
+					WithHeader("Limit", "1").Do()
+
+				biff.AssertEqual(res.StatusCode, http.StatusTooManyRequests)
+			})
+		})
+
+	})
+
+}
+
+func TestDrain(t *testing.T) {
+
+	qs := queue.NewMemoryService()
+	qs.CreateQueue("my-queue")
+
+	h := Build("test version", "", qs)
+
+	api := apitest.NewWithHandler(h)
+
+	done := make(chan *apitest.Response)
+	go func() {
+		done <- api.Request("GET", "/v1/queues/my-queue:read").Do()
+	}()
+
+	for ActiveClients() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	biff.AssertEqual(Drain(ctx), 1)
+
+	res := <-done
+	biff.AssertEqual(res.BodyString(), "")
+	biff.AssertEqual(ActiveClients(), 0)
+}
+
+// brokenWriter writes the first n bytes and fails
+type brokenWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	return w.n, io.ErrClosedPipe
+}
+
+func TestReadGiveBack(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		q, _ := qs.CreateQueue("my-queue")
+		q.Write(queue.JSON(`"one"`))
+
+		h := Build("test version", "", qs)
+
+		read := func(n int) {
+			r := httptest.NewRequest("GET", "/v1/queues/my-queue:read", nil)
+			h.ServeHTTP(&brokenWriter{ResponseWriter: httptest.NewRecorder(), n: n}, r)
+		}
+
+		a.Alternative("Nothing written", func(a *biff.A) {
+			read(0)
+
+			biff.AssertEqual(q.Stats().Len, int64(1))
+		})
+
+		a.Alternative("Partly written", func(a *biff.A) {
+			read(3)
+
+			biff.AssertEqual(q.Stats().Len, int64(0))
+		})
+	})
+}
+
+func TestStructuredAccessLog(t *testing.T) {
+
+	qs := queue.NewMemoryService()
+	qs.CreateQueue("my-queue")
+
+	output := &strings.Builder{}
+
+	h := Build("test version", "", qs)
+	h.WithInterceptors(
+		StructuredAccessLog(&accesslog.Logger{Format: "json", Output: output}),
+	)
+
+	api := apitest.NewWithHandler(h)
+
+	api.Request("POST", "/v1/queues/my-queue:write").
+		WithHeader("X-Request-Id", "my-request").
+		WithHeader("X-Glue-Authentication", `{"user":{"id":"user-1"}}`).
+		WithBodyString(`{"id":1}` + "\n" + `{"id":2}`).Do()
+
+	entry := JSON{}
+	json.Unmarshal([]byte(output.String()), &entry)
+
+	biff.AssertEqual(entry["request_id"], "my-request")
+	biff.AssertEqual(entry["user"], "user-1")
+	biff.AssertEqual(entry["status"], 200.0)
+	biff.AssertEqual(entry["queue"], "my-queue")
+	biff.AssertEqual(entry["writes"], 2.0)
+}
+
+func TestQuietAccessLog(t *testing.T) {
+
+	node := cluster.NewNode(cluster.DefaultConfig, queue.NewMemoryService(), cluster.NewHTTPTransport())
+
+	output := &strings.Builder{}
+
+	h := Build("test version", "", node)
+	h.WithInterceptors(
+		StructuredAccessLog(&accesslog.Logger{Format: "json", Output: output}),
+		PrettyErrorInterceptor,
+		InjectPeerToken("secret"),
+	)
+
+	api := apitest.NewWithHandler(h)
+
+	// Heartbeats are not logged
+	res := api.Request("POST", "/v1/cluster:append").WithHeader("Authorization", "Bearer secret").WithBodyJson(JSON{"to": node.Member().Id, "term": 1}).Do()
+	biff.AssertEqual(res.StatusCode, http.StatusOK)
+	biff.AssertEqual(output.String(), "")
+
+	// Failures are
+	res = api.Request("POST", "/v1/cluster:append").WithHeader("Authorization", "Bearer secret").WithBodyJson(JSON{"to": "other", "term": 1}).Do()
+	biff.AssertEqual(res.StatusCode, http.StatusMisdirectedRequest)
+	biff.AssertTrue(strings.Contains(output.String(), `"action":"append"`))
+}
+
+type memoryExporter struct {
+	spans []*tracing.Span
+}
+
+func (e *memoryExporter) Export(spans []*tracing.Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		qs.CreateQueue("my-queue")
+
+		exporter := &memoryExporter{}
+		tracer := tracing.NewTracer(exporter)
+
+		h := Build("test version", "", qs)
+		h.WithInterceptors(InjectTracer(tracer))
+
+		api := apitest.NewWithHandler(h)
+
+		api.Request("POST", "/v1/queues/my-queue:write").
+			WithHeader("traceparent", traceparent).
+			WithHeader("tracestate", "vendor=value").
+			WithBodyString(`{"id":1}`).Do()
+
+		a.Alternative("Read envelope", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues/my-queue:read").
+				WithHeader("Limit", "1").
+				WithHeader("Envelope", "true").Do()
+
+			message := queue.Message{}
+			json.Unmarshal(res.BodyBytes(), &message)
+
+			biff.AssertEqual(message.Id, uint64(1))
+			biff.AssertEqualJson(message.Payload, JSON{"id": 1})
+			biff.AssertEqual(message.Headers["traceparent"][:36], traceparent[:36])
+			biff.AssertEqual(message.Headers["tracestate"], "vendor=value")
+			biff.AssertEqual(res.Header.Get("traceparent"), message.Headers["traceparent"])
+
+			tracer.Flush()
+
+			biff.AssertEqual(len(exporter.spans), 2)
+			publish, receive := exporter.spans[0], exporter.spans[1]
+			biff.AssertEqual(publish.Name, "my-queue publish")
+			biff.AssertEqual(publish.Parent.String(), "b7ad6b7169203331")
+			biff.AssertEqual(receive.Name, "my-queue receive")
+			biff.AssertEqual(receive.Parent, publish.Context.SpanID)
+			biff.AssertEqual(message.Headers["traceparent"], receive.Context.Traceparent())
+		})
+
+		a.Alternative("Read not delivered", func(a *biff.A) {
+			r := httptest.NewRequest("GET", "/v1/queues/my-queue:read", nil)
+			h.ServeHTTP(&brokenWriter{ResponseWriter: httptest.NewRecorder()}, r)
+
+			tracer.Flush()
+
+			biff.AssertEqual(len(exporter.spans), 2)
+			receive := exporter.spans[1]
+			biff.AssertEqual(receive.Name, "my-queue receive")
+			biff.AssertEqual(receive.Error, io.ErrClosedPipe.Error())
+		})
+
+		a.Alternative("Read payload only", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues/my-queue:read").
+				WithHeader("Limit", "1").Do()
+
+			biff.AssertEqual(res.BodyString(), `{"id":1}`+"\n")
+			biff.AssertEqual(res.Header.Get("traceparent")[:36], traceparent[:36])
+		})
+	})
+}
+
+func TestErrors(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		qs.Limits.MaxMessageSize = 10
+		qs.CreateQueue("my-queue")
+
+		h := Build("test version", "", qs)
+		h.WithInterceptors(PrettyErrorInterceptor)
+
+		api := apitest.NewWithHandler(h)
+
+		a.Alternative("Create existing queue", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues").WithBodyJson(JSON{
+				"name": "my-queue",
+			}).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusConflict)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "queue_already_exists")
+		})
+
+		a.Alternative("Create invalid queue", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues").WithBodyJson(JSON{
+				"name": "",
+			}).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusBadRequest)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "invalid_queue_name")
+		})
+
+		a.Alternative("Retrieve unknown queue", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues/invented").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusNotFound)
+			biff.AssertEqualJson(res.BodyJson(), JSON{
+				"error": JSON{
+					"code":        "queue_not_found",
+					"message":     "queue not found: 'invented'",
+					"description": "Queue not found",
+				},
+			})
+		})
+
+		a.Alternative("Write unknown queue", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues/invented:write").WithBodyString(`{}`).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusNotFound)
+		})
+
+		a.Alternative("Write message too large", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues/my-queue:write").WithBodyString(`"01234567890"`).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusRequestEntityTooLarge)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "message_too_large")
+		})
+
+		a.Alternative("Malformed JSON", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues/my-queue:write").WithBodyString(`{"invalid`).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusBadRequest)
+		})
+
+		a.Alternative("Delete queue", func(a *biff.A) {
+			res := api.Request("DELETE", "/v1/queues/my-queue").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusNoContent)
+
+			res = api.Request("DELETE", "/v1/queues/my-queue").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusNotFound)
+		})
+
+		a.Alternative("Method not allowed", func(a *biff.A) {
+			res := api.Request("PUT", "/v1/queues").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusMethodNotAllowed)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "method_not_allowed")
+		})
+	})
+}
+
+func TestRecoverFromPanic(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		crashLog := &bytes.Buffer{}
+
+		b := box.NewBox()
+		b.WithInterceptors(RecoverFromPanicLog(crashLog), PrettyErrorInterceptor)
+		b.Resource("/panic").WithActions(box.Get(func() {
+			panic("boom")
+		}).WithName("Panic"))
+		b.Resource("/stream").WithActions(box.Get(func(w http.ResponseWriter) {
+			w.Write([]byte("first\n"))
+			w.(http.Flusher).Flush()
+			panic("boom")
+		}).WithName("Stream"))
+
+		api := apitest.NewWithHandler(b)
+
+		a.Alternative("Panic before response", func(a *biff.A) {
+			res := api.Request("GET", "/panic").WithHeader("X-Request-Id", "my-request").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusInternalServerError)
+			biff.AssertEqual(res.Header.Get("X-Request-Id"), "my-request")
+			biff.AssertEqualJson(res.BodyJson(), JSON{
+				"error": JSON{
+					"code":        "internal_error",
+					"message":     "unexpected error serving the request",
+					"description": "Unexpected error",
+					"request_id":  "my-request",
+				},
 			})
 
+			crash := &Crash{}
+			json.Unmarshal(crashLog.Bytes(), crash)
+			biff.AssertEqual(crash.RequestId, "my-request")
+			biff.AssertEqual(crash.Action, "Panic")
+			biff.AssertEqual(crash.Panic, "boom")
+			biff.AssertTrue(strings.Contains(crash.Stack, "TestRecoverFromPanic"))
+
+			m := &bytes.Buffer{}
+			Metrics.WriteText(m)
+			biff.AssertTrue(strings.Contains(m.String(), `tailon_http_panics_total{action="Panic"} 1`))
 		})
 
+		a.Alternative("Panic while streaming", func(a *biff.A) {
+			res, err := http.Get(api.Base + "/stream")
+			biff.AssertNil(err)
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			biff.AssertEqual(string(body), "first\n")
+			biff.AssertNotNil(err) // aborted, not a complete response
+		})
 	})
+}
+
+func TestRequestId(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		qs.CreateQueue("my-queue")
+
+		h := Build("test version", "", qs)
+		h.WithInterceptors(InjectRequestId, PrettyErrorInterceptor)
+
+		api := apitest.NewWithHandler(h)
+
+		a.Alternative("Generated", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues").Do()
+
+			biff.AssertEqual(len(res.Header.Get("X-Request-Id")), 36)
+		})
+
+		a.Alternative("Invalid is replaced", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues").WithHeader("X-Request-Id", "my request").Do()
+
+			biff.AssertEqual(len(res.Header.Get("X-Request-Id")), 36)
+		})
+
+		a.Alternative("Echoed in errors", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues/invented").WithHeader("X-Request-Id", "my-request").Do()
+
+			biff.AssertEqual(res.Header.Get("X-Request-Id"), "my-request")
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["request_id"], "my-request")
+		})
+
+		a.Alternative("Streaming client", func(a *biff.A) {
+			done := make(chan *apitest.Response)
+			go func() {
+				done <- api.Request("GET", "/v1/queues/my-queue:read").
+					WithHeader("X-Request-Id", "my-stream").
+					WithHeader("Limit", "1").Do()
+			}()
+
+			for ActiveClients() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			clients := api.Request("GET", "/v1/clients").Do().BodyJson().(JSON)
+			biff.AssertEqual(clients["my-stream"].(JSON)["id"], "my-stream")
+
+			api.Request("POST", "/v1/queues/my-queue:write").WithBodyString(`"hello"`).Do()
+
+			res := <-done
+			biff.AssertEqual(res.Header.Get("X-Request-Id"), "my-stream")
+			biff.AssertEqual(res.BodyString(), `"hello"`+"\n")
+		})
+	})
+}
+
+func TestWebsocket(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		q, _ := qs.CreateQueue("my-queue")
+
+		h := Build("test version", "", qs)
+		h.WithInterceptors(
+			InjectRequestId,
+			StructuredAccessLog(&accesslog.Logger{Output: io.Discard}),
+			RecoverFromPanic,
+			PrettyErrorInterceptor,
+			InjectWebsocketOrigins([]string{"https://app.example.com"}),
+		)
+
+		api := apitest.NewWithHandler(h)
+		base := "ws" + strings.TrimPrefix(api.Base, "http")
+
+		conn, _, err := websocket.Dial(context.Background(), base+"/v1/queues/my-queue:websocket", nil)
+		biff.AssertNil(err)
+		defer conn.Close(websocket.CloseNormal, "")
+
+		receive := func() JSON {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			frame := JSON{}
+			biff.AssertNil(conn.ReadJSON(&frame))
+			return frame
+		}
+
+		a.Alternative("Publish", func(a *biff.A) {
+			conn.WriteJSON(JSON{"type": "publish", "ref": "1", "payload": JSON{"a": 1}})
+
+			biff.AssertEqualJson(receive(), JSON{"type": "published", "ref": "1", "id": 1})
+			biff.AssertEqual(q.Stats().Len, int64(1))
+		})
+
+		a.Alternative("Invalid message", func(a *biff.A) {
+			conn.WriteJSON(JSON{"type": "invented", "ref": "2"})
+
+			frame := receive()
+			biff.AssertEqual(frame["ref"], "2")
+			biff.AssertEqual(frame["error"].(JSON)["code"], "invalid_message")
+		})
+
+		a.Alternative("Consume", func(a *biff.A) {
+			q.Write(queue.JSON(`"one"`))
+			q.Write(queue.JSON(`"two"`))
+			q.Write(queue.JSON(`"three"`))
+
+			conn.WriteJSON(JSON{"type": "credit", "credit": 2})
+
+			first := receive()
+			biff.AssertEqual(first["type"], "message")
+			biff.AssertEqual(first["payload"], "one")
+			second := receive()
+			biff.AssertEqual(second["payload"], "two")
+
+			time.Sleep(20 * time.Millisecond)
+			biff.AssertEqual(q.Stats().Len, int64(1)) // no more credit
+
+			a.Alternative("Nack", func(a *biff.A) {
+				conn.WriteJSON(JSON{"type": "nack", "id": first["id"]})
+				conn.WriteJSON(JSON{"type": "credit", "credit": 1})
+
+				biff.AssertEqual(receive()["payload"], "one")
+			})
+
+			a.Alternative("Close without ack", func(a *biff.A) {
+				conn.WriteJSON(JSON{"type": "ack", "id": first["id"]})
+				conn.Close(websocket.CloseNormal, "")
+
+				for ActiveClients() > 0 {
+					time.Sleep(time.Millisecond)
+				}
+
+				biff.AssertEqual(q.Stats().Len, int64(2))
+				m, _ := q.Read()
+				biff.AssertEqual(string(m), `"two"`)
+			})
+		})
+
+		a.Alternative("Queue deleted", func(a *biff.A) {
+			conn.WriteJSON(JSON{"type": "credit", "credit": 1})
+			for ActiveClients() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			api.Request("DELETE", "/v1/queues/my-queue").Do()
+
+			biff.AssertEqualJson(receive(), JSON{"type": "notification", "event": "queue_deleted"})
+		})
+
+		a.Alternative("Shutdown", func(a *biff.A) {
+			for ActiveClients() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			Drain(ctx)
+
+			biff.AssertEqualJson(receive(), JSON{"type": "notification", "event": "shutdown"})
+		})
+
+		a.Alternative("Unknown queue", func(a *biff.A) {
+			_, res, err := websocket.Dial(context.Background(), base+"/v1/queues/invented:websocket", nil)
+
+			biff.AssertNotNil(err)
+			biff.AssertEqual(res.StatusCode, http.StatusNotFound)
+		})
+
+		a.Alternative("Origin", func(a *biff.A) {
+			dial := func(origin string) (*http.Response, error) {
+				conn, res, err := websocket.Dial(context.Background(), base+"/v1/queues/my-queue:websocket", http.Header{"Origin": {origin}})
+				if err == nil {
+					conn.Close(websocket.CloseNormal, "")
+				}
+				return res, err
+			}
+
+			_, err := dial(api.Base)
+			biff.AssertNil(err)
+
+			_, err = dial("https://app.example.com")
+			biff.AssertNil(err)
+
+			res, err := dial("https://evil.example.com")
+			biff.AssertNotNil(err)
+			biff.AssertEqual(res.StatusCode, http.StatusForbidden)
+		})
+	})
+}
+
+func TestServerSentEvents(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		q, _ := qs.CreateQueue("my-queue")
+
+		h := Build("test version", "", qs)
+		api := apitest.NewWithHandler(h)
+
+		read := func(limit, lastEventId string) *apitest.Response {
+			req := api.Request("GET", "/v1/queues/my-queue:read").
+				WithHeader("Accept", "text/event-stream").
+				WithHeader("Limit", limit)
+			if lastEventId != "" {
+				req = req.WithHeader("Last-Event-ID", lastEventId)
+			}
+			return req.Do()
+		}
+
+		a.Alternative("Events", func(a *biff.A) {
+			q.Write(queue.JSON(`"one"`))
+			q.Write(queue.JSON("{\"a\":\n1}"))
+
+			res := read("2", "")
+
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+			biff.AssertEqual(res.Header.Get("Content-Type"), "text/event-stream")
+			biff.AssertEqual(res.BodyString(), "id: 1\ndata: \"one\"\n\n"+
+				"id: 2\ndata: {\"a\":\ndata: 1}\n\n")
+		})
+
+		a.Alternative("Resume", func(a *biff.A) {
+			q.Write(queue.JSON(`"one"`))
+			q.Write(queue.JSON(`"two"`))
+
+			// The last event was given back but the client got it
+			res := read("1", "1")
+
+			biff.AssertEqual(res.BodyString(), "id: 2\ndata: \"two\"\n\n")
+			biff.AssertEqual(q.Stats().Len, int64(0))
+		})
+
+		a.Alternative("Resume skips nothing else", func(a *biff.A) {
+			q.Write(queue.JSON(`"one"`))
+			q.Write(queue.JSON(`"two"`))
+
+			// Lower ids may be given back by other consumers, and higher
+			// ones are from another queue or before a restart
+			for _, id := range []string{"2", "5000"} {
+				res := read("1", id)
+
+				biff.AssertEqual(res.BodyString(), "id: 1\ndata: \"one\"\n\n")
+				q.Unread(&queue.Message{Id: 1, Payload: queue.JSON(`"one"`)})
+			}
+			biff.AssertEqual(q.Stats().Len, int64(2))
+		})
+
+		a.Alternative("Heartbeat", func(a *biff.A) {
+			defer func(d time.Duration) { SSEHeartbeat = d }(SSEHeartbeat)
+			SSEHeartbeat = 10 * time.Millisecond
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				q.Write(queue.JSON(`"late"`))
+			}()
+
+			body := read("1", "").BodyString()
+
+			biff.AssertTrue(strings.HasPrefix(body, ": heartbeat\n\n"))
+			biff.AssertTrue(strings.HasSuffix(body, "id: 1\ndata: \"late\"\n\n"))
+		})
+
+		a.Alternative("Queue deleted", func(a *biff.A) {
+			go func() {
+				for ActiveClients() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				qs.DeleteQueue("my-queue")
+			}()
+
+			body := read("1", "").BodyString()
+
+			biff.AssertTrue(strings.HasPrefix(body, "event: error\ndata: {\"error\":{\"code\":\"queue_not_found\""))
+		})
+	})
+}
+
+func TestExportImport(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		q, _ := qs.CreateQueue("my-queue")
+		q.WriteMessage(&queue.Message{Payload: queue.JSON(`1`), Headers: map[string]string{"k": "v"}})
+		q.WriteMessage(&queue.Message{Payload: queue.JSON(`{"a":2}`)})
+		qs.CreateQueue("copy")
+
+		h := Build("test version", "", qs)
+		h.WithInterceptors(PrettyErrorInterceptor)
+		api := apitest.NewWithHandler(h)
+
+		a.Alternative("Export", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues/my-queue:export").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+			biff.AssertEqual(res.Header.Get("Content-Type"), "application/x-ndjson")
+
+			lines := strings.Split(strings.TrimSpace(res.BodyString()), "\n")
+			biff.AssertEqual(len(lines), 2)
+			m := &queue.Message{}
+			json.Unmarshal([]byte(lines[0]), m)
+			biff.AssertEqual(m.Id, uint64(1))
+			biff.AssertEqual(m.Headers["k"], "v")
+			biff.AssertEqual(string(m.Payload), `1`)
+
+			// Messages are not removed
+			biff.AssertEqual(q.Stats().Len, int64(2))
+		})
+
+		a.Alternative("Export and import gzip", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues/my-queue:export").
+				WithHeader("Accept-Encoding", "gzip").Do()
+			biff.AssertEqual(res.Header.Get("Content-Encoding"), "gzip")
+
+			res = api.Request("POST", "/v1/queues/copy:import").
+				WithHeader("Content-Encoding", "gzip").
+				WithBodyString(res.BodyString()).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+			biff.AssertEqualJson(res.BodyJson(), JSON{"imported": 2})
+
+			original, _ := q.Peek(0, 10)
+			copied, _ := qs.GetQueue("copy")
+			imported, _ := copied.Peek(0, 10)
+			biff.AssertEqualJson(imported, original)
+		})
+
+		a.Alternative("Import pages", func(a *biff.A) {
+			buf := &bytes.Buffer{}
+			gz := gzip.NewWriter(buf)
+			for i := 1; i <= ExportPageSize+1; i++ {
+				fmt.Fprintf(gz, `{"payload":%d}`+"\n", i)
+			}
+			gz.Close()
+
+			res := api.Request("POST", "/v1/queues/copy:import").
+				WithHeader("Content-Encoding", "gzip").
+				WithBodyString(buf.String()).Do()
+			biff.AssertEqualJson(res.BodyJson(), JSON{"imported": ExportPageSize + 1})
+
+			res = api.Request("GET", "/v1/queues/copy:export").Do()
+			lines := strings.Split(strings.TrimSpace(res.BodyString()), "\n")
+			biff.AssertEqual(len(lines), ExportPageSize+1)
+			biff.AssertTrue(strings.HasSuffix(lines[ExportPageSize], `"payload":1001}`))
+		})
+
+		a.Alternative("Import invalid", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues/copy:import").
+				WithBodyString(`{"payload":1}` + "\n" + `{"headers":{}}`).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusBadRequest)
+			biff.AssertEqual(res.Header.Get(WrittenHeader), "1")
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "invalid_message")
+		})
+
+		a.Alternative("Import unsupported encoding", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues/copy:import").
+				WithHeader("Content-Encoding", "br").
+				WithBodyString(`{"payload":1}`).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusUnsupportedMediaType)
+		})
+
+		a.Alternative("Export unknown queue", func(a *biff.A) {
+			res := api.Request("GET", "/v1/queues/unknown:export").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusNotFound)
+		})
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		q, _ := qs.CreateQueue("my-queue")
+		q.Write(queue.JSON(`1`))
+
+		file := filepath.Join(t.TempDir(), "tailon.snapshot")
+
+		a.Alternative("Write snapshot", func(a *biff.A) {
+			h := Build("test version", "", qs)
+			h.WithInterceptors(PrettyErrorInterceptor, InjectSnapshotFile(file))
+
+			res := apitest.NewWithHandler(h).Request("POST", "/v1/snapshot").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+			body := res.BodyJson().(JSON)
+			biff.AssertEqual(body["file"], file)
+			biff.AssertEqualJson(body["queues"], 1)
+			biff.AssertEqualJson(body["messages"], 1)
+
+			restored := queue.NewMemoryService()
+			_, err := queue.RestoreFile(restored, file)
+			biff.AssertNil(err)
+			restoredQueue, err := restored.GetQueue("my-queue")
+			biff.AssertNil(err)
+			biff.AssertEqual(restoredQueue.Stats().Len, int64(1))
+		})
+
+		a.Alternative("Disabled", func(a *biff.A) {
+			h := Build("test version", "", qs)
+			h.WithInterceptors(PrettyErrorInterceptor)
+
+			res := apitest.NewWithHandler(h).Request("POST", "/v1/snapshot").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusNotImplemented)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "snapshots_disabled")
+		})
+	})
+}
+
+func TestReplication(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		primary := replication.NewPrimary(queue.NewMemoryService())
+		q, _ := primary.CreateQueue("my-queue")
+		q.Write(queue.JSON(`1`))
+
+		primaryHandler := Build("test version", "", primary)
+		primaryHandler.WithInterceptors(PrettyErrorInterceptor, InjectPeerToken("secret"))
+		primaryServer := httptest.NewServer(primaryHandler)
+		defer primaryServer.Close()
+		defer primaryServer.CloseClientConnections()
+
+		replica := replication.NewReplica(primaryServer.URL, queue.NewMemoryService())
+		replica.Token = "secret"
+		replica.Start()
+		defer replica.Close()
+
+		h := Build("test version", "", replica)
+		h.WithInterceptors(PrettyErrorInterceptor, InjectPeerToken("secret"))
+		api := apitest.NewWithHandler(h)
+
+		status := func() JSON {
+			return api.Request("GET", "/v1/replication").Do().BodyJson().(JSON)
+		}
+		for i := 0; i < 100 && status()["seq"] != json.Number("2"); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		a.Alternative("Status", func(a *biff.A) {
+			s := status()
+			biff.AssertEqual(s["role"], "replica")
+			biff.AssertEqual(s["primary"], primaryServer.URL)
+			biff.AssertEqualJson(s["queues"].(JSON)["my-queue"].(JSON)["seq"], 2)
+
+			res := api.Request("GET", "/v1/queues/my-queue").Do()
+			biff.AssertEqualJson(res.BodyJson().(JSON)["len"], 1)
+		})
+
+		a.Alternative("Read-only", func(a *biff.A) {
+			res := api.Request("POST", "/v1/queues/my-queue:write").WithBodyString(`2`).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusServiceUnavailable)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "read_only")
+		})
+
+		a.Alternative("Promote", func(a *biff.A) {
+			res := api.Request("POST", "/v1/replication:promote").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+			res = api.Request("POST", "/v1/replication:promote").WithHeader("Authorization", "Bearer secret").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+			biff.AssertEqual(res.BodyJson().(JSON)["role"], "primary")
+
+			res = api.Request("POST", "/v1/queues/my-queue:write").WithBodyString(`2`).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+		})
+
+		a.Alternative("Stream out of sync", func(a *biff.A) {
+			res := apitest.NewWithHandler(primaryHandler).
+				Request("GET", "/v1/replication:stream").
+				WithHeader("Authorization", "Bearer secret").
+				WithHeader(replication.IdHeader, "invented").
+				WithHeader(replication.SeqHeader, "0").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusGone)
+		})
+
+		a.Alternative("Unauthorized", func(a *biff.A) {
+			primaryApi := apitest.NewWithHandler(primaryHandler)
+
+			res := primaryApi.Request("GET", "/v1/replication:snapshot").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+			res = primaryApi.Request("GET", "/v1/replication:stream").WithHeader("Authorization", "Bearer invented").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+			// Anyone can send X-Glue-Authentication, it is not a peer
+			res = primaryApi.Request("GET", "/v1/replication:snapshot").
+				WithHeader(glueauth.XGlueAuthentication, `{}`).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+			res = primaryApi.Request("POST", "/v1/replication:promote").
+				WithHeader(glueauth.XGlueAuthentication, `{"user":{"id":"admin"}}`).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+			// Client certificates are verified by the tls server
+			r := httptest.NewRequest("GET", "/v1/replication:snapshot", nil)
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+			w := httptest.NewRecorder()
+			primaryHandler.ServeHTTP(w, r)
+			biff.AssertEqual(w.Code, http.StatusOK)
+		})
+
+		a.Alternative("Disabled", func(a *biff.A) {
+			h := Build("test version", "", queue.NewMemoryService())
+			h.WithInterceptors(PrettyErrorInterceptor)
+
+			res := apitest.NewWithHandler(h).Request("GET", "/v1/replication").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusNotImplemented)
+		})
+	})
+}
+
+func TestCluster(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		config := cluster.DefaultConfig
+		config.ElectionTimeout = 100 * time.Millisecond
+		config.HeartbeatInterval = 20 * time.Millisecond
+		config.Token = "secret"
+
+		// Members reach each other over HTTP
+		startNode := func(c cluster.Config) (*cluster.Node, *apitest.Apitest, func()) {
+			var handler http.Handler
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler.ServeHTTP(w, r)
+			}))
+			c.Addr = server.URL
+
+			transport := cluster.NewHTTPTransport()
+			transport.Token = c.Token
+			node := cluster.NewNode(c, queue.NewMemoryService(), transport)
+			b := Build("test version", "", node)
+			b.WithInterceptors(PrettyErrorInterceptor, InjectPeerToken(c.Token))
+			handler = b
+			node.Start()
+
+			return node, apitest.NewWithBase(server.URL), func() {
+				node.Close()
+				server.CloseClientConnections()
+				server.Close()
+			}
+		}
+
+		bootstrap := config
+		bootstrap.Bootstrap = true
+		leader, leaderApi, stopLeader := startNode(bootstrap)
+		defer stopLeader()
+		follower, followerApi, stopFollower := startNode(config)
+		defer stopFollower()
+
+		for i := 0; i < 100 && leader.Status().Role != cluster.RoleLeader; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		res := leaderApi.Request("POST", "/v1/cluster/members").
+			WithHeader("Authorization", "Bearer secret").
+			WithBodyJson(JSON{"addr": follower.Member().Addr}).Do()
+		biff.AssertEqual(res.StatusCode, http.StatusOK)
+
+		a.Alternative("Status", func(a *biff.A) {
+			s := leaderApi.Request("GET", "/v1/cluster").Do().BodyJson().(JSON)
+			biff.AssertEqual(s["role"], "leader")
+			biff.AssertEqual(len(s["members"].([]interface{})), 2)
+		})
+
+		a.Alternative("Forward to the leader", func(a *biff.A) {
+			res := followerApi.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": "my-queue"}).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusCreated)
+
+			res = followerApi.Request("POST", "/v1/queues/my-queue:write").WithBodyString(`"hello"`).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+
+			res = leaderApi.Request("GET", "/v1/queues/my-queue:read").WithHeader("Limit", "1").Do()
+			biff.AssertEqual(res.BodyString(), "\"hello\"\n")
+
+			res = followerApi.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": "my-queue"}).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusConflict)
+		})
+
+		a.Alternative("Propose on a follower", func(a *biff.A) {
+			res := followerApi.Request("POST", "/v1/cluster:propose").WithHeader("Authorization", "Bearer secret").WithBodyJson(JSON{"type": "noop"}).Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusServiceUnavailable)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "not_leader")
+		})
+
+		a.Alternative("Remove member", func(a *biff.A) {
+			path := "/v1/cluster/members/" + follower.Member().Id
+
+			res := followerApi.Request("DELETE", path).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+			res = followerApi.Request("DELETE", path).WithHeader("Authorization", "Bearer secret").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+			biff.AssertEqual(len(leader.Status().Members), 1)
+
+			res = leaderApi.Request("DELETE", path).WithHeader("Authorization", "Bearer secret").Do()
+			biff.AssertEqual(res.StatusCode, http.StatusNotFound)
+			biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "member_not_found")
+		})
+
+		a.Alternative("Unauthorized", func(a *biff.A) {
+			for _, action := range []string{"vote", "append", "install", "propose"} {
+				res := leaderApi.Request("POST", "/v1/cluster:"+action).WithBodyJson(JSON{}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+				res = leaderApi.Request("POST", "/v1/cluster:"+action).
+					WithHeader(glueauth.XGlueAuthentication, `{}`).WithBodyJson(JSON{}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+			}
+
+			res := leaderApi.Request("POST", "/v1/cluster/members").
+				WithHeader("Authorization", "Bearer invented").
+				WithBodyJson(JSON{"addr": "http://127.0.0.1:1"}).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+			biff.AssertEqual(len(leader.Status().Members), 2)
+		})
+
+		a.Alternative("Disabled", func(a *biff.A) {
+			h := Build("test version", "", queue.NewMemoryService())
+			h.WithInterceptors(PrettyErrorInterceptor)
+
+			res := apitest.NewWithHandler(h).Request("GET", "/v1/cluster").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusNotImplemented)
+		})
+	})
+}
+
+func TestSharding(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		type node struct {
+			router *sharding.Router
+			api    *apitest.Apitest
+		}
+
+		// Nodes reach each other over HTTP, urls are known once listening
+		servers := []*httptest.Server{}
+		defer func() {
+			for _, s := range servers {
+				s.CloseClientConnections()
+				s.Close()
+			}
+		}()
+		start := func() *node {
+			var handler http.Handler
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler.ServeHTTP(w, r)
+			}))
+			servers = append(servers, server)
+
+			router, err := sharding.New(sharding.Config{Addr: server.URL, Token: "secret"}, queue.NewMemoryService())
+			biff.AssertNil(err)
+
+			b := Build("test version", "", router)
+			b.WithInterceptors(InjectRequestId, PrettyErrorInterceptor, InjectPeerToken("secret"))
+			handler = b
+
+			return &node{router: router, api: apitest.NewWithBase(server.URL)}
+		}
+
+		nodeA := start()
+		defer nodeA.router.Close()
+		addrA := nodeA.router.Addr()
+		nodeB := start()
+		defer nodeB.router.Close()
+		addrB := nodeB.router.Addr()
+		nodes := &sharding.Membership{Version: 1, Nodes: []string{addrA, addrB}}
+		nodeA.router.SetMembership(nodes)
+		nodeB.router.SetMembership(nodes)
+
+		// A queue for each node
+		names := map[string]string{}
+		for i := 0; len(names) < 2; i++ {
+			name := "queue-" + strconv.Itoa(i)
+			if owner, _ := nodeA.router.Owner(name); names[owner] == "" {
+				names[owner] = name
+			}
+		}
+		queueA, queueB := names[addrA], names[addrB]
+
+		// settled waits until every node keeps only the queues it owns
+		settled := func(nodes ...*node) bool {
+			for i := 0; i < 200; i++ {
+				ok := true
+				for _, n := range nodes {
+					local, _ := n.router.Local().ListQueues()
+					for _, name := range local {
+						if _, self := n.router.Owner(name); !self {
+							ok = false
+						}
+					}
+				}
+				if ok {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+
+		a.Alternative("Proxy to the owner", func(a *biff.A) {
+			res := nodeA.api.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": queueB}).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusCreated)
+
+			res = nodeA.api.Request("POST", "/v1/queues/"+queueB+":write").WithBodyString(`"hello"`).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusOK)
+
+			_, err := nodeA.router.Local().GetQueue(queueB)
+			biff.AssertNotNil(err)
+			q, _ := nodeB.router.Local().GetQueue(queueB)
+			biff.AssertEqual(q.Stats().Len, int64(1))
+
+			res = nodeA.api.Request("GET", "/v1/queues/"+queueB).WithHeader(RequestIdHeader, "my-request").Do()
+			biff.AssertEqualJson(res.BodyJson().(JSON)["len"], 1)
+			biff.AssertEqual(res.Header.Values(RequestIdHeader), []string{"my-request"})
+
+			res = nodeA.api.Request("GET", "/v1/queues/"+queueB+":read").WithHeader("Limit", "1").Do()
+			biff.AssertEqual(res.BodyString(), "\"hello\"\n")
+
+			res = nodeB.api.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": queueB}).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusConflict)
+			res = nodeA.api.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": queueB}).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusConflict)
+		})
+
+		a.Alternative("List every node", func(a *biff.A) {
+			nodeB.api.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": queueA}).Do()
+			nodeB.api.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": queueB}).Do()
+
+			expected := []interface{}{queueA, queueB}
+			if queueB < queueA {
+				expected = []interface{}{queueB, queueA}
+			}
+			biff.AssertEqual(nodeA.api.Request("GET", "/v1/queues").Do().BodyJson(), expected)
+			biff.AssertEqual(nodeB.api.Request("GET", "/v1/queues").Do().BodyJson(), expected)
+		})
+
+		a.Alternative("Delete on the owner", func(a *biff.A) {
+			nodeA.api.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": queueB}).Do()
+
+			biff.AssertNil(nodeA.router.DeleteQueue(queueB))
+
+			_, err := nodeB.router.Local().GetQueue(queueB)
+			biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+			biff.AssertTrue(errors.Is(nodeA.router.DeleteQueue(queueB), queue.ErrQueueNotFound))
+		})
+
+		a.Alternative("Give back after a move", func(a *biff.A) {
+			nodeA.router.CreateQueue(queueA)
+			q, _ := nodeA.router.GetQueue(queueA)
+			q.Write(queue.JSON(`1`))
+			q.Write(queue.JSON(`2`))
+			message, err := q.ReadMessage(context.Background())
+			biff.AssertNil(err)
+
+			_, err = nodeB.router.RemoveNode(context.Background(), addrA)
+			biff.AssertNil(err)
+			biff.AssertTrue(settled(nodeA))
+
+			// The consumer did not deliver it
+			biff.AssertNil(q.Unread(message))
+
+			moved, _ := nodeB.router.Local().GetQueue(queueA)
+			messages, _ := moved.Peek(0, 10)
+			biff.AssertEqual(len(messages), 2)
+			biff.AssertEqual(string(messages[0].Payload), `2`)
+			biff.AssertEqual(string(messages[1].Payload), `1`)
+		})
+
+		a.Alternative("Rebalance", func(a *biff.A) {
+			for i := 0; i < 20; i++ {
+				name := "queue-" + strconv.Itoa(i)
+				nodeA.api.Request("POST", "/v1/queues").WithBodyJson(JSON{"name": name}).Do()
+				nodeA.api.Request("POST", "/v1/queues/"+name+":write").WithBodyString(`1 2`).Do()
+			}
+
+			readAll := func() {
+				for i := 0; i < 20; i++ {
+					name := "queue-" + strconv.Itoa(i)
+					res := nodeA.api.Request("GET", "/v1/queues/"+name).Do()
+					biff.AssertEqualJson(res.BodyJson().(JSON)["len"], 2)
+				}
+			}
+
+			nodeC := start()
+			defer nodeC.router.Close()
+			addrC := nodeC.router.Addr()
+
+			a.Alternative("Add a node", func(a *biff.A) {
+				res := nodeB.api.Request("POST", "/v1/sharding:add").WithHeader("Authorization", "Bearer secret").WithBodyJson(JSON{"addr": addrC}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusOK)
+				biff.AssertEqualJson(res.BodyJson().(JSON)["version"], 2)
+
+				biff.AssertTrue(settled(nodeA, nodeB, nodeC))
+				local, _ := nodeC.router.Local().ListQueues()
+				biff.AssertTrue(len(local) > 0)
+				biff.AssertEqual(nodeA.router.Membership(), nodeC.router.Membership())
+				readAll()
+			})
+
+			a.Alternative("Remove a node", func(a *biff.A) {
+				res := nodeA.api.Request("POST", "/v1/sharding:remove").WithHeader("Authorization", "Bearer secret").WithBodyJson(JSON{"addr": addrB}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusOK)
+
+				biff.AssertTrue(settled(nodeA, nodeB))
+				local, _ := nodeB.router.Local().ListQueues()
+				biff.AssertEqual(len(local), 0)
+				readAll()
+
+				res = nodeA.api.Request("POST", "/v1/sharding:remove").WithHeader("Authorization", "Bearer secret").WithBodyJson(JSON{"addr": addrA}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusConflict)
+			})
+
+			a.Alternative("Unreachable node", func(a *biff.A) {
+				res := nodeA.api.Request("POST", "/v1/sharding:add").WithHeader("Authorization", "Bearer secret").WithBodyJson(JSON{"addr": "http://127.0.0.1:1"}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusBadGateway)
+				biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "node_unreachable")
+			})
+		})
+
+		a.Alternative("Unauthorized", func(a *biff.A) {
+			res := nodeA.api.Request("PUT", "/v1/sharding").WithBodyJson(JSON{"version": 9, "nodes": []string{addrA}}).Do()
+			biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+			for _, action := range []string{"add", "remove"} {
+				res := nodeA.api.Request("POST", "/v1/sharding:"+action).WithBodyJson(JSON{"addr": addrB}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+				res = nodeA.api.Request("POST", "/v1/sharding:"+action).
+					WithHeader(glueauth.XGlueAuthentication, `{}`).WithBodyJson(JSON{"addr": addrB}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+
+				res = nodeA.api.Request("POST", "/v1/sharding:"+action).
+					WithHeader("Authorization", "Bearer invented").WithBodyJson(JSON{"addr": addrB}).Do()
+				biff.AssertEqual(res.StatusCode, http.StatusUnauthorized)
+			}
+			biff.AssertEqual(nodeA.router.Membership().Version, uint64(1))
+		})
+
+		a.Alternative("Disabled", func(a *biff.A) {
+			h := Build("test version", "", queue.NewMemoryService())
+			h.WithInterceptors(PrettyErrorInterceptor)
+
+			res := apitest.NewWithHandler(h).Request("GET", "/v1/sharding").Do()
+
+			biff.AssertEqual(res.StatusCode, http.StatusNotImplemented)
+		})
+	})
+}
+
+func TestFederation(t *testing.T) {
+
+	qs := queue.NewMemoryService()
+	f, err := federation.New(federation.Config{Links: "orders=http://127.0.0.1:1/central"}, qs)
+	biff.AssertNil(err)
+	defer f.Close()
+
+	h := Build("test version", "", qs)
+	h.WithInterceptors(PrettyErrorInterceptor, InjectFederation(f))
+
+	res := apitest.NewWithHandler(h).Request("GET", "/v1/federation").Do()
+	biff.AssertEqual(res.StatusCode, http.StatusOK)
+	biff.AssertEqual(res.BodyJson().([]interface{})[0].(JSON)["remote"], "http://127.0.0.1:1/central")
+
+	h = Build("test version", "", qs)
+	h.WithInterceptors(PrettyErrorInterceptor, InjectFederation(nil))
 
+	res = apitest.NewWithHandler(h).Request("GET", "/v1/federation").Do()
+	biff.AssertEqual(res.StatusCode, http.StatusNotImplemented)
+	biff.AssertEqual(res.BodyJson().(JSON)["error"].(JSON)["code"], "federation_disabled")
 }
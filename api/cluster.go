@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/cluster"
+)
+
+var ErrClusterDisabled = errors.New("clustering is disabled")
+
+func clusterNode(ctx context.Context) (*cluster.Node, error) {
+	node, ok := GetQueueService(ctx).(*cluster.Node)
+	if !ok {
+		return nil, ErrClusterDisabled
+	}
+	return node, nil
+}
+
+// ClusterStatus tells the role of this node, the leader and the members,
+// with their progress if this node leads
+func ClusterStatus(ctx context.Context) (*cluster.Status, error) {
+	node, err := clusterNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.Status(), nil
+}
+
+func ClusterVote(ctx context.Context, input cluster.VoteRequest) (*cluster.VoteResponse, error) {
+	node, err := clusterNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.RequestVote(&input)
+}
+
+func ClusterAppend(ctx context.Context, input cluster.AppendRequest) (*cluster.AppendResponse, error) {
+	node, err := clusterNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.AppendEntries(&input)
+}
+
+func ClusterInstall(ctx context.Context, input cluster.InstallRequest) (*cluster.AppendResponse, error) {
+	node, err := clusterNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.InstallSnapshot(&input)
+}
+
+// ClusterPropose runs a command forwarded by a follower, the result tells
+// how it went
+func ClusterPropose(ctx context.Context, input cluster.Command) (*cluster.Result, error) {
+	node, err := clusterNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.Propose(ctx, &input)
+}
+
+type AddMemberInput struct {
+	Addr string `json:"addr"`
+}
+
+// AddMember adds a running node to the cluster by its url
+func AddMember(ctx context.Context, input AddMemberInput) (*cluster.Status, error) {
+	node, err := clusterNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.AddMember(ctx, input.Addr)
+}
+
+func RemoveMember(ctx context.Context) (*cluster.Status, error) {
+	node, err := clusterNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.RemoveMember(ctx, box.GetUrlParameter(ctx, "member_id"))
+}
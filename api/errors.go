@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/cluster"
+	"github.com/fulldump/tailon/glueauth"
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/ratelimit"
+	"github.com/fulldump/tailon/replication"
+	"github.com/fulldump/tailon/sharding"
+	"github.com/fulldump/tailon/websocket"
+)
+
+// ErrorResponse is the body of every error, Code is stable and meant for
+// machines, Message and Description for humans.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	Description string `json:"description"`
+	RequestId   string `json:"request_id,omitempty"`
+}
+
+type errorMapping struct {
+	err         error
+	status      int
+	code        string
+	description string
+}
+
+var errorMappings = []errorMapping{
+	{box.ErrResourceNotFound, http.StatusNotFound, "resource_not_found", "Resource not found"},
+	{box.ErrMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed"},
+	{queue.ErrQueueNotFound, http.StatusNotFound, "queue_not_found", "Queue not found"},
+	{queue.ErrQueueAlreadyExists, http.StatusConflict, "queue_already_exists", "Queue already exists"},
+	{queue.ErrInvalidQueueName, http.StatusBadRequest, "invalid_queue_name", "Invalid queue name"},
+	{queue.ErrQueueFull, http.StatusServiceUnavailable, "queue_full", "Queue is full"},
+	{queue.ErrMessageTooLarge, http.StatusRequestEntityTooLarge, "message_too_large", "Message too large"},
+	{queue.ErrUnauthorized, http.StatusUnauthorized, "unauthorized", "Unauthorized"},
+	{glueauth.ErrUnauthorized, http.StatusUnauthorized, "unauthorized", "Unauthorized"},
+	{websocket.ErrBadHandshake, http.StatusBadRequest, "bad_handshake", "Bad websocket handshake"},
+	{websocket.ErrOriginNotAllowed, http.StatusForbidden, "origin_not_allowed", "Websockets from this origin are not allowed"},
+	{ErrInvalidMessage, http.StatusBadRequest, "invalid_message", "Invalid message"},
+	{ErrSnapshotsDisabled, http.StatusNotImplemented, "snapshots_disabled", "Snapshots are disabled"},
+	{ErrReplicationDisabled, http.StatusNotImplemented, "replication_disabled", "Replication is disabled"},
+	{replication.ErrReadOnly, http.StatusServiceUnavailable, "read_only", "Read-only replica, use the primary or promote this one"},
+	{replication.ErrOutOfSync, http.StatusGone, "out_of_sync", "Replica out of sync, start again from a snapshot"},
+	{ErrClusterDisabled, http.StatusNotImplemented, "cluster_disabled", "Clustering is disabled"},
+	{cluster.ErrNotLeader, http.StatusServiceUnavailable, "not_leader", "Not the leader of the cluster"},
+	{cluster.ErrNoLeader, http.StatusServiceUnavailable, "no_leader", "The cluster has no leader, try again later"},
+	{cluster.ErrLeadershipLost, http.StatusServiceUnavailable, "leadership_lost", "The leader changed, the change may or may not be applied"},
+	{cluster.ErrMembershipChange, http.StatusConflict, "membership_change", "Another membership change is in progress"},
+	{cluster.ErrMemberNotFound, http.StatusNotFound, "member_not_found", "Member not found"},
+	{cluster.ErrMemberExists, http.StatusConflict, "member_exists", "Another member has that address, remove it first"},
+	{cluster.ErrWrongMember, http.StatusMisdirectedRequest, "wrong_member", "The request is for another member"},
+	{cluster.ErrClosed, http.StatusServiceUnavailable, "shutting_down", "Shutting down"},
+	{ErrShardingDisabled, http.StatusNotImplemented, "sharding_disabled", "Sharding is disabled"},
+	{sharding.ErrNotOwner, http.StatusMisdirectedRequest, "not_owner", "The queue is kept by another node"},
+	{sharding.ErrInvalidNode, http.StatusBadRequest, "invalid_node", "Invalid node url"},
+	{sharding.ErrNodeNotFound, http.StatusNotFound, "node_not_found", "Node not found"},
+	{sharding.ErrLastNode, http.StatusConflict, "last_node", "The last node can not be removed"},
+	{sharding.ErrUnreachable, http.StatusBadGateway, "node_unreachable", "Another node could not be reached"},
+	{ErrFederationDisabled, http.StatusNotImplemented, "federation_disabled", "Federation is disabled"},
+	{ErrUnsupportedEncoding, http.StatusUnsupportedMediaType, "unsupported_encoding", "Unsupported content encoding"},
+}
+
+// mapError returns status, code and description for an error
+func mapError(err error) (int, string, string) {
+
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return m.status, m.code, m.description
+		}
+	}
+
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return http.StatusBadRequest, "malformed_json", "Malformed JSON"
+	}
+
+	var limitError *ratelimit.ErrLimitExceeded
+	if errors.As(err, &limitError) {
+		return http.StatusTooManyRequests, "rate_limit_exceeded", "Too many requests"
+	}
+
+	return http.StatusInternalServerError, "internal_error", "Unexpected error"
+}
+
+// newErrorDetail uses the default description for the error if description
+// is empty
+func newErrorDetail(err error, description string) (int, ErrorDetail) {
+
+	status, code, defaultDescription := mapError(err)
+	if description == "" {
+		description = defaultDescription
+	}
+
+	return status, ErrorDetail{
+		Code:        code,
+		Message:     err.Error(),
+		Description: description,
+	}
+}
+
+// writeError takes the request id from the response headers
+func writeError(w http.ResponseWriter, err error, description string) {
+
+	status, detail := newErrorDetail(err, description)
+	detail.RequestId = w.Header().Get(RequestIdHeader)
+
+	var limitError *ratelimit.ErrLimitExceeded
+	if errors.As(err, &limitError) {
+		retryAfter := int(math.Ceil(limitError.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: detail})
+}
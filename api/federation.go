@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/federation"
+)
+
+var ErrFederationDisabled = errors.New("federation is disabled")
+
+// InjectFederation sets the links of GET /v1/federation, federation is
+// disabled if f is nil
+func InjectFederation(f *federation.Federation) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			next(SetFederation(ctx, f))
+		}
+	}
+}
+
+const FederationKey = "d3a9c1f4-7e2b-4b6a-8c5d-1f0e9a2b7c64"
+
+func SetFederation(ctx context.Context, f *federation.Federation) context.Context {
+	return context.WithValue(ctx, FederationKey, f)
+}
+
+// GetFederation returns nil if federation is disabled
+func GetFederation(ctx context.Context) *federation.Federation {
+	f, _ := ctx.Value(FederationKey).(*federation.Federation)
+	return f
+}
+
+// FederationStatus tells how every link ships its queue
+func FederationStatus(ctx context.Context) ([]*federation.LinkStatus, error) {
+	f := GetFederation(ctx)
+	if f == nil {
+		return nil, ErrFederationDisabled
+	}
+	return f.Status(), nil
+}
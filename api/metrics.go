@@ -0,0 +1,83 @@
+package api
+
+import (
+	"github.com/fulldump/tailon/metrics"
+	"github.com/fulldump/tailon/queue"
+)
+
+// Metrics is the registry exposed in /metrics
+var Metrics = metrics.NewRegistry()
+
+var httpRequestDuration = Metrics.NewHistogram(
+	"tailon_http_request_duration_seconds",
+	"HTTP request latency, streaming requests last until the stream ends.",
+	nil, "method", "action", "code",
+)
+
+func init() {
+	metrics.RegisterProcess(Metrics)
+}
+
+// newQueueMetrics returns a registry with metrics computed on every scrape
+// from the queue service and the active clients.
+func newQueueMetrics(qs queue.Service) *metrics.Registry {
+
+	r := metrics.NewRegistry()
+
+	queueStats := func(f func(stats queue.Stats) float64) func(metrics.Observe) {
+		return func(observe metrics.Observe) {
+			names, err := qs.ListQueues()
+			if err != nil {
+				return
+			}
+			for _, name := range names {
+				q, err := qs.GetQueue(name)
+				if err != nil {
+					continue // deleted meanwhile
+				}
+				observe(f(q.Stats()), name)
+			}
+		}
+	}
+
+	r.NewGaugeFunc("tailon_queues", "Number of queues.", nil, func(observe metrics.Observe) {
+		if names, err := qs.ListQueues(); err == nil {
+			observe(float64(len(names)))
+		}
+	})
+
+	r.NewGaugeFunc("tailon_queue_messages", "Messages pending in the queue.", []string{"queue"},
+		queueStats(func(s queue.Stats) float64 { return float64(s.Len) }))
+
+	r.NewGaugeFunc("tailon_queue_bytes", "Bytes pending in the queue.", []string{"queue"},
+		queueStats(func(s queue.Stats) float64 { return float64(s.Bytes) }))
+
+	r.NewCounterFunc("tailon_queue_writes_total", "Messages enqueued.", []string{"queue"},
+		queueStats(func(s queue.Stats) float64 { return float64(s.Writes) }))
+
+	r.NewCounterFunc("tailon_queue_reads_total", "Messages dequeued.", []string{"queue"},
+		queueStats(func(s queue.Stats) float64 { return float64(s.Reads) }))
+
+	r.NewCounterFunc("tailon_queue_written_bytes_total", "Bytes enqueued.", []string{"queue"},
+		queueStats(func(s queue.Stats) float64 { return float64(s.BytesWritten) }))
+
+	r.NewCounterFunc("tailon_queue_read_bytes_total", "Bytes dequeued.", []string{"queue"},
+		queueStats(func(s queue.Stats) float64 { return float64(s.BytesRead) }))
+
+	r.NewGaugeFunc("tailon_clients", "Active readers and writers.", []string{"queue", "action"}, func(observe metrics.Observe) {
+		type key struct{ queue, action string }
+		count := map[key]int{}
+
+		activeClientsMutex.RLock()
+		for _, c := range activeClients {
+			count[key{c.Queue, c.Action}]++
+		}
+		activeClientsMutex.RUnlock()
+
+		for k, n := range count {
+			observe(float64(n), k.queue, k.action)
+		}
+	})
+
+	return r
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/glueauth"
+)
+
+// InjectPeerToken sets the secret other nodes of a replication, cluster or
+// sharding send as 'Authorization: Bearer TOKEN'. Only verified client
+// certificates get through RequirePeer if token is empty.
+func InjectPeerToken(token string) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			next(SetPeerToken(ctx, token))
+		}
+	}
+}
+
+const PeerTokenKey = "5e0c8a7d-91b4-4f2e-a3c6-7d8e2b1f4a09"
+
+func SetPeerToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, PeerTokenKey, token)
+}
+
+func GetPeerToken(ctx context.Context) string {
+	token, _ := ctx.Value(PeerTokenKey).(string)
+	return token
+}
+
+// RequirePeer protects the endpoints nodes use to replicate, vote or change
+// their members: requests need the peer token or a verified client
+// certificate. X-Glue-Authentication is not enough, anyone can send it.
+func RequirePeer(next box.H) box.H {
+	return func(ctx context.Context) {
+
+		r := box.GetRequest(ctx)
+
+		token := GetPeerToken(ctx)
+		authorization := r.Header.Get("Authorization")
+		if token != "" && subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+token)) == 1 {
+			next(ctx)
+			return
+		}
+
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			next(ctx)
+			return
+		}
+
+		box.SetError(ctx, glueauth.ErrUnauthorized)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/glueauth"
+	"github.com/fulldump/tailon/ratelimit"
+)
+
+func InjectRateLimiter(r *ratelimit.Registry) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			next(SetRateLimiter(ctx, r))
+		}
+	}
+}
+
+const RateLimiterKey = "4f3c2b8e-0b1d-4c55-9a53-3f1e7c0d2a61"
+
+func SetRateLimiter(ctx context.Context, r *ratelimit.Registry) context.Context {
+	return context.WithValue(ctx, RateLimiterKey, r)
+}
+
+// GetRateLimiter returns nil if there is no rate limiter configured
+func GetRateLimiter(ctx context.Context) *ratelimit.Registry {
+	r, _ := ctx.Value(RateLimiterKey).(*ratelimit.Registry)
+	return r
+}
+
+// limitsFor returns the limiters that apply to a request on a queue
+func limitsFor(ctx context.Context, queueName string, r *http.Request) ratelimit.Set {
+
+	registry := GetRateLimiter(ctx)
+	if registry == nil {
+		return nil
+	}
+
+	limiters := []*ratelimit.Limiter{
+		registry.Queue(queueName),
+		registry.IP(formatRemoteAddr(r)),
+	}
+	if auth := glueauth.GetAuth(ctx); auth != nil && auth.User.ID != "" {
+		limiters = append(limiters, registry.User(auth.User.ID))
+	}
+
+	return ratelimit.NewSet(limiters...)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/fulldump/box"
+)
+
+// ErrPanic is reported to the client when a handler panics, the panic
+// itself is only written to the crash log.
+var ErrPanic = errors.New("unexpected error serving the request")
+
+var httpPanics = Metrics.NewCounter(
+	"tailon_http_panics_total",
+	"Panics recovered while serving requests.",
+	"action",
+)
+
+// Crash is a line in the crash log
+type Crash struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request_id"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Action    string    `json:"action"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+}
+
+func recoverFromPanic(crashLog io.Writer) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			c := box.GetBoxContext(ctx)
+			r := c.Request
+
+			// Know if the response has already started
+			recorder := &responseRecorder{ResponseWriter: c.Response}
+			c.Response = recorder
+
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p) // deliberate abort, nothing to report
+				}
+
+				action := ""
+				if c.Action != nil {
+					action = c.Action.Name
+				}
+				httpPanics.Inc(action)
+
+				id := requestId(ctx, r)
+
+				crash := &Crash{
+					Time:      time.Now(),
+					RequestId: id,
+					Method:    r.Method,
+					URL:       r.URL.String(),
+					Action:    action,
+					Panic:     fmt.Sprint(p),
+					Stack:     string(debug.Stack()),
+				}
+				if crashLog == nil {
+					fmt.Fprintln(os.Stderr, "panic:", crash.Panic, "request_id:", id)
+					os.Stderr.WriteString(crash.Stack)
+				} else {
+					line, _ := json.Marshal(crash)
+					crashLog.Write(append(line, '\n'))
+				}
+
+				// A stream cannot be turned into an error, abort the connection
+				// so the client does not take a truncated stream as complete.
+				if recorder.status != 0 {
+					panic(http.ErrAbortHandler)
+				}
+
+				recorder.Header().Set(RequestIdHeader, id)
+				writeError(recorder, ErrPanic, "")
+			}()
+
+			next(ctx)
+		}
+	}
+}
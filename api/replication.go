@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/fulldump/tailon/replication"
+)
+
+var ErrReplicationDisabled = errors.New("replication is disabled")
+
+func replicationNode(ctx context.Context) (replication.Node, error) {
+	node, ok := GetQueueService(ctx).(replication.Node)
+	if !ok {
+		return nil, ErrReplicationDisabled
+	}
+	return node, nil
+}
+
+// ReplicationStatus tells the role of this server, replicas include the
+// lag of every queue and primaries their replicas
+func ReplicationStatus(ctx context.Context) (*replication.Status, error) {
+	node, err := replicationNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return node.Status(), nil
+}
+
+// ReplicationSnapshot is where replicas start, the position in the log is
+// in the response headers
+func ReplicationSnapshot(ctx context.Context, w http.ResponseWriter) error {
+
+	node, err := replicationNode(ctx)
+	if err != nil {
+		return err
+	}
+	primary, err := node.Source()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	_, err = primary.SnapshotAt(w, func(id string, seq uint64) {
+		w.Header().Set(replication.IdHeader, id)
+		w.Header().Set(replication.SeqHeader, strconv.FormatUint(seq, 10))
+	})
+	if err != nil {
+		// A truncated snapshot must not be taken as complete
+		panic(http.ErrAbortHandler)
+	}
+
+	return nil
+}
+
+// Stream sends the changes after the position in the request headers, 410
+// Gone if the replica has to start again from a snapshot
+func Stream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+	node, err := replicationNode(ctx)
+	if err != nil {
+		return err
+	}
+	primary, err := node.Source()
+	if err != nil {
+		return err
+	}
+
+	id := r.Header.Get(replication.IdHeader)
+	seq, err := strconv.ParseUint(r.Header.Get(replication.SeqHeader), 10, 64)
+	if err != nil {
+		return replication.ErrOutOfSync
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := newClient(ctx, r, "", cancel)
+	defer trackClient(ctx, c)()
+
+	f, isFlusher := w.(http.Flusher)
+	flush := func() {
+		if isFlusher {
+			f.Flush()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return primary.Stream(ctx, id, seq, r.RemoteAddr, w, flush)
+}
+
+// Promote makes a replica the primary
+func Promote(ctx context.Context) (*replication.Status, error) {
+	node, err := replicationNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := node.Promote(); err != nil {
+		return nil, err
+	}
+	return node.Status(), nil
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fulldump/box"
+	"github.com/google/uuid"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// InjectRequestId takes the request id from the X-Request-Id header or
+// generates a new one, and echoes it in the response. It should be the
+// first interceptor so logs and errors can use it.
+func InjectRequestId(next box.H) box.H {
+	return func(ctx context.Context) {
+		c := box.GetBoxContext(ctx)
+
+		id := c.Request.Header.Get(RequestIdHeader)
+		if !validRequestId(id) {
+			id = uuid.New().String()
+		}
+
+		c.Response.Header().Set(RequestIdHeader, id)
+
+		next(SetRequestId(ctx, id))
+	}
+}
+
+const RequestIdKey = "5f0e9d3c-1b7a-4c2e-9a64-3d8f2b1e6c47"
+
+func SetRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIdKey, id)
+}
+
+// GetRequestId returns an empty string if InjectRequestId is not in use
+func GetRequestId(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIdKey).(string)
+	return id
+}
+
+// requestId falls back to the header or a new id if InjectRequestId is not
+// in use
+func requestId(ctx context.Context, r *http.Request) string {
+	if id := GetRequestId(ctx); id != "" {
+		return id
+	}
+	if id := r.Header.Get(RequestIdHeader); validRequestId(id) {
+		return id
+	}
+	return uuid.New().String()
+}
+
+// validRequestId accepts up to 128 printable ascii characters, ids end up in
+// logs and headers
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
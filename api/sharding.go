@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/sharding"
+)
+
+var ErrShardingDisabled = errors.New("sharding is disabled")
+
+func shardingRouter(ctx context.Context) (*sharding.Router, error) {
+	router, ok := GetQueueService(ctx).(*sharding.Router)
+	if !ok {
+		return nil, ErrShardingDisabled
+	}
+	return router, nil
+}
+
+// RouteToOwner proxies requests for a queue to the node that keeps it.
+// Requests forwarded by another node are served with the queues of this
+// one, so nodes that disagree on an owner for a moment do not loop.
+func RouteToOwner(next box.H) box.H {
+	return func(ctx context.Context) {
+
+		router, ok := GetQueueService(ctx).(*sharding.Router)
+		if !ok {
+			next(ctx)
+			return
+		}
+
+		r := box.GetRequest(ctx)
+		if r.Header.Get(sharding.ForwardedHeader) != "" {
+			next(SetQueueService(ctx, router.Local()))
+			return
+		}
+
+		queueName := box.GetUrlParameter(ctx, "queue_id")
+		if queueName == "" {
+			next(ctx) // list and create go through the router
+			return
+		}
+
+		owner, self := router.Owner(queueName)
+		if self {
+			next(ctx)
+			return
+		}
+
+		proxy(box.GetResponse(ctx), r, router.Addr(), owner)
+	}
+}
+
+// proxy streams the request to node and the response back, websockets
+// included. The request id is kept, so both nodes log the same one.
+func proxy(w http.ResponseWriter, r *http.Request, from, node string) {
+
+	target, err := url.Parse(node)
+	if err != nil {
+		writeError(w, err, "")
+		return
+	}
+
+	requestId := w.Header().Get(RequestIdHeader)
+
+	p := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(sharding.ForwardedHeader, from)
+			if requestId != "" {
+				pr.Out.Header.Set(RequestIdHeader, requestId)
+			}
+		},
+		ModifyResponse: func(res *http.Response) error {
+			res.Header.Del(RequestIdHeader) // already set here
+			return nil
+		},
+		FlushInterval: -1, // reads stream
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			writeError(w, fmt.Errorf("%w: %s: %s", sharding.ErrUnreachable, node, err), "")
+		},
+	}
+
+	p.ServeHTTP(w, r)
+}
+
+// ShardingStatus tells the nodes and how moving queues goes
+func ShardingStatus(ctx context.Context) (*sharding.Status, error) {
+	router, err := shardingRouter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return router.Status(), nil
+}
+
+// SetMembership is sent by the node that changes the nodes to every other
+func SetMembership(ctx context.Context, input sharding.Membership) (*sharding.Status, error) {
+	router, err := shardingRouter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return router.SetMembership(&input)
+}
+
+type NodeInput struct {
+	Addr string `json:"addr"`
+}
+
+// AddNode adds a running node by its url, queues it owns are moved there
+func AddNode(ctx context.Context, input NodeInput) (*sharding.Status, error) {
+	router, err := shardingRouter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return router.AddNode(ctx, input.Addr)
+}
+
+// RemoveNode moves the queues of a node to the others
+func RemoveNode(ctx context.Context, input NodeInput) (*sharding.Status, error) {
+	router, err := shardingRouter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return router.RemoveNode(ctx, input.Addr)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// ActiveClients returns the number of clients reading or writing.
+func ActiveClients() int {
+	activeClientsMutex.RLock()
+	defer activeClientsMutex.RUnlock()
+
+	return len(activeClients)
+}
+
+// Drain waits until all active clients finish. When ctx is done, remaining
+// clients are canceled so they stop waiting for messages; messages not yet
+// delivered stay in their queues. It returns the number of canceled clients.
+func Drain(ctx context.Context) int {
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+loop:
+	for ActiveClients() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	activeClientsMutex.RLock()
+	defer activeClientsMutex.RUnlock()
+
+	for _, c := range activeClients {
+		if c.cancel != nil {
+			c.cancel()
+		}
+	}
+
+	return len(activeClients)
+}
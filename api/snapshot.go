@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+var ErrSnapshotsDisabled = errors.New("snapshots are disabled, there is no snapshot file")
+
+// InjectSnapshotFile sets where POST /v1/snapshot writes, snapshots are
+// disabled if file is empty
+func InjectSnapshotFile(file string) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			next(SetSnapshotFile(ctx, file))
+		}
+	}
+}
+
+const SnapshotFileKey = "b7d4f1e2-3a5c-4e8b-9f6d-2c1a0e7b5d93"
+
+func SetSnapshotFile(ctx context.Context, file string) context.Context {
+	return context.WithValue(ctx, SnapshotFileKey, file)
+}
+
+// GetSnapshotFile returns empty if snapshots are disabled
+func GetSnapshotFile(ctx context.Context) string {
+	file, _ := ctx.Value(SnapshotFileKey).(string)
+	return file
+}
+
+type SnapshotOutput struct {
+	File string `json:"file"`
+	*queue.SnapshotInfo
+}
+
+// Snapshot writes every queue to the snapshot file, replacing the previous
+// one once complete
+func Snapshot(ctx context.Context) (*SnapshotOutput, error) {
+
+	file := GetSnapshotFile(ctx)
+	if file == "" {
+		return nil, ErrSnapshotsDisabled
+	}
+
+	info, err := queue.WriteSnapshotFile(GetQueueService(ctx), file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotOutput{File: file, SnapshotInfo: info}, nil
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+const EventStreamContentType = "text/event-stream"
+
+// SSEHeartbeat is how often a comment is sent on idle event streams so
+// proxies do not close them
+var SSEHeartbeat = 15 * time.Second
+
+// acceptsEventStream returns true if the client asks for Server-Sent Events
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == EventStreamContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// lastEventId is the id of the last event a reconnecting EventSource got,
+// zero if none
+func lastEventId(r *http.Request) uint64 {
+	id, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	return id
+}
+
+func startEventStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", EventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeEvent splits data in lines, an event can not contain empty lines. It
+// returns the bytes written, as the event is written in a single call.
+func writeEvent(w io.Writer, event string, id uint64, data []byte) (int, error) {
+
+	b := &bytes.Buffer{}
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	if id > 0 {
+		b.WriteString("id: " + strconv.FormatUint(id, 10) + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(bytes.TrimSuffix(line, []byte("\r")))
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+
+	return w.Write(b.Bytes())
+}
+
+func writeErrorEvent(w io.Writer, err error) error {
+	_, detail := newErrorDetail(err, "")
+	data, _ := json.Marshal(ErrorResponse{Error: detail})
+	_, err = writeEvent(w, "error", 0, data)
+	return err
+}
+
+// readWithHeartbeat calls heartbeat every interval while waiting for a
+// message
+func readWithHeartbeat(ctx context.Context, q queue.Queue, interval time.Duration, heartbeat func() error) (*queue.Message, error) {
+	for {
+		readCtx, cancel := context.WithTimeout(ctx, interval)
+		message, err := q.ReadMessage(readCtx)
+		cancel()
+
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			if err := heartbeat(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return message, nil
+	}
+}
+
+// skipDelivered resumes a reconnecting EventSource. Messages are removed
+// from the queue once their event is written, so the client does not get
+// them again. But when writing fails the message is given back, and the
+// client may have got the event anyway: if it is at the head with the id of
+// Last-Event-ID, it is taken out instead of being sent twice. Nothing else
+// is skipped, lower ids may be messages given back by other consumers.
+func skipDelivered(ctx context.Context, q queue.Queue, id uint64, heartbeat func() error) error {
+
+	if id == 0 {
+		return nil
+	}
+	head, err := q.Peek(0, 1)
+	if err != nil || len(head) == 0 || head[0].Id != id {
+		return nil // errors are seen by the next read
+	}
+
+	message, err := readWithHeartbeat(ctx, q, SSEHeartbeat, heartbeat)
+	if err != nil {
+		return err
+	}
+	if message.Id != id {
+		return q.Unread(message) // taken by another consumer meanwhile
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/tracing"
+)
+
+func InjectTracer(t *tracing.Tracer) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			next(SetTracer(ctx, t))
+		}
+	}
+}
+
+const TracerKey = "8a1d7e62-5f0b-4c3a-b6f4-2e9d0c7a4b15"
+
+func SetTracer(ctx context.Context, t *tracing.Tracer) context.Context {
+	return context.WithValue(ctx, TracerKey, t)
+}
+
+// GetTracer returns nil if tracing is not configured, a nil tracer creates
+// no spans
+func GetTracer(ctx context.Context) *tracing.Tracer {
+	t, _ := ctx.Value(TracerKey).(*tracing.Tracer)
+	return t
+}
+
+// requestTrace returns the trace context sent by the producer, if any
+func requestTrace(r *http.Request) (tracing.SpanContext, bool) {
+	c, err := tracing.ParseTraceparent(r.Header.Get(tracing.Traceparent), r.Header.Get(tracing.Tracestate))
+	return c, err == nil
+}
+
+// messageTrace returns the trace context stored with a message, if any
+func messageTrace(m *queue.Message) (tracing.SpanContext, bool) {
+	if m.Headers == nil {
+		return tracing.SpanContext{}, false
+	}
+	c, err := tracing.ParseTraceparent(m.Headers[tracing.Traceparent], m.Headers[tracing.Tracestate])
+	return c, err == nil
+}
+
+// setMessageTrace stores the trace context so consumers continue the trace
+func setMessageTrace(m *queue.Message, c tracing.SpanContext) {
+	if m.Headers == nil {
+		m.Headers = map[string]string{}
+	}
+	m.Headers[tracing.Traceparent] = c.Traceparent()
+	if c.TraceState != "" {
+		m.Headers[tracing.Tracestate] = c.TraceState
+	}
+}
+
+// startEnqueueSpan links the message to the producer trace; only messages
+// that come with a trace context are traced.
+func startEnqueueSpan(ctx context.Context, m *queue.Message, queueName string, parent tracing.SpanContext, traced bool) *tracing.Span {
+	if !traced {
+		return nil
+	}
+
+	span := GetTracer(ctx).StartSpan(queueName+" publish", tracing.SpanKindProducer, parent)
+	if span == nil {
+		setMessageTrace(m, parent)
+		return nil
+	}
+
+	span.SetAttribute("messaging.system", "tailon")
+	span.SetAttribute("messaging.operation", "publish")
+	span.SetAttribute("messaging.destination.name", queueName)
+	setMessageTrace(m, span.Context)
+
+	return span
+}
+
+func startDequeueSpan(ctx context.Context, m *queue.Message, queueName string) *tracing.Span {
+	parent, traced := messageTrace(m)
+	if !traced {
+		return nil
+	}
+
+	span := GetTracer(ctx).StartSpan(queueName+" receive", tracing.SpanKindConsumer, parent)
+	span.SetAttribute("messaging.system", "tailon")
+	span.SetAttribute("messaging.operation", "receive")
+	span.SetAttribute("messaging.destination.name", queueName)
+	span.SetAttribute("messaging.message.id", strconv.FormatUint(m.Id, 10))
+
+	return span
+}
+
+// deliveredMessage is the message as seen by the consumer: its trace
+// context continues from the receive span. The stored message is not
+// modified so it can be unread.
+func deliveredMessage(m *queue.Message, span *tracing.Span) *queue.Message {
+	if span == nil {
+		return m
+	}
+
+	delivered := *m
+	delivered.Headers = map[string]string{}
+	for k, v := range m.Headers {
+		delivered.Headers[k] = v
+	}
+	setMessageTrace(&delivered, span.Context)
+
+	return &delivered
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// ExportPageSize is the number of messages taken from the queue at a time
+const ExportPageSize = 1000
+
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Export streams the pending messages as JSON lines with their envelope,
+// gzip compressed if the client accepts it. Messages are not removed, so
+// the export is only consistent if nobody consumes the queue meanwhile.
+func Export(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+	queueName := box.GetUrlParameter(ctx, "queue_id")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := newClient(ctx, r, queueName, cancel)
+	defer trackClient(ctx, c)()
+
+	s := GetQueueService(ctx)
+	q, err := s.GetQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	// First page before sending headers, so errors are regular responses
+	page, err := q.Peek(0, ExportPageSize)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	var out io.Writer = w
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+
+	buffered := bufio.NewWriter(out)
+	e := json.NewEncoder(buffered)
+
+	for offset := 0; len(page) > 0; {
+		for _, message := range page {
+			if err := e.Encode(message); err != nil {
+				return nil // client is gone
+			}
+		}
+		offset += len(page)
+
+		page, err = q.Peek(offset, ExportPageSize)
+		if err != nil || ctx.Err() != nil {
+			// Abort the connection so a truncated export is not taken as
+			// complete
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	buffered.Flush()
+
+	return nil
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding, _, _ = strings.Cut(encoding, ";")
+		if strings.TrimSpace(encoding) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+type ImportOutput struct {
+	Imported int64 `json:"imported"`
+}
+
+// Import loads JSON lines with the envelope of Export, gzip compressed if
+// Content-Encoding says so. Headers and time are kept, ids too if they
+// are greater than the last one in the queue. Rate limits throttle the
+// import instead of rejecting it.
+func Import(ctx context.Context, w http.ResponseWriter, r *http.Request) (*ImportOutput, error) {
+
+	queueName := box.GetUrlParameter(ctx, "queue_id")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := newClient(ctx, r, queueName, cancel)
+	defer trackClient(ctx, c)()
+
+	s := GetQueueService(ctx)
+	q, err := s.GetQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages already imported are kept, like in Write
+	fail := func(err error) (*ImportOutput, error) {
+		w.Header().Set(WrittenHeader, strconv.FormatInt(c.Writes, 10))
+		return nil, err
+	}
+
+	var body io.Reader = r.Body
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return fail(fmt.Errorf("%w: %s", ErrUnsupportedEncoding, err))
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return fail(fmt.Errorf("%w: '%s'", ErrUnsupportedEncoding, encoding))
+	}
+
+	j := json.NewDecoder(body)
+
+	for {
+		message := &queue.Message{}
+
+		err := j.Decode(message)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if len(message.Payload) == 0 {
+			return fail(fmt.Errorf("%w: missing payload", ErrInvalidMessage))
+		}
+
+		if err := waitForLimits(ctx, c, false); err != nil {
+			return fail(err)
+		}
+
+		if err := q.WriteMessage(message); err != nil {
+			return fail(err)
+		}
+
+		c.limits.Take(1, float64(len(message.Payload)))
+		c.Writes++
+	}
+
+	w.Header().Set(WrittenHeader, strconv.FormatInt(c.Writes, 10))
+
+	return &ImportOutput{Imported: c.Writes}, nil
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/websocket"
+)
+
+// Websocket publishes and consumes on a single connection. Every websocket
+// message is a JSON object with a type:
+//
+//	client → server
+//	{"type":"publish","ref":"1","headers":{...},"payload":...}
+//	{"type":"credit","credit":10}  allow 10 more deliveries
+//	{"type":"ack","id":3}
+//	{"type":"nack","id":3}         give the message back to the queue
+//
+//	server → client
+//	{"type":"published","ref":"1","id":3}
+//	{"type":"message","id":3,"time":"...","headers":{...},"payload":...}
+//	{"type":"error","ref":"1","error":{"code":...}}
+//	{"type":"notification","event":"queue_deleted"}
+//
+// Nothing is delivered until the client sends credit. Messages not acked
+// when the connection ends go back to the queue.
+func Websocket(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+	// Browsers let any page open websockets, with its cookies
+	if err := websocket.CheckOrigin(r, GetWebsocketOrigins(ctx)); err != nil {
+		return err
+	}
+
+	queueName := box.GetUrlParameter(ctx, "queue_id")
+
+	q, err := GetQueueService(ctx).GetQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return err
+	}
+
+	// The connection does not speak http anymore
+	box.GetBoxContext(ctx).Response = hijackedResponse{}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := newClient(ctx, r, queueName, cancel)
+	defer trackClient(ctx, c)()
+
+	s := &websocketSession{
+		ctx:       ctx,
+		conn:      conn,
+		queue:     q,
+		queueName: queueName,
+		client:    c,
+		pending:   map[uint64]*queue.Message{},
+		wake:      make(chan struct{}, 1),
+	}
+	s.serve(cancel)
+
+	return nil
+}
+
+// InjectWebsocketOrigins allows web pages of other hosts, like
+// https://app.example.com, to open websockets. Pages of this server are
+// always allowed.
+func InjectWebsocketOrigins(origins []string) box.I {
+	return func(next box.H) box.H {
+		return func(ctx context.Context) {
+			next(SetWebsocketOrigins(ctx, origins))
+		}
+	}
+}
+
+const WebsocketOriginsKey = "4e9a2c71-8b3d-4f06-a5e2-7d1c9b0f3a68"
+
+func SetWebsocketOrigins(ctx context.Context, origins []string) context.Context {
+	return context.WithValue(ctx, WebsocketOriginsKey, origins)
+}
+
+func GetWebsocketOrigins(ctx context.Context) []string {
+	origins, _ := ctx.Value(WebsocketOriginsKey).([]string)
+	return origins
+}
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Websocket message types
+const (
+	WebsocketPublish      = "publish"
+	WebsocketCredit       = "credit"
+	WebsocketAck          = "ack"
+	WebsocketNack         = "nack"
+	WebsocketPublished    = "published"
+	WebsocketMessage      = "message"
+	WebsocketError        = "error"
+	WebsocketNotification = "notification"
+)
+
+// Websocket notification events
+const (
+	EventQueueDeleted = "queue_deleted"
+	EventShutdown     = "shutdown"
+)
+
+// WebsocketFrame is every message exchanged except deliveries, Type says
+// which fields are used.
+type WebsocketFrame struct {
+	Type    string            `json:"type"`
+	Ref     string            `json:"ref,omitempty"`
+	Id      uint64            `json:"id,omitempty"`
+	Credit  int               `json:"credit,omitempty"`
+	Event   string            `json:"event,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload queue.JSON        `json:"payload,omitempty"`
+	Error   *ErrorDetail      `json:"error,omitempty"`
+}
+
+// WebsocketDelivery is a message sent to the client
+type WebsocketDelivery struct {
+	Type string `json:"type"`
+	*queue.Message
+}
+
+type websocketSession struct {
+	ctx       context.Context
+	conn      *websocket.Conn
+	queue     queue.Queue
+	queueName string
+	client    *Client
+
+	mutex   sync.Mutex
+	credit  int
+	pending map[uint64]*queue.Message
+	wake    chan struct{}
+}
+
+func (s *websocketSession) serve(cancel context.CancelFunc) {
+
+	done := make(chan struct{})
+	delivered := make(chan struct{})
+
+	go func() {
+		defer close(delivered)
+		s.deliver()
+	}()
+
+	// Drain cancels the client
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			s.notify(EventShutdown)
+			s.conn.Close(websocket.CloseGoingAway, "server shutting down")
+		case <-done:
+		}
+	}()
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			break // closed by the client, or by us
+		}
+
+		frame := &WebsocketFrame{}
+		if err := json.Unmarshal(data, frame); err != nil {
+			s.sendError("", err)
+			continue
+		}
+
+		switch frame.Type {
+		case WebsocketPublish:
+			s.publish(frame)
+		case WebsocketCredit:
+			s.addCredit(frame)
+		case WebsocketAck, WebsocketNack:
+			s.ack(frame)
+		default:
+			s.sendError(frame.Ref, fmt.Errorf("%w: unknown type '%s'", ErrInvalidMessage, frame.Type))
+		}
+	}
+
+	close(done)
+	cancel()
+	<-delivered
+	s.conn.Close(websocket.CloseNormal, "")
+
+	// Give back in reverse order so they keep their position
+	ids := make([]uint64, 0, len(s.pending))
+	for id := range s.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	for _, id := range ids {
+		s.queue.Unread(s.pending[id])
+	}
+}
+
+func (s *websocketSession) publish(frame *WebsocketFrame) {
+
+	if len(frame.Payload) == 0 {
+		s.sendError(frame.Ref, fmt.Errorf("%w: missing payload", ErrInvalidMessage))
+		return
+	}
+
+	size := float64(len(frame.Payload))
+	if err := s.client.limits.Check(1, size); err != nil {
+		s.sendError(frame.Ref, err)
+		return
+	}
+	s.client.limits.Take(1, size)
+
+	message := &queue.Message{Headers: frame.Headers, Payload: frame.Payload}
+	parent, traced := messageTrace(message)
+	span := startEnqueueSpan(s.ctx, message, s.queueName, parent, traced)
+
+	if err := s.queue.WriteMessage(message); err != nil {
+		span.Fail(err)
+		s.sendError(frame.Ref, err)
+		return
+	}
+
+	span.SetAttribute("messaging.message.id", strconv.FormatUint(message.Id, 10))
+	span.Finish()
+
+	s.client.Writes++
+
+	s.conn.WriteJSON(&WebsocketFrame{Type: WebsocketPublished, Ref: frame.Ref, Id: message.Id})
+}
+
+func (s *websocketSession) addCredit(frame *WebsocketFrame) {
+
+	if frame.Credit <= 0 {
+		s.sendError(frame.Ref, fmt.Errorf("%w: credit must be positive", ErrInvalidMessage))
+		return
+	}
+
+	s.mutex.Lock()
+	s.credit += frame.Credit
+	s.mutex.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takeCredit waits for credit, it returns false if the session is over
+func (s *websocketSession) takeCredit() bool {
+	for {
+		s.mutex.Lock()
+		if s.credit > 0 {
+			s.credit--
+			s.mutex.Unlock()
+			return true
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-s.wake:
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (s *websocketSession) ack(frame *WebsocketFrame) {
+
+	s.mutex.Lock()
+	message, exists := s.pending[frame.Id]
+	delete(s.pending, frame.Id)
+	s.mutex.Unlock()
+
+	if !exists {
+		s.sendError(frame.Ref, fmt.Errorf("%w: unknown id %d", ErrInvalidMessage, frame.Id))
+		return
+	}
+
+	if frame.Type == WebsocketNack {
+		s.queue.Unread(message)
+	}
+}
+
+func (s *websocketSession) deliver() {
+	for {
+		if !s.takeCredit() {
+			return
+		}
+
+		if err := waitForLimits(s.ctx, s.client, false); err != nil {
+			return
+		}
+
+		message, err := s.queue.ReadMessage(s.ctx)
+		if errors.Is(err, queue.ErrQueueNotFound) {
+			s.notify(EventQueueDeleted)
+			s.conn.Close(websocket.CloseNormal, "queue deleted")
+			return
+		}
+		if err != nil {
+			return // session is over
+		}
+
+		span := startDequeueSpan(s.ctx, message, s.queueName)
+
+		s.mutex.Lock()
+		s.pending[message.Id] = message
+		s.mutex.Unlock()
+
+		err = s.conn.WriteJSON(&WebsocketDelivery{
+			Type:    WebsocketMessage,
+			Message: deliveredMessage(message, span),
+		})
+		if err != nil {
+			span.Fail(err)
+			return // pending messages are given back
+		}
+
+		span.Finish()
+
+		s.client.limits.Take(1, float64(len(message.Payload)))
+		s.client.Reads++
+	}
+}
+
+func (s *websocketSession) notify(event string) {
+	s.conn.WriteJSON(&WebsocketFrame{Type: WebsocketNotification, Event: event})
+}
+
+func (s *websocketSession) sendError(ref string, err error) {
+	_, detail := newErrorDetail(err, "")
+	s.conn.WriteJSON(&WebsocketFrame{Type: WebsocketError, Ref: ref, Error: &detail})
+}
+
+// hijackedResponse discards what is written once the connection has been
+// taken over
+type hijackedResponse struct{}
+
+func (hijackedResponse) Header() http.Header         { return http.Header{} }
+func (hijackedResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (hijackedResponse) WriteHeader(int)             {}
@@ -0,0 +1,517 @@
+// Package client is the Go SDK for the tailon HTTP API: queue management,
+// a buffered Producer that streams writes and a Consumer that reconnects.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	URL        string // like http://localhost:8080
+	HTTPClient *http.Client
+	Header     http.Header // sent with every request, for example Authorization
+}
+
+func New(url string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(url, "/"),
+		HTTPClient: http.DefaultClient,
+		Header:     http.Header{},
+	}
+}
+
+// Queue is the state of a queue
+type Queue struct {
+	Name   string `json:"name"`
+	Len    int64  `json:"len"`
+	Reads  int64  `json:"reads"`
+	Writes int64  `json:"writes"`
+}
+
+// Message is what consumers get, Id and Time are assigned by the queue
+type Message struct {
+	Id      uint64            `json:"id"`
+	Time    time.Time         `json:"time"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+// ClientInfo is a reader or writer connected to the server
+type ClientInfo struct {
+	Id     string    `json:"id"`
+	Queue  string    `json:"queue"`
+	Action string    `json:"action"`
+	Start  time.Time `json:"start"`
+	IP     string    `json:"IP"`
+	Reads  int64     `json:"reads"`
+	Writes int64     `json:"writes"`
+}
+
+// Snapshot is a snapshot written by the server, Bytes counts payloads
+type Snapshot struct {
+	File     string    `json:"file"`
+	Time     time.Time `json:"time"`
+	Queues   int       `json:"queues"`
+	Messages int64     `json:"messages"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Replication is the role of a server, replicas include the lag of every
+// queue in seconds and primaries the replicas following them
+type Replication struct {
+	Role        string    `json:"role"`
+	Id          string    `json:"id"`
+	Seq         uint64    `json:"seq"`
+	Primary     string    `json:"primary,omitempty"`
+	Connected   bool      `json:"connected"`
+	LastContact time.Time `json:"last_contact,omitzero"`
+	Error       string    `json:"error,omitempty"`
+	Queues      map[string]struct {
+		Seq  uint64    `json:"seq"`
+		Time time.Time `json:"time,omitzero"`
+		Lag  float64   `json:"lag_seconds"`
+	} `json:"queues,omitempty"`
+	Replicas []struct {
+		Addr  string    `json:"addr"`
+		Seq   uint64    `json:"seq"`
+		Start time.Time `json:"start"`
+	} `json:"replicas,omitempty"`
+}
+
+// ClusterStatus is the role of a node and the members of its cluster,
+// with their progress if the node leads
+type ClusterStatus struct {
+	Id      string `json:"id"`
+	Addr    string `json:"addr"`
+	Role    string `json:"role"`
+	Term    uint64 `json:"term"`
+	Leader  string `json:"leader,omitempty"`
+	Members []struct {
+		Id          string    `json:"id"`
+		Addr        string    `json:"addr"`
+		Match       uint64    `json:"match,omitempty"`
+		LastContact time.Time `json:"last_contact,omitzero"`
+	} `json:"members"`
+	Commit   uint64 `json:"commit_index"`
+	Applied  uint64 `json:"applied_index"`
+	Last     uint64 `json:"last_index"`
+	Snapshot uint64 `json:"snapshot_index"`
+}
+
+// ShardingStatus is the list of nodes that share the queues and how this
+// node moves the queues of others
+type ShardingStatus struct {
+	Addr      string   `json:"addr"`
+	Version   uint64   `json:"version"`
+	Nodes     []string `json:"nodes"`
+	Queues    int      `json:"queues"`
+	Rebalance struct {
+		Running  bool      `json:"running"`
+		Moved    int64     `json:"moved"`
+		Messages int64     `json:"messages"`
+		Last     time.Time `json:"last,omitzero"`
+		Error    string    `json:"error,omitempty"`
+	} `json:"rebalance"`
+}
+
+// Link ships a queue of the server to a remote one
+type Link struct {
+	Queue     string    `json:"queue"`
+	Remote    string    `json:"remote"`
+	Connected bool      `json:"connected"`
+	Pending   int64     `json:"pending"`
+	Sent      int64     `json:"sent"`
+	Retries   int64     `json:"retries"`
+	LastSent  time.Time `json:"last_sent,omitzero"`
+	Error     string    `json:"error,omitempty"`
+	RetryAt   time.Time `json:"retry_at,omitzero"`
+}
+
+// Error is a response error, compare it with errors.Is and the Err*
+// values, which match by Code.
+type Error struct {
+	StatusCode  int
+	Code        string
+	Message     string
+	Description string
+	RequestId   string
+	RetryAfter  time.Duration
+
+	// Written is the number of messages written by a failed write, -1 if
+	// unknown
+	Written int
+}
+
+var (
+	ErrQueueNotFound      = &Error{Code: "queue_not_found"}
+	ErrQueueAlreadyExists = &Error{Code: "queue_already_exists"}
+	ErrInvalidQueueName   = &Error{Code: "invalid_queue_name"}
+	ErrQueueFull          = &Error{Code: "queue_full"}
+	ErrMessageTooLarge    = &Error{Code: "message_too_large"}
+	ErrRateLimitExceeded  = &Error{Code: "rate_limit_exceeded"}
+	ErrUnauthorized       = &Error{Code: "unauthorized"}
+)
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Temporary errors are worth retrying, the rest will fail again
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// temporary is true for network errors and temporary responses
+func temporary(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Temporary()
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func readError(res *http.Response) error {
+
+	e := &Error{
+		StatusCode: res.StatusCode,
+		Code:       "unexpected_status",
+		Message:    res.Status,
+		Written:    -1,
+	}
+
+	body := struct {
+		Error struct {
+			Code        string `json:"code"`
+			Message     string `json:"message"`
+			Description string `json:"description"`
+			RequestId   string `json:"request_id"`
+		} `json:"error"`
+	}{}
+	if json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body) == nil && body.Error.Code != "" {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+		e.Description = body.Error.Description
+		e.RequestId = body.Error.RequestId
+	}
+
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	if written, err := strconv.Atoi(res.Header.Get("Written")); err == nil {
+		e.Written = written
+	}
+
+	return e
+}
+
+// do returns an *Error if the status is not 2xx, the caller closes the body
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+
+	return res, nil
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, input, output interface{}) error {
+
+	var body io.Reader
+	header := http.Header{}
+	if input != nil {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+		header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.do(ctx, method, path, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if output == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(output)
+}
+
+func queuePath(name, action string) string {
+	return "/v1/queues/" + url.PathEscape(name) + action
+}
+
+func (c *Client) ListQueues(ctx context.Context) ([]string, error) {
+	names := []string{}
+	err := c.doJSON(ctx, "GET", "/v1/queues", nil, &names)
+	return names, err
+}
+
+func (c *Client) CreateQueue(ctx context.Context, name string) error {
+	return c.doJSON(ctx, "POST", "/v1/queues", map[string]string{"name": name}, nil)
+}
+
+func (c *Client) RetrieveQueue(ctx context.Context, name string) (*Queue, error) {
+	q := &Queue{}
+	err := c.doJSON(ctx, "GET", queuePath(name, ""), nil, q)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (c *Client) DeleteQueue(ctx context.Context, name string) error {
+	return c.doJSON(ctx, "DELETE", queuePath(name, ""), nil, nil)
+}
+
+// Peek returns up to limit messages without removing them
+func (c *Client) Peek(ctx context.Context, name string, limit int) ([]*Message, error) {
+
+	header := http.Header{}
+	header.Set("Limit", strconv.Itoa(limit))
+
+	res, err := c.do(ctx, "GET", queuePath(name, ":peek"), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	messages := []*Message{}
+	err = json.NewDecoder(res.Body).Decode(&messages)
+	return messages, err
+}
+
+// Purge removes every message and returns how many
+func (c *Client) Purge(ctx context.Context, name string) (int64, error) {
+	output := struct {
+		Purged int64 `json:"purged"`
+	}{}
+	err := c.doJSON(ctx, "POST", queuePath(name, ":purge"), nil, &output)
+	return output.Purged, err
+}
+
+// Export writes the pending messages of a queue to w as JSON lines with
+// their envelope, gzip compressed if compress is true. Messages are not
+// removed.
+func (c *Client) Export(ctx context.Context, queue string, w io.Writer, compress bool) error {
+
+	header := http.Header{}
+	if compress {
+		header.Set("Accept-Encoding", "gzip") // so it is not decompressed
+	}
+
+	res, err := c.do(ctx, "GET", queuePath(queue, ":export"), header, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Import loads an export into a queue and returns how many messages were
+// imported. Gzip compressed exports are detected. On error the ones
+// before Error.Written are stored.
+func (c *Client) Import(ctx context.Context, queue string, r io.Reader) (int64, error) {
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-ndjson")
+
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	res, err := c.do(ctx, "POST", queuePath(queue, ":import"), header, buffered)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	output := struct {
+		Imported int64 `json:"imported"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&output)
+	return output.Imported, err
+}
+
+// Snapshot makes the server write every queue to its snapshot file
+func (c *Client) Snapshot(ctx context.Context) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	err := c.doJSON(ctx, "POST", "/v1/snapshot", nil, snapshot)
+	return snapshot, err
+}
+
+func (c *Client) Replication(ctx context.Context) (*Replication, error) {
+	replication := &Replication{}
+	err := c.doJSON(ctx, "GET", "/v1/replication", nil, replication)
+	return replication, err
+}
+
+// Promote makes a replica the primary, it stops following the old one
+func (c *Client) Promote(ctx context.Context) (*Replication, error) {
+	replication := &Replication{}
+	err := c.doJSON(ctx, "POST", "/v1/replication:promote", nil, replication)
+	return replication, err
+}
+
+func (c *Client) Cluster(ctx context.Context) (*ClusterStatus, error) {
+	status := &ClusterStatus{}
+	err := c.doJSON(ctx, "GET", "/v1/cluster", nil, status)
+	return status, err
+}
+
+// AddMember adds the node at addr, it has to be running
+func (c *Client) AddMember(ctx context.Context, addr string) (*ClusterStatus, error) {
+	status := &ClusterStatus{}
+	err := c.doJSON(ctx, "POST", "/v1/cluster/members", map[string]string{"addr": addr}, status)
+	return status, err
+}
+
+func (c *Client) RemoveMember(ctx context.Context, id string) (*ClusterStatus, error) {
+	status := &ClusterStatus{}
+	err := c.doJSON(ctx, "DELETE", "/v1/cluster/members/"+url.PathEscape(id), nil, status)
+	return status, err
+}
+
+func (c *Client) Sharding(ctx context.Context) (*ShardingStatus, error) {
+	status := &ShardingStatus{}
+	err := c.doJSON(ctx, "GET", "/v1/sharding", nil, status)
+	return status, err
+}
+
+// AddNode adds the node at addr to share the queues, it has to be running
+func (c *Client) AddNode(ctx context.Context, addr string) (*ShardingStatus, error) {
+	status := &ShardingStatus{}
+	err := c.doJSON(ctx, "POST", "/v1/sharding:add", map[string]string{"addr": addr}, status)
+	return status, err
+}
+
+// RemoveNode moves the queues of the node at addr to the other nodes
+func (c *Client) RemoveNode(ctx context.Context, addr string) (*ShardingStatus, error) {
+	status := &ShardingStatus{}
+	err := c.doJSON(ctx, "POST", "/v1/sharding:remove", map[string]string{"addr": addr}, status)
+	return status, err
+}
+
+// Federation returns the links that ship queues to remote servers
+func (c *Client) Federation(ctx context.Context) ([]*Link, error) {
+	links := []*Link{}
+	err := c.doJSON(ctx, "GET", "/v1/federation", nil, &links)
+	return links, err
+}
+
+// ListClients returns the connected clients by id
+func (c *Client) ListClients(ctx context.Context) (map[string]*ClientInfo, error) {
+	clients := map[string]*ClientInfo{}
+	err := c.doJSON(ctx, "GET", "/v1/clients", nil, &clients)
+	return clients, err
+}
+
+// Write sends payloads in a single request, on error the ones before
+// Error.Written are stored.
+func (c *Client) Write(ctx context.Context, queue string, payloads ...json.RawMessage) error {
+
+	body := &bytes.Buffer{}
+	for _, payload := range payloads {
+		if !json.Valid(payload) {
+			return ErrInvalidPayload
+		}
+		body.Write(payload)
+		body.WriteByte('\n')
+	}
+
+	res, err := c.do(ctx, "POST", queuePath(queue, ":write"), nil, body)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+var ErrInvalidPayload = errors.New("payload is not valid JSON")
+
+// Read waits for limit messages, if ctx ends before it returns the ones
+// already read and the context error.
+func (c *Client) Read(ctx context.Context, queue string, limit int) ([]*Message, error) {
+
+	messages := []*Message{}
+	err := c.read(ctx, queue, limit, func(m *Message) error {
+		messages = append(messages, m)
+		return nil
+	})
+
+	return messages, err
+}
+
+// read streams messages with their envelope until limit or an error
+func (c *Client) read(ctx context.Context, queue string, limit int, f func(m *Message) error) error {
+
+	header := http.Header{}
+	header.Set("Limit", strconv.Itoa(limit))
+	header.Set("Envelope", "true")
+
+	res, err := c.do(ctx, "GET", queuePath(queue, ":read"), header, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		m := &Message{}
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			return err
+		}
+		if err := f(m); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,481 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/cluster"
+	"github.com/fulldump/tailon/federation"
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/ratelimit"
+	"github.com/fulldump/tailon/replication"
+	"github.com/fulldump/tailon/sharding"
+)
+
+func newTestServer(qs queue.Service, limits ratelimit.Config) *httptest.Server {
+	h := api.Build("test version", "", qs)
+	h.WithInterceptors(
+		api.InjectRequestId,
+		api.PrettyErrorInterceptor,
+		api.InjectRateLimiter(ratelimit.New(limits)),
+	)
+	return httptest.NewServer(h)
+}
+
+func TestClient(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		ctx := context.Background()
+		qs := queue.NewMemoryService()
+		s := newTestServer(qs, ratelimit.Config{})
+		defer s.Close()
+
+		c := New(s.URL)
+
+		a.Alternative("Queue management", func(a *biff.A) {
+			biff.AssertNil(c.CreateQueue(ctx, "my-queue"))
+
+			names, err := c.ListQueues(ctx)
+			biff.AssertNil(err)
+			biff.AssertEqual(names, []string{"my-queue"})
+
+			q, err := c.RetrieveQueue(ctx, "my-queue")
+			biff.AssertNil(err)
+			biff.AssertEqual(q, &Queue{Name: "my-queue"})
+
+			err = c.CreateQueue(ctx, "my-queue")
+			biff.AssertTrue(errors.Is(err, ErrQueueAlreadyExists))
+
+			biff.AssertNil(c.DeleteQueue(ctx, "my-queue"))
+
+			_, err = c.RetrieveQueue(ctx, "my-queue")
+			biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+			e := err.(*Error)
+			biff.AssertEqual(e.StatusCode, 404)
+			biff.AssertTrue(e.RequestId != "")
+		})
+
+		a.Alternative("Write and read", func(a *biff.A) {
+			qs.CreateQueue("my-queue")
+
+			err := c.Write(ctx, "my-queue", json.RawMessage(`{"n":1}`), json.RawMessage(`2`))
+			biff.AssertNil(err)
+
+			messages, err := c.Read(ctx, "my-queue", 2)
+			biff.AssertNil(err)
+			biff.AssertEqual(len(messages), 2)
+			biff.AssertEqual(messages[0].Id, uint64(1))
+			biff.AssertEqual(string(messages[0].Payload), `{"n":1}`)
+			biff.AssertEqual(string(messages[1].Payload), `2`)
+		})
+
+		a.Alternative("Peek and purge", func(a *biff.A) {
+			qs.CreateQueue("my-queue")
+			c.Write(ctx, "my-queue", json.RawMessage(`1`), json.RawMessage(`2`))
+
+			messages, err := c.Peek(ctx, "my-queue", 1)
+			biff.AssertNil(err)
+			biff.AssertEqual(len(messages), 1)
+			biff.AssertEqual(string(messages[0].Payload), `1`)
+
+			purged, err := c.Purge(ctx, "my-queue")
+			biff.AssertNil(err)
+			biff.AssertEqual(purged, int64(2))
+		})
+
+		a.Alternative("Export and import", func(a *biff.A) {
+			qs.CreateQueue("my-queue")
+			qs.CreateQueue("copy")
+			c.Write(ctx, "my-queue", json.RawMessage(`1`), json.RawMessage(`{"n":2}`))
+
+			for _, compress := range []bool{false, true} {
+				c.Purge(ctx, "copy")
+
+				export := &bytes.Buffer{}
+				biff.AssertNil(c.Export(ctx, "my-queue", export, compress))
+
+				imported, err := c.Import(ctx, "copy", export)
+				biff.AssertNil(err)
+				biff.AssertEqual(imported, int64(2))
+
+				messages, _ := c.Peek(ctx, "copy", 10)
+				biff.AssertEqual(len(messages), 2)
+				biff.AssertEqual(string(messages[1].Payload), `{"n":2}`)
+			}
+
+			_, err := c.Import(ctx, "copy", strings.NewReader(`{"payload":3} {}`))
+			biff.AssertEqual(err.(*Error).Written, 1)
+
+			err = c.Export(ctx, "unknown", &bytes.Buffer{}, false)
+			biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+		})
+
+		a.Alternative("Features disabled", func(a *biff.A) {
+			calls := map[string]func() error{
+				"snapshots_disabled":   func() error { _, err := c.Snapshot(ctx); return err },
+				"replication_disabled": func() error { _, err := c.Replication(ctx); return err },
+				"cluster_disabled":     func() error { _, err := c.Cluster(ctx); return err },
+				"sharding_disabled":    func() error { _, err := c.Sharding(ctx); return err },
+				"federation_disabled":  func() error { _, err := c.Federation(ctx); return err },
+			}
+			for code, call := range calls {
+				biff.AssertEqual(call().(*Error).Code, code)
+			}
+		})
+
+		a.Alternative("List clients", func(a *biff.A) {
+			qs.CreateQueue("my-queue")
+			consumer := c.NewConsumer("my-queue", ConsumerConfig{})
+			defer consumer.Close()
+
+			clients := map[string]*ClientInfo{}
+			for len(clients) == 0 {
+				clients, _ = c.ListClients(ctx)
+			}
+			for _, info := range clients {
+				biff.AssertEqual(info.Action, "read")
+				biff.AssertEqual(info.Queue, "my-queue")
+			}
+		})
+
+		a.Alternative("Read until context ends", func(a *biff.A) {
+			qs.CreateQueue("my-queue")
+			c.Write(ctx, "my-queue", json.RawMessage(`1`))
+
+			timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer cancel()
+
+			messages, err := c.Read(timeout, "my-queue", 2)
+			biff.AssertEqual(err, context.DeadlineExceeded)
+			biff.AssertEqual(len(messages), 1)
+		})
+
+		a.Alternative("Producer", func(a *biff.A) {
+			q, _ := qs.CreateQueue("my-queue")
+
+			p := c.NewProducer("my-queue", ProducerConfig{BatchSize: 10})
+			for i := 0; i < 250; i++ {
+				biff.AssertNil(p.Publish(ctx, json.RawMessage(fmt.Sprint(i))))
+			}
+			biff.AssertNil(p.Flush(ctx))
+			biff.AssertEqual(q.Stats().Len, int64(250))
+
+			biff.AssertNil(p.Publish(ctx, json.RawMessage(`250`)))
+			biff.AssertNil(p.Close(ctx))
+			biff.AssertEqual(q.Stats().Len, int64(251))
+
+			for i := 0; i < 251; i++ {
+				payload, _ := q.Read()
+				biff.AssertEqual(string(payload), fmt.Sprint(i))
+			}
+
+			biff.AssertEqual(p.Publish(ctx, json.RawMessage(`1`)), ErrProducerClosed)
+		})
+
+		a.Alternative("Producer drops rejected messages", func(a *biff.A) {
+			qs.Limits.MaxMessageSize = 10
+			q, _ := qs.CreateQueue("my-queue")
+
+			mutex := sync.Mutex{}
+			dropped := []string{}
+			p := c.NewProducer("my-queue", ProducerConfig{
+				OnError: func(err error, payload json.RawMessage) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					biff.AssertTrue(errors.Is(err, ErrMessageTooLarge))
+					dropped = append(dropped, string(payload))
+				},
+			})
+			p.Publish(ctx, json.RawMessage(`1`))
+			p.Publish(ctx, json.RawMessage(`"too large message"`))
+			p.Publish(ctx, json.RawMessage(`3`))
+			biff.AssertNil(p.Close(ctx))
+
+			biff.AssertEqual(dropped, []string{`"too large message"`})
+			biff.AssertEqual(q.Stats().Len, int64(2))
+		})
+
+		a.Alternative("Consumer", func(a *biff.A) {
+			qs.CreateQueue("my-queue")
+			c.Write(ctx, "my-queue", json.RawMessage(`1`), json.RawMessage(`2`), json.RawMessage(`3`))
+
+			consumer := c.NewConsumer("my-queue", ConsumerConfig{Limit: 2})
+			for i := 1; i <= 3; i++ {
+				m := <-consumer.Messages()
+				biff.AssertEqual(string(m.Payload), fmt.Sprint(i))
+			}
+			biff.AssertNil(consumer.Close())
+
+			_, open := <-consumer.Messages()
+			biff.AssertTrue(!open)
+		})
+
+		a.Alternative("Consume stops on callback error", func(a *biff.A) {
+			qs.CreateQueue("my-queue")
+			c.Write(ctx, "my-queue", json.RawMessage(`1`), json.RawMessage(`2`), json.RawMessage(`3`))
+
+			stop := errors.New("stop")
+			received := 0
+			err := c.Consume(ctx, "my-queue", ConsumerConfig{Limit: 1}, func(m *Message) error {
+				received++
+				if received == 3 {
+					return stop
+				}
+				return nil
+			})
+			biff.AssertEqual(err, stop)
+		})
+
+		a.Alternative("Consume up to max", func(a *biff.A) {
+			q, _ := qs.CreateQueue("my-queue")
+			c.Write(ctx, "my-queue", json.RawMessage(`1`), json.RawMessage(`2`), json.RawMessage(`3`))
+
+			received := 0
+			err := c.Consume(ctx, "my-queue", ConsumerConfig{Limit: 5, Max: 2}, func(m *Message) error {
+				received++
+				return nil
+			})
+			biff.AssertNil(err)
+			biff.AssertEqual(received, 2)
+			biff.AssertEqual(q.Stats().Len, int64(1))
+		})
+
+		a.Alternative("Consume missing queue", func(a *biff.A) {
+			err := c.Consume(ctx, "invented", ConsumerConfig{}, func(m *Message) error {
+				return nil
+			})
+			biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+		})
+	})
+}
+
+// newPeerServer listens before the service exists, cluster and sharding
+// nodes need their own url. Other nodes send the token "secret".
+func newPeerServer(interceptors ...box.I) (*httptest.Server, func(qs queue.Service)) {
+
+	var handler http.Handler
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+
+	serve := func(qs queue.Service) {
+		h := api.Build("test version", "", qs)
+		h.WithInterceptors(append([]box.I{api.InjectRequestId, api.PrettyErrorInterceptor, api.InjectPeerToken("secret")}, interceptors...)...)
+		handler = h
+	}
+
+	return s, serve
+}
+
+func TestSnapshot(t *testing.T) {
+
+	qs := queue.NewMemoryService()
+	qs.CreateQueue("my-queue")
+	file := filepath.Join(t.TempDir(), "tailon.snapshot")
+
+	s, serve := newPeerServer(api.InjectSnapshotFile(file))
+	defer s.Close()
+	serve(qs)
+
+	snapshot, err := New(s.URL).Snapshot(context.Background())
+	biff.AssertNil(err)
+	biff.AssertEqual(snapshot.File, file)
+	biff.AssertEqual(snapshot.Queues, 1)
+}
+
+func TestReplication(t *testing.T) {
+
+	ctx := context.Background()
+
+	primary := replication.NewPrimary(queue.NewMemoryService())
+	primary.CreateQueue("my-queue")
+	primaryServer, serve := newPeerServer()
+	defer primaryServer.Close()
+	defer primaryServer.CloseClientConnections()
+	serve(primary)
+
+	replica := replication.NewReplica(primaryServer.URL, queue.NewMemoryService())
+	replica.Token = "secret"
+	replica.Start()
+	defer replica.Close()
+	s, serve := newPeerServer()
+	defer s.Close()
+	serve(replica)
+
+	c := New(s.URL)
+	status := &Replication{}
+	for i := 0; i < 100 && !status.Connected; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, _ = c.Replication(ctx)
+	}
+	biff.AssertEqual(status.Role, "replica")
+	biff.AssertEqual(status.Primary, primaryServer.URL)
+	biff.AssertTrue(status.Connected)
+
+	_, err := c.Promote(ctx)
+	biff.AssertTrue(errors.Is(err, ErrUnauthorized))
+
+	c.Header.Set("Authorization", "Bearer secret")
+	status, err = c.Promote(ctx)
+	biff.AssertNil(err)
+	biff.AssertEqual(status.Role, "primary")
+}
+
+func TestCluster(t *testing.T) {
+
+	ctx := context.Background()
+
+	config := cluster.DefaultConfig
+	config.ElectionTimeout = 100 * time.Millisecond
+	config.HeartbeatInterval = 20 * time.Millisecond
+	config.Token = "secret"
+
+	start := func(c cluster.Config) (*cluster.Node, *httptest.Server) {
+		s, serve := newPeerServer()
+		c.Addr = s.URL
+		node := cluster.New(c, queue.NewMemoryService())
+		serve(node)
+		return node, s
+	}
+
+	bootstrap := config
+	bootstrap.Bootstrap = true
+	leader, leaderServer := start(bootstrap)
+	defer leaderServer.Close()
+	defer leaderServer.CloseClientConnections()
+	defer leader.Close()
+	follower, followerServer := start(config)
+	defer followerServer.Close()
+	defer followerServer.CloseClientConnections()
+	defer follower.Close()
+
+	c := New(leaderServer.URL)
+	status := &ClusterStatus{}
+	for i := 0; i < 100 && status.Role != cluster.RoleLeader; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, _ = c.Cluster(ctx)
+	}
+	biff.AssertEqual(status.Role, cluster.RoleLeader)
+	biff.AssertEqual(len(status.Members), 1)
+
+	_, err := c.AddMember(ctx, followerServer.URL)
+	biff.AssertTrue(errors.Is(err, ErrUnauthorized))
+
+	c.Header.Set("Authorization", "Bearer secret")
+	status, err = c.AddMember(ctx, followerServer.URL)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(status.Members), 2)
+
+	status, err = c.RemoveMember(ctx, follower.Member().Id)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(status.Members), 1)
+
+	_, err = c.RemoveMember(ctx, "invented")
+	biff.AssertEqual(err.(*Error).Code, "member_not_found")
+}
+
+func TestSharding(t *testing.T) {
+
+	ctx := context.Background()
+
+	start := func() (*sharding.Router, *httptest.Server) {
+		s, serve := newPeerServer()
+		router, err := sharding.New(sharding.Config{Addr: s.URL, Token: "secret"}, queue.NewMemoryService())
+		biff.AssertNil(err)
+		serve(router)
+		return router, s
+	}
+
+	routerA, serverA := start()
+	defer serverA.Close()
+	defer serverA.CloseClientConnections()
+	defer routerA.Close()
+	routerB, serverB := start()
+	defer serverB.Close()
+	defer serverB.CloseClientConnections()
+	defer routerB.Close()
+
+	c := New(serverA.URL)
+	status, err := c.Sharding(ctx)
+	biff.AssertNil(err)
+	biff.AssertEqual(status.Addr, serverA.URL)
+	biff.AssertEqual(status.Nodes, []string{serverA.URL})
+
+	_, err = c.AddNode(ctx, serverB.URL)
+	biff.AssertTrue(errors.Is(err, ErrUnauthorized))
+
+	c.Header.Set("Authorization", "Bearer secret")
+	status, err = c.AddNode(ctx, serverB.URL)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(status.Nodes), 2)
+	biff.AssertEqual(len(routerB.Membership().Nodes), 2)
+
+	status, err = c.RemoveNode(ctx, serverB.URL)
+	biff.AssertNil(err)
+	biff.AssertEqual(status.Nodes, []string{serverA.URL})
+
+	_, err = c.RemoveNode(ctx, serverA.URL)
+	biff.AssertEqual(err.(*Error).Code, "last_node")
+}
+
+func TestFederation(t *testing.T) {
+
+	qs := queue.NewMemoryService()
+	f, err := federation.New(federation.Config{Links: "orders=http://127.0.0.1:1/central"}, qs)
+	biff.AssertNil(err)
+	defer f.Close()
+
+	s, serve := newPeerServer(api.InjectFederation(f))
+	defer s.Close()
+	serve(qs)
+
+	links, err := New(s.URL).Federation(context.Background())
+	biff.AssertNil(err)
+	biff.AssertEqual(len(links), 1)
+	biff.AssertEqual(links[0].Queue, "orders")
+	biff.AssertEqual(links[0].Remote, "http://127.0.0.1:1/central")
+}
+
+func TestProducerRetry(t *testing.T) {
+
+	ctx := context.Background()
+	qs := queue.NewMemoryService()
+	q, _ := qs.CreateQueue("my-queue")
+	s := newTestServer(qs, ratelimit.Config{
+		Queue: ratelimit.Limit{Messages: 5},
+	})
+	defer s.Close()
+
+	errs := []error{}
+	p := New(s.URL).NewProducer("my-queue", ProducerConfig{
+		OnError: func(err error, payload json.RawMessage) {
+			biff.AssertNil(payload)
+			errs = append(errs, err)
+		},
+	})
+	for i := 0; i < 8; i++ {
+		p.Publish(ctx, json.RawMessage(fmt.Sprint(i)))
+	}
+	biff.AssertNil(p.Close(ctx))
+
+	biff.AssertEqual(len(errs), 1)
+	biff.AssertTrue(errors.Is(errs[0], ErrRateLimitExceeded))
+	biff.AssertEqual(errs[0].(*Error).Written, 5)
+
+	biff.AssertEqual(q.Stats().Len, int64(8)) // no duplicates
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type ConsumerConfig struct {
+	// Limit is the number of messages per :read request. The server
+	// removes messages from the queue as it sends them, so up to Limit
+	// messages can be lost when the consumer stops.
+	Limit int
+
+	// Max stops consuming after this many messages, requests ask only for
+	// the ones left. Zero means no end.
+	Max int
+
+	RetryMin time.Duration
+	RetryMax time.Duration
+
+	// OnError is called before retrying a failed request
+	OnError func(err error)
+}
+
+var DefaultConsumerConfig = ConsumerConfig{
+	Limit:    100,
+	RetryMin: 100 * time.Millisecond,
+	RetryMax: 10 * time.Second,
+}
+
+func (config ConsumerConfig) withDefaults() ConsumerConfig {
+	d := DefaultConsumerConfig
+	if config.Limit <= 0 {
+		config.Limit = d.Limit
+	}
+	if config.RetryMin <= 0 {
+		config.RetryMin = d.RetryMin
+	}
+	if config.RetryMax <= 0 {
+		config.RetryMax = d.RetryMax
+	}
+	return config
+}
+
+// Consume calls f for every message until ctx ends, f fails or Max is
+// reached, reconnecting when a request ends. Errors that will not go away,
+// like a missing queue, are returned.
+func (c *Client) Consume(ctx context.Context, queue string, config ConsumerConfig, f func(m *Message) error) error {
+
+	config = config.withDefaults()
+	consumed := 0
+
+	for retry := 0; ; retry++ {
+
+		limit := config.Limit
+		if config.Max > 0 && config.Max-consumed < limit {
+			limit = config.Max - consumed
+		}
+
+		var failed error
+		err := c.read(ctx, queue, limit, func(m *Message) error {
+			retry = 0
+			consumed++
+			failed = f(m)
+			return failed
+		})
+		if failed != nil {
+			return failed
+		}
+		if config.Max > 0 && consumed >= config.Max {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			retry = -1 // the request has reached the limit
+			continue
+		}
+		if !temporary(err) {
+			return err
+		}
+
+		if config.OnError != nil {
+			config.OnError(err)
+		}
+
+		retryAfter := time.Duration(0)
+		e := &Error{}
+		if errors.As(err, &e) {
+			retryAfter = e.RetryAfter
+		}
+		if !sleep(ctx, backoff(config.RetryMin, config.RetryMax, retry, retryAfter)) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Consumer delivers messages through a channel
+type Consumer struct {
+	messages chan *Message
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error
+}
+
+func (c *Client) NewConsumer(queue string, config ConsumerConfig) *Consumer {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &Consumer{
+		messages: make(chan *Message),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(consumer.done)
+		defer close(consumer.messages)
+
+		err := c.Consume(ctx, queue, config, func(m *Message) error {
+			select {
+			case consumer.messages <- m:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if ctx.Err() == nil {
+			consumer.err = err
+		}
+	}()
+
+	return consumer
+}
+
+// Messages is closed when the consumer ends
+func (c *Consumer) Messages() <-chan *Message {
+	return c.messages
+}
+
+// Err waits for the consumer to end and tells why, it is nil after Close
+func (c *Consumer) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Close stops consuming, messages received and not taken from the channel
+// are lost
+func (c *Consumer) Close() error {
+	c.cancel()
+	<-c.done
+	return c.err
+}
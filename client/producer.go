@@ -0,0 +1,391 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type ProducerConfig struct {
+	Buffer        int           // messages waiting to be sent, Publish blocks when full
+	BatchSize     int           // messages written together
+	FlushInterval time.Duration // maximum time a message waits for its batch
+
+	// RequestMessages ends the request after this many messages, until
+	// then they are retried if the request fails
+	RequestMessages int
+	RequestAge      time.Duration
+
+	RetryMin time.Duration
+	RetryMax time.Duration
+
+	// OnError is called for every failed request. Messages rejected by the
+	// server, like invalid or too large ones, are dropped and passed as
+	// payload, other failures are retried and payload is nil.
+	OnError func(err error, payload json.RawMessage)
+}
+
+var DefaultProducerConfig = ProducerConfig{
+	Buffer:          1000,
+	BatchSize:       100,
+	FlushInterval:   100 * time.Millisecond,
+	RequestMessages: 10000,
+	RequestAge:      time.Minute,
+	RetryMin:        100 * time.Millisecond,
+	RetryMax:        10 * time.Second,
+}
+
+var (
+	ErrProducerClosed = errors.New("producer closed")
+	ErrUndelivered    = errors.New("messages not delivered")
+)
+
+// Producer streams messages to a queue over a long lived :write request.
+// Delivery is at least once: the server tells how many messages were
+// written when it rejects one, but if the connection breaks every message
+// of the request is sent again.
+type Producer struct {
+	client *Client
+	queue  string
+	config ProducerConfig
+
+	messages chan json.RawMessage
+	flushes  chan chan struct{}
+	closing  chan struct{}
+	done     chan struct{}
+
+	closeOnce sync.Once
+	mutex     sync.RWMutex
+	closed    bool
+
+	// Used only by run
+	ctx         context.Context
+	cancel      context.CancelFunc
+	request     *producerRequest
+	pending     []json.RawMessage // sent with the current request
+	undelivered int
+}
+
+type producerRequest struct {
+	body    *io.PipeWriter
+	result  chan error
+	started time.Time
+}
+
+// NewProducer starts a producer, zero config values take the default
+func (c *Client) NewProducer(queue string, config ProducerConfig) *Producer {
+
+	d := DefaultProducerConfig
+	if config.Buffer <= 0 {
+		config.Buffer = d.Buffer
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = d.BatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = d.FlushInterval
+	}
+	if config.RequestMessages <= 0 {
+		config.RequestMessages = d.RequestMessages
+	}
+	if config.RequestAge <= 0 {
+		config.RequestAge = d.RequestAge
+	}
+	if config.RetryMin <= 0 {
+		config.RetryMin = d.RetryMin
+	}
+	if config.RetryMax <= 0 {
+		config.RetryMax = d.RetryMax
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Producer{
+		client:   c,
+		queue:    queue,
+		config:   config,
+		messages: make(chan json.RawMessage, config.Buffer),
+		flushes:  make(chan chan struct{}),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	go p.run()
+
+	return p
+}
+
+// Publish blocks while the buffer is full
+func (p *Producer) Publish(ctx context.Context, payload json.RawMessage) error {
+
+	if !json.Valid(payload) {
+		return ErrInvalidPayload
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.closed {
+		return ErrProducerClosed
+	}
+
+	select {
+	case p.messages <- payload:
+		return nil
+	case <-p.closing:
+		return ErrProducerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush waits until every message published before is written, or has
+// been dropped
+func (p *Producer) Flush(ctx context.Context) error {
+
+	done := make(chan struct{})
+	select {
+	case p.flushes <- done:
+	case <-p.done:
+		return ErrProducerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends the buffered messages, retrying until ctx ends
+func (p *Producer) Close(ctx context.Context) error {
+
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+	}
+
+	if p.undelivered > 0 {
+		return fmt.Errorf("%w: %d", ErrUndelivered, p.undelivered)
+	}
+	return nil
+}
+
+func (p *Producer) run() {
+
+	defer close(p.done)
+	defer p.cancel()
+
+	batch := []json.RawMessage{}
+	timer := time.NewTimer(p.config.FlushInterval)
+	timer.Stop()
+
+	for {
+		var result chan error
+		if p.request != nil {
+			result = p.request.result
+		}
+
+		select {
+		case payload := <-p.messages:
+			if len(batch) == 0 {
+				timer.Reset(p.config.FlushInterval)
+			}
+			batch = append(batch, payload)
+			if len(batch) < p.config.BatchSize {
+				continue
+			}
+
+		case <-timer.C:
+
+		case err := <-result:
+			// The request ended by itself, like when the server restarts
+			p.request = nil
+			p.settle(err)
+
+		case done := <-p.flushes:
+			for len(p.messages) > 0 {
+				batch = append(batch, <-p.messages)
+			}
+			p.send(batch)
+			batch = batch[:0]
+			p.end()
+			close(done)
+
+		case <-p.closing:
+			// Wait for Publish calls in progress
+			p.mutex.Lock()
+			p.closed = true
+			p.mutex.Unlock()
+
+			for len(p.messages) > 0 {
+				batch = append(batch, <-p.messages)
+			}
+			p.send(batch)
+			p.end()
+			return
+		}
+
+		timer.Stop()
+		p.send(batch)
+		batch = batch[:0]
+
+		if p.request != nil && (len(p.pending) >= p.config.RequestMessages || time.Since(p.request.started) > p.config.RequestAge) {
+			p.end()
+		}
+	}
+}
+
+// send writes the batch to the current request, starting one if needed
+func (p *Producer) send(batch []json.RawMessage) {
+
+	if len(batch) == 0 || p.ctx.Err() != nil {
+		p.undelivered += len(batch)
+		return
+	}
+
+	p.pending = append(p.pending, batch...)
+
+	if p.request == nil {
+		p.start()
+		batch = p.pending // retries included
+	}
+
+	size := 0
+	for _, payload := range batch {
+		size += len(payload) + 1
+	}
+	body := make([]byte, 0, size)
+	for _, payload := range batch {
+		body = append(body, payload...)
+		body = append(body, '\n')
+	}
+
+	if _, err := p.request.body.Write(body); err != nil {
+		// The request has failed, its result tells why
+		err = <-p.request.result
+		p.request = nil
+		p.settle(err)
+	}
+}
+
+func (p *Producer) start() {
+
+	body, writer := io.Pipe()
+	r := &producerRequest{
+		body:    writer,
+		result:  make(chan error, 1),
+		started: time.Now(),
+	}
+
+	go func() {
+		res, err := p.client.do(p.ctx, "POST", queuePath(p.queue, ":write"), nil, body)
+		if err == nil {
+			err = res.Body.Close()
+		}
+		body.CloseWithError(errRequestEnded) // unblocks writes
+		r.result <- err
+	}()
+
+	p.request = r
+}
+
+var errRequestEnded = errors.New("request ended")
+
+// end finishes the current request and waits for every pending message
+func (p *Producer) end() {
+
+	if p.request == nil {
+		return
+	}
+
+	p.request.body.Close()
+	err := <-p.request.result
+	p.request = nil
+
+	p.settle(err)
+}
+
+// settle confirms the pending messages, or retries them with a new request
+// until they are written or dropped
+func (p *Producer) settle(err error) {
+
+	for retry := 0; err != nil; retry++ {
+
+		e := &Error{}
+		if errors.As(err, &e) && e.Written >= 0 && e.Written <= len(p.pending) {
+			p.pending = p.pending[e.Written:]
+		}
+
+		var dropped json.RawMessage
+		if !temporary(err) && len(p.pending) > 0 && p.ctx.Err() == nil {
+			dropped = p.pending[0]
+			p.pending = p.pending[1:]
+		}
+
+		if p.config.OnError != nil {
+			p.config.OnError(err, dropped)
+		}
+
+		if len(p.pending) == 0 {
+			return
+		}
+
+		if dropped == nil && !sleep(p.ctx, backoff(p.config.RetryMin, p.config.RetryMax, retry, e.RetryAfter)) {
+			p.undelivered += len(p.pending)
+			p.pending = nil
+			return
+		}
+
+		p.start()
+		var body []byte
+		for _, payload := range p.pending {
+			body = append(body, payload...)
+			body = append(body, '\n')
+		}
+		p.request.body.Write(body)
+		p.request.body.Close()
+		err = <-p.request.result
+		p.request = nil
+	}
+
+	p.pending = p.pending[:0]
+}
+
+// backoff doubles from min to max, or waits what the server asks
+func backoff(min, max time.Duration, retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := min << retry
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d
+}
+
+// sleep returns false if ctx ends before
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,462 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+// network connects nodes in memory. Requests and responses are encoded as
+// JSON, like over HTTP.
+type network struct {
+	mutex sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+func newNetwork() *network {
+	return &network{nodes: map[string]*Node{}, down: map[string]bool{}}
+}
+
+func (nw *network) setDown(addr string, down bool) {
+	nw.mutex.Lock()
+	nw.down[addr] = down
+	nw.mutex.Unlock()
+}
+
+// memTransport is the side of the network of a node
+type memTransport struct {
+	network *network
+	from    string
+}
+
+func (t *memTransport) reach(addr string) (*Node, error) {
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+	n := t.network.nodes[addr]
+	if n == nil || t.network.down[t.from] || t.network.down[addr] {
+		return nil, errUnreachable
+	}
+	return n, nil
+}
+
+func roundTrip[T any](v *T) *T {
+	b, _ := json.Marshal(v)
+	copied := new(T)
+	json.Unmarshal(b, copied)
+	return copied
+}
+
+func (t *memTransport) RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error) {
+	n, err := t.reach(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.RequestVote(roundTrip(req))
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(res), nil
+}
+
+func (t *memTransport) AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error) {
+	n, err := t.reach(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.AppendEntries(roundTrip(req))
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(res), nil
+}
+
+func (t *memTransport) InstallSnapshot(ctx context.Context, addr string, req *InstallRequest) (*AppendResponse, error) {
+	n, err := t.reach(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.InstallSnapshot(roundTrip(req))
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(res), nil
+}
+
+func (t *memTransport) Propose(ctx context.Context, addr string, c *Command) (*Result, error) {
+	n, err := t.reach(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.Propose(ctx, roundTrip(c))
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(res), nil
+}
+
+func (t *memTransport) Status(ctx context.Context, addr string) (*Status, error) {
+	n, err := t.reach(addr)
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(n.Status()), nil
+}
+
+var testConfig = Config{
+	ElectionTimeout:   100 * time.Millisecond,
+	HeartbeatInterval: 20 * time.Millisecond,
+	Timeout:           5 * time.Second,
+	LogSize:           DefaultConfig.LogSize,
+}
+
+// addNode starts a node, it is not a member until it is added
+func (nw *network) addNode(c Config) *Node {
+
+	nw.mutex.Lock()
+	c.Addr = "node" + strconv.Itoa(len(nw.nodes)+1)
+	n := NewNode(c, queue.NewMemoryService(), &memTransport{network: nw, from: c.Addr})
+	nw.nodes[c.Addr] = n
+	nw.mutex.Unlock()
+
+	n.Start()
+	return n
+}
+
+// newCluster bootstraps the first node and adds the others
+func newCluster(size int, c Config) (*network, []*Node) {
+
+	nw := newNetwork()
+
+	bootstrap := c
+	bootstrap.Bootstrap = true
+	nodes := []*Node{nw.addNode(bootstrap)}
+
+	for len(nodes) < size {
+		n := nw.addNode(c)
+		if _, err := nodes[0].AddMember(context.Background(), n.config.Addr); err != nil {
+			panic(err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	return nw, nodes
+}
+
+func closeAll(nodes []*Node) {
+	for _, n := range nodes {
+		n.Close()
+	}
+}
+
+// eventually waits for condition, followers apply changes asynchronously
+func eventually(condition func() bool) bool {
+	for i := 0; i < 300; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func leaderOf(nodes []*Node) *Node {
+	var leader *Node
+	eventually(func() bool {
+		for _, n := range nodes {
+			if n.Status().Role == RoleLeader {
+				leader = n
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func followersOf(nodes []*Node, leader *Node) []*Node {
+	followers := []*Node{}
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+	return followers
+}
+
+// dump is the state of every queue, to compare nodes
+func dump(s queue.Service) string {
+	state := map[string][]*queue.Message{}
+	names, _ := s.ListQueues()
+	for _, name := range names {
+		q, _ := s.GetQueue(name)
+		state[name], _ = q.Peek(0, 1000)
+	}
+	b, _ := json.Marshal(state)
+	return string(b)
+}
+
+func converged(nodes []*Node) bool {
+	return eventually(func() bool {
+		for _, n := range nodes[1:] {
+			if dump(n) != dump(nodes[0]) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestCluster(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		nw, nodes := newCluster(3, testConfig)
+		defer closeAll(nodes)
+
+		leader := leaderOf(nodes)
+		biff.AssertTrue(leader != nil)
+		followers := followersOf(nodes, leader)
+
+		a.Alternative("Status", func(a *biff.A) {
+			s := leader.Status()
+			biff.AssertEqual(len(s.Members), 3)
+			biff.AssertEqual(s.Leader, leader.config.Addr)
+
+			biff.AssertTrue(eventually(func() bool {
+				return followers[0].Status().Leader == leader.config.Addr
+			}))
+			biff.AssertEqual(followers[0].Status().Role, RoleFollower)
+		})
+
+		a.Alternative("Forward to the leader", func(a *biff.A) {
+			q, err := followers[0].CreateQueue("q")
+			biff.AssertNil(err)
+
+			// Read your writes
+			_, err = followers[0].GetQueue("q")
+			biff.AssertNil(err)
+
+			message := &queue.Message{Payload: queue.JSON(`"a"`), Headers: map[string]string{"k": "v"}}
+			biff.AssertNil(q.WriteMessage(message))
+			biff.AssertEqual(message.Id, uint64(1))
+			biff.AssertNil(q.Write(queue.JSON(`"b"`)))
+			biff.AssertEqual(q.Stats().Len, int64(2))
+
+			biff.AssertTrue(converged(nodes))
+
+			other, err := followers[1].GetQueue("q")
+			biff.AssertNil(err)
+			read, err := other.ReadMessage(context.Background())
+			biff.AssertNil(err)
+			biff.AssertEqualJson(read, message)
+
+			biff.AssertTrue(converged(nodes))
+			biff.AssertEqual(q.Stats().Len, int64(1))
+			biff.AssertEqual(q.Stats().Reads, int64(1))
+
+			purged, err := q.Purge()
+			biff.AssertNil(err)
+			biff.AssertEqual(purged, int64(1))
+
+			biff.AssertNil(leader.DeleteQueue("q"))
+			biff.AssertTrue(converged(nodes))
+			names, _ := followers[1].ListQueues()
+			biff.AssertEqual(len(names), 0)
+		})
+
+		a.Alternative("Errors", func(a *biff.A) {
+			leader.CreateQueue("q")
+
+			_, err := followers[0].CreateQueue("q")
+			biff.AssertTrue(errors.Is(err, queue.ErrQueueAlreadyExists))
+
+			_, err = followers[0].CreateQueue("in:valid")
+			biff.AssertTrue(errors.Is(err, queue.ErrInvalidQueueName))
+
+			err = followers[0].DeleteQueue("missing")
+			biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+
+			_, err = followers[0].GetQueue("missing")
+			biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+		})
+
+		a.Alternative("Blocking read", func(a *biff.A) {
+			leader.CreateQueue("q")
+			biff.AssertTrue(converged(nodes))
+
+			reader, _ := followers[0].GetQueue("q")
+			read := make(chan *queue.Message)
+			go func() {
+				message, _ := reader.ReadMessage(context.Background())
+				read <- message
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := reader.ReadMessage(ctx)
+			biff.AssertEqual(err, context.DeadlineExceeded)
+
+			writer, _ := followers[1].GetQueue("q")
+			writer.Write(queue.JSON(`"hello"`))
+
+			select {
+			case message := <-read:
+				biff.AssertEqual(string(message.Payload), `"hello"`)
+			case <-time.After(5 * time.Second):
+				t.Fatal("message not read")
+			}
+		})
+
+		a.Alternative("Leader failure", func(a *biff.A) {
+			q, _ := leader.CreateQueue("q")
+			q.Write(queue.JSON(`1`))
+
+			nw.setDown(leader.config.Addr, true)
+
+			next := leaderOf(followers)
+			biff.AssertTrue(next != nil)
+			biff.AssertTrue(next.Status().Term > leader.Status().Term || leader.Status().Role != RoleLeader)
+
+			// The old leader steps down without a majority
+			biff.AssertTrue(eventually(func() bool { return leader.Status().Role != RoleLeader }))
+
+			other, _ := followersOf(followers, next)[0].GetQueue("q")
+			biff.AssertNil(other.Write(queue.JSON(`2`)))
+
+			nw.setDown(leader.config.Addr, false)
+			biff.AssertTrue(converged(nodes))
+
+			messages, _ := q.Peek(0, 10)
+			biff.AssertEqual(len(messages), 2)
+		})
+
+		a.Alternative("Membership", func(a *biff.A) {
+			// Removed followers do not get changes
+			removed := followers[0]
+			_, err := followers[1].RemoveMember(context.Background(), removed.id)
+			biff.AssertNil(err)
+			biff.AssertEqual(len(leader.Status().Members), 2)
+
+			_, err = leader.RemoveMember(context.Background(), removed.id)
+			biff.AssertTrue(errors.Is(err, ErrMemberNotFound))
+
+			q, _ := leader.CreateQueue("q")
+			q.Write(queue.JSON(`1`))
+
+			added := nw.addNode(testConfig)
+			defer added.Close()
+			_, err = followers[1].AddMember(context.Background(), added.config.Addr)
+			biff.AssertNil(err)
+
+			biff.AssertTrue(converged([]*Node{leader, followers[1], added}))
+			biff.AssertEqual(dump(removed), "{}")
+
+			// The leader can remove itself
+			_, err = leader.RemoveMember(context.Background(), leader.id)
+			biff.AssertNil(err)
+			next := leaderOf([]*Node{followers[1], added})
+			biff.AssertTrue(next != nil)
+			biff.AssertEqual(len(next.Status().Members), 2)
+		})
+
+		a.Alternative("Join", func(a *biff.A) {
+			c := testConfig
+			c.Join = followers[0].config.Addr
+			joined := nw.addNode(c)
+			defer joined.Close()
+
+			biff.AssertTrue(eventually(func() bool { return len(leader.Status().Members) == 4 }))
+		})
+
+		a.Alternative("Restore", func(a *biff.A) {
+			other := queue.NewMemoryService()
+			oq, _ := other.CreateQueue("restored")
+			oq.Write(queue.JSON(`"r"`))
+			buf := &bytes.Buffer{}
+			other.Snapshot(buf)
+
+			info, err := followers[0].Restore(buf)
+			biff.AssertNil(err)
+			biff.AssertEqual(info.Messages, int64(1))
+
+			biff.AssertTrue(converged(nodes))
+			q, err := followers[1].GetQueue("restored")
+			biff.AssertNil(err)
+			biff.AssertEqual(q.Stats().Len, int64(1))
+		})
+	})
+}
+
+func TestNoMajority(t *testing.T) {
+
+	c := testConfig
+	c.Timeout = time.Second
+	nw, nodes := newCluster(3, c)
+	defer closeAll(nodes)
+
+	leader := leaderOf(nodes)
+	q, err := leader.CreateQueue("q")
+	biff.AssertNil(err)
+
+	for _, f := range followersOf(nodes, leader) {
+		nw.setDown(f.config.Addr, true)
+	}
+
+	err = q.Write(queue.JSON(`1`))
+	biff.AssertNotNil(err)
+	biff.AssertTrue(eventually(func() bool { return leader.Status().Role != RoleLeader }))
+}
+
+func TestCompaction(t *testing.T) {
+
+	c := testConfig
+	c.LogSize = 5
+	nw, nodes := newCluster(1, c)
+	defer closeAll(nodes)
+
+	q, _ := nodes[0].CreateQueue("q")
+	for i := 0; i < 20; i++ {
+		q.Write(queue.JSON(strconv.Itoa(i)))
+	}
+	biff.AssertTrue(eventually(func() bool { return nodes[0].Status().Snapshot > 0 }))
+
+	// New members start from the snapshot
+	added := nw.addNode(c)
+	defer added.Close()
+	_, err := nodes[0].AddMember(context.Background(), added.config.Addr)
+	biff.AssertNil(err)
+
+	biff.AssertTrue(converged([]*Node{nodes[0], added}))
+	biff.AssertTrue(added.Status().Snapshot > 0)
+
+	// And keep following
+	q.Write(queue.JSON(`"after"`))
+	biff.AssertTrue(converged([]*Node{nodes[0], added}))
+}
+
+func TestResultErr(t *testing.T) {
+
+	wrapped := fmt.Errorf("%w: 'q'", queue.ErrQueueNotFound)
+	result := roundTrip(newResult(wrapped))
+
+	biff.AssertTrue(errors.Is(result.Err(), queue.ErrQueueNotFound))
+	biff.AssertEqual(result.Err().Error(), wrapped.Error())
+
+	other := roundTrip(newResult(errors.New("other")))
+	biff.AssertEqual(other.Err().Error(), "other")
+
+	biff.AssertNil(roundTrip(newResult(nil)).Err())
+}
@@ -0,0 +1,33 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/queue/queuetest"
+)
+
+func TestNode_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+		_, nodes := newCluster(1, testConfig)
+		t.Cleanup(func() { closeAll(nodes) })
+		return leaderOf(nodes)
+	})
+}
+
+func TestLeader_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+		_, nodes := newCluster(3, testConfig)
+		t.Cleanup(func() { closeAll(nodes) })
+		return leaderOf(nodes)
+	})
+}
+
+// TestFollower_Conformance forwards every change to the leader
+func TestFollower_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+		_, nodes := newCluster(3, testConfig)
+		t.Cleanup(func() { closeAll(nodes) })
+		return followersOf(nodes, leaderOf(nodes))[0]
+	})
+}
@@ -0,0 +1,1172 @@
+// Package cluster replicates queues across nodes with Raft.
+//
+// Every change, reads included, is a command in a log that the leader
+// replicates to the other members. Commands are applied to the
+// MemoryService of every node once a majority has them, so all nodes keep
+// the same queues and messages. Followers forward commands to the leader
+// and serve peeks and stats from their own copy.
+//
+// State is kept in memory. A node that restarts has a new id and has to
+// join again, the old id is removed from the members.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+type Config struct {
+	Addr              string        `usage:"Url other members reach this node at, clustering is disabled if empty"`
+	Bootstrap         bool          `usage:"Start a new cluster with this node as the only member"`
+	Join              string        `usage:"Url of a member, this node asks to be added to its cluster"`
+	ElectionTimeout   time.Duration `usage:"Time without a leader before an election, randomized up to twice"`
+	HeartbeatInterval time.Duration `usage:"Time between heartbeats of the leader"`
+	Timeout           time.Duration `usage:"Maximum time for a change to be committed"`
+	LogSize           int           `usage:"Applied entries kept before the log is compacted into a snapshot"`
+	Token             string        `usage:"Secret the members send each other, it protects votes, entries, proposals and member changes"`
+}
+
+var DefaultConfig = Config{
+	ElectionTimeout:   time.Second,
+	HeartbeatInterval: 100 * time.Millisecond,
+	Timeout:           10 * time.Second,
+	LogSize:           10 * 1000,
+}
+
+var (
+	ErrNotLeader = errors.New("not the leader")
+	ErrNoLeader  = errors.New("no leader")
+
+	// ErrLeadershipLost means the leader stepped down before a change was
+	// committed, it may or may not be applied
+	ErrLeadershipLost = errors.New("leadership lost")
+
+	ErrMembershipChange = errors.New("membership change in progress")
+	ErrMemberNotFound   = errors.New("member not found")
+	ErrMemberExists     = errors.New("member address in use")
+	ErrWrongMember      = errors.New("request for another member")
+	ErrClosed           = errors.New("cluster node closed")
+
+	// errEmpty is the result of reading an empty queue
+	errEmpty = errors.New("empty queue")
+)
+
+// Roles of a node
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+type Member struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// Entry is a command at a position of the log
+type Entry struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Command *Command `json:"command"`
+}
+
+type VoteRequest struct {
+	To        string `json:"to"` // member id
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	To        string   `json:"to"`
+	Term      uint64   `json:"term"`
+	Leader    Member   `json:"leader"`
+	PrevIndex uint64   `json:"prev_index"`
+	PrevTerm  uint64   `json:"prev_term"`
+	Entries   []*Entry `json:"entries,omitempty"`
+	Commit    uint64   `json:"commit"`
+}
+
+// AppendResponse answers appends and snapshot installs. Match is the last
+// index known to be equal to the leader on success, Hint the next one to
+// try otherwise.
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	Match   uint64 `json:"match,omitempty"`
+	Hint    uint64 `json:"hint,omitempty"`
+}
+
+// InstallRequest replaces the log of a follower up to Index with a
+// snapshot of the queues, when the leader no longer has those entries
+type InstallRequest struct {
+	To      string            `json:"to"`
+	Term    uint64            `json:"term"`
+	Leader  Member            `json:"leader"`
+	Index   uint64            `json:"index"`
+	Last    uint64            `json:"last_term"` // term of Index
+	Members []Member          `json:"members"`
+	Data    []byte            `json:"data"`
+	Created map[string]uint64 `json:"created,omitempty"`
+}
+
+type Status struct {
+	Id       string          `json:"id"`
+	Addr     string          `json:"addr"`
+	Role     string          `json:"role"`
+	Term     uint64          `json:"term"`
+	Leader   string          `json:"leader,omitempty"` // addr
+	Members  []*MemberStatus `json:"members"`
+	Commit   uint64          `json:"commit_index"`
+	Applied  uint64          `json:"applied_index"`
+	Last     uint64          `json:"last_index"`
+	Snapshot uint64          `json:"snapshot_index"`
+}
+
+// MemberStatus includes replication progress on the leader
+type MemberStatus struct {
+	Member
+	Match       uint64    `json:"match,omitempty"`
+	LastContact time.Time `json:"last_contact,omitzero"`
+}
+
+// snapshot is the state up to Index, entries before it are compacted
+type snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []Member
+	Data    []byte
+	Created map[string]uint64
+}
+
+// peer is a member followed by the leader
+type peer struct {
+	member      Member
+	next        uint64
+	match       uint64
+	lastContact time.Time
+	cancel      context.CancelFunc
+}
+
+// proposal waits for an entry of the leader to be applied
+type proposal struct {
+	term uint64
+	done chan *Result
+}
+
+type Node struct {
+	config    Config
+	transport Transport
+	id        string
+	limits    queue.Limits
+
+	local atomic.Pointer[queue.MemoryService]
+
+	mutex       sync.Mutex
+	role        string
+	term        uint64
+	votedFor    string
+	leader      Member
+	lastContact time.Time // with the leader
+	deadline    time.Time // for the next election
+	members     []Member  // latest configuration in the log
+	configIndex uint64
+	log         []*Entry // after the snapshot
+	snapshot    *snapshot
+	commit      uint64
+	applied     uint64
+	peers       map[string]*peer // by id, leader only
+	waiting     map[uint64]*proposal
+	created     map[string]uint64 // index of the create or restore of each queue
+	notify      chan struct{}     // closed and replaced on every change
+
+	applying sync.Mutex // held while the queues change
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// NewNode keeps the queues in local, which is replaced when a snapshot is
+// installed. Call Start to take part in the cluster.
+func NewNode(c Config, local *queue.MemoryService, t Transport) *Node {
+
+	n := &Node{
+		config:    c,
+		transport: t,
+		id:        uuid.New().String(),
+		limits:    local.Limits,
+		role:      RoleFollower,
+		snapshot:  &snapshot{},
+		peers:     map[string]*peer{},
+		waiting:   map[uint64]*proposal{},
+		created:   map[string]uint64{},
+		notify:    make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	n.local.Store(local)
+
+	if c.Bootstrap {
+		n.snapshot.Members = []Member{n.Member()}
+		n.members = n.snapshot.Members
+	}
+
+	return n
+}
+
+// New returns a started node that talks HTTP to the other members
+func New(c Config, local *queue.MemoryService) *Node {
+	t := NewHTTPTransport()
+	t.Token = c.Token
+	n := NewNode(c, local, t)
+	n.Start()
+	return n
+}
+
+func (n *Node) Member() Member {
+	return Member{Id: n.id, Addr: n.config.Addr}
+}
+
+// Start takes part in elections, applies committed entries and joins the
+// cluster of config.Join
+func (n *Node) Start() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n.cancel = cancel
+	n.done = make(chan struct{})
+
+	n.mutex.Lock()
+	n.resetDeadline()
+	n.mutex.Unlock()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n.run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		n.applyCommitted(ctx)
+	}()
+	if n.config.Join != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.join(ctx, n.config.Join)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(n.done)
+	}()
+}
+
+func (n *Node) Close() error {
+
+	if n.cancel == nil {
+		return nil
+	}
+	n.cancel()
+	<-n.done
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.stopLeading()
+	close(n.closed)
+	n.cancel = nil
+
+	return nil
+}
+
+// changed must be called with the mutex held
+func (n *Node) changed() {
+	close(n.notify)
+	n.notify = make(chan struct{})
+}
+
+// resetDeadline must be called with the mutex held
+func (n *Node) resetDeadline() {
+	timeout := n.config.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.log))
+}
+
+// termAt returns false if the entry is compacted or beyond the log
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapshot.Index {
+		return n.snapshot.Term, true
+	}
+	if index < n.snapshot.Index || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.snapshot.Index-1].Term, true
+}
+
+// entries from index, at most max of them
+func (n *Node) entries(from uint64, max int) []*Entry {
+	if from <= n.snapshot.Index || from > n.lastIndex() {
+		return nil
+	}
+	entries := n.log[from-n.snapshot.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return slices.Clone(entries)
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, m := range n.members {
+		if m.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) majority() int {
+	return len(n.members)/2 + 1
+}
+
+// updateMembers takes the latest configuration in the log, after it is
+// truncated or extended
+func (n *Node) updateMembers() {
+
+	n.members, n.configIndex = n.snapshot.Members, n.snapshot.Index
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Command.Type == CommandMembers {
+			n.members, n.configIndex = n.log[i].Command.Members, n.log[i].Index
+			break
+		}
+	}
+
+	if n.role == RoleLeader {
+		n.syncPeers()
+	}
+}
+
+// run starts elections when the leader is silent and makes the leader step
+// down when it can not reach a majority
+func (n *Node) run(ctx context.Context) {
+
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		n.mutex.Lock()
+		switch {
+		case n.role == RoleLeader:
+			if !n.hasQuorum() {
+				n.becomeFollower(n.term)
+			}
+		case n.isMember(n.id) && time.Now().After(n.deadline):
+			go n.campaign(ctx)
+			n.resetDeadline()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// hasQuorum is true if the leader heard from a majority lately
+func (n *Node) hasQuorum() bool {
+
+	reached := 0
+	for _, m := range n.members {
+		if m.Id == n.id {
+			reached++
+		} else if p := n.peers[m.Id]; p != nil && time.Since(p.lastContact) < n.config.ElectionTimeout {
+			reached++
+		}
+	}
+
+	return reached >= n.majority()
+}
+
+func (n *Node) campaign(ctx context.Context) {
+
+	n.mutex.Lock()
+	if n.role == RoleLeader {
+		n.mutex.Unlock()
+		return
+	}
+	n.role = RoleCandidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = Member{}
+	n.changed()
+
+	term := n.term
+	lastIndex := n.lastIndex()
+	lastTerm, _ := n.termAt(lastIndex)
+	members := n.members
+	needed := n.majority()
+	n.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.ElectionTimeout)
+	defer cancel()
+
+	granted := make(chan bool, len(members))
+	for _, m := range members {
+		if m.Id == n.id {
+			granted <- true
+			continue
+		}
+		go func(m Member) {
+			res, err := n.transport.RequestVote(ctx, m.Addr, &VoteRequest{
+				To:        m.Id,
+				Term:      term,
+				Candidate: n.id,
+				LastIndex: lastIndex,
+				LastTerm:  lastTerm,
+			})
+			if err != nil {
+				granted <- false
+				return
+			}
+			n.mutex.Lock()
+			if res.Term > n.term {
+				n.becomeFollower(res.Term)
+			}
+			n.mutex.Unlock()
+			granted <- res.Granted
+		}(m)
+	}
+
+	votes := 0
+	for range members {
+		if <-granted {
+			votes++
+		}
+		if votes >= needed {
+			break
+		}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if votes >= needed && n.term == term && n.role == RoleCandidate {
+		n.becomeLeader()
+	}
+}
+
+// becomeFollower must be called with the mutex held
+func (n *Node) becomeFollower(term uint64) {
+
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	if n.role == RoleLeader {
+		n.stopLeading()
+		n.leader = Member{}
+	}
+	n.role = RoleFollower
+	n.resetDeadline()
+	n.changed()
+}
+
+// becomeLeader must be called with the mutex held. A no-op entry commits
+// the entries of previous terms.
+func (n *Node) becomeLeader() {
+
+	n.role = RoleLeader
+	n.leader = n.Member()
+	n.peers = map[string]*peer{}
+	n.syncPeers()
+
+	n.appendEntry(&Command{Type: CommandNoop})
+}
+
+// syncPeers starts replicating to new members and stops with the removed
+// ones. Must be called with the mutex held.
+func (n *Node) syncPeers() {
+
+	current := map[string]bool{}
+	for _, m := range n.members {
+		current[m.Id] = true
+		if m.Id == n.id || n.peers[m.Id] != nil {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p := &peer{
+			member:      m,
+			next:        n.lastIndex() + 1,
+			lastContact: time.Now(), // some time to answer
+			cancel:      cancel,
+		}
+		n.peers[m.Id] = p
+		go n.replicate(ctx, p)
+	}
+
+	for id, p := range n.peers {
+		if !current[id] {
+			p.cancel()
+			delete(n.peers, id)
+		}
+	}
+}
+
+// stopLeading must be called with the mutex held. Proposals waiting for a
+// commit are not known to fail, they may be committed by the next leader.
+func (n *Node) stopLeading() {
+
+	for id, p := range n.peers {
+		p.cancel()
+		delete(n.peers, id)
+	}
+
+	for index, w := range n.waiting {
+		result := newResult(ErrLeadershipLost)
+		result.Index = index
+		w.done <- result
+		delete(n.waiting, index)
+	}
+}
+
+// appendEntry adds a command to the log of the leader, must be called with
+// the mutex held
+func (n *Node) appendEntry(c *Command) *Entry {
+
+	e := &Entry{Index: n.lastIndex() + 1, Term: n.term, Command: c}
+	n.log = append(n.log, e)
+	if c.Type == CommandMembers {
+		n.updateMembers()
+	}
+	n.advanceCommit()
+	n.changed()
+
+	return e
+}
+
+// advanceCommit commits the entries of this term a majority has, must be
+// called with the mutex held by the leader
+func (n *Node) advanceCommit() {
+
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			return
+		}
+		count := 0
+		for _, m := range n.members {
+			if m.Id == n.id || n.peers[m.Id] != nil && n.peers[m.Id].match >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commit = index
+			n.changed()
+			return
+		}
+	}
+}
+
+// replicate sends entries, snapshots and heartbeats to a follower while
+// this node leads
+func (n *Node) replicate(ctx context.Context, p *peer) {
+
+	heartbeat := time.NewTimer(0)
+	defer heartbeat.Stop()
+
+	for ctx.Err() == nil {
+
+		n.mutex.Lock()
+		term, notify := n.term, n.notify
+		var appendReq *AppendRequest
+		var installReq *InstallRequest
+		if p.next <= n.snapshot.Index {
+			installReq = &InstallRequest{
+				To:      p.member.Id,
+				Term:    term,
+				Leader:  n.Member(),
+				Index:   n.snapshot.Index,
+				Last:    n.snapshot.Term,
+				Members: n.snapshot.Members,
+				Data:    n.snapshot.Data,
+				Created: n.snapshot.Created,
+			}
+		} else {
+			prevTerm, _ := n.termAt(p.next - 1)
+			appendReq = &AppendRequest{
+				To:        p.member.Id,
+				Term:      term,
+				Leader:    n.Member(),
+				PrevIndex: p.next - 1,
+				PrevTerm:  prevTerm,
+				Entries:   n.entries(p.next, 1000),
+				Commit:    n.commit,
+			}
+		}
+		n.mutex.Unlock()
+
+		reqCtx, cancel := context.WithTimeout(ctx, n.config.Timeout)
+		var res *AppendResponse
+		var err error
+		if installReq != nil {
+			res, err = n.transport.InstallSnapshot(reqCtx, p.member.Addr, installReq)
+		} else {
+			res, err = n.transport.AppendEntries(reqCtx, p.member.Addr, appendReq)
+		}
+		cancel()
+
+		more := false
+		if err == nil {
+			n.mutex.Lock()
+			if res.Term > n.term {
+				n.becomeFollower(res.Term)
+			} else if n.role == RoleLeader && n.term == term {
+				p.lastContact = time.Now()
+				if res.Success {
+					if res.Match > p.match {
+						p.match = res.Match
+						n.advanceCommit()
+					}
+					p.next = p.match + 1
+				} else {
+					p.next = max(min(res.Hint, p.next-1), 1)
+				}
+				more = p.next <= n.lastIndex() || !res.Success
+			}
+			n.mutex.Unlock()
+		}
+		if more {
+			continue
+		}
+
+		// Unreachable followers are retried on heartbeats only
+		if err != nil {
+			notify = nil
+		}
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+		case <-ctx.Done():
+			return
+		}
+		if !heartbeat.Stop() {
+			select {
+			case <-heartbeat.C:
+			default:
+			}
+		}
+		heartbeat.Reset(n.config.HeartbeatInterval)
+	}
+}
+
+// RequestVote grants the vote to a candidate with a log at least as
+// complete as this one. Members that hear from a leader ignore
+// candidates, so removed members can not disrupt the cluster.
+func (n *Node) RequestVote(req *VoteRequest) (*VoteResponse, error) {
+
+	if req.To != n.id {
+		return nil, ErrWrongMember
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.role == RoleLeader || n.leader.Id != "" && time.Since(n.lastContact) < n.config.ElectionTimeout {
+		return &VoteResponse{Term: n.term}, nil
+	}
+
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+	if req.Term < n.term {
+		return &VoteResponse{Term: n.term}, nil
+	}
+
+	lastIndex := n.lastIndex()
+	lastTerm, _ := n.termAt(lastIndex)
+	upToDate := req.LastTerm > lastTerm || req.LastTerm == lastTerm && req.LastIndex >= lastIndex
+
+	granted := (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate
+	if granted {
+		n.votedFor = req.Candidate
+		n.resetDeadline()
+	}
+
+	return &VoteResponse{Term: n.term, Granted: granted}, nil
+}
+
+// follow recognizes the leader of a request, must be called with the mutex
+// held. False if the request is from an old term.
+func (n *Node) follow(term uint64, leader Member) bool {
+
+	if term < n.term {
+		return false
+	}
+	if term > n.term || n.role != RoleFollower {
+		n.becomeFollower(term)
+	}
+	if n.leader != leader {
+		n.leader = leader
+		n.changed()
+	}
+	n.lastContact = time.Now()
+	n.resetDeadline()
+
+	return true
+}
+
+// AppendEntries adds the entries of the leader to the log, replacing the
+// ones that conflict
+func (n *Node) AppendEntries(req *AppendRequest) (*AppendResponse, error) {
+
+	if req.To != n.id {
+		return nil, ErrWrongMember
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if !n.follow(req.Term, req.Leader) {
+		return &AppendResponse{Term: n.term}, nil
+	}
+
+	if req.PrevIndex > n.lastIndex() {
+		return &AppendResponse{Term: n.term, Hint: n.lastIndex() + 1}, nil
+	}
+	if term, ok := n.termAt(req.PrevIndex); ok && term != req.PrevTerm {
+		// Committed entries are the same in every log
+		return &AppendResponse{Term: n.term, Hint: n.commit + 1}, nil
+	}
+
+	truncated := false
+	appended := false
+	for _, e := range req.Entries {
+		if e.Index <= n.snapshot.Index {
+			continue // compacted, so committed
+		}
+		if term, ok := n.termAt(e.Index); ok {
+			if term == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-n.snapshot.Index-1]
+			truncated = true
+		}
+		n.log = append(n.log, e)
+		appended = true
+	}
+	if truncated || appended {
+		n.updateMembers()
+		n.changed()
+	}
+
+	match := req.PrevIndex + uint64(len(req.Entries))
+	if commit := min(req.Commit, match); commit > n.commit {
+		n.commit = commit
+		n.changed()
+	}
+
+	return &AppendResponse{Term: n.term, Success: true, Match: match}, nil
+}
+
+// InstallSnapshot replaces the queues and the log up to the snapshot
+func (n *Node) InstallSnapshot(req *InstallRequest) (*AppendResponse, error) {
+
+	if req.To != n.id {
+		return nil, ErrWrongMember
+	}
+
+	n.mutex.Lock()
+	if !n.follow(req.Term, req.Leader) {
+		defer n.mutex.Unlock()
+		return &AppendResponse{Term: n.term}, nil
+	}
+	if req.Index <= n.applied {
+		defer n.mutex.Unlock()
+		return &AppendResponse{Term: n.term, Success: true, Match: req.Index}, nil
+	}
+	n.mutex.Unlock()
+
+	local := queue.NewMemoryService()
+	local.Limits = n.limits
+	if _, err := local.Restore(bytes.NewReader(req.Data)); err != nil {
+		return nil, err
+	}
+
+	n.applying.Lock()
+	defer n.applying.Unlock()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Index <= n.applied || n.term != req.Term {
+		return &AppendResponse{Term: n.term, Success: req.Index <= n.applied, Match: req.Index}, nil
+	}
+	if term, ok := n.termAt(req.Index); ok && term == req.Last {
+		n.log = slices.Clone(n.log[req.Index-n.snapshot.Index:])
+	} else {
+		n.log = nil
+	}
+	n.snapshot = &snapshot{Index: req.Index, Term: req.Last, Members: req.Members, Data: req.Data, Created: req.Created}
+	n.created = map[string]uint64{}
+	maps.Copy(n.created, req.Created)
+	n.commit = max(n.commit, req.Index)
+	n.applied = req.Index
+	n.updateMembers()
+
+	old := n.local.Swap(local)
+	names, _ := old.ListQueues()
+	for _, name := range names {
+		old.DeleteQueue(name)
+	}
+	n.changed()
+
+	return &AppendResponse{Term: n.term, Success: true, Match: req.Index}, nil
+}
+
+// applyCommitted applies entries to the queues in order, once committed
+func (n *Node) applyCommitted(ctx context.Context) {
+
+	for {
+		n.mutex.Lock()
+		for n.applied >= n.commit {
+			notify := n.notify
+			n.mutex.Unlock()
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return
+			}
+			n.mutex.Lock()
+		}
+		entries := n.entries(n.applied+1, int(min(n.commit-n.applied, 1000)))
+		n.mutex.Unlock()
+
+		n.applying.Lock()
+		for _, e := range entries {
+			n.mutex.Lock()
+			next := e.Index == n.applied+1
+			n.mutex.Unlock()
+			if !next {
+				break // a snapshot was installed meanwhile
+			}
+
+			result := n.execute(e)
+			result.Index = e.Index
+
+			n.mutex.Lock()
+			n.applied = e.Index
+			if w := n.waiting[e.Index]; w != nil {
+				if w.term != e.Term {
+					result = newResult(ErrLeadershipLost)
+					result.Index = e.Index
+				}
+				w.done <- result
+				delete(n.waiting, e.Index)
+			}
+			if e.Command.Type == CommandMembers && n.role == RoleLeader && !n.isMember(n.id) {
+				n.becomeFollower(n.term) // removed
+			}
+			n.changed()
+			n.mutex.Unlock()
+		}
+		n.applying.Unlock()
+
+		n.compact()
+	}
+}
+
+// compact replaces the applied entries with a snapshot of the queues once
+// there are more than LogSize
+func (n *Node) compact() {
+
+	n.mutex.Lock()
+	due := n.config.LogSize > 0 && n.applied-n.snapshot.Index > uint64(n.config.LogSize)
+	n.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	n.applying.Lock()
+	defer n.applying.Unlock()
+
+	buf := &bytes.Buffer{}
+	if _, err := n.local.Load().Snapshot(buf); err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	index := n.applied
+	term, ok := n.termAt(index)
+	if !ok || index <= n.snapshot.Index {
+		return
+	}
+
+	members := n.snapshot.Members
+	for _, e := range n.log[:index-n.snapshot.Index] {
+		if e.Command.Type == CommandMembers {
+			members = e.Command.Members
+		}
+	}
+
+	n.log = slices.Clone(n.log[index-n.snapshot.Index:])
+	n.snapshot = &snapshot{Index: index, Term: term, Members: members, Data: buf.Bytes(), Created: maps.Clone(n.created)}
+}
+
+// Propose appends a command to the log and waits until it is applied, only
+// the leader accepts proposals
+func (n *Node) Propose(ctx context.Context, c *Command) (*Result, error) {
+
+	n.mutex.Lock()
+
+	if n.role != RoleLeader {
+		n.mutex.Unlock()
+		return nil, ErrNotLeader
+	}
+
+	if c.Type == CommandAddMember || c.Type == CommandRemoveMember {
+		members, err := n.changeMembers(c)
+		if err != nil || members == nil {
+			n.mutex.Unlock()
+			return newResult(err), nil
+		}
+		c = &Command{Type: CommandMembers, Members: members}
+	} else if c.Type == CommandMembers {
+		n.mutex.Unlock()
+		return newResult(errors.New("members are changed one at a time")), nil
+	}
+
+	e := n.appendEntry(c)
+	w := &proposal{term: e.Term, done: make(chan *Result, 1)}
+	n.waiting[e.Index] = w
+	n.mutex.Unlock()
+
+	select {
+	case result := <-w.done:
+		return result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.closed:
+		return nil, ErrClosed
+	}
+}
+
+// changeMembers returns the members after c, nil if nothing changes. Must
+// be called with the mutex held.
+func (n *Node) changeMembers(c *Command) ([]Member, error) {
+
+	if n.configIndex > n.commit {
+		return nil, ErrMembershipChange
+	}
+
+	members := slices.Clone(n.members)
+	i := slices.IndexFunc(members, func(m Member) bool { return m.Id == c.Member.Id })
+
+	if c.Type == CommandAddMember {
+		if i >= 0 {
+			return nil, nil // already a member
+		}
+		for _, m := range members {
+			if m.Addr == c.Member.Addr {
+				return nil, ErrMemberExists
+			}
+		}
+		return append(members, c.Member), nil
+	}
+
+	if i < 0 {
+		return nil, ErrMemberNotFound
+	}
+	if len(members) == 1 {
+		return nil, errors.New("the last member can not be removed")
+	}
+	return slices.Delete(members, i, i+1), nil
+}
+
+// submit runs a command on the leader, wherever it is, and waits until it
+// is applied here too, so followers read their writes
+func (n *Node) submit(ctx context.Context, c *Command) (*Result, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.Timeout)
+	defer cancel()
+
+	for {
+		n.mutex.Lock()
+		role, leader, notify := n.role, n.leader, n.notify
+		n.mutex.Unlock()
+
+		var result *Result
+		var err error
+		switch {
+		case role == RoleLeader:
+			result, err = n.Propose(ctx, c)
+		case leader.Addr != "":
+			result, err = n.transport.Propose(ctx, leader.Addr, c)
+		default:
+			err = ErrNoLeader
+		}
+
+		if err == nil && c.Type == CommandRemoveMember && c.Member.Id == n.id {
+			return result, nil // removed, changes no longer come here
+		}
+		if err == nil {
+			return result, n.waitApplied(ctx, result.Index)
+		}
+		if !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrNoLeader) {
+			return nil, err
+		}
+
+		// Elections take a while
+		select {
+		case <-notify:
+		case <-time.After(n.config.HeartbeatInterval):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for n.applied < index {
+		notify := n.notify
+		n.mutex.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			n.mutex.Lock()
+			return ctx.Err()
+		}
+		n.mutex.Lock()
+	}
+
+	return nil
+}
+
+// join asks the leader of a member to add this node, until it succeeds
+func (n *Node) join(ctx context.Context, addr string) {
+
+	delay := n.config.HeartbeatInterval
+	for ctx.Err() == nil {
+		err := n.joinOnce(ctx, addr)
+		if err == nil {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay = min(delay*2, 10*time.Second)
+	}
+}
+
+func (n *Node) joinOnce(ctx context.Context, addr string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.Timeout)
+	defer cancel()
+
+	status, err := n.transport.Status(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if status.Leader == "" {
+		return ErrNoLeader
+	}
+
+	result, err := n.transport.Propose(ctx, status.Leader, &Command{Type: CommandAddMember, Member: n.Member()})
+	if err != nil {
+		return err
+	}
+	return result.Err()
+}
+
+// AddMember adds the node at addr to the cluster, it has to be running
+func (n *Node) AddMember(ctx context.Context, addr string) (*Status, error) {
+
+	status, err := n.transport.Status(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := n.submit(ctx, &Command{Type: CommandAddMember, Member: Member{Id: status.Id, Addr: addr}})
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return n.Status(), nil
+}
+
+// RemoveMember takes a member out of the cluster, the leader steps down if
+// it is the one removed
+func (n *Node) RemoveMember(ctx context.Context, id string) (*Status, error) {
+
+	result, err := n.submit(ctx, &Command{Type: CommandRemoveMember, Member: Member{Id: id}})
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return n.Status(), nil
+}
+
+func (n *Node) Status() *Status {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	s := &Status{
+		Id:       n.id,
+		Addr:     n.config.Addr,
+		Role:     n.role,
+		Term:     n.term,
+		Leader:   n.leader.Addr,
+		Members:  []*MemberStatus{},
+		Commit:   n.commit,
+		Applied:  n.applied,
+		Last:     n.lastIndex(),
+		Snapshot: n.snapshot.Index,
+	}
+	for _, m := range n.members {
+		ms := &MemberStatus{Member: m}
+		if p := n.peers[m.Id]; p != nil {
+			ms.Match = p.match
+			ms.LastContact = p.lastContact
+		} else if m.Id == n.id && n.role == RoleLeader {
+			ms.Match = n.lastIndex()
+		}
+		s.Members = append(s.Members, ms)
+	}
+
+	return s
+}
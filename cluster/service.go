@@ -0,0 +1,394 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// Types of Command
+const (
+	CommandNoop         = "noop"
+	CommandMembers      = "members"
+	CommandAddMember    = "add_member"    // proposed, logged as members
+	CommandRemoveMember = "remove_member" // proposed, logged as members
+	CommandCreate       = "create"
+	CommandDelete       = "delete"
+	CommandWrite        = "write"
+	CommandRead         = "read"
+	CommandUnread       = "unread"
+	CommandPurge        = "purge"
+	CommandRestore      = "restore"
+)
+
+// Command is a change of the queues or the members, applied in the same
+// order by every node
+type Command struct {
+	Type  string `json:"type"`
+	Queue string `json:"queue,omitempty"`
+
+	Message        *queue.Message `json:"message,omitempty"` // write and unread
+	Capacity       int            `json:"capacity,omitempty"`
+	MaxMessageSize int            `json:"max_message_size,omitempty"`
+	Data           []byte         `json:"data,omitempty"` // restore
+	Member         Member         `json:"member,omitzero"`
+	Members        []Member       `json:"members,omitempty"`
+
+	// Created is the index of the create of the queue the command was
+	// sent to, so handles of a queue deleted and created again fail
+	Created uint64 `json:"created,omitempty"`
+}
+
+// Result of a command applied by the leader, Error is the outcome of the
+// command itself
+type Result struct {
+	Index   uint64              `json:"index"`
+	Message *queue.Message      `json:"message,omitempty"` // written or read
+	Count   int64               `json:"count,omitempty"`   // purged
+	Info    *queue.SnapshotInfo `json:"info,omitempty"`    // restored
+	Error   string              `json:"error,omitempty"`
+
+	err error
+}
+
+func newResult(err error) *Result {
+	r := &Result{err: err}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Err returns the error of the command, errors of queues and of this
+// package are kept across nodes so errors.Is works
+func (r *Result) Err() error {
+	if r.err != nil || r.Error == "" {
+		return r.err
+	}
+	for _, known := range knownErrors {
+		message := known.Error()
+		if r.Error == message {
+			return known
+		}
+		if strings.HasPrefix(r.Error, message+":") {
+			return fmt.Errorf("%w%s", known, r.Error[len(message):])
+		}
+	}
+	return errors.New(r.Error)
+}
+
+var knownErrors = []error{
+	queue.ErrQueueNotFound,
+	queue.ErrQueueAlreadyExists,
+	queue.ErrInvalidQueueName,
+	queue.ErrQueueFull,
+	queue.ErrMessageTooLarge,
+	queue.ErrInvalidSnapshot,
+	ErrLeadershipLost,
+	ErrMembershipChange,
+	ErrMemberNotFound,
+	ErrMemberExists,
+	errEmpty,
+}
+
+// execute applies a committed entry to the queues
+func (n *Node) execute(e *Entry) *Result {
+
+	c := e.Command
+	local := n.local.Load()
+
+	switch c.Type {
+	case CommandCreate:
+		q, err := local.CreateQueue(c.Queue)
+		if memq, ok := q.(*queue.MemoryQueue); ok {
+			memq.Capacity = c.Capacity
+			memq.MaxMessageSize = c.MaxMessageSize
+		}
+		if err == nil {
+			n.setCreated(c.Queue, e.Index)
+		}
+		return newResult(err)
+
+	case CommandDelete:
+		n.setCreated(c.Queue, 0) // first, so handles fail at once
+		return newResult(local.DeleteQueue(c.Queue))
+
+	case CommandRestore:
+		before := queues(local)
+		info, err := local.Restore(bytes.NewReader(c.Data))
+		for name, q := range queues(local) {
+			if before[name] != q {
+				n.setCreated(name, e.Index) // replaced
+			}
+		}
+		result := newResult(err)
+		result.Info = info
+		return result
+
+	case CommandWrite, CommandRead, CommandUnread, CommandPurge:
+		if c.Type != CommandRead && c.Type != CommandPurge && c.Message == nil {
+			return newResult(fmt.Errorf("%s without message", c.Type))
+		}
+		if c.Created != 0 && c.Created != n.createdAt(c.Queue) {
+			return newResult(queue.ErrQueueNotFound)
+		}
+
+	default:
+		return newResult(nil) // noop, members and unknown commands
+	}
+
+	q, err := local.GetQueue(c.Queue)
+	if err != nil {
+		return newResult(err)
+	}
+	memq, ok := q.(*queue.MemoryQueue)
+	if !ok {
+		return newResult(errors.New("cluster needs memory queues"))
+	}
+
+	switch c.Type {
+	case CommandWrite:
+		message := *c.Message // entries are shared, ids are assigned here
+		result := newResult(memq.WriteMessage(&message))
+		result.Message = &message
+		return result
+
+	case CommandRead:
+		head, err := memq.Peek(0, 1)
+		if err != nil {
+			return newResult(err)
+		}
+		if len(head) == 0 {
+			return newResult(errEmpty)
+		}
+		message, err := memq.Remove(head[0].Id)
+		result := newResult(err)
+		result.Message = message
+		return result
+
+	case CommandUnread:
+		message := *c.Message
+		return newResult(memq.Unread(&message))
+
+	default: // CommandPurge
+		purged, err := memq.Purge()
+		result := newResult(err)
+		result.Count = purged
+		return result
+	}
+}
+
+// createdAt returns the index of the create of a queue, 0 if there is none
+func (n *Node) createdAt(name string) uint64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.created[name]
+}
+
+// setCreated forgets the queue if index is 0
+func (n *Node) setCreated(name string, index uint64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if index == 0 {
+		delete(n.created, name)
+		return
+	}
+	n.created[name] = index
+}
+
+func queues(s *queue.MemoryService) map[string]queue.Queue {
+	s.QueuesMutex.RLock()
+	defer s.QueuesMutex.RUnlock()
+	return maps.Clone(s.Queues)
+}
+
+// do submits a command and returns its outcome
+func (n *Node) do(ctx context.Context, c *Command) (*Result, error) {
+	result, err := n.submit(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return result, result.Err()
+}
+
+func (n *Node) GetQueue(name string) (queue.Queue, error) {
+	if _, err := n.local.Load().GetQueue(name); err != nil {
+		return nil, err
+	}
+	created := n.createdAt(name)
+	if created == 0 {
+		return nil, queue.ErrQueueNotFound // being created or deleted
+	}
+	return &clusterQueue{node: n, name: name, created: created}, nil
+}
+
+// ListQueues is served by this node, followers may not have the latest
+// changes yet
+func (n *Node) ListQueues() ([]string, error) {
+	return n.local.Load().ListQueues()
+}
+
+func (n *Node) CreateQueue(name string) (queue.Queue, error) {
+
+	if err := queue.ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	result, err := n.do(context.Background(), &Command{
+		Type:           CommandCreate,
+		Queue:          name,
+		Capacity:       n.limits.Capacity,
+		MaxMessageSize: n.limits.MaxMessageSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &clusterQueue{node: n, name: name, created: result.Index}, nil
+}
+
+func (n *Node) DeleteQueue(name string) error {
+	_, err := n.do(context.Background(), &Command{Type: CommandDelete, Queue: name})
+	return err
+}
+
+func (n *Node) Snapshot(w io.Writer) (*queue.SnapshotInfo, error) {
+	return n.local.Load().Snapshot(w)
+}
+
+// Restore loads a snapshot in every node
+func (n *Node) Restore(r io.Reader) (*queue.SnapshotInfo, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := n.do(context.Background(), &Command{Type: CommandRestore, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Info, nil
+}
+
+// clusterQueue changes a queue through the log. Once the queue is deleted,
+// or replaced by a restore, it is not found even if created again.
+type clusterQueue struct {
+	node    *Node
+	name    string
+	created uint64 // index of the create
+}
+
+// local returns the queue kept by this node
+func (q *clusterQueue) local() (queue.Queue, error) {
+	if q.node.createdAt(q.name) != q.created {
+		return nil, queue.ErrQueueNotFound
+	}
+	return q.node.local.Load().GetQueue(q.name)
+}
+
+func (q *clusterQueue) Write(payload queue.JSON) error {
+	return q.WriteMessage(&queue.Message{Payload: payload})
+}
+
+func (q *clusterQueue) Read() (queue.JSON, error) {
+	message, err := q.ReadMessage(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return message.Payload, nil
+}
+
+// WriteMessage sets the time here, every node keeps the same one
+func (q *clusterQueue) WriteMessage(message *queue.Message) error {
+
+	if message.Time.IsZero() {
+		message.Time = time.Now()
+	}
+
+	// A copy, the log keeps it while it is sent to the other nodes
+	logged := *message
+	result, err := q.node.do(context.Background(), &Command{Type: CommandWrite, Queue: q.name, Created: q.created, Message: &logged})
+	if err != nil {
+		return err
+	}
+	message.Id = result.Message.Id
+
+	return nil
+}
+
+// ReadMessage waits until this node sees a pending message and then takes
+// the head of the queue through the log. Other consumers may take it
+// first, then it waits again.
+func (q *clusterQueue) ReadMessage(ctx context.Context) (*queue.Message, error) {
+
+	for {
+		q.node.mutex.Lock()
+		notify := q.node.notify
+		q.node.mutex.Unlock()
+
+		local, err := q.local()
+		if err != nil {
+			return nil, err
+		}
+
+		if local.Stats().Len > 0 {
+			// Not canceled with ctx, a message taken is given back instead
+			result, err := q.node.do(context.Background(), &Command{Type: CommandRead, Queue: q.name, Created: q.created})
+			if err == nil {
+				if ctx.Err() != nil {
+					q.Unread(result.Message)
+					return nil, ctx.Err()
+				}
+				return result.Message, nil
+			}
+			if !errors.Is(err, errEmpty) {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *clusterQueue) Unread(message *queue.Message) error {
+	logged := *message
+	_, err := q.node.do(context.Background(), &Command{Type: CommandUnread, Queue: q.name, Created: q.created, Message: &logged})
+	return err
+}
+
+func (q *clusterQueue) Peek(offset, n int) ([]*queue.Message, error) {
+	local, err := q.local()
+	if err != nil {
+		return nil, err
+	}
+	return local.Peek(offset, n)
+}
+
+func (q *clusterQueue) Purge() (int64, error) {
+	result, err := q.node.do(context.Background(), &Command{Type: CommandPurge, Queue: q.name, Created: q.created})
+	if err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+func (q *clusterQueue) Stats() queue.Stats {
+	local, err := q.local()
+	if err != nil {
+		return queue.Stats{}
+	}
+	return local.Stats()
+}
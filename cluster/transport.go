@@ -0,0 +1,102 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Transport reaches the other members by their address
+type Transport interface {
+	RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, addr string, req *InstallRequest) (*AppendResponse, error)
+
+	// Propose fails with ErrNotLeader if addr does not lead the cluster
+	Propose(ctx context.Context, addr string, c *Command) (*Result, error)
+	Status(ctx context.Context, addr string) (*Status, error)
+}
+
+// HTTPTransport uses the /v1/cluster endpoints of the api
+type HTTPTransport struct {
+	HTTPClient *http.Client
+	Token      string // sent as 'Authorization: Bearer TOKEN'
+}
+
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{HTTPClient: http.DefaultClient}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error) {
+	res := &VoteResponse{}
+	return res, t.do(ctx, "POST", addr, "/v1/cluster:vote", req, res)
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error) {
+	res := &AppendResponse{}
+	return res, t.do(ctx, "POST", addr, "/v1/cluster:append", req, res)
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, addr string, req *InstallRequest) (*AppendResponse, error) {
+	res := &AppendResponse{}
+	return res, t.do(ctx, "POST", addr, "/v1/cluster:install", req, res)
+}
+
+func (t *HTTPTransport) Propose(ctx context.Context, addr string, c *Command) (*Result, error) {
+	res := &Result{}
+	return res, t.do(ctx, "POST", addr, "/v1/cluster:propose", c, res)
+}
+
+func (t *HTTPTransport) Status(ctx context.Context, addr string) (*Status, error) {
+	res := &Status{}
+	return res, t.do(ctx, "GET", addr, "/v1/cluster", nil, res)
+}
+
+func (t *HTTPTransport) do(ctx context.Context, method, addr, path string, input, output any) error {
+
+	var body io.Reader
+	if input != nil {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(addr, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if input != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+
+	res, err := t.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		e := struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&e)
+		if e.Error.Code == "not_leader" {
+			return ErrNotLeader
+		}
+		return fmt.Errorf("%s: %s", res.Status, e.Error.Message)
+	}
+
+	return json.NewDecoder(res.Body).Decode(output)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fulldump/tailon/client"
+)
+
+const cliUsage = `Usage:
+  tailon [flags]                     run the server, see tailon -help
+  tailon queues list
+  tailon queues create QUEUE
+  tailon queues delete QUEUE
+  tailon queues stats QUEUE
+  tailon publish [-file FILE] QUEUE  publish JSON lines from stdin or a file
+  tailon consume [-limit N] [-follow] [-envelope] QUEUE
+  tailon peek [-limit N] [-envelope] QUEUE
+  tailon purge QUEUE
+  tailon export [-gzip] [-file FILE] QUEUE  write pending messages to stdout or a file
+  tailon import [-file FILE] QUEUE          load an export, gzip is detected
+  tailon snapshot                           write every queue to the server snapshot file
+  tailon replication status                 role, replicas or lag of every queue
+  tailon replication promote                make a replica the primary
+  tailon cluster status                     role, leader and members of the cluster
+  tailon cluster add ADDR                   add the running node at ADDR
+  tailon cluster remove ID                  remove a member by id
+  tailon sharding status                    nodes sharing the queues and rebalancing
+  tailon sharding add ADDR                  add the running node at ADDR
+  tailon sharding remove ADDR               move the queues of a node to the others
+  tailon federation status                  links shipping queues to remote servers
+  tailon clients list
+
+Commands accept -server URL, default is $TAILON_SERVER or
+http://localhost:8080, and -token TOKEN, default is $TAILON_TOKEN. Flags go
+before arguments.
+`
+
+var ErrUsage = errors.New("invalid arguments, see tailon help")
+
+// groups are the commands of two words, like queues list
+var groups = map[string]bool{
+	"queues":      true,
+	"clients":     true,
+	"replication": true,
+	"cluster":     true,
+	"sharding":    true,
+	"federation":  true,
+}
+
+// runCommand runs a subcommand against a remote server
+func runCommand(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+
+	name := args[0]
+	if groups[name] {
+		if len(args) < 2 {
+			return ErrUsage
+		}
+		name += " " + args[1]
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	server := os.Getenv("TAILON_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	flags.StringVar(&server, "server", server, "tailon server url")
+	token := os.Getenv("TAILON_TOKEN")
+	flags.StringVar(&token, "token", token, "sent as 'Authorization: Bearer TOKEN', replication, cluster and sharding changes need the peer token")
+
+	file := ""
+	limit := 0
+	follow := false
+	envelope := false
+	compress := false
+	switch name {
+	case "publish":
+		flags.StringVar(&file, "file", "", "JSON lines file, default is stdin")
+	case "consume":
+		flags.IntVar(&limit, "limit", 0, "Maximum messages, 0 means every pending one or no end with -follow")
+		flags.BoolVar(&follow, "follow", false, "Wait for new messages")
+		flags.BoolVar(&envelope, "envelope", false, "Print id, time and headers with the payload")
+	case "peek":
+		flags.IntVar(&limit, "limit", 10, "Maximum messages")
+		flags.BoolVar(&envelope, "envelope", false, "Print id, time and headers with the payload")
+	case "export":
+		flags.StringVar(&file, "file", "", "Output file, default is stdout")
+		flags.BoolVar(&compress, "gzip", false, "Compress with gzip")
+	case "import":
+		flags.StringVar(&file, "file", "", "Export file, default is stdin")
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	c := client.New(server)
+	if token != "" {
+		c.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	withQueue := func(f func(queue string) error) error {
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		return f(args[0])
+	}
+
+	switch name {
+	case "help":
+		fmt.Fprint(stdout, cliUsage)
+		return nil
+
+	case "queues list":
+		names, err := c.ListQueues(ctx)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(stdout, name)
+		}
+		return nil
+
+	case "queues create":
+		return withQueue(func(queue string) error {
+			return c.CreateQueue(ctx, queue)
+		})
+
+	case "queues delete":
+		return withQueue(func(queue string) error {
+			return c.DeleteQueue(ctx, queue)
+		})
+
+	case "queues stats":
+		return withQueue(func(queue string) error {
+			q, err := c.RetrieveQueue(ctx, queue)
+			if err != nil {
+				return err
+			}
+			e := json.NewEncoder(stdout)
+			e.SetIndent("", "  ")
+			return e.Encode(q)
+		})
+
+	case "publish":
+		return withQueue(func(queue string) error {
+			input := stdin
+			if file != "" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				input = f
+			}
+			return publish(ctx, c, queue, input, stderr)
+		})
+
+	case "consume":
+		return withQueue(func(queue string) error {
+			return consume(ctx, c, queue, limit, follow, envelope, stdout)
+		})
+
+	case "peek":
+		return withQueue(func(queue string) error {
+			messages, err := c.Peek(ctx, queue, limit)
+			if err != nil {
+				return err
+			}
+			for _, m := range messages {
+				if err := printMessage(stdout, m, envelope); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+	case "purge":
+		return withQueue(func(queue string) error {
+			purged, err := c.Purge(ctx, queue)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(stdout, purged)
+			return nil
+		})
+
+	case "export":
+		return withQueue(func(queue string) error {
+			if file == "" {
+				return c.Export(ctx, queue, stdout, compress)
+			}
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			err = c.Export(ctx, queue, f, compress)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		})
+
+	case "import":
+		return withQueue(func(queue string) error {
+			input := stdin
+			if file != "" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				input = f
+			}
+			imported, err := c.Import(ctx, queue, input)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(stdout, imported)
+			return nil
+		})
+
+	case "snapshot":
+		if len(args) != 0 {
+			return ErrUsage
+		}
+		snapshot, err := c.Snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(snapshot)
+
+	case "replication status", "replication promote":
+		if len(args) != 0 {
+			return ErrUsage
+		}
+		get := c.Replication
+		if name == "replication promote" {
+			get = c.Promote
+		}
+		replication, err := get(ctx)
+		if err != nil {
+			return err
+		}
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(replication)
+
+	case "cluster status", "cluster add", "cluster remove":
+		var status *client.ClusterStatus
+		var err error
+		switch {
+		case name == "cluster status" && len(args) == 0:
+			status, err = c.Cluster(ctx)
+		case name == "cluster add" && len(args) == 1:
+			status, err = c.AddMember(ctx, args[0])
+		case name == "cluster remove" && len(args) == 1:
+			status, err = c.RemoveMember(ctx, args[0])
+		default:
+			return ErrUsage
+		}
+		if err != nil {
+			return err
+		}
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(status)
+
+	case "sharding status", "sharding add", "sharding remove":
+		var status *client.ShardingStatus
+		var err error
+		switch {
+		case name == "sharding status" && len(args) == 0:
+			status, err = c.Sharding(ctx)
+		case name == "sharding add" && len(args) == 1:
+			status, err = c.AddNode(ctx, args[0])
+		case name == "sharding remove" && len(args) == 1:
+			status, err = c.RemoveNode(ctx, args[0])
+		default:
+			return ErrUsage
+		}
+		if err != nil {
+			return err
+		}
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(status)
+
+	case "federation status":
+		if len(args) != 0 {
+			return ErrUsage
+		}
+		links, err := c.Federation(ctx)
+		if err != nil {
+			return err
+		}
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(links)
+
+	case "clients list":
+		clients, err := c.ListClients(ctx)
+		if err != nil {
+			return err
+		}
+		return printClients(stdout, clients)
+	}
+
+	return ErrUsage
+}
+
+// publish reads JSON lines, blank ones are skipped
+func publish(ctx context.Context, c *client.Client, queue string, input io.Reader, stderr io.Writer) error {
+
+	p := c.NewProducer(queue, client.ProducerConfig{
+		OnError: func(err error, payload json.RawMessage) {
+			if payload != nil {
+				fmt.Fprintln(stderr, "dropped:", err)
+			}
+		},
+	})
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, 64<<20)
+
+	var err error
+	for n := 1; err == nil && scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			err = fmt.Errorf("line %d is not valid JSON", n)
+			break
+		}
+		err = p.Publish(ctx, append(json.RawMessage{}, line...))
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+
+	// Messages read before an error are still sent
+	closeCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if closeErr := p.Close(closeCtx); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// consume without follow takes the messages pending when it starts
+func consume(ctx context.Context, c *client.Client, queue string, limit int, follow, envelope bool, stdout io.Writer) error {
+
+	max := limit
+	if !follow {
+		q, err := c.RetrieveQueue(ctx, queue)
+		if err != nil {
+			return err
+		}
+		if max == 0 || int64(max) > q.Len {
+			max = int(q.Len)
+		}
+		if max == 0 {
+			return nil
+		}
+	}
+
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+
+	err := c.Consume(ctx, queue, client.ConsumerConfig{Max: max}, func(m *client.Message) error {
+		if err := printMessage(w, m, envelope); err != nil {
+			return err
+		}
+		return w.Flush() // so tail -f like pipes see every message
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil // interrupted
+	}
+
+	return err
+}
+
+func printMessage(w io.Writer, m *client.Message, envelope bool) error {
+	line := []byte(m.Payload)
+	if envelope {
+		line, _ = json.Marshal(m)
+	}
+	_, err := w.Write(append(line, '\n'))
+	return err
+}
+
+func printClients(w io.Writer, clients map[string]*client.ClientInfo) error {
+
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "ID\tQUEUE\tACTION\tIP\tREADS\tWRITES\tSTART")
+	for _, id := range ids {
+		c := clients[id]
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", id, c.Queue, c.Action, c.IP, c.Reads, c.Writes, c.Start.Format(time.RFC3339))
+	}
+
+	return t.Flush()
+}
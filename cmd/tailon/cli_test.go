@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+	"github.com/fulldump/box"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/client"
+	"github.com/fulldump/tailon/cluster"
+	"github.com/fulldump/tailon/federation"
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/replication"
+	"github.com/fulldump/tailon/sharding"
+)
+
+// runOn runs a command against server, flags go after the command words
+func runOn(server, stdin string, args ...string) (string, error) {
+
+	words := 1
+	if groups[args[0]] {
+		words = 2
+	}
+	args = append(append(args[:words:words], "-server", server), args[words:]...)
+
+	stdout := &strings.Builder{}
+	err := runCommand(context.Background(), args, strings.NewReader(stdin), stdout, stdout)
+	return stdout.String(), err
+}
+
+func TestCommands(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		h := api.Build("test version", "", qs)
+		snapshotFile := filepath.Join(t.TempDir(), "tailon.snapshot")
+		h.WithInterceptors(api.PrettyErrorInterceptor, api.InjectSnapshotFile(snapshotFile))
+		s := httptest.NewServer(h)
+		defer s.Close()
+
+		run := func(stdin string, args ...string) (string, error) {
+			return runOn(s.URL, stdin, args...)
+		}
+
+		_, err := run("", "queues", "create", "my-queue")
+		biff.AssertNil(err)
+
+		a.Alternative("List queues", func(a *biff.A) {
+			out, err := run("", "queues", "list")
+			biff.AssertNil(err)
+			biff.AssertEqual(out, "my-queue\n")
+		})
+
+		a.Alternative("Missing queue", func(a *biff.A) {
+			_, err := run("", "queues", "stats", "invented")
+			biff.AssertTrue(errors.Is(err, client.ErrQueueNotFound))
+		})
+
+		a.Alternative("Unknown command", func(a *biff.A) {
+			_, err := run("", "invented")
+			biff.AssertEqual(err, ErrUsage)
+		})
+
+		a.Alternative("Publish", func(a *biff.A) {
+			_, err := run("{\"n\":1}\n\n2\n3\n", "publish", "my-queue")
+			biff.AssertNil(err)
+
+			q, _ := qs.GetQueue("my-queue")
+			biff.AssertEqual(q.Stats().Len, int64(3))
+
+			a.Alternative("Peek", func(a *biff.A) {
+				out, err := run("", "peek", "-limit", "2", "my-queue")
+				biff.AssertNil(err)
+				biff.AssertEqual(out, "{\"n\":1}\n2\n")
+			})
+
+			a.Alternative("Consume pending", func(a *biff.A) {
+				out, err := run("", "consume", "my-queue")
+				biff.AssertNil(err)
+				biff.AssertEqual(out, "{\"n\":1}\n2\n3\n")
+			})
+
+			a.Alternative("Consume with limit", func(a *biff.A) {
+				out, err := run("", "consume", "-limit", "1", "-envelope", "my-queue")
+				biff.AssertNil(err)
+				biff.AssertTrue(strings.HasPrefix(out, `{"id":1,"time":`))
+				biff.AssertEqual(q.Stats().Len, int64(2))
+			})
+
+			a.Alternative("Purge", func(a *biff.A) {
+				out, err := run("", "purge", "my-queue")
+				biff.AssertNil(err)
+				biff.AssertEqual(out, "3\n")
+			})
+
+			a.Alternative("Export and import", func(a *biff.A) {
+				file := filepath.Join(t.TempDir(), "export.jsonl.gz")
+				_, err := run("", "export", "-gzip", "-file", file, "my-queue")
+				biff.AssertNil(err)
+
+				run("", "queues", "create", "copy")
+				out, err := run("", "import", "-file", file, "copy")
+				biff.AssertNil(err)
+				biff.AssertEqual(out, "3\n")
+
+				export, _ := run("", "export", "my-queue")
+				copied, _ := run("", "export", "copy")
+				biff.AssertEqual(copied, export)
+			})
+		})
+
+		a.Alternative("Snapshot", func(a *biff.A) {
+			out, err := run("", "snapshot")
+			biff.AssertNil(err)
+			biff.AssertTrue(strings.Contains(out, `"queues": 1`))
+
+			_, err = queue.RestoreFile(queue.NewMemoryService(), snapshotFile)
+			biff.AssertNil(err)
+		})
+
+		a.Alternative("Features disabled", func(a *biff.A) {
+			for _, feature := range []string{"replication", "cluster", "sharding", "federation"} {
+				_, err := run("", feature, "status")
+				biff.AssertEqual(err.(*client.Error).Code, feature+"_disabled")
+			}
+
+			_, err := run("", "cluster", "add")
+			biff.AssertEqual(err, ErrUsage)
+			_, err = run("", "sharding", "remove")
+			biff.AssertEqual(err, ErrUsage)
+		})
+
+		a.Alternative("Publish invalid JSON", func(a *biff.A) {
+			_, err := run("1\n{\n", "publish", "my-queue")
+			biff.AssertEqual(err.Error(), "line 2 is not valid JSON")
+
+			q, _ := qs.GetQueue("my-queue")
+			biff.AssertEqual(q.Stats().Len, int64(1))
+		})
+	})
+}
+
+// newPeerServer listens before the service exists, cluster and sharding
+// nodes need their own url. Nodes and -token send "secret".
+func newPeerServer(interceptors ...box.I) (*httptest.Server, func(qs queue.Service)) {
+
+	var handler http.Handler
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+
+	serve := func(qs queue.Service) {
+		h := api.Build("test version", "", qs)
+		h.WithInterceptors(append([]box.I{api.PrettyErrorInterceptor, api.InjectPeerToken("secret")}, interceptors...)...)
+		handler = h
+	}
+
+	return s, serve
+}
+
+func TestReplicationCommands(t *testing.T) {
+
+	primary := replication.NewPrimary(queue.NewMemoryService())
+	primaryServer, serve := newPeerServer()
+	defer primaryServer.Close()
+	defer primaryServer.CloseClientConnections()
+	serve(primary)
+
+	replica := replication.NewReplica(primaryServer.URL, queue.NewMemoryService())
+	replica.Token = "secret"
+	replica.Start()
+	defer replica.Close()
+	s, serve := newPeerServer()
+	defer s.Close()
+	serve(replica)
+
+	status := &client.Replication{}
+	for i := 0; i < 100 && !status.Connected; i++ {
+		time.Sleep(10 * time.Millisecond)
+		out, _ := runOn(s.URL, "", "replication", "status")
+		json.Unmarshal([]byte(out), status)
+	}
+	biff.AssertEqual(status.Role, "replica")
+	biff.AssertEqual(status.Primary, primaryServer.URL)
+
+	_, err := runOn(s.URL, "", "replication", "promote")
+	biff.AssertTrue(errors.Is(err, client.ErrUnauthorized))
+
+	out, err := runOn(s.URL, "", "replication", "promote", "-token", "secret")
+	biff.AssertNil(err)
+	biff.AssertNil(json.Unmarshal([]byte(out), status))
+	biff.AssertEqual(status.Role, "primary")
+}
+
+func TestClusterCommands(t *testing.T) {
+
+	config := cluster.DefaultConfig
+	config.ElectionTimeout = 100 * time.Millisecond
+	config.HeartbeatInterval = 20 * time.Millisecond
+	config.Token = "secret"
+
+	start := func(c cluster.Config) (*cluster.Node, *httptest.Server) {
+		s, serve := newPeerServer()
+		c.Addr = s.URL
+		node := cluster.New(c, queue.NewMemoryService())
+		serve(node)
+		return node, s
+	}
+
+	bootstrap := config
+	bootstrap.Bootstrap = true
+	leader, leaderServer := start(bootstrap)
+	defer leaderServer.Close()
+	defer leaderServer.CloseClientConnections()
+	defer leader.Close()
+	follower, followerServer := start(config)
+	defer followerServer.Close()
+	defer followerServer.CloseClientConnections()
+	defer follower.Close()
+
+	status := &client.ClusterStatus{}
+	for i := 0; i < 100 && status.Role != cluster.RoleLeader; i++ {
+		time.Sleep(10 * time.Millisecond)
+		out, _ := runOn(leaderServer.URL, "", "cluster", "status")
+		json.Unmarshal([]byte(out), status)
+	}
+	biff.AssertEqual(status.Role, cluster.RoleLeader)
+
+	out, err := runOn(leaderServer.URL, "", "cluster", "add", "-token", "secret", followerServer.URL)
+	biff.AssertNil(err)
+	biff.AssertNil(json.Unmarshal([]byte(out), status))
+	biff.AssertEqual(len(status.Members), 2)
+
+	out, err = runOn(leaderServer.URL, "", "cluster", "remove", "-token", "secret", follower.Member().Id)
+	biff.AssertNil(err)
+	biff.AssertNil(json.Unmarshal([]byte(out), status))
+	biff.AssertEqual(len(status.Members), 1)
+}
+
+func TestShardingCommands(t *testing.T) {
+
+	start := func() (*sharding.Router, *httptest.Server) {
+		s, serve := newPeerServer()
+		router, err := sharding.New(sharding.Config{Addr: s.URL, Token: "secret"}, queue.NewMemoryService())
+		biff.AssertNil(err)
+		serve(router)
+		return router, s
+	}
+
+	routerA, serverA := start()
+	defer serverA.Close()
+	defer serverA.CloseClientConnections()
+	defer routerA.Close()
+	routerB, serverB := start()
+	defer serverB.Close()
+	defer serverB.CloseClientConnections()
+	defer routerB.Close()
+
+	status := &client.ShardingStatus{}
+	out, err := runOn(serverA.URL, "", "sharding", "status")
+	biff.AssertNil(err)
+	biff.AssertNil(json.Unmarshal([]byte(out), status))
+	biff.AssertEqual(status.Nodes, []string{serverA.URL})
+
+	_, err = runOn(serverA.URL, "", "sharding", "add", serverB.URL)
+	biff.AssertTrue(errors.Is(err, client.ErrUnauthorized))
+
+	out, err = runOn(serverA.URL, "", "sharding", "add", "-token", "secret", serverB.URL)
+	biff.AssertNil(err)
+	biff.AssertNil(json.Unmarshal([]byte(out), status))
+	biff.AssertEqual(len(status.Nodes), 2)
+
+	out, err = runOn(serverA.URL, "", "sharding", "remove", "-token", "secret", serverB.URL)
+	biff.AssertNil(err)
+	biff.AssertNil(json.Unmarshal([]byte(out), status))
+	biff.AssertEqual(status.Nodes, []string{serverA.URL})
+}
+
+func TestFederationCommands(t *testing.T) {
+
+	qs := queue.NewMemoryService()
+	f, err := federation.New(federation.Config{Links: "orders=http://127.0.0.1:1/central"}, qs)
+	biff.AssertNil(err)
+	defer f.Close()
+
+	s, serve := newPeerServer(api.InjectFederation(f))
+	defer s.Close()
+	serve(qs)
+
+	out, err := runOn(s.URL, "", "federation", "status")
+	biff.AssertNil(err)
+	links := []*client.Link{}
+	biff.AssertNil(json.Unmarshal([]byte(out), &links))
+	biff.AssertEqual(len(links), 1)
+	biff.AssertEqual(links[0].Queue, "orders")
+}
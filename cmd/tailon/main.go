@@ -1,29 +1,105 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/fulldump/goconfig"
 
+	"github.com/fulldump/tailon/accesslog"
 	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/cluster"
+	"github.com/fulldump/tailon/federation"
+	"github.com/fulldump/tailon/glueauth"
+	"github.com/fulldump/tailon/grpcapi"
+	"github.com/fulldump/tailon/kv"
+	"github.com/fulldump/tailon/mqtt"
 	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/ratelimit"
+	"github.com/fulldump/tailon/replication"
+	"github.com/fulldump/tailon/resp"
+	"github.com/fulldump/tailon/sharding"
+	"github.com/fulldump/tailon/stomp"
+	"github.com/fulldump/tailon/tlsconfig"
+	"github.com/fulldump/tailon/tracing"
 )
 
 var VERSION = "dev"
 
 type Config struct {
-	HttpAddr string `usage:"Service address"`
-	Statics  string `usage:"statics directory or http address"`
-	Version  bool   `usage:"Show version and exit"`
+	HttpAddr         string        `usage:"Service address"`
+	GrpcAddr         string        `usage:"gRPC service address, disabled if empty"`
+	StompAddr        string        `usage:"STOMP service address, disabled if empty"`
+	RespAddr         string        `usage:"Redis protocol service address, disabled if empty"`
+	Statics          string        `usage:"statics directory or http address"`
+	Version          bool          `usage:"Show version and exit"`
+	ShutdownTimeout  time.Duration `usage:"Time to wait for active clients before exit"`
+	CrashLog         string        `usage:"File to write panics with their stack as JSON lines, default is stderr"`
+	Snapshot         string        `usage:"File written by POST /v1/snapshot, snapshots are disabled if empty"`
+	Restore          string        `usage:"Snapshot file to restore before serving"`
+	WebsocketOrigins string        `usage:"Comma separated origins, like https://app.example.com, whose web pages can open websockets besides this server, * allows any"`
+
+	Queues      queue.Limits
+	Storage     queue.Storage
+	RateLimit   ratelimit.Config
+	TLS         tlsconfig.Config
+	AccessLog   accesslog.Config
+	Tracing     tracing.Config
+	MQTT        mqtt.Config
+	Replication replication.Config
+	Cluster     cluster.Config
+	Sharding    sharding.Config
+	Federation  federation.Config
 }
 
 func main() {
 
+	// Subcommands operate a remote server
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := runCommand(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+		stop()
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tailon:", err)
+			if errors.Is(err, ErrUsage) {
+				fmt.Fprint(os.Stderr, cliUsage)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	c := &Config{
-		HttpAddr: ":8080",
+		HttpAddr:        ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		Queues:          queue.DefaultLimits,
+		Storage: queue.Storage{
+			Engine: "memory",
+			Path:   "tailon.kv",
+		},
+		Replication: replication.Config{
+			LogSize: replication.DefaultLogSize,
+		},
+		Cluster:    cluster.DefaultConfig,
+		Sharding:   sharding.DefaultConfig,
+		Federation: federation.DefaultConfig,
+		Tracing: tracing.Config{
+			ServiceName: "tailon",
+		},
 	}
 	goconfig.Read(c)
 
@@ -32,21 +108,298 @@ func main() {
 		os.Exit(0)
 	}
 
-	queueService := queue.NewMemoryService()
+	memoryService := queue.NewMemoryService()
+	memoryService.Limits = c.Queues
+
+	restore := func(s queue.Service) {
+		info, err := queue.RestoreFile(s, c.Restore)
+		if err != nil {
+			log.Fatalln("Restore:", err)
+		}
+		log.Println("Restored", info.Queues, "queues and", info.Messages, "messages from", c.Restore)
+	}
+
+	var queueService queue.Service = memoryService
+	switch c.Storage.Engine {
+	case "memory":
+	case "kv":
+		if c.Replication.Primary || c.Replication.Follow != "" || c.Cluster.Addr != "" || c.Sharding.Addr != "" {
+			log.Fatalln("The kv storage can not be used with replication, clustering or sharding")
+		}
+		kvService, err := queue.OpenKVService(c.Storage.Path, &kv.Options{NoSync: c.Storage.NoSync})
+		if err != nil {
+			log.Fatalln("Storage:", err)
+		}
+		kvService.Limits = c.Queues
+		queueService = kvService
+		fmt.Println("Storing queues in", c.Storage.Path)
+	default:
+		log.Fatalln("Unknown storage engine", c.Storage.Engine)
+	}
+
+	if c.Restore != "" && c.Cluster.Addr == "" {
+		restore(queueService)
+	}
+
+	// Shared by the nodes, only one of replication, cluster or sharding
+	peerToken := ""
+
+	if c.Replication.Primary || c.Replication.Follow != "" {
+		if c.Cluster.Addr != "" {
+			log.Fatalln("Replication and clustering can not be used together")
+		}
+		if c.Replication.Token == "" {
+			log.Fatalln("Replication needs -replication.token, the secret replicas send to the primary")
+		}
+		peerToken = c.Replication.Token
+		queueService = replication.New(c.Replication, memoryService)
+		if c.Replication.Follow != "" {
+			fmt.Println("Replicating", c.Replication.Follow)
+		}
+	}
+
+	if c.Cluster.Addr != "" {
+		if c.Cluster.Token == "" {
+			log.Fatalln("Clustering needs -cluster.token, the secret the members send each other")
+		}
+		peerToken = c.Cluster.Token
+		queueService = cluster.New(c.Cluster, memoryService)
+		fmt.Println("Cluster member at", c.Cluster.Addr)
+
+		// Through the log, so every member restores it
+		if c.Restore != "" {
+			restore(queueService)
+		}
+	}
+
+	if c.Sharding.Addr != "" {
+		if c.Replication.Primary || c.Replication.Follow != "" || c.Cluster.Addr != "" {
+			log.Fatalln("Sharding can not be used with replication or clustering")
+		}
+		if c.Sharding.Token == "" {
+			log.Fatalln("Sharding needs -sharding.token, the secret the nodes send each other")
+		}
+		peerToken = c.Sharding.Token
+		router, err := sharding.New(c.Sharding, memoryService)
+		if err != nil {
+			log.Fatalln("Sharding:", err)
+		}
+		queueService = router
+		fmt.Println("Sharding node at", router.Addr())
+	}
+
+	var links *federation.Federation
+	if c.Federation.Links != "" {
+		var err error
+		links, err = federation.New(c.Federation, queueService)
+		if err != nil {
+			log.Fatalln("Federation:", err)
+		}
+	}
 
 	b := api.Build(VERSION, c.Statics, queueService)
 
+	accessLog := api.AccessLog(log.Default())
+	if c.AccessLog != (accesslog.Config{}) {
+		l, closer, err := accesslog.Open(c.AccessLog)
+		if err != nil {
+			log.Fatalln("Access log:", err)
+		}
+		defer closer.Close()
+		accessLog = api.StructuredAccessLog(l)
+	}
+
+	recoverFromPanic := api.RecoverFromPanic
+	if c.CrashLog != "" {
+		f, err := accesslog.OpenRotatingFile(c.CrashLog, 0, 0)
+		if err != nil {
+			log.Fatalln("Crash log:", err)
+		}
+		defer f.Close()
+		recoverFromPanic = api.RecoverFromPanicLog(f)
+	}
+
+	var tracer *tracing.Tracer
+	if c.Tracing.OTLPEndpoint != "" {
+		tracer = tracing.NewTracer(tracing.NewOTLPExporter(c.Tracing.OTLPEndpoint, c.Tracing.ServiceName))
+		defer tracer.Close()
+	}
+
 	b.WithInterceptors(
-		api.AccessLog(log.Default()),
-		api.RecoverFromPanic,
+		api.InjectRequestId,
+		accessLog,
+		recoverFromPanic,
 		api.PrettyErrorInterceptor,
+		glueauth.ClientCertificate,
+		api.InjectRateLimiter(ratelimit.New(c.RateLimit)),
+		api.InjectTracer(tracer),
+		api.InjectSnapshotFile(c.Snapshot),
+		api.InjectFederation(links),
+		api.InjectWebsocketOrigins(splitList(c.WebsocketOrigins)),
+		api.InjectPeerToken(peerToken),
 	)
 
-	s := &http.Server{
+	var certs *tlsconfig.Reloader
+	if c.TLS.Enabled() {
+		var err error
+		certs, err = tlsconfig.New(c.TLS)
+		if err != nil {
+			log.Fatalln("TLS:", err)
+		}
+		go reloadOnHangup(certs)
+	}
+
+	servers := []*http.Server{{
 		Addr:    c.HttpAddr,
 		Handler: b,
+	}}
+
+	if c.GrpcAddr != "" {
+		if !grpcapi.Cleartext && certs == nil {
+			log.Fatalln("gRPC without TLS needs tailon built with Go 1.24 or later")
+		}
+		s := &http.Server{
+			Addr:    c.GrpcAddr,
+			Handler: grpcapi.NewServer(queueService),
+		}
+		grpcapi.ConfigureServer(s)
+		servers = append(servers, s)
+	}
+
+	for _, s := range servers {
+		go func(s *http.Server) {
+			err := listen(s, certs)
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}(s)
+	}
+
+	// Other protocols, closed after draining clients
+	closers := []io.Closer{}
+
+	if links != nil {
+		closers = append(closers, links)
+	}
+
+	if c.StompAddr != "" {
+		s := stomp.NewServer(queueService)
+		closers = append(closers, s)
+		go func() {
+			fmt.Println("STOMP listening on", c.StompAddr)
+			err := s.ListenAndServe(c.StompAddr)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
+	if c.RespAddr != "" {
+		s := resp.NewServer(queueService)
+		closers = append(closers, s)
+		go func() {
+			fmt.Println("Redis protocol listening on", c.RespAddr)
+			err := s.ListenAndServe(c.RespAddr)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
+	if c.MQTT.Addr != "" {
+		topics, err := mqtt.ParseMapping(c.MQTT.Topics)
+		if err != nil {
+			log.Fatalln("MQTT:", err)
+		}
+		s := mqtt.NewServer(queueService, topics)
+		closers = append(closers, s)
+		go func() {
+			fmt.Println("MQTT listening on", c.MQTT.Addr)
+			err := s.ListenAndServe(c.MQTT.Addr)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	shutdown(servers, closers, queueService, c.ShutdownTimeout)
+}
+
+// splitList returns the non empty items of a comma separated list
+func splitList(s string) []string {
+	result := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func listen(s *http.Server, certs *tlsconfig.Reloader) error {
+
+	if certs == nil {
+		fmt.Println("Server listening on", s.Addr)
+		return s.ListenAndServe()
+	}
+
+	s.TLSConfig = certs.TLSConfig()
+
+	fmt.Println("Server listening on", s.Addr, "(TLS)")
+	return s.ListenAndServeTLS("", "")
+}
+
+// reloadOnHangup reloads certificates without restarting
+func reloadOnHangup(certs *tlsconfig.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := certs.Reload(); err != nil {
+			log.Println("TLS reload:", err)
+			continue
+		}
+		log.Println("TLS certificates reloaded")
+	}
+}
+
+// shutdown stops accepting connections, lets active clients finish until
+// timeout and releases the queue service.
+func shutdown(servers []*http.Server, closers []io.Closer, qs queue.Service, timeout time.Duration) {
+
+	log.Println("Shutting down, waiting up to", timeout, "for", api.ActiveClients(), "clients")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, s := range servers {
+		go s.Shutdown(ctx)
+	}
+
+	if canceled := api.Drain(ctx); canceled > 0 {
+		log.Println("Canceled", canceled, "clients")
+
+		// Give canceled clients a chance to put back undelivered messages
+		grace, cancelGrace := context.WithTimeout(context.Background(), time.Second)
+		api.Drain(grace)
+		cancelGrace()
+	}
+
+	for _, s := range servers {
+		s.Close()
+	}
+	for _, c := range closers {
+		c.Close()
+	}
+
+	if closer, ok := qs.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println("Close queue service:", err)
+		}
 	}
 
-	fmt.Println("Server listening on", s.Addr)
-	s.ListenAndServe()
+	log.Println("Bye")
 }
@@ -0,0 +1,163 @@
+// Package federation ships queues to other tailon servers.
+//
+// A link takes the messages of a local queue and writes them to a queue of
+// a remote server with :write requests. Messages leave the local queue
+// when they are read, and the ones the remote did not store are put back,
+// so every message arrives at least once: a failed request may store some
+// that are sent again.
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+type Config struct {
+	Links      string        `usage:"Comma separated links from a local queue to a remote one, like orders=https://central:8080/site1-orders"`
+	Header     string        `usage:"Header sent to remotes, like 'Authorization: Bearer TOKEN'"`
+	BatchSize  int           `usage:"Maximum messages sent in one :write request"`
+	MaxBackoff time.Duration `usage:"Maximum wait between retries when a remote fails"`
+}
+
+var DefaultConfig = Config{
+	BatchSize:  100,
+	MaxBackoff: 30 * time.Second,
+}
+
+// MinBackoff is the first wait after a failure, it doubles on every
+// failure up to Config.MaxBackoff
+var MinBackoff = 100 * time.Millisecond
+
+var ErrInvalidLink = errors.New("invalid federation link")
+
+// Federation runs the links of a server
+type Federation struct {
+	links  []*Link
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New starts the links of c.Links, local queues are created if missing
+func New(c Config, qs queue.Service) (*Federation, error) {
+
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultConfig.BatchSize
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DefaultConfig.MaxBackoff
+	}
+
+	header := http.Header{}
+	if c.Header != "" {
+		name, value, found := strings.Cut(c.Header, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid federation header '%s'", c.Header)
+		}
+		header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	f := &Federation{}
+	for _, link := range strings.Split(c.Links, ",") {
+		if strings.TrimSpace(link) == "" {
+			continue
+		}
+		l, err := ParseLink(link)
+		if err != nil {
+			return nil, err
+		}
+		l.batchSize = c.BatchSize
+		l.maxBackoff = c.MaxBackoff
+		l.remote.header = header.Clone()
+		f.links = append(f.links, l)
+	}
+
+	f.Start(qs)
+
+	return f, nil
+}
+
+// ParseLink reads queue=url, the last segment of the url path is the
+// remote queue, the local name if the path is empty
+func ParseLink(link string) (*Link, error) {
+
+	name, target, found := strings.Cut(strings.TrimSpace(link), "=")
+	if !found || queue.ValidateName(name) != nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrInvalidLink, link)
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(target, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: '%s'", ErrInvalidLink, link)
+	}
+
+	remoteQueue := name
+	if u.Path != "" {
+		u.Path, remoteQueue = path.Split(u.Path)
+	}
+	server := strings.TrimSuffix(u.String(), "/")
+
+	l := &Link{
+		Queue:  name,
+		Remote: server + "/" + remoteQueue,
+		remote: &remote{
+			url:        server,
+			queue:      remoteQueue,
+			header:     http.Header{},
+			httpClient: http.DefaultClient,
+		},
+		batchSize:  DefaultConfig.BatchSize,
+		maxBackoff: DefaultConfig.MaxBackoff,
+	}
+	l.status = LinkStatus{Queue: l.Queue, Remote: l.Remote}
+
+	return l, nil
+}
+
+func (f *Federation) Start(qs queue.Service) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.done = make(chan struct{})
+
+	wg := &sync.WaitGroup{}
+	for _, l := range f.links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.run(ctx, qs)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(f.done)
+	}()
+}
+
+// Close stops the links, messages being sent are put back
+func (f *Federation) Close() error {
+	if f.cancel == nil {
+		return nil
+	}
+	f.cancel()
+	<-f.done
+	f.cancel = nil
+	return nil
+}
+
+func (f *Federation) Status() []*LinkStatus {
+	result := []*LinkStatus{}
+	for _, l := range f.links {
+		result = append(result, l.Status())
+	}
+	return result
+}
@@ -0,0 +1,203 @@
+package federation
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// central stores what :write sends, it can fail after storing some
+type central struct {
+	mutex    sync.Mutex
+	queues   map[string][]string
+	failures int // requests to fail
+	store    int // messages stored by a failing request
+	header   http.Header
+}
+
+func (r *central) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.header = req.Header.Clone()
+
+	if req.Method == "POST" && req.URL.Path == "/v1/queues" {
+		body := struct{ Name string }{}
+		json.NewDecoder(req.Body).Decode(&body)
+		r.queues[body.Name] = []string{}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	name, found := strings.CutSuffix(strings.TrimPrefix(req.URL.Path, "/v1/queues/"), ":write")
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, exists := r.queues[name]; !exists {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":"queue_not_found"}}`))
+		return
+	}
+
+	written := 0
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		if r.failures > 0 && written == r.store {
+			r.failures--
+			w.Header().Set("Written", strconv.Itoa(written))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"code":"queue_full"}}`))
+			return
+		}
+		r.queues[name] = append(r.queues[name], scanner.Text())
+		written++
+	}
+	w.Header().Set("Written", strconv.Itoa(written))
+}
+
+func (r *central) messages(name string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.queues[name]...)
+}
+
+func TestFederation(t *testing.T) {
+
+	MinBackoff = time.Millisecond
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		rem := &central{queues: map[string][]string{"central": {}}}
+		server := httptest.NewServer(rem)
+		defer server.Close()
+
+		qs := queue.NewMemoryService()
+
+		c := DefaultConfig
+		c.Links = "orders=" + server.URL + "/central"
+		c.BatchSize = 3
+
+		eventually := func(f func() bool) bool {
+			for i := 0; i < 200 && !f(); i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			return f()
+		}
+
+		write := func(n int) {
+			q, _ := qs.GetQueue("orders")
+			for i := 1; i <= n; i++ {
+				q.Write(queue.JSON(strconv.Itoa(i)))
+			}
+		}
+
+		expected := []string{"1", "2", "3", "4", "5", "6", "7"}
+
+		a.Alternative("Ship messages", func(a *biff.A) {
+			c.Header = "Authorization: Bearer secret"
+			f, err := New(c, qs)
+			biff.AssertNil(err)
+			defer f.Close()
+
+			biff.AssertTrue(eventually(func() bool {
+				_, err := qs.GetQueue("orders")
+				return err == nil
+			}))
+			write(7)
+
+			biff.AssertTrue(eventually(func() bool { return len(rem.messages("central")) == 7 }))
+			biff.AssertEqual(rem.messages("central"), expected)
+
+			status := f.Status()[0]
+			biff.AssertEqual(status.Queue, "orders")
+			biff.AssertEqual(status.Remote, server.URL+"/central")
+			biff.AssertEqual(status.Sent, int64(7))
+			biff.AssertEqual(status.Pending, int64(0))
+			biff.AssertTrue(status.Connected)
+			biff.AssertEqual(rem.header.Get("Authorization"), "Bearer secret")
+		})
+
+		a.Alternative("Retry what was not stored", func(a *biff.A) {
+			rem.failures = 2
+			rem.store = 1
+
+			qs.CreateQueue("orders")
+			write(7)
+
+			f, _ := New(c, qs)
+			defer f.Close()
+
+			biff.AssertTrue(eventually(func() bool { return len(rem.messages("central")) == 7 }))
+			biff.AssertEqual(rem.messages("central"), expected)
+
+			status := f.Status()[0]
+			biff.AssertEqual(status.Retries, int64(2))
+			biff.AssertEqual(status.Sent, int64(7))
+		})
+
+		a.Alternative("Create the remote queue", func(a *biff.A) {
+			c.Links = "orders=" + server.URL
+
+			qs.CreateQueue("orders")
+			write(7)
+
+			f, _ := New(c, qs)
+			defer f.Close()
+
+			biff.AssertTrue(eventually(func() bool { return len(rem.messages("orders")) == 7 }))
+			biff.AssertEqual(rem.messages("orders"), expected)
+		})
+
+		a.Alternative("Unreachable remote", func(a *biff.A) {
+			c.Links = "orders=http://127.0.0.1:1/central"
+
+			qs.CreateQueue("orders")
+			write(7)
+
+			f, _ := New(c, qs)
+
+			biff.AssertTrue(eventually(func() bool { return f.Status()[0].Retries > 2 }))
+			status := f.Status()[0]
+			biff.AssertTrue(!status.Connected)
+			biff.AssertTrue(status.Error != "")
+
+			f.Close()
+
+			q, _ := qs.GetQueue("orders")
+			messages, _ := q.Peek(0, 10)
+			biff.AssertEqual(len(messages), 7)
+			biff.AssertEqual(string(messages[0].Payload), "1")
+		})
+	})
+}
+
+func TestParseLink(t *testing.T) {
+
+	l, err := ParseLink("orders=https://central:8080/prefix/site1-orders/")
+	biff.AssertNil(err)
+	biff.AssertEqual(l.Remote, "https://central:8080/prefix/site1-orders")
+	biff.AssertEqual(l.remote.queue, "site1-orders")
+	biff.AssertEqual(l.remote.url, "https://central:8080/prefix")
+
+	l, err = ParseLink(" orders=http://central:8080")
+	biff.AssertNil(err)
+	biff.AssertEqual(l.Remote, "http://central:8080/orders")
+
+	for _, link := range []string{"orders", "=http://central", "orders=central:8080", "orders=ftp://central"} {
+		_, err := ParseLink(link)
+		biff.AssertTrue(errors.Is(err, ErrInvalidLink))
+	}
+}
@@ -0,0 +1,178 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+type LinkStatus struct {
+	Queue     string    `json:"queue"`
+	Remote    string    `json:"remote"`
+	Connected bool      `json:"connected"` // the last request worked
+	Pending   int64     `json:"pending"`   // in the local queue
+	Sent      int64     `json:"sent"`
+	Retries   int64     `json:"retries"`
+	LastSent  time.Time `json:"last_sent,omitzero"`
+	Error     string    `json:"error,omitempty"` // of the last failure
+	RetryAt   time.Time `json:"retry_at,omitzero"`
+}
+
+// Link ships a local queue to a remote one
+type Link struct {
+	Queue  string // local
+	Remote string // url of the remote queue
+
+	remote     *remote
+	batchSize  int
+	maxBackoff time.Duration
+
+	mutex  sync.Mutex
+	status LinkStatus
+	local  queue.Queue
+}
+
+func (l *Link) Status() *LinkStatus {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	status := l.status
+	if l.local != nil {
+		status.Pending = l.local.Stats().Len
+	}
+	return &status
+}
+
+// run sends batches until ctx ends, waiting more after every failure
+func (l *Link) run(ctx context.Context, qs queue.Service) {
+
+	backoff := MinBackoff
+	for ctx.Err() == nil {
+
+		err := l.send(ctx, qs)
+		if err == nil || ctx.Err() != nil {
+			backoff = MinBackoff
+			continue
+		}
+
+		retryAt := time.Now().Add(backoff)
+		l.mutex.Lock()
+		l.status.Connected = false
+		l.status.Retries++
+		l.status.Error = err.Error()
+		l.status.RetryAt = retryAt
+		l.mutex.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff = min(backoff*2, l.maxBackoff)
+	}
+}
+
+// send waits for messages and writes a batch to the remote. Messages the
+// remote did not store are put back at the head of the local queue.
+func (l *Link) send(ctx context.Context, qs queue.Service) error {
+
+	q, err := l.open(qs)
+	if err != nil {
+		return err
+	}
+
+	first, err := q.ReadMessage(ctx)
+	if err != nil {
+		return err
+	}
+	batch := []*queue.Message{first}
+	for len(batch) < l.batchSize && q.Stats().Len > 0 {
+		more, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		message, err := q.ReadMessage(more)
+		cancel()
+		if err != nil {
+			break
+		}
+		batch = append(batch, message)
+	}
+
+	payloads := make([]json.RawMessage, len(batch))
+	for i, message := range batch {
+		payloads[i] = message.Payload
+	}
+
+	// Not canceled with ctx, so messages are not sent twice on shutdown
+	write, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+
+	err = l.remote.write(write, payloads)
+	var e *RemoteError
+	if errors.As(err, &e) && e.Code == "queue_not_found" {
+		err = l.remote.create(write)
+		if errors.As(err, &e) && e.Code == "queue_already_exists" {
+			err = nil
+		}
+		if err == nil {
+			err = l.remote.write(write, payloads)
+		}
+	}
+	if err != nil {
+		written := 0
+		if errors.As(err, &e) && e.Written > 0 {
+			written = e.Written
+		}
+		l.sent(written)
+		l.putBack(q, batch[written:])
+		return err
+	}
+
+	l.sent(len(batch))
+
+	l.mutex.Lock()
+	l.status.Connected = true
+	l.status.Error = ""
+	l.status.RetryAt = time.Time{}
+	l.mutex.Unlock()
+
+	return nil
+}
+
+// open returns the local queue, created if missing
+func (l *Link) open(qs queue.Service) (queue.Queue, error) {
+
+	q, err := qs.GetQueue(l.Queue)
+	if errors.Is(err, queue.ErrQueueNotFound) {
+		q, err = qs.CreateQueue(l.Queue)
+		if errors.Is(err, queue.ErrQueueAlreadyExists) {
+			q, err = qs.GetQueue(l.Queue)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	l.local = q
+	l.mutex.Unlock()
+
+	return q, nil
+}
+
+func (l *Link) sent(n int) {
+	if n == 0 {
+		return
+	}
+	l.mutex.Lock()
+	l.status.Sent += int64(n)
+	l.status.LastSent = time.Now()
+	l.mutex.Unlock()
+}
+
+// putBack unreads in reverse order, so messages keep their order
+func (l *Link) putBack(q queue.Queue, messages []*queue.Message) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		q.Unread(messages[i])
+	}
+}
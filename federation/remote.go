@@ -0,0 +1,101 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// RemoteError is an error response of the remote server
+type RemoteError struct {
+	StatusCode int
+	Code       string
+	Message    string
+
+	// Written is the number of messages stored by a failed write, -1 if
+	// unknown
+	Written int
+}
+
+func (e *RemoteError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// remote is the queue of a server that a link writes to
+type remote struct {
+	url        string // of the server, like http://central:8080
+	queue      string
+	header     http.Header
+	httpClient *http.Client
+}
+
+// write sends payloads as JSON lines in a single :write request
+func (r *remote) write(ctx context.Context, payloads []json.RawMessage) error {
+
+	body := &bytes.Buffer{}
+	for _, payload := range payloads {
+		body.Write(payload)
+		body.WriteByte('\n')
+	}
+
+	return r.do(ctx, "/v1/queues/"+url.PathEscape(r.queue)+":write", body)
+}
+
+func (r *remote) create(ctx context.Context) error {
+	b, _ := json.Marshal(map[string]string{"name": r.queue})
+	return r.do(ctx, "/v1/queues", bytes.NewReader(b))
+}
+
+// do posts body and returns a *RemoteError if the status is not 2xx
+func (r *remote) do(ctx context.Context, path string, body io.Reader) error {
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.url+path, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 300 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+
+	e := &RemoteError{
+		StatusCode: res.StatusCode,
+		Code:       "unexpected_status",
+		Message:    res.Status,
+		Written:    -1,
+	}
+
+	response := struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&response) == nil && response.Error.Code != "" {
+		e.Code = response.Error.Code
+		e.Message = response.Error.Message
+	}
+	if written, err := strconv.Atoi(res.Header.Get("Written")); err == nil {
+		e.Written = written
+	}
+
+	return e
+}
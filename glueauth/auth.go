@@ -2,8 +2,10 @@ package glueauth
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"net/http"
 
 	"github.com/fulldump/box"
 )
@@ -27,18 +29,14 @@ var ErrUnauthorized = errors.New("unauthorized")
 func Require(next box.H) box.H {
 	return func(ctx context.Context) {
 
-		d := box.GetRequest(ctx).Header.Get(XGlueAuthentication)
-
-		if d == "" {
-			box.SetError(ctx, ErrUnauthorized)
+		if GetAuth(ctx) != nil {
+			next(ctx)
 			return
 		}
 
-		a := &GlueAuthentication{}
-
-		err := json.Unmarshal([]byte(d), &a)
+		a, err := Parse(box.GetRequest(ctx))
 		if err != nil {
-			box.SetError(ctx, ErrUnauthorized)
+			box.SetError(ctx, err)
 			return
 		}
 
@@ -48,13 +46,78 @@ func Require(next box.H) box.H {
 	}
 }
 
+// Optional stores the authentication in context if present and valid, but
+// does not reject anonymous requests.
+func Optional(next box.H) box.H {
+	return func(ctx context.Context) {
+
+		if GetAuth(ctx) != nil {
+			next(ctx)
+			return
+		}
+
+		if a, err := Parse(box.GetRequest(ctx)); err == nil {
+			ctx = SetAuth(ctx, a)
+		}
+
+		next(ctx)
+	}
+}
+
+func Parse(r *http.Request) (*GlueAuthentication, error) {
+
+	d := r.Header.Get(XGlueAuthentication)
+
+	if d == "" {
+		return nil, ErrUnauthorized
+	}
+
+	a := &GlueAuthentication{}
+
+	err := json.Unmarshal([]byte(d), &a)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	return a, nil
+}
+
+// ClientCertificate authenticates requests with the verified TLS client
+// certificate subject. It takes precedence over the X-Glue-Authentication
+// header.
+func ClientCertificate(next box.H) box.H {
+	return func(ctx context.Context) {
+
+		r := box.GetRequest(ctx)
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			ctx = SetAuth(ctx, FromCertificate(r.TLS.VerifiedChains[0][0]))
+		}
+
+		next(ctx)
+	}
+}
+
+func FromCertificate(cert *x509.Certificate) *GlueAuthentication {
+
+	a := &GlueAuthentication{}
+	a.Session.ID = cert.SerialNumber.Text(16)
+	a.User.ID = cert.Subject.String()
+	a.User.Nick = cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		a.User.Email = cert.EmailAddresses[0]
+	}
+
+	return a
+}
+
 const key = "6fbc299a-3546-11ed-bf91-87a0b0cea4af"
 
 func SetAuth(ctx context.Context, a *GlueAuthentication) context.Context {
 	return context.WithValue(ctx, key, a)
 }
 
+// GetAuth returns nil if the request is not authenticated
 func GetAuth(ctx context.Context) *GlueAuthentication {
-	v := ctx.Value(key)
-	return v.(*GlueAuthentication)
+	v, _ := ctx.Value(key).(*GlueAuthentication)
+	return v
 }
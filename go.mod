@@ -1,6 +1,6 @@
 module github.com/fulldump/tailon
 
-go 1.19
+go 1.22
 
 require (
 	github.com/fulldump/apitest v1.2.2
@@ -0,0 +1,17 @@
+//go:build go1.24
+
+package grpcapi
+
+import "net/http"
+
+// Cleartext is true if ConfigureServer enables HTTP/2 without TLS
+const Cleartext = true
+
+// ConfigureServer enables HTTP/2 without TLS (h2c), that gRPC clients use
+// with insecure credentials. HTTP/2 over TLS is negotiated by ALPN.
+func ConfigureServer(s *http.Server) {
+	p := &http.Protocols{}
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	s.Protocols = p
+}
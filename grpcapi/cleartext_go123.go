@@ -0,0 +1,12 @@
+//go:build !go1.24
+
+package grpcapi
+
+import "net/http"
+
+// Cleartext is false, net/http serves HTTP/2 without TLS since Go 1.24, so
+// gRPC clients need TLS
+const Cleartext = false
+
+// ConfigureServer does nothing, HTTP/2 over TLS is negotiated by ALPN
+func ConfigureServer(s *http.Server) {}
@@ -0,0 +1,31 @@
+//go:build go1.24
+
+package grpcapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+func TestCleartext(t *testing.T) {
+
+	s := httptest.NewUnstartedServer(NewServer(queue.NewMemoryService()))
+	ConfigureServer(s.Config)
+	s.Start()
+	defer s.Close()
+
+	p := &http.Protocols{}
+	p.SetUnencryptedHTTP2(true)
+	c := &testClient{
+		base:   s.URL,
+		client: &http.Client{Transport: &http.Transport{Protocols: p}},
+	}
+
+	code := c.unary("CreateQueue", &CreateQueueRequest{Name: "my-queue"}, &CreateQueueResponse{})
+	biff.AssertEqual(code, OK)
+}
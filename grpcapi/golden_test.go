@@ -0,0 +1,54 @@
+package grpcapi
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/fulldump/biff"
+)
+
+// golden holds the bytes protobuf-go produces for the same messages, copied
+// from the log of `go test -v -run TestWire` in ./interop
+var golden = []struct {
+	name    string
+	message ProtoMessage
+	hex     string
+}{
+	{"CreateQueueRequest", &CreateQueueRequest{Name: "my-queue"}, "0a086d792d7175657565"},
+	{"CreateQueueResponse", &CreateQueueResponse{}, ""},
+	{"ListQueuesRequest", &ListQueuesRequest{}, ""},
+	{"ListQueuesResponse", &ListQueuesResponse{Names: []string{"a", "", "ñandú"}}, "0a01610a000a07c3b1616e64c3ba"},
+	{"RetrieveQueueRequest", &RetrieveQueueRequest{Name: "my-queue"}, "0a086d792d7175657565"},
+	{"Queue", &Queue{Name: "my-queue", Len: 1, Bytes: 300, Writes: 1 << 40, Reads: 0, BytesWritten: 127, BytesRead: 128}, "0a086d792d7175657565100118ac0220808080808020307f388001"},
+	{"DeleteQueueRequest", &DeleteQueueRequest{Name: "my-queue"}, "0a086d792d7175657565"},
+	{"DeleteQueueResponse", &DeleteQueueResponse{}, ""},
+	{"PublishRequest", &PublishRequest{
+		Queue:   "my-queue",
+		Payload: []byte(`{"hello":"world"}`),
+		Headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "b": "2", "a": "1"},
+		Ref:     "1",
+	}, "0a086d792d717565756512117b2268656c6c6f223a22776f726c64227d1a060a01611201311a060a01621201321a460a0b7472616365706172656e74123730302d30616637363531393136636434336464383434386562323131633830333139632d623761643662373136393230333333312d3031220131"},
+	{"PublishResponse", &PublishResponse{Ref: "1", Id: 18446744073709551615}, "0a013110ffffffffffffffffff01"},
+	{"ConsumeRequest", &ConsumeRequest{Queue: "my-queue", Limit: -1}, "0a086d792d717565756510ffffffffffffffffff01"},
+	{"Message", &Message{
+		Id:           3,
+		TimeUnixNano: 1660529293000000000,
+		Headers:      map[string]string{"x": "y"},
+		Payload:      []byte(`[1,2,3]`),
+	}, "080310808495c381d3d885171a060a017812017922075b312c322c335d"},
+}
+
+func TestGolden(t *testing.T) {
+
+	for _, g := range golden {
+		t.Run(g.name, func(t *testing.T) {
+			biff.AssertEqual(hex.EncodeToString(g.message.Marshal()), g.hex)
+
+			data, _ := hex.DecodeString(g.hex)
+			decoded := reflect.New(reflect.TypeOf(g.message).Elem()).Interface().(ProtoMessage)
+			biff.AssertNil(decoded.Unmarshal(data))
+			biff.AssertEqual(decoded, g.message)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package interop
+
+import (
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// tailon.proto, field by field, as protoc would describe it
+
+type fieldType = descriptorpb.FieldDescriptorProto_Type
+
+const (
+	typeString = descriptorpb.FieldDescriptorProto_TYPE_STRING
+	typeBytes  = descriptorpb.FieldDescriptorProto_TYPE_BYTES
+	typeInt64  = descriptorpb.FieldDescriptorProto_TYPE_INT64
+	typeUint64 = descriptorpb.FieldDescriptorProto_TYPE_UINT64
+)
+
+func field(name string, number int32, t fieldType) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Type:   t.Enum(),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+}
+
+func repeated(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+	f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	return f
+}
+
+func message(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+	return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+}
+
+// withHeaders adds map<string, string> headers, a repeated nested entry,
+// and the fields after it
+func withHeaders(m *descriptorpb.DescriptorProto, number int32, after ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+	entry := message("HeadersEntry", field("key", 1, typeString), field("value", 2, typeString))
+	entry.Options = &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)}
+	m.NestedType = append(m.NestedType, entry)
+
+	headers := repeated(field("headers", number, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE))
+	headers.TypeName = proto.String(".tailon.v1." + m.GetName() + ".HeadersEntry")
+	m.Field = append(m.Field, headers)
+	m.Field = append(m.Field, after...)
+	return m
+}
+
+func method(name, input, output string, clientStreaming, serverStreaming bool) *descriptorpb.MethodDescriptorProto {
+	return &descriptorpb.MethodDescriptorProto{
+		Name:            proto.String(name),
+		InputType:       proto.String(".tailon.v1." + input),
+		OutputType:      proto.String(".tailon.v1." + output),
+		ClientStreaming: proto.Bool(clientStreaming),
+		ServerStreaming: proto.Bool(serverStreaming),
+	}
+}
+
+var tailonProto = &descriptorpb.FileDescriptorProto{
+	Name:    proto.String("tailon.proto"),
+	Package: proto.String("tailon.v1"),
+	Syntax:  proto.String("proto3"),
+	MessageType: []*descriptorpb.DescriptorProto{
+		message("CreateQueueRequest", field("name", 1, typeString)),
+		message("CreateQueueResponse"),
+		message("ListQueuesRequest"),
+		message("ListQueuesResponse", repeated(field("names", 1, typeString))),
+		message("RetrieveQueueRequest", field("name", 1, typeString)),
+		message("Queue",
+			field("name", 1, typeString),
+			field("len", 2, typeInt64),
+			field("bytes", 3, typeInt64),
+			field("writes", 4, typeInt64),
+			field("reads", 5, typeInt64),
+			field("bytes_written", 6, typeInt64),
+			field("bytes_read", 7, typeInt64),
+		),
+		message("DeleteQueueRequest", field("name", 1, typeString)),
+		message("DeleteQueueResponse"),
+		withHeaders(message("PublishRequest",
+			field("queue", 1, typeString),
+			field("payload", 2, typeBytes),
+		), 3, field("ref", 4, typeString)),
+		message("PublishResponse", field("ref", 1, typeString), field("id", 2, typeUint64)),
+		message("ConsumeRequest", field("queue", 1, typeString), field("limit", 2, typeInt64)),
+		withHeaders(message("Message",
+			field("id", 1, typeUint64),
+			field("time_unix_nano", 2, typeInt64),
+		), 3, field("payload", 4, typeBytes)),
+	},
+	Service: []*descriptorpb.ServiceDescriptorProto{{
+		Name: proto.String("Tailon"),
+		Method: []*descriptorpb.MethodDescriptorProto{
+			method("CreateQueue", "CreateQueueRequest", "CreateQueueResponse", false, false),
+			method("ListQueues", "ListQueuesRequest", "ListQueuesResponse", false, false),
+			method("RetrieveQueue", "RetrieveQueueRequest", "Queue", false, false),
+			method("DeleteQueue", "DeleteQueueRequest", "DeleteQueueResponse", false, false),
+			method("Publish", "PublishRequest", "PublishResponse", true, true),
+			method("Consume", "ConsumeRequest", "Message", false, true),
+		},
+	}},
+}
+
+var tailonFile = func() protoreflect.FileDescriptor {
+	f, err := protodesc.NewFile(tailonProto, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}()
+
+// newMessage returns an empty tailon.v1 message
+func newMessage(name string) *dynamicpb.Message {
+	return dynamicpb.NewMessage(tailonFile.Messages().ByName(protoreflect.Name(name)))
+}
@@ -0,0 +1,22 @@
+module github.com/fulldump/tailon/grpcapi/interop
+
+go 1.25.0
+
+require (
+	github.com/fulldump/biff v1.3.0
+	github.com/fulldump/tailon v0.0.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/fulldump/apitest v1.2.2 // indirect
+	github.com/fulldump/box v0.7.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
+
+replace github.com/fulldump/tailon => ../..
@@ -0,0 +1,202 @@
+// Package interop checks the hand written gRPC service of tailon against
+// grpc-go and protobuf-go, the reference implementations. It is a module of
+// its own so tailon does not depend on them.
+package interop
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/fulldump/biff"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/fulldump/tailon/grpcapi"
+	"github.com/fulldump/tailon/queue"
+)
+
+// snake turns a Go field name into its proto name, TimeUnixNano is
+// time_unix_nano
+func snake(name string) string {
+	b := &strings.Builder{}
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// toDynamic copies the fields of a grpcapi message into the tailon.v1
+// message name
+func toDynamic(name string, m grpcapi.ProtoMessage) *dynamicpb.Message {
+
+	d := newMessage(name)
+	fields := d.Descriptor().Fields()
+
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fd := fields.ByName(protoreflect.Name(snake(v.Type().Field(i).Name)))
+		switch value := v.Field(i).Interface().(type) {
+		case string:
+			d.Set(fd, protoreflect.ValueOfString(value))
+		case []byte:
+			d.Set(fd, protoreflect.ValueOfBytes(value))
+		case int64:
+			d.Set(fd, protoreflect.ValueOfInt64(value))
+		case uint64:
+			d.Set(fd, protoreflect.ValueOfUint64(value))
+		case []string:
+			list := d.Mutable(fd).List()
+			for _, s := range value {
+				list.Append(protoreflect.ValueOfString(s))
+			}
+		case map[string]string:
+			entries := d.Mutable(fd).Map()
+			for k, s := range value {
+				entries.Set(protoreflect.ValueOfString(k).MapKey(), protoreflect.ValueOfString(s))
+			}
+		default:
+			panic("unexpected field " + v.Type().Field(i).Name)
+		}
+	}
+
+	return d
+}
+
+var samples = []struct {
+	name    string
+	message grpcapi.ProtoMessage
+}{
+	{"CreateQueueRequest", &grpcapi.CreateQueueRequest{Name: "my-queue"}},
+	{"CreateQueueResponse", &grpcapi.CreateQueueResponse{}},
+	{"ListQueuesRequest", &grpcapi.ListQueuesRequest{}},
+	{"ListQueuesResponse", &grpcapi.ListQueuesResponse{Names: []string{"a", "", "ñandú"}}},
+	{"RetrieveQueueRequest", &grpcapi.RetrieveQueueRequest{Name: "my-queue"}},
+	{"Queue", &grpcapi.Queue{Name: "my-queue", Len: 1, Bytes: 300, Writes: 1 << 40, Reads: 0, BytesWritten: 127, BytesRead: 128}},
+	{"DeleteQueueRequest", &grpcapi.DeleteQueueRequest{Name: "my-queue"}},
+	{"DeleteQueueResponse", &grpcapi.DeleteQueueResponse{}},
+	{"PublishRequest", &grpcapi.PublishRequest{
+		Queue:   "my-queue",
+		Payload: []byte(`{"hello":"world"}`),
+		Headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "b": "2", "a": "1"},
+		Ref:     "1",
+	}},
+	{"PublishResponse", &grpcapi.PublishResponse{Ref: "1", Id: 18446744073709551615}},
+	{"ConsumeRequest", &grpcapi.ConsumeRequest{Queue: "my-queue", Limit: -1}},
+	{"Message", &grpcapi.Message{
+		Id:           3,
+		TimeUnixNano: 1660529293000000000,
+		Headers:      map[string]string{"x": "y"},
+		Payload:      []byte(`[1,2,3]`),
+	}},
+}
+
+// TestWire compares the encoding of every message with protobuf-go, the
+// golden bytes in grpcapi come from its log
+func TestWire(t *testing.T) {
+
+	for _, sample := range samples {
+		expected, err := proto.MarshalOptions{Deterministic: true}.Marshal(toDynamic(sample.name, sample.message))
+		biff.AssertNil(err)
+		t.Logf("%s %s", sample.name, hex.EncodeToString(expected))
+
+		biff.AssertEqual(hex.EncodeToString(sample.message.Marshal()), hex.EncodeToString(expected))
+
+		decoded := reflect.New(reflect.TypeOf(sample.message).Elem()).Interface().(grpcapi.ProtoMessage)
+		biff.AssertNil(decoded.Unmarshal(expected))
+		biff.AssertEqual(decoded, sample.message)
+	}
+}
+
+func TestClient(t *testing.T) {
+
+	s := httptest.NewUnstartedServer(grpcapi.NewServer(queue.NewMemoryService()))
+	grpcapi.ConfigureServer(s.Config)
+	s.Start()
+	defer s.Close()
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(s.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	biff.AssertNil(err)
+	defer conn.Close()
+
+	ctx := context.Background()
+	service := "/" + grpcapi.ServiceName + "/"
+
+	unary := func(method string, req *dynamicpb.Message, res string) (*dynamicpb.Message, error) {
+		m := newMessage(res)
+		err := conn.Invoke(ctx, service+method, req, m)
+		return m, err
+	}
+
+	get := func(m *dynamicpb.Message, name string) protoreflect.Value {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+	}
+
+	// Create
+	_, err = unary("CreateQueue", toDynamic("CreateQueueRequest", &grpcapi.CreateQueueRequest{Name: "my-queue"}), "CreateQueueResponse")
+	biff.AssertNil(err)
+
+	_, err = unary("CreateQueue", toDynamic("CreateQueueRequest", &grpcapi.CreateQueueRequest{Name: "my-queue"}), "CreateQueueResponse")
+	biff.AssertEqual(status.Code(err), codes.AlreadyExists)
+	biff.AssertEqual(status.Convert(err).Message(), "queue already exists: 'my-queue'")
+
+	list, err := unary("ListQueues", newMessage("ListQueuesRequest"), "ListQueuesResponse")
+	biff.AssertNil(err)
+	biff.AssertEqual(get(list, "names").List().Get(0).String(), "my-queue")
+
+	// Publish, bidirectional
+	publish, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, service+"Publish")
+	biff.AssertNil(err)
+	biff.AssertNil(publish.SendMsg(toDynamic("PublishRequest", &grpcapi.PublishRequest{
+		Queue:   "my-queue",
+		Payload: []byte(`{"hello":"world"}`),
+		Headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		Ref:     "a",
+	})))
+	published := newMessage("PublishResponse")
+	biff.AssertNil(publish.RecvMsg(published))
+	biff.AssertEqual(get(published, "ref").String(), "a")
+	biff.AssertEqual(get(published, "id").Uint(), uint64(1))
+	biff.AssertNil(publish.CloseSend())
+	biff.AssertTrue(errors.Is(publish.RecvMsg(newMessage("PublishResponse")), io.EOF))
+
+	// Consume, server streaming
+	consume, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, service+"Consume")
+	biff.AssertNil(err)
+	biff.AssertNil(consume.SendMsg(toDynamic("ConsumeRequest", &grpcapi.ConsumeRequest{Queue: "my-queue", Limit: 1})))
+	biff.AssertNil(consume.CloseSend())
+	message := newMessage("Message")
+	biff.AssertNil(consume.RecvMsg(message))
+	biff.AssertEqual(get(message, "id").Uint(), uint64(1))
+	biff.AssertEqual(string(get(message, "payload").Bytes()), `{"hello":"world"}`)
+	traceparent := get(message, "headers").Map().Get(protoreflect.ValueOfString("traceparent").MapKey())
+	biff.AssertEqual(traceparent.String(), "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	biff.AssertTrue(get(message, "time_unix_nano").Int() > 0)
+	biff.AssertTrue(errors.Is(consume.RecvMsg(newMessage("Message")), io.EOF))
+
+	// Retrieve and delete
+	q, err := unary("RetrieveQueue", toDynamic("RetrieveQueueRequest", &grpcapi.RetrieveQueueRequest{Name: "my-queue"}), "Queue")
+	biff.AssertNil(err)
+	biff.AssertEqual(get(q, "writes").Int(), int64(1))
+	biff.AssertEqual(get(q, "reads").Int(), int64(1))
+
+	_, err = unary("DeleteQueue", toDynamic("DeleteQueueRequest", &grpcapi.DeleteQueueRequest{Name: "my-queue"}), "DeleteQueueResponse")
+	biff.AssertNil(err)
+
+	_, err = unary("RetrieveQueue", toDynamic("RetrieveQueueRequest", &grpcapi.RetrieveQueueRequest{Name: "my-queue"}), "Queue")
+	biff.AssertEqual(status.Code(err), codes.NotFound)
+}
@@ -0,0 +1,269 @@
+package grpcapi
+
+// Messages defined in tailon.proto
+
+// ProtoMessage is implemented by every request and response
+type ProtoMessage interface {
+	Marshal() []byte
+	Unmarshal(b []byte) error
+}
+
+type CreateQueueRequest struct {
+	Name string
+}
+
+func (m *CreateQueueRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Name)
+	return e.b
+}
+
+func (m *CreateQueueRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		if field == 1 {
+			m.Name = string(data)
+		}
+		return nil
+	})
+}
+
+type CreateQueueResponse struct{}
+
+func (m *CreateQueueResponse) Marshal() []byte { return nil }
+
+func (m *CreateQueueResponse) Unmarshal(b []byte) error { return decode(b, ignore) }
+
+type ListQueuesRequest struct{}
+
+func (m *ListQueuesRequest) Marshal() []byte { return nil }
+
+func (m *ListQueuesRequest) Unmarshal(b []byte) error { return decode(b, ignore) }
+
+type ListQueuesResponse struct {
+	Names []string
+}
+
+func (m *ListQueuesResponse) Marshal() []byte {
+	e := &encoder{}
+	e.strings(1, m.Names)
+	return e.b
+}
+
+func (m *ListQueuesResponse) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		if field == 1 {
+			m.Names = append(m.Names, string(data))
+		}
+		return nil
+	})
+}
+
+type RetrieveQueueRequest struct {
+	Name string
+}
+
+func (m *RetrieveQueueRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Name)
+	return e.b
+}
+
+func (m *RetrieveQueueRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		if field == 1 {
+			m.Name = string(data)
+		}
+		return nil
+	})
+}
+
+type Queue struct {
+	Name         string
+	Len          int64
+	Bytes        int64
+	Writes       int64
+	Reads        int64
+	BytesWritten int64
+	BytesRead    int64
+}
+
+func (m *Queue) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Name)
+	e.int64(2, m.Len)
+	e.int64(3, m.Bytes)
+	e.int64(4, m.Writes)
+	e.int64(5, m.Reads)
+	e.int64(6, m.BytesWritten)
+	e.int64(7, m.BytesRead)
+	return e.b
+}
+
+func (m *Queue) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Name = string(data)
+		case 2:
+			m.Len = int64(v)
+		case 3:
+			m.Bytes = int64(v)
+		case 4:
+			m.Writes = int64(v)
+		case 5:
+			m.Reads = int64(v)
+		case 6:
+			m.BytesWritten = int64(v)
+		case 7:
+			m.BytesRead = int64(v)
+		}
+		return nil
+	})
+}
+
+type DeleteQueueRequest struct {
+	Name string
+}
+
+func (m *DeleteQueueRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Name)
+	return e.b
+}
+
+func (m *DeleteQueueRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		if field == 1 {
+			m.Name = string(data)
+		}
+		return nil
+	})
+}
+
+type DeleteQueueResponse struct{}
+
+func (m *DeleteQueueResponse) Marshal() []byte { return nil }
+
+func (m *DeleteQueueResponse) Unmarshal(b []byte) error { return decode(b, ignore) }
+
+type PublishRequest struct {
+	Queue   string
+	Payload []byte
+	Headers map[string]string
+	Ref     string
+}
+
+func (m *PublishRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Queue)
+	e.bytes(2, m.Payload)
+	e.stringMap(3, m.Headers)
+	e.string(4, m.Ref)
+	return e.b
+}
+
+func (m *PublishRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Queue = string(data)
+		case 2:
+			m.Payload = append([]byte{}, data...)
+		case 3:
+			if m.Headers == nil {
+				m.Headers = map[string]string{}
+			}
+			return decodeMapEntry(data, m.Headers)
+		case 4:
+			m.Ref = string(data)
+		}
+		return nil
+	})
+}
+
+type PublishResponse struct {
+	Ref string
+	Id  uint64
+}
+
+func (m *PublishResponse) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Ref)
+	e.uint64(2, m.Id)
+	return e.b
+}
+
+func (m *PublishResponse) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Ref = string(data)
+		case 2:
+			m.Id = v
+		}
+		return nil
+	})
+}
+
+type ConsumeRequest struct {
+	Queue string
+	Limit int64
+}
+
+func (m *ConsumeRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Queue)
+	e.int64(2, m.Limit)
+	return e.b
+}
+
+func (m *ConsumeRequest) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Queue = string(data)
+		case 2:
+			m.Limit = int64(v)
+		}
+		return nil
+	})
+}
+
+type Message struct {
+	Id           uint64
+	TimeUnixNano int64
+	Headers      map[string]string
+	Payload      []byte
+}
+
+func (m *Message) Marshal() []byte {
+	e := &encoder{}
+	e.uint64(1, m.Id)
+	e.int64(2, m.TimeUnixNano)
+	e.stringMap(3, m.Headers)
+	e.bytes(4, m.Payload)
+	return e.b
+}
+
+func (m *Message) Unmarshal(b []byte) error {
+	return decode(b, func(field, wireType int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Id = v
+		case 2:
+			m.TimeUnixNano = int64(v)
+		case 3:
+			if m.Headers == nil {
+				m.Headers = map[string]string{}
+			}
+			return decodeMapEntry(data, m.Headers)
+		case 4:
+			m.Payload = append([]byte{}, data...)
+		}
+		return nil
+	})
+}
+
+func ignore(field, wireType int, v uint64, data []byte) error {
+	return nil
+}
@@ -0,0 +1,412 @@
+// Package grpcapi serves the Tailon gRPC service defined in tailon.proto
+// over HTTP/2, backed by the same queue.Service as the HTTP API.
+package grpcapi
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+const ServiceName = "tailon.v1.Tailon"
+
+// DefaultMaxMessageSize is the largest message received, as in grpc-go
+const DefaultMaxMessageSize = 4 << 20
+
+type Server struct {
+	Queues         queue.Service
+	MaxMessageSize int
+
+	methods map[string]func(s *stream) error
+}
+
+func NewServer(qs queue.Service) *Server {
+
+	s := &Server{
+		Queues:         qs,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+
+	s.methods = map[string]func(*stream) error{
+		"CreateQueue":   s.createQueue,
+		"ListQueues":    s.listQueues,
+		"RetrieveQueue": s.retrieveQueue,
+		"DeleteQueue":   s.deleteQueue,
+		"Publish":       s.publish,
+		"Consume":       s.consume,
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	st := &stream{
+		ctx:     r.Context(),
+		w:       w,
+		r:       r,
+		maxSize: s.MaxMessageSize,
+	}
+
+	err := st.checkEncoding()
+
+	if err == nil && r.Method != http.MethodPost {
+		err = Errorf(Unimplemented, "method %s not allowed", r.Method)
+	}
+
+	service, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	handler, exists := s.methods[method]
+	if err == nil && (service != ServiceName || !exists) {
+		err = Errorf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	if err == nil {
+		if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			var cancel context.CancelFunc
+			st.ctx, cancel = context.WithTimeout(st.ctx, timeout)
+			defer cancel()
+		}
+		err = handler(st)
+	}
+
+	st.finish(err)
+}
+
+// stream reads and writes length prefixed messages on a request
+type stream struct {
+	ctx        context.Context
+	w          http.ResponseWriter
+	r          *http.Request
+	maxSize    int
+	headerSent bool
+}
+
+func (s *stream) checkEncoding() error {
+	encoding := s.r.Header.Get("Grpc-Encoding")
+	if encoding != "" && encoding != "identity" {
+		s.w.Header().Set("Grpc-Accept-Encoding", "identity")
+		return Errorf(Unimplemented, "compression %s not supported", encoding)
+	}
+	return nil
+}
+
+func (s *stream) sendHeader() {
+	if s.headerSent {
+		return
+	}
+	s.headerSent = true
+	s.w.Header().Set("Content-Type", "application/grpc")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// Recv returns io.EOF when the client has finished sending
+func (s *stream) Recv(m ProtoMessage) error {
+
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(s.r.Body, prefix); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return Errorf(Canceled, "reading request: %s", err)
+	}
+
+	if prefix[0] != 0 {
+		return Errorf(Unimplemented, "compressed messages not supported")
+	}
+
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if int64(length) > int64(s.maxSize) {
+		return Errorf(ResourceExhausted, "message of %d bytes is larger than %d", length, s.maxSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(s.r.Body, data); err != nil {
+		return Errorf(Canceled, "reading request: %s", err)
+	}
+
+	if err := m.Unmarshal(data); err != nil {
+		return Errorf(InvalidArgument, "%s", err)
+	}
+
+	return nil
+}
+
+func (s *stream) Send(m ProtoMessage) error {
+
+	s.sendHeader()
+
+	data := m.Marshal()
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	frame = append(frame, data...)
+
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+// finish sends the status as trailers, or as headers if nothing has been
+// sent (trailers-only response)
+func (s *stream) finish(err error) {
+
+	status := &Status{Code: OK}
+	if err != nil {
+		status = statusFromError(err)
+	}
+
+	prefix := http.TrailerPrefix
+	if !s.headerSent {
+		prefix = ""
+		s.w.Header().Set("Content-Type", "application/grpc")
+	}
+
+	s.w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		s.w.Header().Set(prefix+"Grpc-Message", encodeMessage(status.Message))
+	}
+
+	if !s.headerSent {
+		s.w.WriteHeader(http.StatusOK)
+	}
+}
+
+// unary reads a single request into req and sends the response of f
+func unary(s *stream, req ProtoMessage, f func() (ProtoMessage, error)) error {
+
+	if err := s.Recv(req); err != nil {
+		if err == io.EOF {
+			return Errorf(InvalidArgument, "missing request")
+		}
+		return err
+	}
+
+	res, err := f()
+	if err != nil {
+		return err
+	}
+
+	return s.Send(res)
+}
+
+func (s *Server) createQueue(st *stream) error {
+	req := &CreateQueueRequest{}
+	return unary(st, req, func() (ProtoMessage, error) {
+		_, err := s.Queues.CreateQueue(req.Name)
+		return &CreateQueueResponse{}, err
+	})
+}
+
+func (s *Server) listQueues(st *stream) error {
+	req := &ListQueuesRequest{}
+	return unary(st, req, func() (ProtoMessage, error) {
+		names, err := s.Queues.ListQueues()
+		sort.Strings(names)
+		return &ListQueuesResponse{Names: names}, err
+	})
+}
+
+func (s *Server) retrieveQueue(st *stream) error {
+	req := &RetrieveQueueRequest{}
+	return unary(st, req, func() (ProtoMessage, error) {
+		q, err := s.Queues.GetQueue(req.Name)
+		if err != nil {
+			return nil, err
+		}
+		stats := q.Stats()
+		return &Queue{
+			Name:         req.Name,
+			Len:          stats.Len,
+			Bytes:        stats.Bytes,
+			Writes:       stats.Writes,
+			Reads:        stats.Reads,
+			BytesWritten: stats.BytesWritten,
+			BytesRead:    stats.BytesRead,
+		}, nil
+	})
+}
+
+func (s *Server) deleteQueue(st *stream) error {
+	req := &DeleteQueueRequest{}
+	return unary(st, req, func() (ProtoMessage, error) {
+		return &DeleteQueueResponse{}, s.Queues.DeleteQueue(req.Name)
+	})
+}
+
+// trackClient lists the stream in /v1/clients, Drain cancels it
+func trackClient(st *stream, queueName, action string) (*api.Client, func()) {
+
+	ctx, cancel := context.WithCancel(st.ctx)
+	st.ctx = ctx
+
+	id := st.r.Header.Get(api.RequestIdHeader)
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	c := api.NewClient(id, queueName, action, st.r.RemoteAddr, cancel)
+	untrack := api.TrackClient(c)
+
+	return c, func() {
+		untrack()
+		cancel()
+	}
+}
+
+// publish keeps the messages written before an error, the client should
+// retry from the first one without response
+func (s *Server) publish(st *stream) error {
+
+	var q queue.Queue
+	var c *api.Client
+	queueName := ""
+
+	// Headers are sent so the client can start receiving responses
+	st.sendHeader()
+	if f, ok := st.w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	for {
+		req := &PublishRequest{}
+		err := st.Recv(req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if req.Queue != "" && req.Queue != queueName {
+			q, err = s.Queues.GetQueue(req.Queue)
+			if err != nil {
+				return err
+			}
+			queueName = req.Queue
+			if c == nil {
+				var untrack func()
+				c, untrack = trackClient(st, queueName, "grpc.Publish")
+				defer untrack()
+			}
+			c.Queue = queueName
+		}
+		if q == nil {
+			return Errorf(InvalidArgument, "the first request must set the queue")
+		}
+
+		if !json.Valid(req.Payload) {
+			return Errorf(InvalidArgument, "payload is not valid JSON")
+		}
+
+		message := &queue.Message{Headers: req.Headers, Payload: req.Payload}
+		if err := q.WriteMessage(message); err != nil {
+			return err
+		}
+		c.Writes++
+
+		if err := st.Send(&PublishResponse{Ref: req.Ref, Id: message.Id}); err != nil {
+			return err
+		}
+	}
+}
+
+// consume gives back the message it could not send
+func (s *Server) consume(st *stream) error {
+
+	req := &ConsumeRequest{}
+	if err := st.Recv(req); err != nil {
+		if err == io.EOF {
+			return Errorf(InvalidArgument, "missing request")
+		}
+		return err
+	}
+
+	q, err := s.Queues.GetQueue(req.Queue)
+	if err != nil {
+		return err
+	}
+
+	c, untrack := trackClient(st, req.Queue, "grpc.Consume")
+	defer untrack()
+
+	st.sendHeader()
+	if f, ok := st.w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	for n := int64(0); req.Limit == 0 || n < req.Limit; n++ {
+
+		message, err := q.ReadMessage(st.ctx)
+		if err != nil && st.r.Context().Err() != nil {
+			return err // client is gone
+		}
+		if err == context.Canceled {
+			return Errorf(Unavailable, "server shutting down")
+		}
+		if err != nil {
+			return err
+		}
+
+		err = st.Send(&Message{
+			Id:           message.Id,
+			TimeUnixNano: message.Time.UnixNano(),
+			Headers:      message.Headers,
+			Payload:      message.Payload,
+		})
+		if err != nil {
+			q.Unread(message) // not delivered, give it back
+			return err
+		}
+
+		c.Reads++
+	}
+
+	return nil
+}
+
+// parseTimeout reads grpc-timeout, like 100m or 5S
+func parseTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
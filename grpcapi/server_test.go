@@ -0,0 +1,231 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+// testClient speaks gRPC with the bare minimum
+type testClient struct {
+	base   string
+	client *http.Client
+}
+
+// newTestServer serves HTTP/2 over TLS, as every Go version does
+func newTestServer(qs queue.Service) *httptest.Server {
+	s := httptest.NewUnstartedServer(NewServer(qs))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s
+}
+
+func newTestClient(s *httptest.Server) *testClient {
+	return &testClient{
+		base:   s.URL,
+		client: s.Client(),
+	}
+}
+
+func frame(m ProtoMessage) []byte {
+	data := m.Marshal()
+	f := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(f[1:], uint32(len(data)))
+	return append(f, data...)
+}
+
+func readFrame(r io.Reader, m ProtoMessage) error {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return m.Unmarshal(data)
+}
+
+func (c *testClient) open(method string, body io.Reader) *http.Response {
+	req, _ := http.NewRequest("POST", c.base+"/"+ServiceName+"/"+method, body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	res, err := c.client.Do(req)
+	biff.AssertNil(err)
+	return res
+}
+
+// status reads the body until the end and returns the grpc status
+func status(res *http.Response) (Code, string) {
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	s := res.Trailer.Get("Grpc-Status")
+	message := res.Trailer.Get("Grpc-Message")
+	if s == "" { // trailers-only
+		s = res.Header.Get("Grpc-Status")
+		message = res.Header.Get("Grpc-Message")
+	}
+	code, _ := strconv.Atoi(s)
+	return Code(code), decodeMessage(message)
+}
+
+func (c *testClient) unary(method string, req, res ProtoMessage) Code {
+	r := c.open(method, bytes.NewReader(frame(req)))
+	readFrame(r.Body, res)
+	code, _ := status(r)
+	return code
+}
+
+func TestServer(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+
+		s := newTestServer(qs)
+		defer s.Close()
+
+		c := newTestClient(s)
+
+		a.Alternative("Create queue", func(a *biff.A) {
+			code := c.unary("CreateQueue", &CreateQueueRequest{Name: "my-queue"}, &CreateQueueResponse{})
+			biff.AssertEqual(code, OK)
+
+			list := &ListQueuesResponse{}
+			biff.AssertEqual(c.unary("ListQueues", &ListQueuesRequest{}, list), OK)
+			biff.AssertEqual(list.Names, []string{"my-queue"})
+
+			a.Alternative("Create again", func(a *biff.A) {
+				r := c.open("CreateQueue", bytes.NewReader(frame(&CreateQueueRequest{Name: "my-queue"})))
+				code, message := status(r)
+				biff.AssertEqual(code, AlreadyExists)
+				biff.AssertEqual(message, "queue already exists: 'my-queue'")
+			})
+
+			a.Alternative("Delete", func(a *biff.A) {
+				code := c.unary("DeleteQueue", &DeleteQueueRequest{Name: "my-queue"}, &DeleteQueueResponse{})
+				biff.AssertEqual(code, OK)
+
+				code = c.unary("RetrieveQueue", &RetrieveQueueRequest{Name: "my-queue"}, &Queue{})
+				biff.AssertEqual(code, NotFound)
+			})
+
+			a.Alternative("Publish and consume", func(a *biff.A) {
+				body, writer := io.Pipe()
+				r := c.open("Publish", body)
+
+				writer.Write(frame(&PublishRequest{Queue: "my-queue", Payload: []byte(`{"n":1}`), Ref: "a"}))
+				published := &PublishResponse{}
+				biff.AssertNil(readFrame(r.Body, published))
+				biff.AssertEqual(published.Ref, "a")
+				biff.AssertEqual(published.Id, uint64(1))
+
+				writer.Write(frame(&PublishRequest{Payload: []byte(`"two"`), Headers: map[string]string{"k": "v"}}))
+				biff.AssertNil(readFrame(r.Body, published))
+				biff.AssertEqual(published.Id, uint64(2))
+
+				writer.Close()
+				code, _ := status(r)
+				biff.AssertEqual(code, OK)
+
+				info := &Queue{}
+				biff.AssertEqual(c.unary("RetrieveQueue", &RetrieveQueueRequest{Name: "my-queue"}, info), OK)
+				biff.AssertEqual(info.Len, int64(2))
+				biff.AssertEqual(info.Writes, int64(2))
+
+				r = c.open("Consume", bytes.NewReader(frame(&ConsumeRequest{Queue: "my-queue", Limit: 2})))
+				first, second := &Message{}, &Message{}
+				biff.AssertNil(readFrame(r.Body, first))
+				biff.AssertNil(readFrame(r.Body, second))
+				code, _ = status(r)
+				biff.AssertEqual(code, OK)
+
+				biff.AssertEqual(string(first.Payload), `{"n":1}`)
+				biff.AssertEqual(second.Headers, map[string]string{"k": "v"})
+				biff.AssertTrue(second.TimeUnixNano > 0)
+			})
+
+			a.Alternative("Publish invalid JSON", func(a *biff.A) {
+				r := c.open("Publish", bytes.NewReader(frame(&PublishRequest{Queue: "my-queue", Payload: []byte(`{`)})))
+				code, _ := status(r)
+				biff.AssertEqual(code, InvalidArgument)
+			})
+
+			a.Alternative("Consume timeout", func(a *biff.A) {
+				req, _ := http.NewRequest("POST", c.base+"/"+ServiceName+"/Consume", bytes.NewReader(frame(&ConsumeRequest{Queue: "my-queue"})))
+				req.Header.Set("Content-Type", "application/grpc")
+				req.Header.Set("Grpc-Timeout", "20m")
+				r, err := c.client.Do(req)
+				biff.AssertNil(err)
+
+				code, _ := status(r)
+				biff.AssertEqual(code, DeadlineExceeded)
+			})
+
+			a.Alternative("Consume drained", func(a *biff.A) {
+				done := make(chan Code)
+				go func() {
+					code, _ := status(c.open("Consume", bytes.NewReader(frame(&ConsumeRequest{Queue: "my-queue"}))))
+					done <- code
+				}()
+
+				for api.ActiveClients() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+				defer cancel()
+				api.Drain(ctx)
+
+				biff.AssertEqual(<-done, Unavailable)
+			})
+		})
+
+		a.Alternative("Unknown method", func(a *biff.A) {
+			code, _ := status(c.open("Invented", bytes.NewReader(nil)))
+			biff.AssertEqual(code, Unimplemented)
+		})
+	})
+}
+
+func TestWire(t *testing.T) {
+
+	m := &Message{
+		Id:           300,
+		TimeUnixNano: -1,
+		Headers:      map[string]string{"a": "1", "b": ""},
+		Payload:      []byte(`{}`),
+	}
+
+	decoded := &Message{}
+	biff.AssertNil(decoded.Unmarshal(m.Marshal()))
+	biff.AssertEqual(decoded, m)
+
+	// Field 2 varint 150
+	r := &PublishResponse{}
+	biff.AssertNil(r.Unmarshal([]byte{0x10, 0x96, 0x01}))
+	biff.AssertEqual(r.Id, uint64(150))
+
+	biff.AssertNotNil(r.Unmarshal([]byte{0x12, 0x05, 'a'}))
+}
+
+func TestParseTimeout(t *testing.T) {
+
+	d, ok := parseTimeout("100m")
+	biff.AssertTrue(ok)
+	biff.AssertEqual(d, 100*time.Millisecond)
+
+	_, ok = parseTimeout("1x")
+	biff.AssertTrue(!ok)
+}
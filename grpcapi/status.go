@@ -0,0 +1,97 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// Code is a gRPC status code
+type Code int
+
+const (
+	OK                Code = 0
+	Canceled          Code = 1
+	Unknown           Code = 2
+	InvalidArgument   Code = 3
+	DeadlineExceeded  Code = 4
+	NotFound          Code = 5
+	AlreadyExists     Code = 6
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+	Unauthenticated   Code = 16
+)
+
+// Status is an error with a gRPC code, sent in the grpc-status and
+// grpc-message trailers
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", s.Code, s.Message)
+}
+
+func Errorf(code Code, format string, a ...interface{}) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+var statusMappings = []struct {
+	err  error
+	code Code
+}{
+	{queue.ErrQueueNotFound, NotFound},
+	{queue.ErrQueueAlreadyExists, AlreadyExists},
+	{queue.ErrInvalidQueueName, InvalidArgument},
+	{queue.ErrQueueFull, ResourceExhausted},
+	{queue.ErrMessageTooLarge, ResourceExhausted},
+	{queue.ErrUnauthorized, Unauthenticated},
+	{context.Canceled, Canceled},
+	{context.DeadlineExceeded, DeadlineExceeded},
+}
+
+// statusFromError maps queue errors to codes, unknown errors are internal
+func statusFromError(err error) *Status {
+
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	}
+
+	for _, m := range statusMappings {
+		if errors.Is(err, m.err) {
+			return &Status{Code: m.code, Message: err.Error()}
+		}
+	}
+
+	return &Status{Code: Internal, Message: err.Error()}
+}
+
+// encodeMessage percent-encodes grpc-message as the spec requires
+func encodeMessage(s string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func decodeMessage(s string) string {
+	d, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return d
+}
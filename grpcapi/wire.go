@@ -0,0 +1,148 @@
+package grpcapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Protocol buffers wire format, only what tailon.proto needs
+
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+	wire32     = 5
+)
+
+var errMalformed = errors.New("malformed protobuf message")
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) tag(field, wireType int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field)<<3|uint64(wireType))
+}
+
+// Zero values are not encoded, as in proto3
+
+func (e *encoder) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+func (e *encoder) int64(field int, v int64) {
+	e.uint64(field, uint64(v))
+}
+
+func (e *encoder) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) string(field int, v string) {
+	e.bytes(field, []byte(v))
+}
+
+// strings encodes a repeated string, empty strings included
+func (e *encoder) strings(field int, v []string) {
+	for _, s := range v {
+		e.tag(field, wireBytes)
+		e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+		e.b = append(e.b, s...)
+	}
+}
+
+// stringMap encodes a map<string, string> sorted by key
+func (e *encoder) stringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		entry := &encoder{}
+		entry.string(1, k)
+		entry.string(2, m[k])
+		e.tag(field, wireBytes)
+		e.b = binary.AppendUvarint(e.b, uint64(len(entry.b)))
+		e.b = append(e.b, entry.b...)
+	}
+}
+
+// decode calls f for every field, v is set for varints and data for length
+// delimited fields. Fixed size fields are skipped.
+func decode(b []byte, f func(field, wireType int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformed
+		}
+		b = b[n:]
+
+		field, wireType := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+
+		switch wireType {
+		case wireVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errMalformed
+			}
+			b = b[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errMalformed
+			}
+			data = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case wire64:
+			if len(b) < 8 {
+				return errMalformed
+			}
+			b = b[8:]
+			continue
+		case wire32:
+			if len(b) < 4 {
+				return errMalformed
+			}
+			b = b[4:]
+			continue
+		default:
+			return errMalformed
+		}
+
+		if err := f(field, wireType, v, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeMapEntry adds a map<string, string> entry to m
+func decodeMapEntry(data []byte, m map[string]string) error {
+	var key, value string
+	err := decode(data, func(field, wireType int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			key = string(data)
+		case 2:
+			value = string(data)
+		}
+		return nil
+	})
+	m[key] = value
+	return err
+}
@@ -0,0 +1,462 @@
+// Package kv is an embedded key-value store with transactions, in pure Go.
+//
+// Keys are kept sorted in memory and every committed transaction is
+// appended to a log file as a single record with a checksum, synced to
+// disk before Update returns. Opening the file replays the log, a record
+// torn by a crash is discarded with its whole transaction. Once the log
+// is mostly overwritten and deleted keys it is compacted: rewritten with
+// the live keys only and swapped atomically.
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultCompactSize is the minimum log size before it is compacted
+const DefaultCompactSize = 64 << 20
+
+type Options struct {
+	// NoSync does not wait for commits to reach the disk, the last ones
+	// can be lost if the machine crashes
+	NoSync bool
+
+	// CompactSize is the minimum log size before it is compacted, once it
+	// also doubles the live data
+	CompactSize int64
+}
+
+var (
+	ErrClosed   = errors.New("kv: database closed")
+	ErrReadOnly = errors.New("kv: read-only transaction")
+	ErrCorrupt  = errors.New("kv: corrupt log")
+)
+
+// Kinds of op in a record
+const (
+	opPut    = 1
+	opDelete = 2
+)
+
+// recordHeader is the payload length and its CRC-32C
+const recordHeader = 8
+
+// overhead approximates the bytes of a record per key, to tell how much of
+// the log is live
+const overhead = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// DB is safe for concurrent use. Writers go one at a time, readers wait
+// for the writer and see only committed transactions.
+type DB struct {
+	mutex   sync.RWMutex
+	path    string
+	options Options
+	file    *os.File
+	size    int64 // of the log
+	live    int64 // bytes of the live keys in the log
+	index   *skiplist
+	closed  bool
+}
+
+// Open creates the file if missing. A torn record at the end of the log
+// is removed, corruption anywhere else is an error.
+func Open(path string, options *Options) (*DB, error) {
+
+	db := &DB{path: path, index: newSkiplist()}
+	if options != nil {
+		db.options = *options
+	}
+	if db.options.CompactSize <= 0 {
+		db.options.CompactSize = DefaultCompactSize
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := db.replay(file)
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	db.file = file
+	db.size = size
+
+	return db, nil
+}
+
+// replay applies every complete record and returns where they end
+func (db *DB) replay(file *os.File) (int64, error) {
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReaderSize(file, 1<<20)
+	header := make([]byte, recordHeader)
+	offset := int64(0)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return offset, nil // end, or torn header
+		}
+		length := int64(binary.LittleEndian.Uint32(header))
+		sum := binary.LittleEndian.Uint32(header[4:])
+		end := offset + recordHeader + length
+		if end > info.Size() {
+			return offset, nil // torn payload
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, err
+		}
+		if crc32.Checksum(payload, castagnoli) != sum {
+			if end == info.Size() {
+				return offset, nil // last record was being written
+			}
+			return 0, fmt.Errorf("%w: bad checksum at offset %d", ErrCorrupt, offset)
+		}
+
+		err := decode(payload, func(kind byte, key, value []byte) {
+			if kind == opPut {
+				db.put(string(key), value)
+			} else {
+				db.remove(string(key))
+			}
+		})
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s at offset %d", ErrCorrupt, err, offset)
+		}
+
+		offset = end
+	}
+}
+
+// put and remove change the index keeping live up to date
+func (db *DB) put(key string, value []byte) ([]byte, bool) {
+	old, existed := db.index.set(key, value)
+	if existed {
+		db.live -= int64(len(old))
+	} else {
+		db.live += int64(len(key) + overhead)
+	}
+	db.live += int64(len(value))
+	return old, existed
+}
+
+func (db *DB) remove(key string) ([]byte, bool) {
+	old, existed := db.index.delete(key)
+	if existed {
+		db.live -= int64(len(key) + len(old) + overhead)
+	}
+	return old, existed
+}
+
+// View runs f with a read-only transaction
+func (db *DB) View(f func(tx *Tx) error) error {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	return f(&Tx{db: db})
+}
+
+// Update runs f with a writable transaction, committed if f returns nil
+// and rolled back otherwise. Once it returns the changes are on disk,
+// unless Options.NoSync.
+func (db *DB) Update(f func(tx *Tx) error) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	tx := &Tx{db: db, writable: true}
+	defer tx.rollback() // unless committed, also if f panics
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	if len(tx.record) == 0 {
+		return nil // nothing changed
+	}
+
+	if err := db.append(tx.record); err != nil {
+		return err
+	}
+	tx.undo = nil
+
+	if db.size > db.options.CompactSize && db.size > 2*db.live {
+		// The commit is durable already, a failed compaction is retried
+		// on the next one
+		db.compact()
+	}
+
+	return nil
+}
+
+// append writes a record, a failed write is cut from the log
+func (db *DB) append(payload []byte) error {
+
+	record := make([]byte, recordHeader, recordHeader+len(payload))
+	binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(payload, castagnoli))
+	record = append(record, payload...)
+
+	_, err := db.file.Write(record)
+	if err == nil && !db.options.NoSync {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		db.file.Truncate(db.size)
+		db.file.Seek(db.size, io.SeekStart)
+		return err
+	}
+
+	db.size += int64(len(record))
+
+	return nil
+}
+
+// Compact rewrites the log with the live keys only
+func (db *DB) Compact() error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.compact()
+}
+
+// compact must be called with the mutex held. The new log replaces the old
+// one once it is complete and synced.
+func (db *DB) compact() error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), filepath.Base(db.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+
+	compacted := &DB{file: tmp, options: Options{NoSync: true}}
+
+	// Records of about 1MB, they only need to be atomic together
+	payload := []byte{}
+	for x := db.index.head.next[0]; x != nil && err == nil; x = x.next[0] {
+		payload = encode(payload, opPut, []byte(x.key), x.value)
+		if len(payload) >= 1<<20 || x.next[0] == nil {
+			err = compacted.append(payload)
+			payload = payload[:0]
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.path)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// The rename is durable with the directory, until then a crash leaves
+	// the old log, which is as valid
+	syncDir(filepath.Dir(db.path))
+
+	db.file.Close()
+	db.file = tmp
+	db.size = compacted.size
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Size is the length of the log file
+func (db *DB) Size() int64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.size
+}
+
+func (db *DB) Close() error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	return db.file.Close()
+}
+
+// Tx is valid only within View or Update. Values returned must not be
+// modified.
+type Tx struct {
+	db       *DB
+	writable bool
+	record   []byte // ops to log
+	undo     []undo
+}
+
+type undo struct {
+	key     string
+	value   []byte
+	existed bool
+}
+
+func (tx *Tx) Get(key []byte) []byte {
+	value, _ := tx.db.index.get(string(key))
+	return value
+}
+
+// Put keeps value, it must not be modified afterwards
+func (tx *Tx) Put(key, value []byte) error {
+
+	if !tx.writable {
+		return ErrReadOnly
+	}
+
+	old, existed := tx.db.put(string(key), value)
+	tx.undo = append(tx.undo, undo{key: string(key), value: old, existed: existed})
+	tx.record = encode(tx.record, opPut, key, value)
+
+	return nil
+}
+
+func (tx *Tx) Delete(key []byte) error {
+
+	if !tx.writable {
+		return ErrReadOnly
+	}
+
+	old, existed := tx.db.remove(string(key))
+	if !existed {
+		return nil
+	}
+	tx.undo = append(tx.undo, undo{key: string(key), value: old, existed: true})
+	tx.record = encode(tx.record, opDelete, key, nil)
+
+	return nil
+}
+
+// Scan calls f with the keys that have prefix, from start on if it is
+// greater, in order until f returns false. Keys must not be changed while
+// scanning.
+func (tx *Tx) Scan(prefix, start []byte, f func(key, value []byte) bool) {
+
+	from := prefix
+	if bytes.Compare(start, prefix) > 0 {
+		from = start
+	}
+
+	for x := tx.db.index.seek(string(from), nil); x != nil; x = x.next[0] {
+		key := []byte(x.key)
+		if !bytes.HasPrefix(key, prefix) || !f(key, x.value) {
+			return
+		}
+	}
+}
+
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := tx.undo[i]
+		if u.existed {
+			tx.db.put(u.key, u.value)
+		} else {
+			tx.db.remove(u.key)
+		}
+	}
+	tx.undo = nil
+	tx.record = nil
+}
+
+// encode appends an op: kind, key length, key and, for puts, value length
+// and value. Lengths are uvarints.
+func encode(b []byte, kind byte, key, value []byte) []byte {
+	b = append(b, kind)
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	if kind == opPut {
+		b = binary.AppendUvarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+	return b
+}
+
+func decode(b []byte, f func(kind byte, key, value []byte)) error {
+
+	field := func() ([]byte, error) {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || uint64(len(b)-size) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		field := b[size : size+int(n)]
+		b = b[size+int(n):]
+		return field, nil
+	}
+
+	for len(b) > 0 {
+		kind := b[0]
+		b = b[1:]
+
+		key, err := field()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case opPut:
+			value, err := field()
+			if err != nil {
+				return err
+			}
+			f(kind, key, bytes.Clone(value))
+		case opDelete:
+			f(kind, key, nil)
+		default:
+			return fmt.Errorf("unknown op %d", kind)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fulldump/biff"
+)
+
+func keys(db *DB, prefix, start string) []string {
+	result := []string{}
+	db.View(func(tx *Tx) error {
+		tx.Scan([]byte(prefix), []byte(start), func(key, value []byte) bool {
+			result = append(result, string(key)+"="+string(value))
+			return true
+		})
+		return nil
+	})
+	return result
+}
+
+func TestDB(t *testing.T) {
+
+	biff.Alternative("Open", func(a *biff.A) {
+
+		path := filepath.Join(t.TempDir(), "tailon.kv") // new for every alternative
+		db, err := Open(path, nil)
+		biff.AssertNil(err)
+		defer func() { db.Close() }()
+
+		err = db.Update(func(tx *Tx) error {
+			tx.Put([]byte("a/2"), []byte("two"))
+			tx.Put([]byte("a/1"), []byte("one"))
+			tx.Put([]byte("b/1"), []byte("three"))
+			return nil
+		})
+		biff.AssertNil(err)
+
+		a.Alternative("Scan", func(a *biff.A) {
+			biff.AssertEqual(keys(db, "a/", ""), []string{"a/1=one", "a/2=two"})
+			biff.AssertEqual(keys(db, "a/", "a/2"), []string{"a/2=two"})
+			biff.AssertEqual(keys(db, "", ""), []string{"a/1=one", "a/2=two", "b/1=three"})
+			biff.AssertEqual(keys(db, "c/", ""), []string{})
+		})
+
+		a.Alternative("Get", func(a *biff.A) {
+			db.View(func(tx *Tx) error {
+				biff.AssertEqual(string(tx.Get([]byte("a/1"))), "one")
+				biff.AssertNil(tx.Get([]byte("a/3")))
+				return nil
+			})
+		})
+
+		a.Alternative("Read-only", func(a *biff.A) {
+			err := db.View(func(tx *Tx) error {
+				return tx.Put([]byte("a/3"), []byte("three"))
+			})
+			biff.AssertTrue(errors.Is(err, ErrReadOnly))
+		})
+
+		a.Alternative("Rollback", func(a *biff.A) {
+			failed := errors.New("failed")
+			err := db.Update(func(tx *Tx) error {
+				tx.Put([]byte("a/1"), []byte("changed"))
+				tx.Put([]byte("a/3"), []byte("three"))
+				tx.Delete([]byte("a/2"))
+				return failed
+			})
+			biff.AssertEqual(err, failed)
+			biff.AssertEqual(keys(db, "a/", ""), []string{"a/1=one", "a/2=two"})
+
+			db.Close()
+			db, err = Open(path, nil)
+			biff.AssertNil(err)
+			biff.AssertEqual(keys(db, "a/", ""), []string{"a/1=one", "a/2=two"})
+		})
+
+		a.Alternative("Reopen", func(a *biff.A) {
+			db.Update(func(tx *Tx) error {
+				tx.Delete([]byte("a/1"))
+				return tx.Put([]byte("b/1"), []byte("changed"))
+			})
+			db.Close()
+
+			db, err = Open(path, nil)
+			biff.AssertNil(err)
+			biff.AssertEqual(keys(db, "", ""), []string{"a/2=two", "b/1=changed"})
+		})
+
+		a.Alternative("Closed", func(a *biff.A) {
+			db.Close()
+			err := db.View(func(tx *Tx) error { return nil })
+			biff.AssertTrue(errors.Is(err, ErrClosed))
+		})
+	})
+}
+
+func TestDB_TornRecord(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tailon.kv")
+
+	db, _ := Open(path, nil)
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("a"), []byte("1")) })
+	size := db.Size()
+	db.Update(func(tx *Tx) error {
+		tx.Put([]byte("b"), []byte("2"))
+		return tx.Put([]byte("c"), []byte("3"))
+	})
+	db.Close()
+
+	// A crash while writing the second transaction
+	os.Truncate(path, size+10)
+
+	db, err := Open(path, nil)
+	biff.AssertNil(err)
+	biff.AssertEqual(keys(db, "", ""), []string{"a=1"})
+	biff.AssertEqual(db.Size(), size)
+
+	err = db.Update(func(tx *Tx) error { return tx.Put([]byte("d"), []byte("4")) })
+	biff.AssertNil(err)
+	db.Close()
+
+	db, err = Open(path, nil)
+	biff.AssertNil(err)
+	biff.AssertEqual(keys(db, "", ""), []string{"a=1", "d=4"})
+	db.Close()
+}
+
+func TestDB_Corrupt(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tailon.kv")
+
+	db, _ := Open(path, nil)
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("a"), []byte("1")) })
+	db.Update(func(tx *Tx) error { return tx.Put([]byte("b"), []byte("2")) })
+	db.Close()
+
+	data, _ := os.ReadFile(path)
+	data[recordHeader] ^= 0xff // first record
+	os.WriteFile(path, data, 0o644)
+
+	_, err := Open(path, nil)
+	biff.AssertTrue(errors.Is(err, ErrCorrupt))
+}
+
+func TestDB_Compact(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tailon.kv")
+
+	db, err := Open(path, &Options{NoSync: true, CompactSize: 4096})
+	biff.AssertNil(err)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Update(func(tx *Tx) error {
+			tx.Delete([]byte(fmt.Sprintf("key-%d", i-1)))
+			return tx.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		})
+		biff.AssertNil(err)
+	}
+	biff.AssertTrue(db.Size() < 8192) // compacted on the way
+
+	biff.AssertNil(db.Compact())
+	db.Close()
+
+	db, err = Open(path, nil)
+	biff.AssertNil(err)
+	biff.AssertEqual(keys(db, "", ""), []string{"key-999=value"})
+	db.Close()
+
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+	biff.AssertEqual(len(files), 1) // no temporary files left
+}
@@ -0,0 +1,96 @@
+package kv
+
+import (
+	"math/bits"
+	"math/rand/v2"
+)
+
+const maxLevel = 24
+
+// skiplist keeps the keys sorted, inserts and deletes are O(log n)
+type skiplist struct {
+	head  *node
+	level int
+	len   int
+}
+
+type node struct {
+	key   string
+	value []byte
+	next  []*node
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{head: &node{next: make([]*node, maxLevel)}, level: 1}
+}
+
+// seek returns the first node with a key >= key, filling update with the
+// last node before it in every level if not nil
+func (s *skiplist) seek(key string, update []*node) *node {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (s *skiplist) get(key string) ([]byte, bool) {
+	x := s.seek(key, nil)
+	if x == nil || x.key != key {
+		return nil, false
+	}
+	return x.value, true
+}
+
+// set returns the previous value
+func (s *skiplist) set(key string, value []byte) ([]byte, bool) {
+
+	update := make([]*node, maxLevel)
+	x := s.seek(key, update)
+	if x != nil && x.key == key {
+		old := x.value
+		x.value = value
+		return old, true
+	}
+
+	// Every level has half the nodes of the one below
+	level := min(1+bits.TrailingZeros64(rand.Uint64()), maxLevel)
+	for i := s.level; i < level; i++ {
+		update[i] = s.head
+	}
+	s.level = max(s.level, level)
+
+	x = &node{key: key, value: value, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = update[i].next[i]
+		update[i].next[i] = x
+	}
+	s.len++
+
+	return nil, false
+}
+
+// delete returns the deleted value
+func (s *skiplist) delete(key string) ([]byte, bool) {
+
+	update := make([]*node, maxLevel)
+	x := s.seek(key, update)
+	if x == nil || x.key != key {
+		return nil, false
+	}
+
+	for i := 0; i < len(x.next); i++ {
+		update[i].next[i] = x.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.len--
+
+	return x.value, true
+}
@@ -0,0 +1,363 @@
+// Package metrics implements the minimum of Prometheus client needed by
+// tailon: counters, gauges, histograms and values computed on scrape, all
+// exposed in the text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	mutex   sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: map[string]bool{},
+	}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.names[name] {
+		panic("metric '" + name + "' already registered")
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all metrics in Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mutex.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+	return err
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric '%s' expects %d labels, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series is a single time series of a metric
+type series struct {
+	labels []string
+	value  float64
+}
+
+// vector is a set of series indexed by label values
+type vector struct {
+	desc
+	series map[string]*series
+	mutex  sync.Mutex
+}
+
+func (v *vector) get(values []string) *series {
+	k := v.key(values)
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		v.series[k] = s
+	}
+	return s
+}
+
+func (v *vector) write(w io.Writer) error {
+	v.mutex.Lock()
+	all := make([]series, 0, len(v.series))
+	for _, s := range v.series {
+		all = append(all, *s)
+	}
+	v.mutex.Unlock()
+
+	sortSeries(all)
+
+	if err := v.header(w); err != nil {
+		return err
+	}
+	for _, s := range all {
+		if err := writeSample(w, v.name, v.labels, s.labels, "", "", s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Counter struct {
+	vector
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vector{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		series: map[string]*series{},
+	}}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.mutex.Lock()
+	c.get(labelValues).value += value
+	c.mutex.Unlock()
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+type Gauge struct {
+	vector
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vector{
+		desc:   desc{name: name, help: help, kind: "gauge", labels: labels},
+		series: map[string]*series{},
+	}}
+	r.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	g.get(labelValues).value = value
+	g.mutex.Unlock()
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	g.get(labelValues).value += value
+	g.mutex.Unlock()
+}
+
+// Observe is the callback passed to functional metrics to emit each series.
+type Observe func(value float64, labelValues ...string)
+
+type function struct {
+	desc
+	f func(Observe)
+}
+
+// NewGaugeFunc registers a gauge computed on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, f func(Observe)) {
+	r.register(name, &function{
+		desc: desc{name: name, help: help, kind: "gauge", labels: labels},
+		f:    f,
+	})
+}
+
+// NewCounterFunc registers a counter read on every scrape, typically from
+// counters kept somewhere else.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, f func(Observe)) {
+	r.register(name, &function{
+		desc: desc{name: name, help: help, kind: "counter", labels: labels},
+		f:    f,
+	})
+}
+
+func (m *function) write(w io.Writer) error {
+	all := []series{}
+	m.f(func(value float64, labelValues ...string) {
+		m.key(labelValues) // check cardinality
+		all = append(all, series{labels: labelValues, value: value})
+	})
+
+	sortSeries(all)
+
+	if err := m.header(w); err != nil {
+		return err
+	}
+	for _, s := range all {
+		if err := writeSample(w, m.name, m.labels, s.labels, "", "", s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+	mutex   sync.Mutex
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // not cumulative, last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	k := h.key(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{
+			labels: append([]string{}, labelValues...),
+			counts: make([]uint64, len(h.buckets)+1),
+		}
+		h.series[k] = s
+	}
+
+	i := sort.SearchFloat64s(h.buckets, value)
+	s.counts[i]++
+	s.sum += value
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mutex.Lock()
+	all := make([]histogramSeries, 0, len(h.series))
+	for _, s := range h.series {
+		c := *s
+		c.counts = append([]uint64{}, s.counts...)
+		all = append(all, c)
+	}
+	h.mutex.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labels, "\xff") < strings.Join(all[j].labels, "\xff")
+	})
+
+	if err := h.header(w); err != nil {
+		return err
+	}
+	for _, s := range all {
+		cumulative := uint64(0)
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			err := writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", formatFloat(le), float64(cumulative))
+			if err != nil {
+				return err
+			}
+		}
+		if err := writeSample(w, h.name+"_sum", h.labels, s.labels, "", "", s.sum); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_count", h.labels, s.labels, "", "", float64(s.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortSeries(all []series) {
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labels, "\xff") < strings.Join(all[j].labels, "\xff")
+	})
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, extraLabel, extraValue string, value float64) error {
+	b := strings.Builder{}
+	b.WriteString(name)
+
+	if len(labels) > 0 || extraLabel != "" {
+		b.WriteString("{")
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(extraLabel + `="` + escapeLabel(extraValue) + `"`)
+		}
+		b.WriteString("}")
+	}
+
+	b.WriteString(" " + formatFloat(value) + "\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fulldump/biff"
+)
+
+func TestCounter(t *testing.T) {
+
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Total requests.", "method")
+	c.Inc("GET")
+	c.Add(2, "POST")
+	c.Inc("GET")
+
+	b := &strings.Builder{}
+	biff.AssertNil(r.WriteText(b))
+
+	biff.AssertEqual(b.String(), ""+
+		"# HELP requests_total Total requests.\n"+
+		"# TYPE requests_total counter\n"+
+		"requests_total{method=\"GET\"} 2\n"+
+		"requests_total{method=\"POST\"} 2\n")
+}
+
+func TestGauge_NoLabels(t *testing.T) {
+
+	r := NewRegistry()
+	g := r.NewGauge("temperature", "Current temperature.")
+	g.Set(21.5)
+
+	b := &strings.Builder{}
+	r.WriteText(b)
+
+	biff.AssertEqual(b.String(), ""+
+		"# HELP temperature Current temperature.\n"+
+		"# TYPE temperature gauge\n"+
+		"temperature 21.5\n")
+}
+
+func TestGaugeFunc_Escape(t *testing.T) {
+
+	r := NewRegistry()
+	r.NewGaugeFunc("queue_messages", "Pending messages.", []string{"queue"}, func(observe Observe) {
+		observe(3, `a "quoted" \ name`)
+	})
+
+	b := &strings.Builder{}
+	r.WriteText(b)
+
+	biff.AssertTrue(strings.Contains(b.String(), `queue_messages{queue="a \"quoted\" \\ name"} 3`))
+}
+
+func TestHistogram(t *testing.T) {
+
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	b := &strings.Builder{}
+	r.WriteText(b)
+
+	biff.AssertEqual(b.String(), ""+
+		"# HELP latency_seconds Latency.\n"+
+		"# TYPE latency_seconds histogram\n"+
+		"latency_seconds_bucket{le=\"0.1\"} 2\n"+
+		"latency_seconds_bucket{le=\"1\"} 3\n"+
+		"latency_seconds_bucket{le=\"+Inf\"} 4\n"+
+		"latency_seconds_sum 5.65\n"+
+		"latency_seconds_count 4\n")
+}
+
+func TestRegistry_Duplicated(t *testing.T) {
+
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Total requests.")
+
+	defer func() {
+		biff.AssertNotNil(recover())
+	}()
+
+	r.NewCounter("requests_total", "Total requests.")
+}
+
+func TestRegisterProcess(t *testing.T) {
+
+	r := NewRegistry()
+	RegisterProcess(r)
+
+	b := &strings.Builder{}
+	r.WriteText(b)
+
+	biff.AssertTrue(strings.Contains(b.String(), "\ngo_goroutines "))
+	biff.AssertTrue(strings.Contains(b.String(), "\nprocess_start_time_seconds "))
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegisterProcess adds Go runtime and process metrics to r.
+func RegisterProcess(r *Registry) {
+
+	start := time.Now()
+
+	r.NewGaugeFunc("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", nil, func(observe Observe) {
+		observe(float64(start.UnixNano()) / 1e9)
+	})
+
+	r.NewCounterFunc("process_cpu_seconds_total", "Total user and system CPU time spent in seconds.", nil, func(observe Observe) {
+		if s, ok := cpuSeconds(); ok {
+			observe(s)
+		}
+	})
+
+	r.NewGaugeFunc("process_resident_memory_bytes", "Resident memory size in bytes.", nil, func(observe Observe) {
+		if rss, ok := residentMemory(); ok {
+			observe(rss)
+		}
+	})
+
+	r.NewGaugeFunc("process_open_fds", "Number of open file descriptors.", nil, func(observe Observe) {
+		if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+			observe(float64(len(fds)))
+		}
+	})
+
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", nil, func(observe Observe) {
+		observe(float64(runtime.NumGoroutine()))
+	})
+
+	r.NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", nil, func(observe Observe) {
+		observe(float64(memStats().Alloc))
+	})
+
+	r.NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from system.", nil, func(observe Observe) {
+		observe(float64(memStats().Sys))
+	})
+
+	r.NewGaugeFunc("go_memstats_heap_objects", "Number of allocated objects.", nil, func(observe Observe) {
+		observe(float64(memStats().HeapObjects))
+	})
+
+	r.NewCounterFunc("go_gc_cycles_total", "Number of completed GC cycles.", nil, func(observe Observe) {
+		observe(float64(memStats().NumGC))
+	})
+}
+
+func memStats() *runtime.MemStats {
+	m := &runtime.MemStats{}
+	runtime.ReadMemStats(m)
+	return m
+}
+
+// residentMemory only works where /proc is available
+func residentMemory() (float64, bool) {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * float64(os.Getpagesize()), true
+}
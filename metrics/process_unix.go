@@ -0,0 +1,15 @@
+//go:build unix
+
+package metrics
+
+import "syscall"
+
+func cpuSeconds() (float64, bool) {
+	u := syscall.Rusage{}
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &u); err != nil {
+		return 0, false
+	}
+	user := float64(u.Utime.Sec) + float64(u.Utime.Usec)/1e6
+	system := float64(u.Stime.Sec) + float64(u.Stime.Usec)/1e6
+	return user + system, true
+}
@@ -0,0 +1,482 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+// TopicHeader keeps the topic of published messages
+const TopicHeader = "mqtt-topic"
+
+// ConnectTimeout is the time to send CONNECT after opening the connection
+var ConnectTimeout = 10 * time.Second
+
+var ErrInvalidPayload = errors.New("payload must be JSON or UTF-8 text")
+
+type will struct {
+	topic   string
+	payload []byte
+}
+
+type conn struct {
+	server    *Server
+	nc        net.Conn
+	reader    *bufio.Reader
+	clientId  string
+	keepAlive time.Duration
+	will      *will
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	writeMutex sync.Mutex
+
+	mutex         sync.Mutex
+	subscriptions map[string]*subscription // by filter
+	inflight      map[uint16]*delivery     // QoS 1 sent without PUBACK
+	lastPacketId  uint16
+	received      map[uint16]bool // QoS 2 received without PUBREL
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		server:        s,
+		nc:            nc,
+		reader:        bufio.NewReader(nc),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		subscriptions: map[string]*subscription{},
+		inflight:      map[uint16]*delivery{},
+		received:      map[uint16]bool{},
+	}
+}
+
+func (c *conn) Serve() {
+
+	defer close(c.done)
+	defer c.server.forget(c)
+	defer c.cleanup()
+
+	// Cancel closes the connection, Drain and Close use it
+	go func() {
+		<-c.ctx.Done()
+		c.nc.Close()
+	}()
+
+	if err := c.connect(); err != nil {
+		return
+	}
+
+	for {
+		if c.keepAlive > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+
+		p, err := readPacket(c.reader, c.server.MaxPacketSize)
+		if err != nil {
+			return
+		}
+
+		if p.kind == DISCONNECT {
+			c.will = nil
+			return
+		}
+
+		if err := c.handle(p); err != nil {
+			if c.ctx.Err() == nil {
+				log.Println("MQTT", c.clientId+":", err)
+			}
+			return
+		}
+	}
+}
+
+// Close cancels the connection and waits for Serve to return
+func (c *conn) Close() {
+	c.cancel()
+	<-c.done
+}
+
+func (c *conn) connect() error {
+
+	c.nc.SetReadDeadline(time.Now().Add(ConnectTimeout))
+	p, err := readPacket(c.reader, c.server.MaxPacketSize)
+	if err != nil {
+		return err
+	}
+	c.nc.SetReadDeadline(time.Time{})
+
+	if p.kind != CONNECT {
+		return fmt.Errorf("%w: expected CONNECT", ErrMalformedPacket)
+	}
+
+	d := &decoder{b: p.body}
+	protocol := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := d.uint16()
+	clientId := d.string()
+	if d.err != nil || protocol != "MQTT" || flags&0x01 != 0 {
+		return ErrMalformedPacket
+	}
+
+	if level != 4 {
+		c.write(&packet{kind: CONNACK, body: []byte{0, UnacceptableProtocolVersion}})
+		return fmt.Errorf("unsupported protocol level %d", level)
+	}
+
+	cleanSession := flags&0x02 != 0
+	if flags&0x04 != 0 {
+		c.will = &will{topic: d.string(), payload: d.bytes()}
+		if !validTopic(c.will.topic) {
+			return fmt.Errorf("%w: invalid will topic", ErrMalformedPacket)
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	// Username and password are accepted as they are
+
+	if clientId == "" {
+		if !cleanSession {
+			c.write(&packet{kind: CONNACK, body: []byte{0, IdentifierRejected}})
+			return errors.New("empty client id needs a clean session")
+		}
+		clientId = uuid.New().String()
+	}
+
+	c.clientId = clientId
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+
+	c.server.takeOver(c)
+
+	// Sessions are not kept, session present is always 0
+	return c.write(&packet{kind: CONNACK, body: []byte{0, Accepted}})
+}
+
+func (c *conn) write(p *packet) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.nc.Write(p.bytes())
+	return err
+}
+
+func (c *conn) handle(p *packet) error {
+
+	d := &decoder{b: p.body}
+
+	switch p.kind {
+	case PUBLISH:
+		return c.publish(p)
+
+	case PUBACK:
+		c.acknowledge(d.uint16())
+		return d.err
+
+	case PUBREL:
+		id := d.uint16()
+		if d.err != nil || p.flags != 0x02 {
+			return ErrMalformedPacket
+		}
+		c.mutex.Lock()
+		delete(c.received, id)
+		c.mutex.Unlock()
+		return c.write(&packet{kind: PUBCOMP, body: appendUint16(nil, id)})
+
+	case SUBSCRIBE:
+		if p.flags != 0x02 {
+			return ErrMalformedPacket
+		}
+		return c.subscribe(d)
+
+	case UNSUBSCRIBE:
+		if p.flags != 0x02 {
+			return ErrMalformedPacket
+		}
+		return c.unsubscribe(d)
+
+	case PINGREQ:
+		return c.write(&packet{kind: PINGRESP})
+	}
+
+	return fmt.Errorf("%w: unexpected packet type %d", ErrMalformedPacket, p.kind)
+}
+
+func (c *conn) publish(p *packet) error {
+
+	qos := (p.flags >> 1) & 0x03
+	if qos == 3 {
+		return fmt.Errorf("%w: invalid QoS", ErrMalformedPacket)
+	}
+
+	d := &decoder{b: p.body}
+	topic := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	if d.err != nil || !validTopic(topic) {
+		return fmt.Errorf("%w: invalid topic", ErrMalformedPacket)
+	}
+	payload := d.b
+
+	// A QoS 2 retransmission before PUBREL is already written
+	c.mutex.Lock()
+	duplicated := qos == 2 && c.received[id]
+	c.mutex.Unlock()
+
+	if !duplicated {
+		if err := c.store(topic, payload); err != nil {
+			return err
+		}
+	}
+
+	switch qos {
+	case 1:
+		return c.write(&packet{kind: PUBACK, body: appendUint16(nil, id)})
+	case 2:
+		c.mutex.Lock()
+		c.received[id] = true
+		c.mutex.Unlock()
+		return c.write(&packet{kind: PUBREC, body: appendUint16(nil, id)})
+	}
+
+	return nil
+}
+
+func (c *conn) store(topic string, payload []byte) error {
+
+	q, err := c.server.Queues.GetQueue(c.server.Topics.Queue(topic))
+	if err != nil {
+		return err
+	}
+
+	message, err := encode(payload)
+	if err != nil {
+		return err
+	}
+	message.Headers[TopicHeader] = topic
+
+	return q.WriteMessage(message)
+}
+
+func (c *conn) subscribe(d *decoder) error {
+
+	id := d.uint16()
+
+	type request struct {
+		filter string
+		qos    byte
+	}
+	requests := []request{}
+	for len(d.b) > 0 && d.err == nil {
+		requests = append(requests, request{filter: d.string(), qos: d.byte()})
+	}
+	if d.err != nil || len(requests) == 0 {
+		return ErrMalformedPacket
+	}
+
+	codes := make([]byte, len(requests))
+	started := []*subscription{}
+	for i, r := range requests {
+		if r.qos > 2 || !validFilter(r.filter) {
+			return ErrMalformedPacket
+		}
+
+		codes[i] = SubscribeFailure
+		name, ok := c.server.Topics.QueueForFilter(r.filter)
+		if !ok {
+			continue
+		}
+		q, err := c.server.Queues.GetQueue(name)
+		if err != nil {
+			continue
+		}
+
+		qos := r.qos
+		if qos > 1 {
+			qos = 1
+		}
+		codes[i] = qos
+
+		// A subscription to the same filter is replaced
+		c.mutex.Lock()
+		previous := c.subscriptions[r.filter]
+		delete(c.subscriptions, r.filter)
+		c.mutex.Unlock()
+		if previous != nil {
+			previous.stop()
+		}
+
+		started = append(started, c.newSubscription(r.filter, name, q, qos))
+	}
+
+	err := c.write(&packet{kind: SUBACK, body: append(appendUint16(nil, id), codes...)})
+
+	for _, s := range started {
+		close(s.ready)
+	}
+
+	return err
+}
+
+func (c *conn) unsubscribe(d *decoder) error {
+
+	id := d.uint16()
+	filters := []string{}
+	for len(d.b) > 0 && d.err == nil {
+		filters = append(filters, d.string())
+	}
+	if d.err != nil || len(filters) == 0 {
+		return ErrMalformedPacket
+	}
+
+	for _, filter := range filters {
+		c.mutex.Lock()
+		s := c.subscriptions[filter]
+		delete(c.subscriptions, filter)
+		c.mutex.Unlock()
+		if s != nil {
+			s.stop()
+		}
+	}
+
+	return c.write(&packet{kind: UNSUBACK, body: appendUint16(nil, id)})
+}
+
+func (c *conn) newSubscription(filter, name string, q queue.Queue, qos byte) *subscription {
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	s := &subscription{
+		conn:   c,
+		filter: filter,
+		queue:  q,
+		qos:    qos,
+		slots:  make(chan struct{}, DefaultInflight),
+		ready:  make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	// Drain closes the whole connection
+	s.client = api.NewClient(c.clientId+"/"+filter, name, "mqtt.SUBSCRIBE", c.nc.RemoteAddr().String(), c.cancel)
+
+	untrack := api.TrackClient(s.client)
+
+	c.mutex.Lock()
+	c.subscriptions[filter] = s
+	c.mutex.Unlock()
+
+	go func() {
+		defer close(s.done)
+		defer untrack()
+		s.run()
+	}()
+
+	return s
+}
+
+// acknowledge ignores unknown packet ids, they may belong to a subscription
+// that has ended
+func (c *conn) acknowledge(id uint16) {
+
+	c.mutex.Lock()
+	d := c.inflight[id]
+	delete(c.inflight, id)
+	if d != nil {
+		d.subscription.remove(d)
+	}
+	c.mutex.Unlock()
+
+	if d != nil {
+		<-d.subscription.slots
+	}
+}
+
+// nextPacketId must be called with mutex held
+func (c *conn) nextPacketId() uint16 {
+	for {
+		c.lastPacketId++
+		if c.lastPacketId == 0 {
+			continue
+		}
+		if _, used := c.inflight[c.lastPacketId]; !used {
+			return c.lastPacketId
+		}
+	}
+}
+
+// cleanup gives back every unacknowledged message and publishes the will
+// if the client did not disconnect
+func (c *conn) cleanup() {
+
+	c.cancel()
+
+	c.mutex.Lock()
+	subscriptions := c.subscriptions
+	c.subscriptions = map[string]*subscription{}
+	c.mutex.Unlock()
+
+	for _, s := range subscriptions {
+		s.stop()
+	}
+
+	c.nc.Close()
+
+	if c.will != nil {
+		if err := c.store(c.will.topic, c.will.payload); err != nil {
+			log.Println("MQTT", c.clientId, "will:", err)
+		}
+	}
+}
+
+// encode stores JSON payloads as they are and text as a JSON string with a
+// text/plain content type
+func encode(payload []byte) (*queue.Message, error) {
+
+	if json.Valid(payload) {
+		return &queue.Message{Headers: map[string]string{}, Payload: payload}, nil
+	}
+
+	if !utf8.Valid(payload) {
+		return nil, ErrInvalidPayload
+	}
+
+	text, _ := json.Marshal(string(payload))
+	return &queue.Message{
+		Headers: map[string]string{"content-type": "text/plain"},
+		Payload: text,
+	}, nil
+}
+
+func decode(message *queue.Message) []byte {
+
+	contentType := message.Headers["content-type"]
+	if contentType == "" || strings.HasPrefix(contentType, "application/json") {
+		return message.Payload
+	}
+
+	text := ""
+	if json.Unmarshal(message.Payload, &text) != nil {
+		return message.Payload
+	}
+	return []byte(text)
+}
@@ -0,0 +1,266 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+// testClient is a bare MQTT 3.1.1 client
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(addr string, connect []byte) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	biff.AssertNil(err)
+
+	c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	c.send(&packet{kind: CONNECT, body: connect})
+
+	return c
+}
+
+// connectBody has a clean session, client id and optionally a will
+func connectBody(clientId string, will ...string) []byte {
+	flags := byte(0x02)
+	if len(will) == 2 {
+		flags |= 0x04
+	}
+	b := appendString(nil, "MQTT")
+	b = append(b, 4, flags, 0, 60)
+	b = appendString(b, clientId)
+	if len(will) == 2 {
+		b = appendString(b, will[0])
+		b = appendString(b, will[1])
+	}
+	return b
+}
+
+func (c *testClient) send(p *packet) {
+	_, err := c.conn.Write(p.bytes())
+	biff.AssertNil(err)
+}
+
+func (c *testClient) receive() *packet {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := readPacket(c.reader, 0)
+	biff.AssertNil(err)
+	return p
+}
+
+func (c *testClient) closed() bool {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := readPacket(c.reader, 0)
+	return err != nil
+}
+
+func (c *testClient) publish(topic string, qos byte, id uint16, payload string) {
+	body := appendString(nil, topic)
+	if qos > 0 {
+		body = appendUint16(body, id)
+	}
+	c.send(&packet{kind: PUBLISH, flags: qos << 1, body: append(body, payload...)})
+}
+
+func (c *testClient) subscribe(id uint16, filter string, qos byte) []byte {
+	body := appendString(appendUint16(nil, id), filter)
+	c.send(&packet{kind: SUBSCRIBE, flags: 0x02, body: append(body, qos)})
+
+	suback := c.receive()
+	biff.AssertEqual(suback.kind, byte(SUBACK))
+	return suback.body[2:]
+}
+
+// receivePublish returns topic, packet id and payload
+func (c *testClient) receivePublish() (string, uint16, string) {
+	p := c.receive()
+	biff.AssertEqual(p.kind, byte(PUBLISH))
+
+	d := &decoder{b: p.body}
+	topic := d.string()
+	id := uint16(0)
+	if p.flags&0x06 != 0 {
+		id = d.uint16()
+	}
+	return topic, id, string(d.b)
+}
+
+func TestServer(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		temperatures, _ := qs.CreateQueue("temperatures")
+		events, _ := qs.CreateQueue("events")
+
+		topics, err := ParseMapping("sensors/+/temperature=temperatures")
+		biff.AssertNil(err)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		biff.AssertNil(err)
+
+		s := NewServer(qs, topics)
+		go s.Serve(l)
+		defer s.Close()
+
+		addr := l.Addr().String()
+
+		a.Alternative("Unsupported protocol level", func(a *biff.A) {
+			body := connectBody("device")
+			body[6] = 3
+			c := dial(addr, body)
+
+			connack := c.receive()
+			biff.AssertEqual(connack.kind, byte(CONNACK))
+			biff.AssertEqual(connack.body, []byte{0, UnacceptableProtocolVersion})
+			biff.AssertTrue(c.closed())
+		})
+
+		a.Alternative("Connected", func(a *biff.A) {
+
+			c := dial(addr, connectBody("device", "events", "gone"))
+			biff.AssertEqual(c.receive().body, []byte{0, Accepted})
+
+			a.Alternative("Publish QoS 0", func(a *biff.A) {
+				c.publish("sensors/kitchen/temperature", 0, 0, `21.5`)
+				c.publish("events", 0, 0, `door open`)
+				c.send(&packet{kind: PINGREQ})
+				biff.AssertEqual(c.receive().kind, byte(PINGRESP))
+
+				message, _ := temperatures.ReadMessage(context.Background())
+				biff.AssertEqual(string(message.Payload), `21.5`)
+				biff.AssertEqual(message.Headers, map[string]string{"mqtt-topic": "sensors/kitchen/temperature"})
+
+				message, _ = events.ReadMessage(context.Background())
+				biff.AssertEqual(string(message.Payload), `"door open"`)
+				biff.AssertEqual(message.Headers["content-type"], "text/plain")
+			})
+
+			a.Alternative("Publish QoS 1", func(a *biff.A) {
+				c.publish("events", 1, 7, `1`)
+
+				puback := c.receive()
+				biff.AssertEqual(puback.kind, byte(PUBACK))
+				biff.AssertEqual(puback.body, []byte{0, 7})
+				biff.AssertEqual(events.Stats().Len, int64(1))
+			})
+
+			a.Alternative("Publish QoS 2", func(a *biff.A) {
+				c.publish("events", 2, 8, `1`)
+				biff.AssertEqual(c.receive().kind, byte(PUBREC))
+
+				c.publish("events", 2, 8, `1`) // retransmission
+				biff.AssertEqual(c.receive().kind, byte(PUBREC))
+
+				c.send(&packet{kind: PUBREL, flags: 0x02, body: []byte{0, 8}})
+				biff.AssertEqual(c.receive().kind, byte(PUBCOMP))
+
+				biff.AssertEqual(events.Stats().Len, int64(1))
+			})
+
+			a.Alternative("Publish to missing queue closes", func(a *biff.A) {
+				c.publish("invented", 1, 1, `1`)
+
+				biff.AssertTrue(c.closed())
+			})
+
+			a.Alternative("Subscribe QoS 1", func(a *biff.A) {
+				temperatures.WriteMessage(&queue.Message{
+					Headers: map[string]string{"mqtt-topic": "sensors/hall/temperature"},
+					Payload: []byte(`19`),
+				})
+				temperatures.Write(queue.JSON(`20`))
+
+				biff.AssertEqual(c.subscribe(1, "sensors/+/temperature", 2), []byte{1})
+				biff.AssertEqual(api.ActiveClients(), 1)
+
+				topic, id, payload := c.receivePublish()
+				biff.AssertEqual(topic, "sensors/hall/temperature")
+				biff.AssertEqual(payload, `19`)
+
+				topic, _, payload = c.receivePublish()
+				biff.AssertEqual(topic, "sensors/+/temperature")
+				biff.AssertEqual(payload, `20`)
+
+				a.Alternative("Unacknowledged go back on disconnect", func(a *biff.A) {
+					c.send(&packet{kind: PUBACK, body: appendUint16(nil, id)})
+					c.send(&packet{kind: DISCONNECT})
+					biff.AssertTrue(c.closed())
+
+					for temperatures.Stats().Len != 1 {
+						time.Sleep(time.Millisecond)
+					}
+					payload, _ := temperatures.Read()
+					biff.AssertEqual(string(payload), `20`)
+					biff.AssertEqual(events.Stats().Len, int64(0)) // no will
+				})
+
+				a.Alternative("Unsubscribe", func(a *biff.A) {
+					c.send(&packet{kind: UNSUBSCRIBE, flags: 0x02, body: appendString([]byte{0, 2}, "sensors/+/temperature")})
+
+					biff.AssertEqual(c.receive().kind, byte(UNSUBACK))
+					biff.AssertEqual(temperatures.Stats().Len, int64(2))
+					biff.AssertEqual(api.ActiveClients(), 0)
+				})
+			})
+
+			a.Alternative("Subscribe QoS 0 with text", func(a *biff.A) {
+				c.publish("events", 0, 0, `hello`)
+
+				biff.AssertEqual(c.subscribe(1, "events", 0), []byte{0})
+
+				topic, _, payload := c.receivePublish()
+				biff.AssertEqual(topic, "events")
+				biff.AssertEqual(payload, `hello`)
+			})
+
+			a.Alternative("Subscribe unknown", func(a *biff.A) {
+				biff.AssertEqual(c.subscribe(1, "invented", 1), []byte{SubscribeFailure})
+				biff.AssertEqual(c.subscribe(2, "sensors/#", 1), []byte{SubscribeFailure})
+			})
+
+			a.Alternative("Will", func(a *biff.A) {
+				c.conn.Close()
+
+				message, _ := events.ReadMessage(context.Background())
+				biff.AssertEqual(string(message.Payload), `"gone"`)
+			})
+
+			a.Alternative("Take over", func(a *biff.A) {
+				other := dial(addr, connectBody("device"))
+				biff.AssertEqual(other.receive().body, []byte{0, Accepted})
+
+				biff.AssertTrue(c.closed())
+			})
+		})
+	})
+}
+
+func TestTopics(t *testing.T) {
+
+	m, err := ParseMapping("sensors/+/temperature=temperatures, devices/#=devices")
+	biff.AssertNil(err)
+	biff.AssertEqual(m.Queue("sensors/kitchen/temperature"), "temperatures")
+	biff.AssertEqual(m.Queue("devices"), "devices")
+	biff.AssertEqual(m.Queue("devices/a/b"), "devices")
+	biff.AssertEqual(m.Queue("other"), "other")
+
+	_, err = ParseMapping("sensors/temp+=temperatures")
+	biff.AssertNotNil(err)
+
+	_, err = ParseMapping("sensors=a/b")
+	biff.AssertNotNil(err)
+
+	biff.AssertTrue(!matchTopic("#", "$SYS/uptime"))
+	biff.AssertTrue(!matchTopic("a/+", "a/b/c"))
+	biff.AssertTrue(matchTopic("a/+/c", "a/b/c"))
+}
@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// CONNACK return codes
+const (
+	Accepted                    = 0
+	UnacceptableProtocolVersion = 1
+	IdentifierRejected          = 2
+)
+
+// SubscribeFailure is the SUBACK return code for a rejected filter
+const SubscribeFailure = 0x80
+
+var (
+	ErrPacketTooLarge  = errors.New("packet too large")
+	ErrMalformedPacket = errors.New("malformed packet")
+)
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, fmt.Errorf("%w: remaining length", ErrMalformedPacket)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if maxSize > 0 && length > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	p := &packet{
+		kind:  header >> 4,
+		flags: header & 0x0f,
+		body:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *packet) bytes() []byte {
+
+	b := []byte{p.kind<<4 | p.flags}
+
+	length := len(p.body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(b, p.body...)
+}
+
+// decoder reads fields in order, the first error is kept
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformedPacket
+	}
+	d.b = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.b) < 2 {
+		d.fail()
+		return 0
+	}
+	v := uint16(d.b[0])<<8 | uint16(d.b[1])
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if len(d.b) < n {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
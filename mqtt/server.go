@@ -0,0 +1,95 @@
+// Package mqtt is an MQTT 3.1.1 front-end so devices can publish to and
+// subscribe from tailon queues.
+//
+// Publishes go to the queue of the first route matching the topic (see
+// Mapping), or to the queue named as the topic. Queues are not created on
+// demand and a publish that can not be written closes the connection, the
+// only error MQTT 3.1.1 has. The topic is kept in the mqtt-topic header.
+//
+// A subscription consumes the queue of the route with the same pattern or
+// of a topic without wildcards. QoS 2 is granted as QoS 1, and QoS 1
+// subscriptions receive up to DefaultInflight messages without PUBACK,
+// the ones not acknowledged when the subscription ends go back to the
+// queue. Every session is clean and retained messages are not supported.
+package mqtt
+
+import (
+	"net"
+	"sync"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/tcpserver"
+)
+
+type Config struct {
+	Addr   string `usage:"MQTT service address, disabled if empty"`
+	Topics string `usage:"Topic to queue routes, for example 'sensors/+/temperature=temperatures,devices/#=devices', other topics are queue names"`
+}
+
+// DefaultMaxPacketSize limits the packets received
+const DefaultMaxPacketSize = 16 << 20
+
+// DefaultInflight is the maximum of QoS 1 messages without PUBACK for a
+// subscription
+const DefaultInflight = 100
+
+type Server struct {
+	Queues        queue.Service
+	Topics        Mapping
+	MaxPacketSize int
+
+	tcp     tcpserver.Server
+	clients map[string]*conn // by client id
+	mutex   sync.Mutex
+}
+
+func NewServer(qs queue.Service, topics Mapping) *Server {
+	return &Server{
+		Queues:        qs,
+		Topics:        topics,
+		MaxPacketSize: DefaultMaxPacketSize,
+		clients:       map[string]*conn{},
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	return s.tcp.ListenAndServe(addr, s.newConn)
+}
+
+// Serve returns net.ErrClosed after Close
+func (s *Server) Serve(l net.Listener) error {
+	return s.tcp.Serve(l, s.newConn)
+}
+
+func (s *Server) newConn(nc net.Conn) tcpserver.Conn {
+	return newConn(s, nc)
+}
+
+// takeOver registers the client id and closes a previous connection with
+// the same one, as the spec requires
+func (s *Server) takeOver(c *conn) {
+
+	s.mutex.Lock()
+	previous := s.clients[c.clientId]
+	s.clients[c.clientId] = c
+	s.mutex.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+}
+
+// forget unregisters the client id unless another connection took it over
+func (s *Server) forget(c *conn) {
+	s.mutex.Lock()
+	if s.clients[c.clientId] == c {
+		delete(s.clients, c.clientId)
+	}
+	s.mutex.Unlock()
+}
+
+// Close stops listening and closes every connection, unacknowledged
+// messages go back to their queues.
+func (s *Server) Close() error {
+	return s.tcp.Close()
+}
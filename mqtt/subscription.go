@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+type delivery struct {
+	packetId     uint16
+	message      *queue.Message
+	subscription *subscription
+}
+
+type subscription struct {
+	conn   *conn
+	filter string
+	queue  queue.Queue
+	qos    byte
+	client *api.Client
+
+	pending []*delivery   // protected by conn.mutex
+	slots   chan struct{} // one per message without PUBACK
+
+	ready  chan struct{} // closed after SUBACK
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (s *subscription) run() {
+
+	select {
+	case <-s.ready:
+	case <-s.ctx.Done():
+		return
+	}
+
+	for {
+		if s.qos > 0 {
+			select {
+			case s.slots <- struct{}{}:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		message, err := s.queue.ReadMessage(s.ctx)
+		if errors.Is(err, queue.ErrQueueNotFound) {
+			s.conn.cancel() // MQTT has no way to tell
+			return
+		}
+		if err != nil {
+			return // unsubscribed or disconnected
+		}
+
+		body := appendString(nil, s.topic(message))
+		flags := byte(0)
+		if s.qos > 0 {
+			d := &delivery{message: message, subscription: s}
+			s.conn.mutex.Lock()
+			d.packetId = s.conn.nextPacketId()
+			s.pending = append(s.pending, d)
+			s.conn.inflight[d.packetId] = d
+			s.conn.mutex.Unlock()
+
+			flags = s.qos << 1
+			body = appendUint16(body, d.packetId)
+		}
+		body = append(body, decode(message)...)
+
+		if err := s.conn.write(&packet{kind: PUBLISH, flags: flags, body: body}); err != nil {
+			if s.qos == 0 {
+				s.queue.Unread(message) // not delivered, give it back
+			}
+			return // pending ones are given back by stop
+		}
+
+		s.client.Reads++
+	}
+}
+
+// topic is the one the message was published to if it matches the filter
+func (s *subscription) topic(message *queue.Message) string {
+	if topic := message.Headers[TopicHeader]; topic != "" && matchTopic(s.filter, topic) {
+		return topic
+	}
+	return s.filter
+}
+
+// remove must be called with conn.mutex held
+func (s *subscription) remove(d *delivery) {
+	for i, pending := range s.pending {
+		if pending == d {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// stop waits for the subscription to end and gives back unacknowledged
+// messages in reverse order so they keep their position
+func (s *subscription) stop() {
+
+	s.cancel()
+	<-s.done
+
+	s.conn.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	for _, d := range pending {
+		delete(s.conn.inflight, d.packetId)
+	}
+	s.conn.mutex.Unlock()
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		s.queue.Unread(pending[i].message)
+	}
+}
@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// Route maps the topics matching Pattern to Queue
+type Route struct {
+	Pattern string
+	Queue   string
+}
+
+// Mapping is checked in order, topics not matching any route are used as
+// queue names.
+type Mapping []Route
+
+// ParseMapping reads 'pattern=queue' routes separated by commas, for
+// example 'sensors/+/temperature=temperatures,devices/#=devices'.
+func ParseMapping(s string) (Mapping, error) {
+
+	m := Mapping{}
+	for _, route := range strings.Split(s, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		pattern, name, found := strings.Cut(route, "=")
+		if !found {
+			return nil, fmt.Errorf("route '%s' must be pattern=queue", route)
+		}
+		if !validFilter(pattern) {
+			return nil, fmt.Errorf("invalid topic pattern '%s'", pattern)
+		}
+		if err := queue.ValidateName(name); err != nil {
+			return nil, err
+		}
+
+		m = append(m, Route{Pattern: pattern, Queue: name})
+	}
+
+	return m, nil
+}
+
+// Queue returns the queue name for a topic
+func (m Mapping) Queue(topic string) string {
+	for _, route := range m {
+		if matchTopic(route.Pattern, topic) {
+			return route.Queue
+		}
+	}
+	return topic
+}
+
+// QueueForFilter returns the queue consumed by a subscription, which is
+// the one of a route with the same pattern or the one of a topic without
+// wildcards.
+func (m Mapping) QueueForFilter(filter string) (string, bool) {
+	for _, route := range m {
+		if route.Pattern == filter {
+			return route.Queue, true
+		}
+	}
+	if strings.ContainsAny(filter, "+#") {
+		return "", false
+	}
+	return m.Queue(filter), true
+}
+
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+func validFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTopic follows MQTT rules, '+' matches a level, '#' the rest
+// including the parent, and wildcards at the first level do not match
+// topics starting with '$'.
+func matchTopic(filter, topic string) bool {
+
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i == len(topics) {
+			return false
+		}
+		if f != "+" && f != topics[i] {
+			return false
+		}
+	}
+
+	return len(filters) == len(topics)
+}
@@ -0,0 +1,26 @@
+package queue_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/queue/queuetest"
+)
+
+func TestMemoryService_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+		return queue.NewMemoryService()
+	})
+}
+
+func TestKVService_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+		s, err := queue.OpenKVService(filepath.Join(t.TempDir(), "tailon.kv"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
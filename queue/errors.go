@@ -0,0 +1,31 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by services and queues, possibly wrapped with details.
+// Check them with errors.Is.
+var (
+	ErrQueueNotFound      = errors.New("queue not found")
+	ErrQueueAlreadyExists = errors.New("queue already exists")
+	ErrInvalidQueueName   = errors.New("invalid queue name")
+	ErrQueueFull          = errors.New("queue is full")
+	ErrMessageTooLarge    = errors.New("message too large")
+	ErrUnauthorized       = errors.New("unauthorized")
+)
+
+// ValidateName checks a queue name can be used in urls and with the
+// :action suffix.
+func ValidateName(name string) error {
+	if name == "" || len(name) > 255 {
+		return fmt.Errorf("%w: '%s'", ErrInvalidQueueName, name)
+	}
+	for _, c := range name {
+		if c <= ' ' || c == '/' || c == ':' || c == '?' || c == '#' || c == '%' || c == 0x7f {
+			return fmt.Errorf("%w: '%s'", ErrInvalidQueueName, name)
+		}
+	}
+	return nil
+}
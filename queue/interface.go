@@ -1,7 +1,9 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 )
 
 type JSON = json.RawMessage
@@ -9,6 +11,35 @@ type JSON = json.RawMessage
 type Queue interface {
 	Write(JSON) error
 	Read() (JSON, error)
+
+	// WriteMessage assigns Time if it is zero, and Id unless it is greater
+	// than the previous one, ids are always increasing in a queue
+	WriteMessage(*Message) error
+
+	// ReadMessage blocks until there is a message or ctx is done
+	ReadMessage(ctx context.Context) (*Message, error)
+
+	// Unread puts back a message at the head of the queue, typically because
+	// it could not be delivered
+	Unread(*Message) error
+
+	// Peek returns up to n messages from the head, skipping the first
+	// offset ones, without removing them
+	Peek(offset, n int) ([]*Message, error)
+
+	// Purge removes every pending message and returns how many
+	Purge() (int64, error)
+
+	Stats() Stats
+}
+
+type Stats struct {
+	Len          int64 `json:"len"`
+	Bytes        int64 `json:"bytes"`
+	Writes       int64 `json:"writes"`
+	Reads        int64 `json:"reads"`
+	BytesWritten int64 `json:"bytes_written"`
+	BytesRead    int64 `json:"bytes_read"`
 }
 
 type Info struct {
@@ -21,4 +52,9 @@ type Service interface {
 	ListQueues() ([]string, error)
 	CreateQueue(name string) (Queue, error)
 	DeleteQueue(name string) error
+
+	// Snapshot writes every queue with its pending messages, consistent at
+	// a point in time, Restore loads it back
+	Snapshot(w io.Writer) (*SnapshotInfo, error)
+	Restore(r io.Reader) (*SnapshotInfo, error)
 }
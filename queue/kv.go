@@ -0,0 +1,657 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fulldump/tailon/kv"
+)
+
+// Keys of KVService, queue names can not have slashes
+const (
+	kvQueuePrefix   = "q/" // q/{name} is the kvQueueInfo
+	kvMessagePrefix = "m/" // m/{name}/{id} is the message, ids big endian
+)
+
+// kvQueueInfo is kept with the queue, so ids keep increasing after all the
+// messages are read
+type kvQueueInfo struct {
+	LastId         uint64 `json:"last_id"`
+	Capacity       int    `json:"capacity"`
+	MaxMessageSize int    `json:"max_message_size"`
+}
+
+// Storage selects where a server keeps its queues
+type Storage struct {
+	Engine string `usage:"Where queues are kept: memory, or kv for a file at Path that survives restarts"`
+	Path   string `usage:"File of the kv engine"`
+	NoSync bool   `usage:"Do not wait for kv writes to reach the disk, the last ones can be lost if the machine crashes"`
+}
+
+// KVService keeps queues in a kv file. Changes are on disk when they
+// return, a message is removed before a reader gets it, so acks are
+// durable. Messages are in order of id, unread ones go back to their place.
+type KVService struct {
+	Limits Limits
+
+	db     *kv.DB
+	mutex  sync.RWMutex
+	queues map[string]*KVQueue
+}
+
+// OpenKVService loads the queues of the file at path, created if missing
+func OpenKVService(path string, options *kv.Options) (*KVService, error) {
+
+	db, err := kv.Open(path, options)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &KVService{
+		Limits: DefaultLimits,
+		db:     db,
+		queues: map[string]*KVQueue{},
+	}
+
+	err = db.View(func(tx *kv.Tx) error {
+		var err error
+		tx.Scan([]byte(kvQueuePrefix), nil, func(key, value []byte) bool {
+			info := kvQueueInfo{}
+			if err = json.Unmarshal(value, &info); err != nil {
+				return false
+			}
+			q := s.newQueue(string(key[len(kvQueuePrefix):]), info)
+			tx.Scan(q.prefix, nil, func(key, value []byte) bool {
+				q.len++
+				q.bytes += int64(messageSize(value))
+				return true
+			})
+			s.queues[q.name] = q
+			return true
+		})
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *KVService) newQueue(name string, info kvQueueInfo) *KVQueue {
+	return &KVQueue{
+		Capacity:       info.Capacity,
+		MaxMessageSize: info.MaxMessageSize,
+		db:             s.db,
+		name:           name,
+		prefix:         []byte(kvMessagePrefix + name + "/"),
+		seq:            info.LastId,
+		notify:         make(chan struct{}),
+	}
+}
+
+func (s *KVService) Close() error {
+	return s.db.Close()
+}
+
+func (s *KVService) GetQueue(name string) (Queue, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	q, exists := s.queues[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: '%s'", ErrQueueNotFound, name)
+	}
+
+	return q, nil
+}
+
+func (s *KVService) ListQueues() ([]string, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := []string{}
+	for name := range s.queues {
+		result = append(result, name)
+	}
+
+	return result, nil
+}
+
+func (s *KVService) CreateQueue(name string) (Queue, error) {
+
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.queues[name]; exists {
+		return nil, fmt.Errorf("%w: '%s'", ErrQueueAlreadyExists, name)
+	}
+
+	q := s.newQueue(name, kvQueueInfo{
+		Capacity:       s.Limits.Capacity,
+		MaxMessageSize: s.Limits.MaxMessageSize,
+	})
+	err := s.db.Update(func(tx *kv.Tx) error {
+		return tx.Put(q.infoKey(), q.info())
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.queues[name] = q
+
+	return q, nil
+}
+
+func (s *KVService) DeleteQueue(name string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	q, exists := s.queues[name]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrQueueNotFound, name)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	err := s.db.Update(func(tx *kv.Tx) error {
+		if err := q.deleteMessages(tx); err != nil {
+			return err
+		}
+		return tx.Delete(q.infoKey())
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(s.queues, name)
+	q.delete()
+
+	return nil
+}
+
+// Snapshot reads every queue in a single transaction
+func (s *KVService) Snapshot(w io.Writer) (*SnapshotInfo, error) {
+
+	s.mutex.RLock()
+	names := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	queues := make([]*snapshotQueue, 0, len(names))
+	err := s.db.View(func(tx *kv.Tx) error {
+		for _, name := range names {
+			q := s.queues[name]
+			info := kvQueueInfo{}
+			if err := json.Unmarshal(tx.Get(q.infoKey()), &info); err != nil {
+				return err
+			}
+			snapshot := &snapshotQueue{
+				Name:           name,
+				Capacity:       info.Capacity,
+				MaxMessageSize: info.MaxMessageSize,
+				LastId:         info.LastId,
+			}
+			var err error
+			tx.Scan(q.prefix, nil, func(key, value []byte) bool {
+				message := &Message{}
+				if err = json.Unmarshal(value, message); err != nil {
+					return false
+				}
+				snapshot.messages = append(snapshot.messages, message)
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			snapshot.Len = len(snapshot.messages)
+			queues = append(queues, snapshot)
+		}
+		return nil
+	})
+	s.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return writeSnapshot(w, queues)
+}
+
+// Restore replaces the queues in the snapshot in a single transaction,
+// the others are kept
+func (s *KVService) Restore(r io.Reader) (*SnapshotInfo, error) {
+
+	info, snapshots, err := readSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Replaced queues take no writes until they are marked as deleted
+	replaced := []*KVQueue{}
+	for _, snapshot := range snapshots {
+		if old, exists := s.queues[snapshot.Name]; exists {
+			old.mutex.Lock()
+			defer old.mutex.Unlock()
+			replaced = append(replaced, old)
+		}
+	}
+
+	restored := make([]*KVQueue, len(snapshots))
+	err = s.db.Update(func(tx *kv.Tx) error {
+		for i, snapshot := range snapshots {
+			if old, exists := s.queues[snapshot.Name]; exists {
+				if err := old.deleteMessages(tx); err != nil {
+					return err
+				}
+			}
+			q := s.newQueue(snapshot.Name, kvQueueInfo{
+				LastId:         snapshot.LastId,
+				Capacity:       snapshot.Capacity,
+				MaxMessageSize: snapshot.MaxMessageSize,
+			})
+			if err := tx.Put(q.infoKey(), q.info()); err != nil {
+				return err
+			}
+			for _, message := range snapshot.messages {
+				value, err := json.Marshal(message)
+				if err != nil {
+					return err
+				}
+				if err := tx.Put(q.key(message.Id), value); err != nil {
+					return err
+				}
+				q.len++
+				q.bytes += int64(len(message.Payload))
+			}
+			restored[i] = q
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, old := range replaced {
+		old.delete()
+	}
+	for _, q := range restored {
+		s.queues[q.name] = q
+	}
+
+	return info, nil
+}
+
+type KVQueue struct {
+	Capacity       int
+	MaxMessageSize int
+	Writes         int64
+	Reads          int64
+	BytesWritten   int64
+	BytesRead      int64
+
+	db      *kv.DB
+	name    string
+	prefix  []byte
+	seq     uint64 // last assigned message id
+	len     int64
+	bytes   int64 // pending payloads
+	deleted bool
+	mutex   sync.Mutex
+	notify  chan struct{} // closed and replaced on every change
+
+	// The last message of a Peek, so the next page seeks there instead of
+	// scanning from the head. Reads, unreads and removes change the offsets
+	// and count as shifts, writes go at the end.
+	shifts uint64
+	peeked struct {
+		offset int
+		key    []byte
+		shifts uint64
+	}
+}
+
+func (q *KVQueue) infoKey() []byte {
+	return []byte(kvQueuePrefix + q.name)
+}
+
+func (q *KVQueue) info() []byte {
+	b, _ := json.Marshal(kvQueueInfo{
+		LastId:         q.seq,
+		Capacity:       q.Capacity,
+		MaxMessageSize: q.MaxMessageSize,
+	})
+	return b
+}
+
+func (q *KVQueue) key(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(bytes.Clone(q.prefix), id)
+}
+
+// changed must be called with the mutex held
+func (q *KVQueue) changed() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// delete marks the queue as deleted once its messages are, it must be
+// called with the mutex held
+func (q *KVQueue) delete() {
+	q.deleted = true
+	q.len = 0
+	q.bytes = 0
+	q.changed()
+}
+
+// deleteMessages collects the keys first, they can not change while
+// scanning
+func (q *KVQueue) deleteMessages(tx *kv.Tx) error {
+	keys := [][]byte{}
+	tx.Scan(q.prefix, nil, func(key, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *KVQueue) Write(payload JSON) error {
+	return q.WriteMessage(&Message{Payload: payload})
+}
+
+func (q *KVQueue) Read() (JSON, error) {
+	message, err := q.ReadMessage(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return message.Payload, nil
+}
+
+func (q *KVQueue) WriteMessage(message *Message) error {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deleted {
+		return ErrQueueNotFound
+	}
+	if q.MaxMessageSize > 0 && len(message.Payload) > q.MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes, max is %d", ErrMessageTooLarge, len(message.Payload), q.MaxMessageSize)
+	}
+	if q.Capacity > 0 && q.len >= int64(q.Capacity) {
+		return fmt.Errorf("%w: %d messages", ErrQueueFull, q.Capacity)
+	}
+
+	previous := *message
+	seq := q.seq
+	q.seq = message.assign(q.seq)
+
+	err := q.db.Update(func(tx *kv.Tx) error {
+		value, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(q.key(message.Id), value); err != nil {
+			return err
+		}
+		return tx.Put(q.infoKey(), q.info())
+	})
+	if err != nil {
+		q.seq = seq
+		*message = previous
+		return err
+	}
+
+	q.len++
+	q.bytes += int64(len(message.Payload))
+	q.changed()
+
+	atomic.AddInt64(&q.Writes, 1)
+	atomic.AddInt64(&q.BytesWritten, int64(len(message.Payload)))
+
+	return nil
+}
+
+// ReadMessage removes the message from the file before returning it
+func (q *KVQueue) ReadMessage(ctx context.Context) (*Message, error) {
+
+	// A queue with the same name may be created after this one is deleted,
+	// its messages have the same prefix
+	q.mutex.Lock()
+	for q.deleted || q.len == 0 {
+		if q.deleted {
+			q.mutex.Unlock()
+			return nil, ErrQueueNotFound
+		}
+		notify := q.notify
+		q.mutex.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		q.mutex.Lock()
+	}
+	defer q.mutex.Unlock()
+
+	message := &Message{}
+	err := q.db.Update(func(tx *kv.Tx) error {
+		var key, value []byte
+		tx.Scan(q.prefix, nil, func(k, v []byte) bool {
+			key, value = k, v
+			return false
+		})
+		if key == nil {
+			return fmt.Errorf("queue '%s' has %d messages but none is stored", q.name, q.len)
+		}
+		if err := json.Unmarshal(value, message); err != nil {
+			return err
+		}
+		return tx.Delete(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q.len--
+	q.bytes -= int64(len(message.Payload))
+	q.shifts++
+	q.changed()
+
+	atomic.AddInt64(&q.Reads, 1)
+	atomic.AddInt64(&q.BytesRead, int64(len(message.Payload)))
+
+	return message, nil
+}
+
+func (q *KVQueue) Unread(message *Message) error {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deleted {
+		return ErrQueueNotFound
+	}
+
+	err := q.db.Update(func(tx *kv.Tx) error {
+		value, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		return tx.Put(q.key(message.Id), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	q.len++
+	q.bytes += int64(len(message.Payload))
+	q.shifts++
+	q.changed()
+
+	atomic.AddInt64(&q.Reads, -1)
+	atomic.AddInt64(&q.BytesRead, -int64(len(message.Payload)))
+
+	return nil
+}
+
+// Remove takes out the pending message with id, as if it was read, and
+// returns nil if there is none. It is a lookup by key, not a scan.
+func (q *KVQueue) Remove(id uint64) (*Message, error) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deleted {
+		return nil, ErrQueueNotFound
+	}
+
+	var message *Message
+	err := q.db.Update(func(tx *kv.Tx) error {
+		value := tx.Get(q.key(id))
+		if value == nil {
+			return nil
+		}
+		message = &Message{}
+		if err := json.Unmarshal(value, message); err != nil {
+			return err
+		}
+		return tx.Delete(q.key(id))
+	})
+	if err != nil || message == nil {
+		return nil, err
+	}
+
+	q.len--
+	q.bytes -= int64(len(message.Payload))
+	q.shifts++
+	q.changed()
+
+	atomic.AddInt64(&q.Reads, 1)
+	atomic.AddInt64(&q.BytesRead, int64(len(message.Payload)))
+
+	return message, nil
+}
+
+// Peek pages in order are not scanned again from the head, see peeked
+func (q *KVQueue) Peek(offset, n int) ([]*Message, error) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deleted {
+		return nil, ErrQueueNotFound
+	}
+
+	result := []*Message{}
+	if n <= 0 {
+		return result, nil
+	}
+
+	var start []byte
+	skip := offset
+	if q.peeked.key != nil && q.peeked.shifts == q.shifts && offset >= q.peeked.offset {
+		start = q.peeked.key
+		skip = offset - q.peeked.offset
+	}
+
+	var last []byte
+	err := q.db.View(func(tx *kv.Tx) error {
+		var err error
+		tx.Scan(q.prefix, start, func(key, value []byte) bool {
+			if skip > 0 {
+				skip--
+				return true
+			}
+			message := &Message{}
+			if err = json.Unmarshal(value, message); err != nil {
+				return false
+			}
+			result = append(result, message)
+			last = key
+			return len(result) < n
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if last != nil {
+		q.peeked.offset = offset + len(result) - 1
+		q.peeked.key = bytes.Clone(last)
+		q.peeked.shifts = q.shifts
+	}
+
+	return result, nil
+}
+
+func (q *KVQueue) Purge() (int64, error) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.deleted {
+		return 0, ErrQueueNotFound
+	}
+
+	err := q.db.Update(q.deleteMessages)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := q.len
+	q.len = 0
+	q.bytes = 0
+	q.shifts++
+	q.changed()
+
+	return purged, nil
+}
+
+func (q *KVQueue) Stats() Stats {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return Stats{
+		Len:          q.len,
+		Bytes:        q.bytes,
+		Writes:       atomic.LoadInt64(&q.Writes),
+		Reads:        atomic.LoadInt64(&q.Reads),
+		BytesWritten: atomic.LoadInt64(&q.BytesWritten),
+		BytesRead:    atomic.LoadInt64(&q.BytesRead),
+	}
+}
+
+// messageSize is the payload size of a stored message
+func messageSize(value []byte) int {
+	message := struct {
+		Payload JSON `json:"payload"`
+	}{}
+	json.Unmarshal(value, &message)
+	return len(message.Payload)
+}
@@ -0,0 +1,205 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+)
+
+func TestKVService(t *testing.T) {
+
+	biff.Alternative("Open", func(a *biff.A) {
+
+		path := filepath.Join(t.TempDir(), "tailon.kv")
+		s, err := OpenKVService(path, nil)
+		biff.AssertNil(err)
+		defer func() { s.Close() }()
+
+		reopen := func() {
+			s.Close()
+			s, err = OpenKVService(path, nil)
+			biff.AssertNil(err)
+		}
+
+		q, err := s.CreateQueue("my-queue")
+		biff.AssertNil(err)
+		for _, payload := range []string{`1`, `2`, `3`} {
+			biff.AssertNil(q.Write(JSON(payload)))
+		}
+
+		a.Alternative("Reopen", func(a *biff.A) {
+			reopen()
+
+			names, _ := s.ListQueues()
+			biff.AssertEqual(names, []string{"my-queue"})
+			q, _ := s.GetQueue("my-queue")
+			biff.AssertEqual(q.Stats().Len, int64(3))
+			biff.AssertEqual(q.Stats().Bytes, int64(3))
+
+			messages, _ := q.Peek(0, 10)
+			biff.AssertEqual(len(messages), 3)
+			biff.AssertEqual(messages[2].Id, uint64(3))
+		})
+
+		a.Alternative("Read is durable", func(a *biff.A) {
+			payload, err := q.Read()
+			biff.AssertNil(err)
+			biff.AssertEqual(string(payload), `1`)
+			reopen()
+
+			q, _ := s.GetQueue("my-queue")
+			payload, _ = q.Read()
+			biff.AssertEqual(string(payload), `2`)
+		})
+
+		a.Alternative("Ids keep increasing", func(a *biff.A) {
+			q.Purge()
+			reopen()
+
+			q, _ := s.GetQueue("my-queue")
+			message := &Message{Payload: JSON(`4`)}
+			q.WriteMessage(message)
+			biff.AssertEqual(message.Id, uint64(4))
+		})
+
+		a.Alternative("Unread", func(a *biff.A) {
+			message, _ := q.ReadMessage(context.Background())
+			biff.AssertNil(q.Unread(message))
+
+			payload, _ := q.Read()
+			biff.AssertEqual(string(payload), `1`)
+			biff.AssertEqual(q.Stats().Reads, int64(1))
+		})
+
+		a.Alternative("Remove", func(a *biff.A) {
+			message, err := q.(*KVQueue).Remove(2)
+			biff.AssertNil(err)
+			biff.AssertEqual(string(message.Payload), `2`)
+
+			message, err = q.(*KVQueue).Remove(2)
+			biff.AssertNil(err)
+			biff.AssertTrue(message == nil)
+
+			messages, _ := q.Peek(1, 10)
+			biff.AssertEqual(len(messages), 1)
+			biff.AssertEqual(messages[0].Id, uint64(3))
+		})
+
+		a.Alternative("Peek pages", func(a *biff.A) {
+			for _, payload := range []string{`4`, `5`, `6`, `7`} {
+				q.Write(JSON(payload))
+			}
+
+			ids := func(messages []*Message) []uint64 {
+				result := []uint64{}
+				for _, message := range messages {
+					result = append(result, message.Id)
+				}
+				return result
+			}
+
+			all := []*Message{}
+			for offset := 0; ; offset += 3 {
+				page, err := q.Peek(offset, 3)
+				biff.AssertNil(err)
+				if len(page) == 0 {
+					break
+				}
+				all = append(all, page...)
+			}
+			biff.AssertEqual(ids(all), []uint64{1, 2, 3, 4, 5, 6, 7})
+
+			// The next page seeks the last message peeked
+			page, _ := q.Peek(0, 3)
+			biff.AssertEqual(q.(*KVQueue).peeked.offset, 2)
+			page, _ = q.Peek(3, 3)
+			biff.AssertEqual(ids(page), []uint64{4, 5, 6})
+
+			// Reads and unreads move the offsets
+			message, _ := q.ReadMessage(context.Background())
+			page, _ = q.Peek(5, 3)
+			biff.AssertEqual(ids(page), []uint64{7})
+			q.Unread(message)
+			page, _ = q.Peek(5, 3)
+			biff.AssertEqual(ids(page), []uint64{6, 7})
+			page, _ = q.Peek(1, 2)
+			biff.AssertEqual(ids(page), []uint64{2, 3})
+		})
+
+		a.Alternative("Limits", func(a *biff.A) {
+			s.Limits = Limits{Capacity: 1, MaxMessageSize: 2}
+			q, _ := s.CreateQueue("limited")
+			biff.AssertTrue(errors.Is(q.Write(JSON(`100`)), ErrMessageTooLarge))
+			biff.AssertNil(q.Write(JSON(`10`)))
+			biff.AssertTrue(errors.Is(q.Write(JSON(`10`)), ErrQueueFull))
+
+			reopen()
+			q, _ = s.GetQueue("limited")
+			biff.AssertTrue(errors.Is(q.Write(JSON(`10`)), ErrQueueFull))
+		})
+
+		a.Alternative("Delete wakes readers", func(a *biff.A) {
+			q, _ := s.CreateQueue("empty")
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				s.DeleteQueue("empty")
+			}()
+			_, err := q.ReadMessage(context.Background())
+			biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+
+			reopen()
+			names, _ := s.ListQueues()
+			biff.AssertEqual(names, []string{"my-queue"})
+		})
+
+		a.Alternative("Delete and create again", func(a *biff.A) {
+			biff.AssertNil(s.DeleteQueue("my-queue"))
+			again, _ := s.CreateQueue("my-queue")
+			again.Write(JSON(`4`))
+
+			// Messages have the same keys, the old handle must not see them
+			_, err := q.ReadMessage(context.Background())
+			biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+			_, err = q.Peek(0, 10)
+			biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+			biff.AssertEqual(q.Stats().Len, int64(0))
+
+			payload, _ := again.Read()
+			biff.AssertEqual(string(payload), `4`)
+		})
+
+		a.Alternative("Snapshot", func(a *biff.A) {
+			q.Read()
+			snapshot := &bytes.Buffer{}
+			info, err := s.Snapshot(snapshot)
+			biff.AssertNil(err)
+			biff.AssertEqual(info.Messages, int64(2))
+
+			restored := NewMemoryService()
+			_, err = restored.Restore(bytes.NewReader(snapshot.Bytes()))
+			biff.AssertNil(err)
+			r, _ := restored.GetQueue("my-queue")
+			biff.AssertEqual(r.Stats().Len, int64(2))
+
+			q.Write(JSON(`4`))
+			info, err = s.Restore(bytes.NewReader(snapshot.Bytes()))
+			biff.AssertNil(err)
+			biff.AssertEqual(info.Messages, int64(2))
+			biff.AssertTrue(errors.Is(q.Write(JSON(`5`)), ErrQueueNotFound)) // replaced
+
+			reopen()
+			q, _ := s.GetQueue("my-queue")
+			messages, _ := q.Peek(0, 10)
+			biff.AssertEqual(len(messages), 2)
+			biff.AssertEqual(string(messages[0].Payload), `2`)
+			message := &Message{Payload: JSON(`6`)}
+			q.WriteMessage(message)
+			biff.AssertEqual(message.Id, uint64(4))
+		})
+	})
+}
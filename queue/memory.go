@@ -1,19 +1,32 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"sync/atomic"
 )
 
+// Limits apply to every queue created by a service
+type Limits struct {
+	Capacity       int `usage:"Maximum pending messages per queue, 0 means unlimited"`
+	MaxMessageSize int `usage:"Maximum message size in bytes, 0 means unlimited"`
+}
+
+var DefaultLimits = Limits{
+	Capacity: 10 * 1000 * 1000,
+}
+
 type MemoryService struct {
 	Queues      map[string]Queue // todo: replace by sync.Map
 	QueuesMutex sync.RWMutex
+	Limits      Limits
 }
 
 func NewMemoryService() *MemoryService {
 	return &MemoryService{
 		Queues: map[string]Queue{},
+		Limits: DefaultLimits,
 	}
 }
 
@@ -24,7 +37,7 @@ func (m *MemoryService) GetQueue(name string) (Queue, error) {
 
 	q, exists := m.Queues[name]
 	if !exists {
-		return nil, fmt.Errorf("queue '%s' does not exist", name)
+		return nil, fmt.Errorf("%w: '%s'", ErrQueueNotFound, name)
 	}
 
 	return q, nil
@@ -32,6 +45,9 @@ func (m *MemoryService) GetQueue(name string) (Queue, error) {
 
 func (m *MemoryService) ListQueues() ([]string, error) {
 
+	m.QueuesMutex.RLock()
+	defer m.QueuesMutex.RUnlock()
+
 	result := []string{}
 
 	for name := range m.Queues {
@@ -43,14 +59,20 @@ func (m *MemoryService) ListQueues() ([]string, error) {
 
 func (m *MemoryService) CreateQueue(name string) (Queue, error) {
 
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
 	m.QueuesMutex.Lock()
 	defer m.QueuesMutex.Unlock()
 
 	if _, exists := m.Queues[name]; exists {
-		return nil, fmt.Errorf("queue '%s' already exists", name)
+		return nil, fmt.Errorf("%w: '%s'", ErrQueueAlreadyExists, name)
 	}
 
 	q := NewMemoryQueue()
+	q.Capacity = m.Limits.Capacity
+	q.MaxMessageSize = m.Limits.MaxMessageSize
 	m.Queues[name] = q
 
 	return q, nil
@@ -61,40 +83,259 @@ func (m *MemoryService) DeleteQueue(name string) error {
 	m.QueuesMutex.Lock()
 	defer m.QueuesMutex.Unlock()
 
-	if _, exists := m.Queues[name]; !exists {
-		return fmt.Errorf("queue '%s' does not exist", name)
+	q, exists := m.Queues[name]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrQueueNotFound, name)
 	}
 
 	delete(m.Queues, name)
+
+	if memq, ok := q.(*MemoryQueue); ok {
+		memq.delete()
+	}
+
 	return nil
 }
 
+// MemoryQueue keeps the pending messages in a slice, so they can be peeked,
+// given back and removed. It does not have the Queue channel anymore, use
+// ReadMessage and Write instead.
 type MemoryQueue struct {
-	Queue  chan JSON
-	Writes int64
-	Reads  int64
+	Capacity       int
+	MaxMessageSize int
+	Writes         int64
+	Reads          int64
+	BytesWritten   int64
+	BytesRead      int64
+
+	seq     uint64 // last assigned message id
+	bytes   int64  // pending
+	items   []*Message
+	head    int
+	deleted bool
+	mutex   sync.Mutex
+	notify  chan struct{} // closed and replaced on every change
 }
 
 func NewMemoryQueue() *MemoryQueue {
 	return &MemoryQueue{
-		Queue: make(chan JSON, 10*1000*1000),
+		Capacity: DefaultLimits.Capacity,
+		notify:   make(chan struct{}),
 	}
 }
 
+// delete wakes up blocked readers, they will get ErrQueueNotFound
+func (m *MemoryQueue) delete() {
+	m.mutex.Lock()
+	m.deleted = true
+	m.changed()
+	m.mutex.Unlock()
+}
+
+// changed must be called with the mutex held
+func (m *MemoryQueue) changed() {
+	close(m.notify)
+	m.notify = make(chan struct{})
+}
+
+func (m *MemoryQueue) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.items) - m.head
+}
+
 func (m *MemoryQueue) Write(item JSON) error {
+	return m.WriteMessage(&Message{Payload: item})
+}
 
-	atomic.AddInt64(&m.Writes, 1)
+func (m *MemoryQueue) WriteMessage(message *Message) error {
 
-	m.Queue <- item // todo: make it sync?
+	if m.MaxMessageSize > 0 && len(message.Payload) > m.MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes, max is %d", ErrMessageTooLarge, len(message.Payload), m.MaxMessageSize)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.deleted {
+		return ErrQueueNotFound
+	}
+
+	if m.Capacity > 0 && len(m.items)-m.head >= m.Capacity {
+		return fmt.Errorf("%w: %d messages", ErrQueueFull, m.Capacity)
+	}
+
+	m.seq = message.assign(m.seq)
+	m.items = append(m.items, message)
+	m.bytes += int64(len(message.Payload))
+	m.changed()
+
+	atomic.AddInt64(&m.Writes, 1)
+	atomic.AddInt64(&m.BytesWritten, int64(len(message.Payload)))
 
 	return nil
 }
 
 func (m *MemoryQueue) Read() (JSON, error) {
+	message, err := m.ReadMessage(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return message.Payload, nil
+}
+
+func (m *MemoryQueue) ReadMessage(ctx context.Context) (*Message, error) {
+
+	m.mutex.Lock()
+	for m.head == len(m.items) {
+		if m.deleted {
+			m.mutex.Unlock()
+			return nil, ErrQueueNotFound
+		}
+		notify := m.notify
+		m.mutex.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		m.mutex.Lock()
+	}
+
+	message := m.items[m.head]
+	m.items[m.head] = nil
+	m.head++
+	m.bytes -= int64(len(message.Payload))
 
-	item := <-m.Queue
+	// Reclaim consumed space
+	if m.head == len(m.items) {
+		m.items = m.items[:0]
+		m.head = 0
+	} else if m.head > 1024 && m.head > len(m.items)/2 {
+		m.items = append(m.items[:0], m.items[m.head:]...)
+		m.head = 0
+	}
+
+	m.changed()
+	m.mutex.Unlock()
 
 	atomic.AddInt64(&m.Reads, 1)
+	atomic.AddInt64(&m.BytesRead, int64(len(message.Payload)))
 
-	return item, nil
+	return message, nil
+}
+
+func (m *MemoryQueue) Unread(message *Message) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.deleted {
+		return ErrQueueNotFound
+	}
+
+	if m.head > 0 {
+		m.head--
+		m.items[m.head] = message
+	} else {
+		m.items = append([]*Message{message}, m.items...)
+	}
+	m.bytes += int64(len(message.Payload))
+	m.changed()
+
+	atomic.AddInt64(&m.Reads, -1)
+	atomic.AddInt64(&m.BytesRead, -int64(len(message.Payload)))
+
+	return nil
+}
+
+// Remove takes out the pending message with id, as if it was read, and
+// returns nil if there is none. Replicas use it to follow reads.
+func (m *MemoryQueue) Remove(id uint64) (*Message, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.deleted {
+		return nil, ErrQueueNotFound
+	}
+
+	for i := m.head; i < len(m.items); i++ {
+		message := m.items[i]
+		if message.Id != id {
+			continue
+		}
+
+		if i == m.head {
+			m.items[i] = nil
+			m.head++
+		} else {
+			m.items = append(m.items[:i], m.items[i+1:]...)
+		}
+		m.bytes -= int64(len(message.Payload))
+		m.changed()
+
+		atomic.AddInt64(&m.Reads, 1)
+		atomic.AddInt64(&m.BytesRead, int64(len(message.Payload)))
+
+		return message, nil
+	}
+
+	return nil, nil
+}
+
+func (m *MemoryQueue) Peek(offset, n int) ([]*Message, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.deleted {
+		return nil, ErrQueueNotFound
+	}
+
+	pending := m.items[m.head:]
+	if offset > len(pending) {
+		offset = len(pending)
+	}
+	pending = pending[offset:]
+	if n < len(pending) {
+		pending = pending[:n]
+	}
+
+	return append([]*Message{}, pending...), nil
+}
+
+func (m *MemoryQueue) Purge() (int64, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.deleted {
+		return 0, ErrQueueNotFound
+	}
+
+	purged := int64(len(m.items) - m.head)
+	m.items = nil
+	m.head = 0
+	m.bytes = 0
+	m.changed()
+
+	return purged, nil
+}
+
+func (m *MemoryQueue) Stats() Stats {
+
+	m.mutex.Lock()
+	length, bytes := len(m.items)-m.head, m.bytes
+	m.mutex.Unlock()
+
+	return Stats{
+		Len:          int64(length),
+		Bytes:        bytes,
+		Writes:       atomic.LoadInt64(&m.Writes),
+		Reads:        atomic.LoadInt64(&m.Reads),
+		BytesWritten: atomic.LoadInt64(&m.BytesWritten),
+		BytesRead:    atomic.LoadInt64(&m.BytesRead),
+	}
 }
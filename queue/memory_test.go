@@ -1,7 +1,10 @@
 package queue
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/fulldump/biff"
 )
@@ -106,3 +109,193 @@ func TestMemoryQueue_WriteAndRead(t *testing.T) {
 	biff.AssertNil(errRead)
 	biff.AssertEqualJson(item, map[string]interface{}{"my": "object"})
 }
+
+func TestMemoryQueue_ReadMessage_Canceled(t *testing.T) {
+
+	q := NewMemoryQueue()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	message, err := q.ReadMessage(ctx)
+	biff.AssertEqual(err, context.DeadlineExceeded)
+	biff.AssertNil(message)
+}
+
+func TestMemoryQueue_ReadMessage_Blocking(t *testing.T) {
+
+	q := NewMemoryQueue()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Write(JSON(`1`))
+	}()
+
+	message, err := q.ReadMessage(context.Background())
+	biff.AssertNil(err)
+	biff.AssertEqual(string(message.Payload), `1`)
+}
+
+func TestMemoryQueue_WriteMessage(t *testing.T) {
+
+	q := NewMemoryQueue()
+
+	q.Write(JSON(`1`))
+	q.WriteMessage(&Message{
+		Headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		Payload: JSON(`2`),
+	})
+
+	m1, _ := q.ReadMessage(context.Background())
+	biff.AssertEqual(m1.Id, uint64(1))
+	biff.AssertEqual(m1.Time.IsZero(), false)
+
+	m2, _ := q.ReadMessage(context.Background())
+	biff.AssertEqual(m2.Id, uint64(2))
+	biff.AssertEqual(m2.Headers["traceparent"], "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+}
+
+func TestMemoryQueue_Unread(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Write(JSON(`1`))
+	q.Write(JSON(`2`))
+
+	message, _ := q.ReadMessage(context.Background())
+	biff.AssertEqual(string(message.Payload), `1`)
+	biff.AssertEqual(q.Len(), 1)
+
+	biff.AssertNil(q.Unread(message))
+	biff.AssertEqual(q.Len(), 2)
+	biff.AssertEqual(q.Reads, int64(0))
+
+	item, _ := q.Read()
+	biff.AssertEqual(string(item), `1`)
+	item, _ = q.Read()
+	biff.AssertEqual(string(item), `2`)
+}
+
+func TestMemoryQueue_Peek(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Write(JSON(`1`))
+	q.Write(JSON(`2`))
+	q.Write(JSON(`3`))
+	q.Read()
+
+	messages, err := q.Peek(0, 1)
+	biff.AssertNil(err)
+	biff.AssertEqual(len(messages), 1)
+	biff.AssertEqual(string(messages[0].Payload), `2`)
+
+	messages, _ = q.Peek(0, 10)
+	biff.AssertEqual(len(messages), 2)
+	biff.AssertEqual(q.Len(), 2)
+
+	messages, _ = q.Peek(1, 10)
+	biff.AssertEqual(len(messages), 1)
+	biff.AssertEqual(string(messages[0].Payload), `3`)
+
+	messages, _ = q.Peek(5, 10)
+	biff.AssertEqual(len(messages), 0)
+}
+
+func TestMemoryQueue_Remove(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Write(JSON(`1`))
+	q.Write(JSON(`2`))
+	q.Write(JSON(`3`))
+
+	message, err := q.Remove(2)
+	biff.AssertNil(err)
+	biff.AssertEqual(string(message.Payload), `2`)
+
+	message, _ = q.Remove(2)
+	biff.AssertNil(message)
+
+	q.Remove(1)
+	biff.AssertEqual(q.Stats().Len, int64(1))
+	biff.AssertEqual(q.Stats().Reads, int64(2))
+
+	message, _ = q.ReadMessage(context.Background())
+	biff.AssertEqual(message.Id, uint64(3))
+}
+
+func TestMemoryQueue_Purge(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Write(JSON(`1`))
+	q.Write(JSON(`2`))
+
+	purged, err := q.Purge()
+	biff.AssertNil(err)
+	biff.AssertEqual(purged, int64(2))
+	biff.AssertEqual(q.Stats().Len, int64(0))
+	biff.AssertEqual(q.Stats().Bytes, int64(0))
+
+	// Ids keep increasing
+	q.Write(JSON(`3`))
+	message, _ := q.ReadMessage(context.Background())
+	biff.AssertEqual(message.Id, uint64(3))
+}
+
+func TestMemoryQueue_Capacity(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Capacity = 1
+	biff.AssertNil(q.Write(JSON(`1`)))
+
+	err := q.Write(JSON(`2`))
+	biff.AssertTrue(errors.Is(err, ErrQueueFull))
+
+	q.Read()
+	biff.AssertNil(q.Write(JSON(`2`)))
+	biff.AssertEqual(q.Len(), 1)
+}
+
+func TestMemoryQueue_MaxMessageSize(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.MaxMessageSize = 3
+
+	biff.AssertNil(q.Write(JSON(`123`)))
+
+	err := q.Write(JSON(`1234`))
+	biff.AssertTrue(errors.Is(err, ErrMessageTooLarge))
+	biff.AssertEqual(q.Len(), 1)
+}
+
+func TestMemoryService_DeleteQueue_WakesReaders(t *testing.T) {
+
+	s := NewMemoryService()
+	q, _ := s.CreateQueue("my-queue")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.DeleteQueue("my-queue")
+	}()
+
+	_, err := q.Read()
+	biff.AssertEqual(err, ErrQueueNotFound)
+}
+
+func TestMemoryService_Errors(t *testing.T) {
+
+	s := NewMemoryService()
+	s.CreateQueue("my-queue")
+
+	_, err := s.CreateQueue("my-queue")
+	biff.AssertTrue(errors.Is(err, ErrQueueAlreadyExists))
+
+	_, err = s.GetQueue("invented")
+	biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+
+	err = s.DeleteQueue("invented")
+	biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+
+	for _, name := range []string{"", "a/b", "a:read", "with space"} {
+		_, err = s.CreateQueue(name)
+		biff.AssertTrue(errors.Is(err, ErrInvalidQueueName))
+	}
+}
@@ -0,0 +1,29 @@
+package queue
+
+import (
+	"time"
+)
+
+// Message is the envelope stored in queues, Payload is what producers
+// write and what consumers read by default.
+type Message struct {
+	Id      uint64            `json:"id"`
+	Time    time.Time         `json:"time"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload JSON              `json:"payload"`
+}
+
+// assign fills Id and Time if missing, given the last id in the queue, and
+// returns the new last id.
+func (m *Message) assign(last uint64) uint64 {
+	if m.Id == 0 || m.Id <= last {
+		last++
+		m.Id = last
+	} else {
+		last = m.Id
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	return last
+}
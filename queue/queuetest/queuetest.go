@@ -0,0 +1,506 @@
+// Package queuetest checks that a queue.Service behaves as the others do.
+//
+// Backends run the whole suite against themselves from a test:
+//
+//	func TestConformance(t *testing.T) {
+//		queuetest.Run(t, func(t *testing.T) queue.Service {
+//			return queue.NewMemoryService()
+//		})
+//	}
+//
+// Every case gets a new service from the factory, which can use t.TempDir
+// and t.Cleanup for its files. Limits are left to the backend, the default
+// ones must not get in the way of a few thousand small messages.
+package queuetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// Factory returns an empty service
+type Factory func(t *testing.T) queue.Service
+
+// Timeout bounds every wait of the suite, a broken backend fails instead
+// of blocking forever
+var Timeout = 5 * time.Second
+
+type testCase struct {
+	name string
+	f    func(t *testing.T, s queue.Service, factory Factory)
+}
+
+var cases = []testCase{
+	{"Create, list, get and delete", testQueues},
+	{"Errors", testErrors},
+	{"FIFO", testFIFO},
+	{"Messages", testMessages},
+	{"Unread", testUnread},
+	{"Peek", testPeek},
+	{"Purge", testPurge},
+	{"Stats", testStats},
+	{"Blocking", testBlocking},
+	{"Canceled", testCanceled},
+	{"Delete wakes readers", testDeleteWakesReaders},
+	{"Stale handle", testStaleHandle},
+	{"Concurrent readers and writers", testConcurrent},
+	{"Concurrent writers keep order", testConcurrentOrder},
+	{"Snapshot", testSnapshot},
+}
+
+// Run runs every case as a subtest
+func Run(t *testing.T, factory Factory) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.f(t, factory(t), factory)
+		})
+	}
+}
+
+func create(s queue.Service, name string) queue.Queue {
+	q, err := s.CreateQueue(name)
+	biff.AssertNil(err)
+	return q
+}
+
+func write(q queue.Queue, payloads ...string) {
+	for _, payload := range payloads {
+		biff.AssertNil(q.Write(queue.JSON(payload)))
+	}
+}
+
+// read waits up to Timeout
+func read(q queue.Queue) (*queue.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	return q.ReadMessage(ctx)
+}
+
+func payloads(messages []*queue.Message) []string {
+	result := []string{}
+	for _, message := range messages {
+		result = append(result, string(message.Payload))
+	}
+	return result
+}
+
+func testQueues(t *testing.T, s queue.Service, factory Factory) {
+
+	names, err := s.ListQueues()
+	biff.AssertNil(err)
+	biff.AssertEqual(names, []string{})
+
+	q1 := create(s, "a")
+	create(s, "b")
+
+	names, _ = s.ListQueues()
+	sort.Strings(names)
+	biff.AssertEqual(names, []string{"a", "b"})
+
+	// The same queue, not necessarily the same value
+	q2, err := s.GetQueue("a")
+	biff.AssertNil(err)
+	write(q1, `1`)
+	biff.AssertEqual(q2.Stats().Len, int64(1))
+
+	biff.AssertNil(s.DeleteQueue("a"))
+	names, _ = s.ListQueues()
+	biff.AssertEqual(names, []string{"b"})
+
+	_, err = s.GetQueue("a")
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+
+	err = q1.Write(queue.JSON(`1`))
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+
+	// A new queue with the same name starts empty
+	q3 := create(s, "a")
+	biff.AssertEqual(q3.Stats().Len, int64(0))
+}
+
+func testErrors(t *testing.T, s queue.Service, factory Factory) {
+
+	create(s, "my-queue")
+
+	_, err := s.CreateQueue("my-queue")
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueAlreadyExists))
+
+	_, err = s.GetQueue("invented")
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+
+	err = s.DeleteQueue("invented")
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+
+	for _, name := range []string{"", "a/b", "a:read", "with space"} {
+		_, err = s.CreateQueue(name)
+		biff.AssertTrue(errors.Is(err, queue.ErrInvalidQueueName))
+	}
+
+	names, _ := s.ListQueues()
+	biff.AssertEqual(names, []string{"my-queue"})
+}
+
+func testFIFO(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+	expected := []string{}
+	for i := 1; i <= 100; i++ {
+		expected = append(expected, strconv.Itoa(i))
+	}
+	write(q, expected...)
+
+	obtained := []string{}
+	last := uint64(0)
+	for range expected {
+		message, err := read(q)
+		biff.AssertNil(err)
+		biff.AssertTrue(message.Id > last)
+		last = message.Id
+		obtained = append(obtained, string(message.Payload))
+	}
+	biff.AssertEqual(obtained, expected)
+}
+
+func testMessages(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+
+	write(q, `{"my":"object"}`)
+	sent := &queue.Message{
+		Headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		Payload: queue.JSON(`2`),
+	}
+	biff.AssertNil(q.WriteMessage(sent))
+	biff.AssertEqual(sent.Id, uint64(2))
+	biff.AssertFalse(sent.Time.IsZero())
+
+	// Greater ids are kept, others are replaced
+	biff.AssertNil(q.WriteMessage(&queue.Message{Id: 10, Payload: queue.JSON(`3`)}))
+	biff.AssertNil(q.WriteMessage(&queue.Message{Id: 5, Payload: queue.JSON(`4`)}))
+
+	payload, err := q.Read()
+	biff.AssertNil(err)
+	biff.AssertEqualJson(payload, map[string]interface{}{"my": "object"})
+
+	message, _ := read(q)
+	biff.AssertEqual(message.Id, uint64(2))
+	biff.AssertEqual(message.Headers, sent.Headers)
+	biff.AssertTrue(message.Time.Equal(sent.Time))
+
+	message, _ = read(q)
+	biff.AssertEqual(message.Id, uint64(10))
+	message, _ = read(q)
+	biff.AssertEqual(message.Id, uint64(11))
+}
+
+func testUnread(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+	write(q, `1`, `2`, `3`)
+
+	first, _ := read(q)
+	second, _ := read(q)
+	biff.AssertEqual(q.Stats().Len, int64(1))
+
+	// In reverse order, as they were
+	biff.AssertNil(q.Unread(second))
+	biff.AssertNil(q.Unread(first))
+	biff.AssertEqual(q.Stats().Len, int64(3))
+	biff.AssertEqual(q.Stats().Reads, int64(0))
+
+	messages, _ := q.Peek(0, 10)
+	biff.AssertEqual(payloads(messages), []string{`1`, `2`, `3`})
+
+	message, _ := read(q)
+	biff.AssertEqual(message.Id, first.Id)
+}
+
+func testPeek(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+	write(q, `1`, `2`, `3`)
+	q.Read()
+
+	messages, err := q.Peek(0, 1)
+	biff.AssertNil(err)
+	biff.AssertEqual(payloads(messages), []string{`2`})
+
+	messages, _ = q.Peek(0, 10)
+	biff.AssertEqual(payloads(messages), []string{`2`, `3`})
+	biff.AssertEqual(q.Stats().Len, int64(2))
+
+	messages, _ = q.Peek(1, 10)
+	biff.AssertEqual(payloads(messages), []string{`3`})
+
+	messages, _ = q.Peek(5, 10)
+	biff.AssertEqual(len(messages), 0)
+
+	messages, _ = q.Peek(0, 0)
+	biff.AssertEqual(len(messages), 0)
+}
+
+func testPurge(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+	write(q, `1`, `2`)
+
+	purged, err := q.Purge()
+	biff.AssertNil(err)
+	biff.AssertEqual(purged, int64(2))
+	biff.AssertEqual(q.Stats().Len, int64(0))
+	biff.AssertEqual(q.Stats().Bytes, int64(0))
+
+	// Ids keep increasing
+	write(q, `3`)
+	message, _ := read(q)
+	biff.AssertEqual(message.Id, uint64(3))
+}
+
+func testStats(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+	biff.AssertEqual(q.Stats(), queue.Stats{})
+
+	write(q, `1`, `22`, `333`)
+	q.Read()
+
+	biff.AssertEqual(q.Stats(), queue.Stats{
+		Len:          2,
+		Bytes:        5,
+		Writes:       3,
+		Reads:        1,
+		BytesWritten: 6,
+		BytesRead:    1,
+	})
+}
+
+func testBlocking(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Write(queue.JSON(`1`))
+	}()
+
+	message, err := read(q)
+	biff.AssertNil(err)
+	biff.AssertEqual(string(message.Payload), `1`)
+}
+
+func testCanceled(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	message, err := q.ReadMessage(ctx)
+	biff.AssertEqual(err, context.DeadlineExceeded)
+	biff.AssertTrue(message == nil)
+
+	// Nothing is lost by the canceled reader
+	write(q, `1`)
+	biff.AssertEqual(q.Stats().Len, int64(1))
+}
+
+func testDeleteWakesReaders(t *testing.T, s queue.Service, factory Factory) {
+
+	q := create(s, "my-queue")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.DeleteQueue("my-queue")
+	}()
+
+	_, err := read(q)
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+}
+
+// testStaleHandle checks a queue deleted and created again is a new one
+// for handles taken before
+func testStaleHandle(t *testing.T, s queue.Service, factory Factory) {
+
+	stale := create(s, "a")
+	write(stale, `"old"`)
+	biff.AssertNil(s.DeleteQueue("a"))
+
+	q := create(s, "a")
+	write(q, `"new"`)
+
+	// Pending messages of the deleted queue may still be handed out
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; ; i++ {
+		message, err := stale.ReadMessage(done)
+		if err != nil {
+			break
+		}
+		biff.AssertEqual(string(message.Payload), `"old"`)
+		biff.AssertTrue(i == 0)
+
+		err = stale.Unread(message)
+		biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+	}
+	biff.AssertEqual(stale.Stats().Len, int64(0))
+	biff.AssertEqual(stale.Stats().Bytes, int64(0))
+	_, err := stale.Peek(0, 10)
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+	_, err = stale.Purge()
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+
+	// The new queue is not affected
+	biff.AssertEqual(q.Stats().Len, int64(1))
+	message, err := read(q)
+	biff.AssertNil(err)
+	biff.AssertEqual(string(message.Payload), `"new"`)
+}
+
+// testConcurrent checks every message is read exactly once
+func testConcurrent(t *testing.T, s queue.Service, factory Factory) {
+
+	const writers, readers, messages = 4, 4, 250
+
+	q := create(s, "my-queue")
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				q.Write(queue.JSON(fmt.Sprintf(`"%d-%d"`, w, i)))
+			}
+		}()
+	}
+
+	mutex := sync.Mutex{}
+	read := map[string]int{}
+	failures := []error{}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writers*messages/readers; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+				message, err := q.ReadMessage(ctx)
+				cancel()
+				mutex.Lock()
+				if err != nil {
+					failures = append(failures, err)
+				} else {
+					read[string(message.Payload)]++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	biff.AssertEqual(failures, []error{})
+	biff.AssertEqual(len(read), writers*messages)
+	repeated := []string{}
+	for payload, n := range read {
+		if n > 1 {
+			repeated = append(repeated, payload)
+		}
+	}
+	biff.AssertEqual(repeated, []string{})
+
+	stats := q.Stats()
+	biff.AssertEqual(stats.Len, int64(0))
+	biff.AssertEqual(stats.Writes, int64(writers*messages))
+	biff.AssertEqual(stats.Reads, int64(writers*messages))
+}
+
+// testConcurrentOrder checks the messages of every writer are read in the
+// order they were written, with increasing ids
+func testConcurrentOrder(t *testing.T, s queue.Service, factory Factory) {
+
+	const writers, messages = 4, 250
+
+	q := create(s, "my-queue")
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				q.Write(queue.JSON(fmt.Sprintf(`[%d,%d]`, w, i)))
+			}
+		}()
+	}
+
+	next := make([]int, writers)
+	last := uint64(0)
+	for i := 0; i < writers*messages; i++ {
+		message, err := read(q)
+		biff.AssertNil(err)
+		biff.AssertTrue(message.Id > last)
+		last = message.Id
+
+		var w, n int
+		fmt.Sscanf(string(message.Payload), "[%d,%d]", &w, &n)
+		biff.AssertEqual(n, next[w])
+		next[w]++
+	}
+	wg.Wait()
+}
+
+func testSnapshot(t *testing.T, s queue.Service, factory Factory) {
+
+	create(s, "empty")
+	q := create(s, "my-queue")
+	write(q, `1`, `2`, `3`)
+	q.Read()
+
+	snapshot := &bytes.Buffer{}
+	info, err := s.Snapshot(snapshot)
+	biff.AssertNil(err)
+	biff.AssertEqual(info.Queues, 2)
+	biff.AssertEqual(info.Messages, int64(2))
+	biff.AssertEqual(info.Bytes, int64(2))
+
+	restored := factory(t)
+	create(restored, "other") // kept
+	info, err = restored.Restore(bytes.NewReader(snapshot.Bytes()))
+	biff.AssertNil(err)
+	biff.AssertEqual(info.Queues, 2)
+
+	names, _ := restored.ListQueues()
+	sort.Strings(names)
+	biff.AssertEqual(names, []string{"empty", "my-queue", "other"})
+
+	r, _ := restored.GetQueue("my-queue")
+	messages, _ := r.Peek(0, 10)
+	biff.AssertEqual(payloads(messages), []string{`2`, `3`})
+	biff.AssertEqual(messages[0].Id, uint64(2))
+
+	// Ids keep increasing
+	message := &queue.Message{Payload: queue.JSON(`4`)}
+	biff.AssertNil(r.WriteMessage(message))
+	biff.AssertEqual(message.Id, uint64(4))
+
+	// Restoring again replaces the queue, handles of the old one fail
+	_, err = restored.Restore(bytes.NewReader(snapshot.Bytes()))
+	biff.AssertNil(err)
+	stale := r
+	r, _ = restored.GetQueue("my-queue")
+	biff.AssertEqual(r.Stats().Len, int64(2))
+	_, err = stale.Peek(0, 10)
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+	biff.AssertTrue(errors.Is(stale.Write(queue.JSON(`5`)), queue.ErrQueueNotFound))
+	biff.AssertEqual(r.Stats().Len, int64(2))
+}
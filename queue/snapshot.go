@@ -0,0 +1,302 @@
+package queue
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the format written by Snapshot. A snapshot is gzip
+// compressed JSON lines: a snapshotHeader, then for every queue a
+// snapshotQueue followed by its pending messages.
+const SnapshotVersion = 1
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+type snapshotHeader struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Queues  int       `json:"queues"`
+}
+
+type snapshotQueue struct {
+	Name           string `json:"name"`
+	Capacity       int    `json:"capacity"`
+	MaxMessageSize int    `json:"max_message_size"`
+	LastId         uint64 `json:"last_id"`
+	Len            int    `json:"len"`
+
+	messages []*Message
+}
+
+// SnapshotInfo describes a snapshot written or restored
+type SnapshotInfo struct {
+	Time     time.Time `json:"time"`
+	Queues   int       `json:"queues"`
+	Messages int64     `json:"messages"`
+	Bytes    int64     `json:"bytes"` // payloads
+}
+
+// Snapshot writes every queue, with its limits and pending messages, as
+// they are at a single point in time. Queues are locked only while their
+// messages are collected, the archive is written afterwards.
+func (m *MemoryService) Snapshot(w io.Writer) (*SnapshotInfo, error) {
+	return m.SnapshotWith(w, nil)
+}
+
+// SnapshotWith calls collected, if not nil, once the state is taken and
+// before it is written, so the caller knows which changes are included.
+func (m *MemoryService) SnapshotWith(w io.Writer, collected func()) (*SnapshotInfo, error) {
+
+	queues, err := m.collect()
+	if collected != nil {
+		collected()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return writeSnapshot(w, queues)
+}
+
+// writeSnapshot writes queues in the format of SnapshotVersion
+func writeSnapshot(w io.Writer, queues []*snapshotQueue) (*SnapshotInfo, error) {
+
+	info := &SnapshotInfo{Time: time.Now(), Queues: len(queues)}
+
+	gz := gzip.NewWriter(w)
+	buffered := bufio.NewWriter(gz)
+	e := json.NewEncoder(buffered)
+
+	err := e.Encode(snapshotHeader{Version: SnapshotVersion, Time: info.Time, Queues: len(queues)})
+	for _, q := range queues {
+		if err != nil {
+			break
+		}
+		err = e.Encode(q)
+		for _, message := range q.messages {
+			if err != nil {
+				break
+			}
+			err = e.Encode(message)
+			info.Messages++
+			info.Bytes += int64(len(message.Payload))
+		}
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// collect locks the service and then every queue, so nothing changes
+// while the messages are taken
+func (m *MemoryService) collect() ([]*snapshotQueue, error) {
+
+	m.QueuesMutex.RLock()
+	defer m.QueuesMutex.RUnlock()
+
+	names := make([]string, 0, len(m.Queues))
+	for name := range m.Queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if memq, ok := m.Queues[name].(*MemoryQueue); ok {
+			memq.mutex.Lock()
+			defer memq.mutex.Unlock()
+		}
+	}
+
+	queues := make([]*snapshotQueue, 0, len(names))
+	for _, name := range names {
+		s := &snapshotQueue{Name: name}
+
+		switch q := m.Queues[name].(type) {
+		case *MemoryQueue:
+			s.Capacity = q.Capacity
+			s.MaxMessageSize = q.MaxMessageSize
+			s.LastId = q.seq
+			s.messages = append([]*Message{}, q.items[q.head:]...)
+		default:
+			messages, err := q.Peek(0, math.MaxInt)
+			if err != nil {
+				return nil, err
+			}
+			s.Capacity = m.Limits.Capacity
+			s.MaxMessageSize = m.Limits.MaxMessageSize
+			s.messages = messages
+		}
+
+		s.Len = len(s.messages)
+		queues = append(queues, s)
+	}
+
+	return queues, nil
+}
+
+// Restore loads a snapshot. Queues in the snapshot replace the existing
+// ones with the same name, the others are kept. Nothing changes if the
+// snapshot is not valid.
+func (m *MemoryService) Restore(r io.Reader) (*SnapshotInfo, error) {
+
+	info, queues, err := readSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	restored := map[string]*MemoryQueue{}
+	for _, s := range queues {
+		q := NewMemoryQueue()
+		q.Capacity = s.Capacity
+		q.MaxMessageSize = s.MaxMessageSize
+		q.seq = s.LastId
+		q.items = s.messages
+		for _, message := range s.messages {
+			q.bytes += int64(len(message.Payload))
+		}
+		restored[s.Name] = q
+	}
+
+	m.QueuesMutex.Lock()
+	defer m.QueuesMutex.Unlock()
+
+	for name, q := range restored {
+		if old, ok := m.Queues[name].(*MemoryQueue); ok {
+			old.delete()
+		}
+		m.Queues[name] = q
+	}
+
+	return info, nil
+}
+
+// readSnapshot decodes a whole snapshot. Messages without id get one and
+// LastId is at least the greatest id.
+func readSnapshot(r io.Reader) (*SnapshotInfo, []*snapshotQueue, error) {
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	defer gz.Close()
+
+	d := json.NewDecoder(bufio.NewReader(gz))
+	invalid := func(err error) (*SnapshotInfo, []*snapshotQueue, error) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+
+	header := snapshotHeader{}
+	if err := d.Decode(&header); err != nil {
+		return invalid(err)
+	}
+	if header.Version != SnapshotVersion {
+		return invalid(fmt.Errorf("unsupported version %d", header.Version))
+	}
+	if header.Queues < 0 {
+		return invalid(fmt.Errorf("negative number of queues %d", header.Queues))
+	}
+
+	info := &SnapshotInfo{Time: header.Time, Queues: header.Queues}
+	queues := []*snapshotQueue{}
+	seen := map[string]bool{}
+
+	for i := 0; i < header.Queues; i++ {
+		s := &snapshotQueue{}
+		if err := d.Decode(s); err != nil {
+			return invalid(err)
+		}
+		if err := ValidateName(s.Name); err != nil {
+			return invalid(err)
+		}
+		if seen[s.Name] {
+			return invalid(fmt.Errorf("queue '%s' is repeated", s.Name))
+		}
+		seen[s.Name] = true
+		if s.Len < 0 {
+			return invalid(fmt.Errorf("queue '%s' has a negative length %d", s.Name, s.Len))
+		}
+
+		// Len is not trusted to allocate, a message is decoded for each one
+		seq := uint64(0)
+		s.messages = []*Message{}
+		for j := 0; j < s.Len; j++ {
+			message := &Message{}
+			if err := d.Decode(message); err != nil {
+				return invalid(err)
+			}
+			// Ids are kept as they are, unread messages can be out of order
+			if message.Id == 0 {
+				seq = message.assign(seq)
+			} else if message.Id > seq {
+				seq = message.Id
+			}
+			s.messages = append(s.messages, message)
+			info.Bytes += int64(len(message.Payload))
+		}
+		s.LastId = max(s.LastId, seq)
+
+		queues = append(queues, s)
+		info.Messages += int64(s.Len)
+	}
+
+	return info, queues, nil
+}
+
+// WriteSnapshotFile writes a snapshot to a temporary file that replaces
+// path once it is complete, so path is always a valid snapshot.
+func WriteSnapshotFile(s Service, path string) (*SnapshotInfo, error) {
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name()) // fails once renamed
+
+	info, err := s.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// RestoreFile restores the snapshot written by WriteSnapshotFile
+func RestoreFile(s Service, path string) (*SnapshotInfo, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return s.Restore(f)
+}
@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/fulldump/biff"
+)
+
+func TestMemoryService_Snapshot(t *testing.T) {
+
+	s := NewMemoryService()
+	a, _ := s.CreateQueue("a")
+	a.WriteMessage(&Message{Payload: JSON(`1`), Headers: map[string]string{"k": "v"}})
+	a.Write(JSON(`2`))
+	a.Write(JSON(`3`))
+	a.Read()
+	b, _ := s.CreateQueue("b")
+	b.(*MemoryQueue).Capacity = 5
+
+	snapshot := &bytes.Buffer{}
+	info, err := s.Snapshot(snapshot)
+	biff.AssertNil(err)
+	biff.AssertEqual(info.Queues, 2)
+	biff.AssertEqual(info.Messages, int64(2))
+	biff.AssertEqual(info.Bytes, int64(2))
+
+	// Changes after the snapshot are not restored
+	a.Write(JSON(`4`))
+
+	restored := NewMemoryService()
+	restored.CreateQueue("c")
+	info, err = restored.Restore(snapshot)
+	biff.AssertNil(err)
+	biff.AssertEqual(info.Messages, int64(2))
+
+	names, _ := restored.ListQueues()
+	biff.AssertEqual(len(names), 3)
+
+	q, _ := restored.GetQueue("a")
+	messages, _ := q.Peek(0, 10)
+	biff.AssertEqual(len(messages), 2)
+	biff.AssertEqual(messages[0].Id, uint64(2))
+	biff.AssertEqual(string(messages[1].Payload), `3`)
+
+	// Ids keep increasing
+	q.Write(JSON(`4`))
+	messages, _ = q.Peek(2, 1)
+	biff.AssertEqual(messages[0].Id, uint64(4))
+
+	q, _ = restored.GetQueue("b")
+	biff.AssertEqual(q.(*MemoryQueue).Capacity, 5)
+}
+
+func TestMemoryService_RestoreReplaces(t *testing.T) {
+
+	s := NewMemoryService()
+	q, _ := s.CreateQueue("a")
+	q.Write(JSON(`"snapshot"`))
+
+	snapshot := &bytes.Buffer{}
+	s.Snapshot(snapshot)
+
+	q.Write(JSON(`"later"`))
+	_, err := s.Restore(snapshot)
+	biff.AssertNil(err)
+
+	// The replaced queue is deleted
+	err = q.Write(JSON(`"lost"`))
+	biff.AssertTrue(errors.Is(err, ErrQueueNotFound))
+
+	q, _ = s.GetQueue("a")
+	biff.AssertEqual(q.Stats().Len, int64(1))
+}
+
+func TestMemoryService_RestoreInvalid(t *testing.T) {
+
+	s := NewMemoryService()
+	q, _ := s.CreateQueue("a")
+	q.Write(JSON(`1`))
+	s.CreateQueue("b")
+
+	snapshot := &bytes.Buffer{}
+	s.Snapshot(snapshot)
+
+	_, err := NewMemoryService().Restore(bytes.NewReader([]byte(`{}`)))
+	biff.AssertTrue(errors.Is(err, ErrInvalidSnapshot))
+
+	// Truncated snapshots change nothing
+	restored := NewMemoryService()
+	gz, _ := gzip.NewReader(snapshot)
+	lines, _ := io.ReadAll(gz)
+	truncated := &bytes.Buffer{}
+	w := gzip.NewWriter(truncated)
+	w.Write(lines[:bytes.LastIndexByte(lines[:len(lines)-1], '\n')+1]) // without b
+	w.Close()
+	_, err = restored.Restore(truncated)
+	biff.AssertTrue(errors.Is(err, ErrInvalidSnapshot))
+	names, _ := restored.ListQueues()
+	biff.AssertEqual(len(names), 0)
+
+	// Lengths are not trusted
+	for _, header := range []string{
+		`{"version":1,"queues":-1}`,
+		`{"version":1,"queues":1}` + "\n" + `{"name":"a","len":-1}`,
+		`{"version":1,"queues":1}` + "\n" + `{"name":"a","len":9223372036854775807}`,
+	} {
+		forged := &bytes.Buffer{}
+		w := gzip.NewWriter(forged)
+		w.Write([]byte(header + "\n"))
+		w.Close()
+		_, err = restored.Restore(forged)
+		biff.AssertTrue(errors.Is(err, ErrInvalidSnapshot))
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+
+	s := NewMemoryService()
+	q, _ := s.CreateQueue("a")
+	q.Write(JSON(`1`))
+
+	path := filepath.Join(t.TempDir(), "tailon.snapshot")
+	_, err := WriteSnapshotFile(s, path)
+	biff.AssertNil(err)
+
+	restored := NewMemoryService()
+	info, err := RestoreFile(restored, path)
+	biff.AssertNil(err)
+	biff.AssertEqual(info.Queues, 1)
+
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+	biff.AssertEqual(len(files), 1) // no temporary files left
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket that refills at Rate tokens per second up to
+// Burst tokens. A zero Rate means unlimited.
+type Bucket struct {
+	Rate  float64
+	Burst float64
+
+	tokens float64
+	last   time.Time
+	used   time.Time
+	mutex  sync.Mutex
+}
+
+// BucketState is a point in time view of a Bucket.
+type BucketState struct {
+	Rate   float64 `json:"rate"`
+	Burst  float64 `json:"burst"`
+	Tokens float64 `json:"tokens"`
+}
+
+func NewBucket(rate, burst float64) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &Bucket{
+		Rate:   rate,
+		Burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		used:   time.Now(),
+	}
+}
+
+// refill must be called with the mutex held
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(b.Burst, b.tokens+elapsed*b.Rate)
+	b.last = now
+}
+
+// Check returns how long the caller should wait before n tokens are
+// available. Zero means they are available right now.
+func (b *Bucket) Check(n float64) time.Duration {
+	if b == nil || b.Rate <= 0 {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+
+	if b.tokens >= n || b.tokens >= b.Burst {
+		// A single request bigger than the burst is let through when the
+		// bucket is full, otherwise it could never pass.
+		return 0
+	}
+
+	missing := math.Min(n, b.Burst) - b.tokens
+	return time.Duration(missing / b.Rate * float64(time.Second))
+}
+
+// Take consumes n tokens. The bucket can go into debt, so subsequent calls
+// to Check will have to wait until it is paid.
+func (b *Bucket) Take(n float64) {
+	if b == nil || b.Rate <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+	b.used = time.Now()
+}
+
+func (b *Bucket) State() BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+
+	return BucketState{
+		Rate:   b.Rate,
+		Burst:  b.Burst,
+		Tokens: b.tokens,
+	}
+}
+
+// idle returns true if the bucket is full and has not been used since t
+func (b *Bucket) idle(t time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+
+	return b.used.Before(t) && b.tokens >= b.Burst
+}
@@ -0,0 +1,221 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limit is the allowed throughput for a single key. Zero values mean
+// unlimited.
+type Limit struct {
+	Messages float64 `usage:"Messages per second, 0 means unlimited"`
+	Bytes    float64 `usage:"Bytes per second, 0 means unlimited"`
+}
+
+func (l Limit) unlimited() bool {
+	return l.Messages <= 0 && l.Bytes <= 0
+}
+
+// Config holds the limits applied to every queue, every authenticated user
+// and every remote IP.
+type Config struct {
+	Queue Limit
+	User  Limit
+	IP    Limit
+}
+
+// ErrLimitExceeded is returned when a Limiter has not enough tokens.
+type ErrLimitExceeded struct {
+	Limiter    string
+	RetryAfter time.Duration
+}
+
+func (e *ErrLimitExceeded) Error() string {
+	return fmt.Sprintf("rate limit exceeded for '%s', retry after %s", e.Limiter, e.RetryAfter)
+}
+
+// Limiter limits messages and bytes per second for a single key.
+type Limiter struct {
+	Name     string
+	Messages *Bucket
+	Bytes    *Bucket
+}
+
+// LimiterState is a point in time view of a Limiter.
+type LimiterState struct {
+	Messages *BucketState `json:"messages,omitempty"`
+	Bytes    *BucketState `json:"bytes,omitempty"`
+}
+
+func NewLimiter(name string, l Limit) *Limiter {
+	limiter := &Limiter{
+		Name: name,
+	}
+	if l.Messages > 0 {
+		limiter.Messages = NewBucket(l.Messages, l.Messages)
+	}
+	if l.Bytes > 0 {
+		limiter.Bytes = NewBucket(l.Bytes, l.Bytes)
+	}
+	return limiter
+}
+
+// Check returns how long to wait until messages and bytes are available.
+func (l *Limiter) Check(messages, bytes float64) time.Duration {
+	m := l.Messages.Check(messages)
+	b := l.Bytes.Check(bytes)
+	if m > b {
+		return m
+	}
+	return b
+}
+
+func (l *Limiter) Take(messages, bytes float64) {
+	l.Messages.Take(messages)
+	l.Bytes.Take(bytes)
+}
+
+func (l *Limiter) State() LimiterState {
+	s := LimiterState{}
+	if l.Messages != nil {
+		m := l.Messages.State()
+		s.Messages = &m
+	}
+	if l.Bytes != nil {
+		b := l.Bytes.State()
+		s.Bytes = &b
+	}
+	return s
+}
+
+func (l *Limiter) idle(t time.Time) bool {
+	return l.Messages.idle(t) && l.Bytes.idle(t)
+}
+
+// Set is a group of limiters that must all agree.
+type Set []*Limiter
+
+// NewSet discards nil limiters, so unlimited keys can be passed directly.
+func NewSet(limiters ...*Limiter) Set {
+	s := Set{}
+	for _, l := range limiters {
+		if l != nil {
+			s = append(s, l)
+		}
+	}
+	return s
+}
+
+// Check returns nil if every limiter has enough tokens, otherwise the error
+// carries the longest wait.
+func (s Set) Check(messages, bytes float64) error {
+	var err *ErrLimitExceeded
+	for _, l := range s {
+		wait := l.Check(messages, bytes)
+		if wait <= 0 {
+			continue
+		}
+		if err == nil || wait > err.RetryAfter {
+			err = &ErrLimitExceeded{
+				Limiter:    l.Name,
+				RetryAfter: wait,
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s Set) Take(messages, bytes float64) {
+	for _, l := range s {
+		l.Take(messages, bytes)
+	}
+}
+
+func (s Set) State() map[string]LimiterState {
+	result := map[string]LimiterState{}
+	for _, l := range s {
+		result[l.Name] = l.State()
+	}
+	return result
+}
+
+// Registry creates limiters on demand and forgets them once they are idle.
+type Registry struct {
+	Config Config
+
+	// IdleTimeout is the time after which a full and unused limiter is
+	// forgotten.
+	IdleTimeout time.Duration
+
+	limiters map[string]*Limiter
+	mutex    sync.Mutex
+	lastGC   time.Time
+}
+
+func New(c Config) *Registry {
+	return &Registry{
+		Config:      c,
+		IdleTimeout: 10 * time.Minute,
+		limiters:    map[string]*Limiter{},
+		lastGC:      time.Now(),
+	}
+}
+
+func (r *Registry) Queue(name string) *Limiter {
+	return r.get("queue:"+name, r.Config.Queue)
+}
+
+func (r *Registry) User(id string) *Limiter {
+	return r.get("user:"+id, r.Config.User)
+}
+
+func (r *Registry) IP(ip string) *Limiter {
+	return r.get("ip:"+ip, r.Config.IP)
+}
+
+// get returns nil if the limit is unlimited
+func (r *Registry) get(name string, l Limit) *Limiter {
+	if r == nil || l.unlimited() {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	limiter, exists := r.limiters[name]
+	if !exists {
+		r.gc()
+		limiter = NewLimiter(name, l)
+		r.limiters[name] = limiter
+	}
+
+	return limiter
+}
+
+// gc must be called with the mutex held
+func (r *Registry) gc() {
+	now := time.Now()
+	if now.Sub(r.lastGC) < r.IdleTimeout {
+		return
+	}
+	r.lastGC = now
+
+	deadline := now.Add(-r.IdleTimeout)
+	for name, limiter := range r.limiters {
+		if limiter.idle(deadline) {
+			delete(r.limiters, name)
+		}
+	}
+}
+
+// Len returns the number of tracked limiters.
+func (r *Registry) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.limiters)
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+)
+
+func TestBucket_Unlimited(t *testing.T) {
+
+	b := NewBucket(0, 0)
+
+	b.Take(1000)
+	biff.AssertEqual(b.Check(1000), time.Duration(0))
+}
+
+func TestBucket_Exhausted(t *testing.T) {
+
+	b := NewBucket(10, 10)
+
+	biff.AssertEqual(b.Check(10), time.Duration(0))
+	b.Take(10)
+
+	wait := b.Check(1)
+	biff.AssertTrue(wait > 0)
+	biff.AssertTrue(wait <= 100*time.Millisecond)
+}
+
+func TestBucket_Debt(t *testing.T) {
+
+	b := NewBucket(10, 10)
+	b.Take(20)
+
+	wait := b.Check(1)
+	biff.AssertTrue(wait > time.Second)
+}
+
+func TestBucket_BiggerThanBurst(t *testing.T) {
+
+	b := NewBucket(10, 10)
+
+	biff.AssertEqual(b.Check(100), time.Duration(0))
+}
+
+func TestRegistry_Unlimited(t *testing.T) {
+
+	r := New(Config{})
+
+	biff.AssertNil(r.Queue("my-queue"))
+	biff.AssertNil(NewSet(r.Queue("my-queue")).Check(1, 1))
+	biff.AssertEqual(r.Len(), 0)
+}
+
+func TestRegistry_SameLimiter(t *testing.T) {
+
+	r := New(Config{
+		IP: Limit{Messages: 1},
+	})
+
+	l1 := r.IP("127.0.0.1")
+	l2 := r.IP("127.0.0.1")
+	l3 := r.IP("10.0.0.1")
+
+	biff.AssertEqual(l1, l2)
+	biff.AssertNotEqual(l1, l3)
+	biff.AssertEqual(r.Len(), 2)
+}
+
+func TestSet_Check(t *testing.T) {
+
+	r := New(Config{
+		Queue: Limit{Messages: 100},
+		User:  Limit{Bytes: 10},
+	})
+
+	s := NewSet(r.Queue("my-queue"), r.User("fulldump"), r.IP("127.0.0.1"))
+	biff.AssertEqual(len(s), 2)
+
+	biff.AssertNil(s.Check(1, 10))
+	s.Take(1, 10)
+
+	err := s.Check(1, 10)
+	biff.AssertNotNil(err)
+
+	e := err.(*ErrLimitExceeded)
+	biff.AssertEqual(e.Limiter, "user:fulldump")
+	biff.AssertTrue(e.RetryAfter > 0)
+}
+
+func TestRegistry_ForgetIdle(t *testing.T) {
+
+	r := New(Config{
+		IP: Limit{Messages: 1000},
+	})
+	r.IdleTimeout = time.Millisecond
+
+	r.IP("127.0.0.1")
+	time.Sleep(10 * time.Millisecond)
+	r.IP("10.0.0.1")
+
+	biff.AssertEqual(r.Len(), 1)
+}
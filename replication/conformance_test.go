@@ -0,0 +1,14 @@
+package replication
+
+import (
+	"testing"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/queue/queuetest"
+)
+
+func TestPrimary_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+		return NewPrimary(queue.NewMemoryService())
+	})
+}
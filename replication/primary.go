@@ -0,0 +1,553 @@
+// Package replication keeps read-only replicas of a queue service.
+//
+// A Primary wraps a MemoryService and logs every change: queues created
+// and deleted, messages written, removed by a read, unread and purged. A
+// Replica loads a snapshot of the primary and then follows its log over
+// HTTP, asynchronously. Replicas serve stats and peeks and can be
+// promoted to take over when the primary fails.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// DefaultLogSize is the number of changes kept for replicas to catch up
+// without a full sync
+const DefaultLogSize = 100 * 1000
+
+// HeartbeatInterval is sent to idle replicas, so they know they are up to
+// date and the primary is alive
+var HeartbeatInterval = time.Second
+
+type Config struct {
+	Primary bool   `usage:"Keep a log of changes so replicas can follow this server"`
+	Follow  string `usage:"Primary url to follow, this server is a read-only replica until promoted"`
+	LogSize int    `usage:"Changes kept for replicas to catch up without a full sync"`
+	Token   string `usage:"Secret replicas send to the primary, it protects the snapshot, the stream and promote"`
+}
+
+var (
+	ErrReadOnly = errors.New("read-only replica")
+
+	// ErrOutOfSync means the log does not have the changes a replica
+	// needs, it has to sync again from a snapshot
+	ErrOutOfSync = errors.New("replica out of sync")
+)
+
+// New returns a Replica of c.Follow, already following it, or a Primary
+// if there is nothing to follow
+func New(c Config, inner *queue.MemoryService) Node {
+
+	logSize := c.LogSize
+	if logSize <= 0 {
+		logSize = DefaultLogSize
+	}
+
+	if c.Follow == "" {
+		p := NewPrimary(inner)
+		p.LogSize = logSize
+		return p
+	}
+
+	r := NewReplica(c.Follow, inner)
+	r.Token = c.Token
+	r.local.LogSize = logSize
+	r.Start()
+	return r
+}
+
+// Headers of snapshots and streams, they tell the log and the position
+const (
+	IdHeader  = "Replication-Id"
+	SeqHeader = "Replication-Seq"
+)
+
+// Types of Op
+const (
+	OpCreate    = "create"
+	OpDelete    = "delete"
+	OpWrite     = "write"
+	OpRemove    = "remove"
+	OpUnread    = "unread"
+	OpPurge     = "purge"
+	OpHeartbeat = "heartbeat"
+)
+
+// Op is a change in the log, a line in the stream
+type Op struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Queue string    `json:"queue,omitempty"`
+
+	Id             uint64         `json:"id,omitempty"`      // remove
+	Message        *queue.Message `json:"message,omitempty"` // write and unread
+	Capacity       int            `json:"capacity,omitempty"`
+	MaxMessageSize int            `json:"max_message_size,omitempty"`
+}
+
+// Node is a Primary or a Replica
+type Node interface {
+	queue.Service
+	Status() *Status
+
+	// Source is the primary replicas follow, ErrReadOnly until promoted
+	Source() (*Primary, error)
+	Promote() error
+}
+
+type Status struct {
+	Role        string                  `json:"role"` // primary or replica
+	Id          string                  `json:"id"`   // of the log
+	Seq         uint64                  `json:"seq"`  // last change, applied by replicas
+	Primary     string                  `json:"primary,omitempty"`
+	Connected   bool                    `json:"connected"`
+	LastContact time.Time               `json:"last_contact,omitzero"`
+	Error       string                  `json:"error,omitempty"`
+	Queues      map[string]*QueueStatus `json:"queues,omitempty"`
+	Replicas    []*FollowerStatus       `json:"replicas,omitempty"`
+}
+
+// QueueStatus is the last change applied to a queue by a replica. Lag is
+// how long after the primary it was applied, 0 once the replica is up to
+// date.
+type QueueStatus struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time,omitzero"`
+	Lag  float64   `json:"lag_seconds"`
+}
+
+// FollowerStatus is a replica streaming from a primary
+type FollowerStatus struct {
+	Addr  string    `json:"addr"`
+	Seq   uint64    `json:"seq"` // last change sent
+	Start time.Time `json:"start"`
+}
+
+type Primary struct {
+	LogSize int
+
+	inner atomic.Pointer[queue.MemoryService]
+
+	id        string
+	seq       uint64
+	ops       []*Op         // the last ones, up to seq
+	notify    chan struct{} // closed and replaced on every change
+	followers map[*FollowerStatus]bool
+	mutex     sync.Mutex
+}
+
+func NewPrimary(inner *queue.MemoryService) *Primary {
+	p := &Primary{
+		LogSize:   DefaultLogSize,
+		id:        uuid.New().String(),
+		notify:    make(chan struct{}),
+		followers: map[*FollowerStatus]bool{},
+	}
+	p.inner.Store(inner)
+	return p
+}
+
+// append must be called with the mutex held
+func (p *Primary) append(op *Op) {
+
+	p.seq++
+	op.Seq = p.seq
+	op.Time = time.Now()
+
+	p.ops = append(p.ops, op)
+	if p.LogSize > 0 && len(p.ops) > p.LogSize {
+		p.ops = p.ops[len(p.ops)-p.LogSize:]
+	}
+
+	p.changed()
+}
+
+// changed must be called with the mutex held
+func (p *Primary) changed() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// restart begins a new log, replicas of the previous one sync again. Must
+// be called with the mutex held.
+func (p *Primary) restart() {
+	p.id = uuid.New().String()
+	p.ops = nil
+	p.changed()
+}
+
+func (p *Primary) GetQueue(name string) (queue.Queue, error) {
+	q, err := p.inner.Load().GetQueue(name)
+	if err != nil {
+		return nil, err
+	}
+	return &primaryQueue{primary: p, name: name, queue: q}, nil
+}
+
+func (p *Primary) ListQueues() ([]string, error) {
+	return p.inner.Load().ListQueues()
+}
+
+func (p *Primary) CreateQueue(name string) (queue.Queue, error) {
+	return p.createQueue(name, nil)
+}
+
+// createQueue with the limits of the service if limits is nil
+func (p *Primary) createQueue(name string, limits *queue.Limits) (queue.Queue, error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	q, err := p.inner.Load().CreateQueue(name)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &Op{Type: OpCreate, Queue: name}
+	if memq, ok := q.(*queue.MemoryQueue); ok {
+		if limits != nil {
+			memq.Capacity = limits.Capacity
+			memq.MaxMessageSize = limits.MaxMessageSize
+		}
+		op.Capacity = memq.Capacity
+		op.MaxMessageSize = memq.MaxMessageSize
+	}
+	p.append(op)
+
+	return &primaryQueue{primary: p, name: name, queue: q}, nil
+}
+
+func (p *Primary) DeleteQueue(name string) error {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err := p.inner.Load().DeleteQueue(name)
+	if err == nil {
+		p.append(&Op{Type: OpDelete, Queue: name})
+	}
+
+	return err
+}
+
+func (p *Primary) Snapshot(w io.Writer) (*queue.SnapshotInfo, error) {
+	return p.inner.Load().Snapshot(w)
+}
+
+// Restore changes queues outside of the log, replicas sync again
+func (p *Primary) Restore(r io.Reader) (*queue.SnapshotInfo, error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info, err := p.inner.Load().Restore(r)
+	if err == nil {
+		p.restart()
+	}
+
+	return info, err
+}
+
+// SnapshotAt writes a snapshot for a replica to start following the log,
+// started is called with the position before anything is written
+func (p *Primary) SnapshotAt(w io.Writer, started func(id string, seq uint64)) (*queue.SnapshotInfo, error) {
+
+	// Changes wait while the queues are collected
+	p.mutex.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			p.mutex.Unlock()
+		}
+	}()
+
+	return p.inner.Load().SnapshotWith(w, func() {
+		started(p.id, p.seq)
+		p.mutex.Unlock()
+		locked = false
+	})
+}
+
+// Reset replaces every queue with a snapshot and starts a new log
+func (p *Primary) Reset(r io.Reader) (*queue.SnapshotInfo, error) {
+
+	old := p.inner.Load()
+
+	inner := queue.NewMemoryService()
+	inner.Limits = old.Limits
+	info, err := inner.Restore(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.inner.Store(inner)
+	names, _ := old.ListQueues()
+	for _, name := range names {
+		old.DeleteQueue(name) // wakes up blocked readers
+	}
+	p.restart()
+
+	return info, nil
+}
+
+// since returns the changes after from, in pages, and the channel closed on
+// the next change
+func (p *Primary) since(id string, from uint64) ([]*Op, uint64, chan struct{}, error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	first := p.seq - uint64(len(p.ops)) + 1
+	if id != p.id || from > p.seq || from+1 < first {
+		return nil, 0, nil, ErrOutOfSync
+	}
+
+	ops := p.ops[from+1-first:]
+	if len(ops) > 1000 {
+		ops = ops[:1000]
+	}
+
+	return append([]*Op{}, ops...), p.seq, p.notify, nil
+}
+
+// Stream writes the changes after from as JSON lines, and heartbeats when
+// there are none, until ctx is done. It fails with ErrOutOfSync before
+// writing anything if the replica has to sync again.
+func (p *Primary) Stream(ctx context.Context, id string, from uint64, addr string, w io.Writer, flush func()) error {
+
+	ops, seq, notify, err := p.since(id, from)
+	if err != nil {
+		return err
+	}
+
+	follower := &FollowerStatus{Addr: addr, Seq: from, Start: time.Now()}
+	p.mutex.Lock()
+	p.followers[follower] = true
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		delete(p.followers, follower)
+		p.mutex.Unlock()
+	}()
+
+	e := json.NewEncoder(w)
+	heartbeat := time.NewTimer(0)
+	defer heartbeat.Stop()
+
+	for {
+		for _, op := range ops {
+			if err := e.Encode(op); err != nil {
+				return err
+			}
+		}
+		if len(ops) > 0 {
+			from = ops[len(ops)-1].Seq
+			p.mutex.Lock()
+			follower.Seq = from
+			p.mutex.Unlock()
+			flush()
+			heartbeat.Reset(HeartbeatInterval)
+		}
+
+		if from == seq {
+			select {
+			case <-notify:
+			case <-heartbeat.C:
+				if err := e.Encode(&Op{Seq: seq, Time: time.Now(), Type: OpHeartbeat}); err != nil {
+					return err
+				}
+				flush()
+				heartbeat.Reset(HeartbeatInterval)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		ops, seq, notify, err = p.since(id, from)
+		if err != nil {
+			return nil // restarted, the replica will find out
+		}
+	}
+}
+
+// apply a change of another log, as a replica
+func (p *Primary) apply(op *Op) error {
+
+	switch op.Type {
+	case OpCreate:
+		_, err := p.createQueue(op.Queue, &queue.Limits{Capacity: op.Capacity, MaxMessageSize: op.MaxMessageSize})
+		return err
+
+	case OpDelete:
+		return p.DeleteQueue(op.Queue)
+	}
+
+	q, err := p.GetQueue(op.Queue)
+	if err != nil {
+		return err
+	}
+	pq := q.(*primaryQueue)
+
+	switch op.Type {
+	case OpWrite:
+		if op.Message == nil {
+			return errors.New("write without message")
+		}
+		return pq.WriteMessage(op.Message)
+	case OpRemove:
+		return pq.remove(op.Id)
+	case OpUnread:
+		if op.Message == nil {
+			return errors.New("unread without message")
+		}
+		return pq.Unread(op.Message)
+	case OpPurge:
+		_, err := pq.Purge()
+		return err
+	}
+
+	return nil // unknown changes are from newer versions
+}
+
+func (p *Primary) Status() *Status {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	s := &Status{
+		Role:      "primary",
+		Id:        p.id,
+		Seq:       p.seq,
+		Connected: true,
+		Replicas:  []*FollowerStatus{},
+	}
+	for f := range p.followers {
+		copied := *f
+		s.Replicas = append(s.Replicas, &copied)
+	}
+
+	return s
+}
+
+func (p *Primary) Source() (*Primary, error) {
+	return p, nil
+}
+
+// Promote does nothing, it is already the primary
+func (p *Primary) Promote() error {
+	return nil
+}
+
+// primaryQueue logs the changes of a queue
+type primaryQueue struct {
+	primary *Primary
+	name    string
+	queue   queue.Queue
+}
+
+func (q *primaryQueue) Write(payload queue.JSON) error {
+	return q.WriteMessage(&queue.Message{Payload: payload})
+}
+
+func (q *primaryQueue) Read() (queue.JSON, error) {
+	message, err := q.ReadMessage(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return message.Payload, nil
+}
+
+func (q *primaryQueue) WriteMessage(message *queue.Message) error {
+
+	q.primary.mutex.Lock()
+	defer q.primary.mutex.Unlock()
+
+	err := q.queue.WriteMessage(message)
+	if err == nil {
+		q.primary.append(&Op{Type: OpWrite, Queue: q.name, Message: message})
+	}
+
+	return err
+}
+
+// ReadMessage can not hold the log while it waits, removes are logged by
+// id so their order with other changes does not matter
+func (q *primaryQueue) ReadMessage(ctx context.Context) (*queue.Message, error) {
+
+	message, err := q.queue.ReadMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q.primary.mutex.Lock()
+	q.primary.append(&Op{Type: OpRemove, Queue: q.name, Id: message.Id})
+	q.primary.mutex.Unlock()
+
+	return message, nil
+}
+
+func (q *primaryQueue) remove(id uint64) error {
+
+	memq, ok := q.queue.(*queue.MemoryQueue)
+	if !ok {
+		return errors.New("remove needs a memory queue")
+	}
+
+	q.primary.mutex.Lock()
+	defer q.primary.mutex.Unlock()
+
+	_, err := memq.Remove(id)
+	if err == nil {
+		q.primary.append(&Op{Type: OpRemove, Queue: q.name, Id: id})
+	}
+
+	return err
+}
+
+func (q *primaryQueue) Unread(message *queue.Message) error {
+
+	q.primary.mutex.Lock()
+	defer q.primary.mutex.Unlock()
+
+	err := q.queue.Unread(message)
+	if err == nil {
+		q.primary.append(&Op{Type: OpUnread, Queue: q.name, Message: message})
+	}
+
+	return err
+}
+
+func (q *primaryQueue) Peek(offset, n int) ([]*queue.Message, error) {
+	return q.queue.Peek(offset, n)
+}
+
+func (q *primaryQueue) Purge() (int64, error) {
+
+	q.primary.mutex.Lock()
+	defer q.primary.mutex.Unlock()
+
+	purged, err := q.queue.Purge()
+	if err == nil {
+		q.primary.append(&Op{Type: OpPurge, Queue: q.name})
+	}
+
+	return purged, err
+}
+
+func (q *primaryQueue) Stats() queue.Stats {
+	return q.queue.Stats()
+}
@@ -0,0 +1,384 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// Replica follows a primary until it is promoted. Meanwhile queues can be
+// listed, peeked and their stats retrieved, changes fail with ErrReadOnly.
+type Replica struct {
+	URL        string
+	Token      string // sent as 'Authorization: Bearer TOKEN'
+	HTTPClient *http.Client
+	RetryMin   time.Duration
+	RetryMax   time.Duration
+
+	local    *Primary
+	promoted atomic.Bool
+
+	mutex       sync.Mutex
+	id          string // of the primary log, empty to sync again
+	seq         uint64
+	connected   bool
+	lastContact time.Time
+	lastError   string
+	queues      map[string]*QueueStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReplica keeps the queues of the primary at url in inner, which is
+// replaced on the first sync. Call Start to follow it.
+func NewReplica(url string, inner *queue.MemoryService) *Replica {
+	return &Replica{
+		URL:        strings.TrimSuffix(url, "/"),
+		HTTPClient: http.DefaultClient,
+		RetryMin:   100 * time.Millisecond,
+		RetryMax:   10 * time.Second,
+		local:      NewPrimary(inner),
+		queues:     map[string]*QueueStatus{},
+	}
+}
+
+// Start follows the primary in background, reconnecting on errors
+func (r *Replica) Start() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		r.run(ctx)
+	}()
+}
+
+func (r *Replica) run(ctx context.Context) {
+
+	delay := r.RetryMin
+	for ctx.Err() == nil {
+		contacted, err := r.follow(ctx)
+
+		r.mutex.Lock()
+		r.connected = false
+		if err != nil && ctx.Err() == nil {
+			r.lastError = err.Error()
+		}
+		r.mutex.Unlock()
+
+		if contacted {
+			delay = r.RetryMin
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay = min(delay*2, r.RetryMax)
+	}
+}
+
+// stop following, Close and Promote use it
+func (r *Replica) stop() {
+	if r.cancel != nil {
+		r.cancel()
+		<-r.done
+	}
+}
+
+func (r *Replica) Close() error {
+	r.stop()
+	return nil
+}
+
+// Promote stops following the primary and accepts changes, replicas can
+// follow this one from now on
+func (r *Replica) Promote() error {
+	r.stop()
+	r.promoted.Store(true)
+	return nil
+}
+
+func (r *Replica) Source() (*Primary, error) {
+	if !r.promoted.Load() {
+		return nil, ErrReadOnly
+	}
+	return r.local, nil
+}
+
+// follow syncs if needed and applies changes until an error. contacted is
+// true if the primary answered.
+func (r *Replica) follow(ctx context.Context) (contacted bool, err error) {
+
+	r.mutex.Lock()
+	id, seq := r.id, r.seq
+	r.mutex.Unlock()
+
+	if id == "" {
+		if err := r.sync(ctx); err != nil {
+			return false, err
+		}
+		r.mutex.Lock()
+		id, seq = r.id, r.seq
+		r.mutex.Unlock()
+	}
+
+	// The primary is considered gone without heartbeats
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := time.AfterFunc(3*HeartbeatInterval, cancel)
+	defer watchdog.Stop()
+
+	res, err := r.request(ctx, "/v1/replication:stream", id, seq)
+	if err == ErrOutOfSync {
+		r.mutex.Lock()
+		r.id = ""
+		r.mutex.Unlock()
+		return true, err
+	}
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	r.mutex.Lock()
+	r.connected = true
+	r.lastError = ""
+	r.mutex.Unlock()
+
+	d := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		op := &Op{}
+		if err := d.Decode(op); err != nil {
+			if ctx.Err() != nil {
+				return true, fmt.Errorf("primary is not responding: %w", ctx.Err())
+			}
+			return true, err
+		}
+		watchdog.Reset(3 * HeartbeatInterval)
+
+		if err := r.apply(op); err != nil {
+			r.mutex.Lock()
+			r.id = "" // diverged, sync again
+			r.mutex.Unlock()
+			return true, fmt.Errorf("applying %s %d: %w", op.Type, op.Seq, err)
+		}
+	}
+}
+
+// sync replaces every queue with a snapshot of the primary
+func (r *Replica) sync(ctx context.Context) error {
+
+	res, err := r.request(ctx, "/v1/replication:snapshot", "", 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	id := res.Header.Get(IdHeader)
+	seq, err := strconv.ParseUint(res.Header.Get(SeqHeader), 10, 64)
+	if id == "" || err != nil {
+		return fmt.Errorf("%w: snapshot without position", ErrOutOfSync)
+	}
+
+	if _, err := r.local.Reset(res.Body); err != nil {
+		return err
+	}
+
+	names, _ := r.local.ListQueues()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.id, r.seq = id, seq
+	r.lastContact = time.Now()
+	r.queues = map[string]*QueueStatus{}
+	for _, name := range names {
+		r.queues[name] = &QueueStatus{Seq: seq}
+	}
+
+	return nil
+}
+
+func (r *Replica) request(ctx context.Context, path, id string, seq uint64) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", r.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	if id != "" {
+		req.Header.Set(IdHeader, id)
+		req.Header.Set(SeqHeader, strconv.FormatUint(seq, 10))
+	}
+
+	res, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusGone {
+		res.Body.Close()
+		return nil, ErrOutOfSync
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return res, nil
+}
+
+func (r *Replica) apply(op *Op) error {
+
+	now := time.Now()
+
+	if op.Type != OpHeartbeat {
+		if err := r.local.apply(op); err != nil {
+			return err
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastContact = now
+
+	if op.Type == OpHeartbeat {
+		if op.Seq == r.seq {
+			for _, q := range r.queues {
+				q.Lag = 0 // up to date
+			}
+		}
+		return nil
+	}
+
+	r.seq = op.Seq
+	if op.Type == OpDelete {
+		delete(r.queues, op.Queue)
+		return nil
+	}
+	r.queues[op.Queue] = &QueueStatus{
+		Seq:  op.Seq,
+		Time: op.Time,
+		Lag:  max(now.Sub(op.Time).Seconds(), 0),
+	}
+
+	return nil
+}
+
+func (r *Replica) Status() *Status {
+
+	if r.promoted.Load() {
+		return r.local.Status()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := &Status{
+		Role:        "replica",
+		Id:          r.id,
+		Seq:         r.seq,
+		Primary:     r.URL,
+		Connected:   r.connected,
+		LastContact: r.lastContact,
+		Error:       r.lastError,
+		Queues:      map[string]*QueueStatus{},
+	}
+	for name, q := range r.queues {
+		copied := *q
+		s.Queues[name] = &copied
+	}
+
+	return s
+}
+
+func (r *Replica) GetQueue(name string) (queue.Queue, error) {
+	q, err := r.local.GetQueue(name)
+	if err != nil || r.promoted.Load() {
+		return q, err
+	}
+	return &readOnlyQueue{q}, nil
+}
+
+func (r *Replica) ListQueues() ([]string, error) {
+	return r.local.ListQueues()
+}
+
+func (r *Replica) CreateQueue(name string) (queue.Queue, error) {
+	if !r.promoted.Load() {
+		return nil, ErrReadOnly
+	}
+	return r.local.CreateQueue(name)
+}
+
+func (r *Replica) DeleteQueue(name string) error {
+	if !r.promoted.Load() {
+		return ErrReadOnly
+	}
+	return r.local.DeleteQueue(name)
+}
+
+func (r *Replica) Snapshot(w io.Writer) (*queue.SnapshotInfo, error) {
+	return r.local.Snapshot(w)
+}
+
+func (r *Replica) Restore(reader io.Reader) (*queue.SnapshotInfo, error) {
+	if !r.promoted.Load() {
+		return nil, ErrReadOnly
+	}
+	return r.local.Restore(reader)
+}
+
+// readOnlyQueue allows stats and peeks
+type readOnlyQueue struct {
+	queue queue.Queue
+}
+
+func (q *readOnlyQueue) Write(queue.JSON) error {
+	return ErrReadOnly
+}
+
+func (q *readOnlyQueue) Read() (queue.JSON, error) {
+	return nil, ErrReadOnly
+}
+
+func (q *readOnlyQueue) WriteMessage(*queue.Message) error {
+	return ErrReadOnly
+}
+
+func (q *readOnlyQueue) ReadMessage(context.Context) (*queue.Message, error) {
+	return nil, ErrReadOnly
+}
+
+func (q *readOnlyQueue) Unread(*queue.Message) error {
+	return ErrReadOnly
+}
+
+func (q *readOnlyQueue) Peek(offset, n int) ([]*queue.Message, error) {
+	return q.queue.Peek(offset, n)
+}
+
+func (q *readOnlyQueue) Purge() (int64, error) {
+	return 0, ErrReadOnly
+}
+
+func (q *readOnlyQueue) Stats() queue.Stats {
+	return q.queue.Stats()
+}
@@ -0,0 +1,222 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+func init() {
+	HeartbeatInterval = 20 * time.Millisecond
+}
+
+// newTestServer serves what replicas need, like the api does
+func newTestServer(node Node) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		primary, err := node.Source()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/replication:snapshot":
+			primary.SnapshotAt(w, func(id string, seq uint64) {
+				w.Header().Set(IdHeader, id)
+				w.Header().Set(SeqHeader, strconv.FormatUint(seq, 10))
+			})
+		case "/v1/replication:stream":
+			seq, _ := strconv.ParseUint(r.Header.Get(SeqHeader), 10, 64)
+			err := primary.Stream(r.Context(), r.Header.Get(IdHeader), seq, r.RemoteAddr, w, w.(http.Flusher).Flush)
+			if err == ErrOutOfSync {
+				http.Error(w, err.Error(), http.StatusGone)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// eventually waits for condition, replication is asynchronous
+func eventually(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// dump is the state of every queue, to compare services
+func dump(s queue.Service) string {
+	state := map[string][]*queue.Message{}
+	names, _ := s.ListQueues()
+	for _, name := range names {
+		q, _ := s.GetQueue(name)
+		state[name], _ = q.Peek(0, 1000)
+	}
+	b, _ := json.Marshal(state)
+	return string(b)
+}
+
+func TestReplication(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		primary := NewPrimary(queue.NewMemoryService())
+		q, _ := primary.CreateQueue("existing")
+		q.Write(queue.JSON(`1`))
+		q.Write(queue.JSON(`2`))
+
+		server := newTestServer(primary)
+		defer server.Close()
+
+		replica := NewReplica(server.URL, queue.NewMemoryService())
+		replica.Start()
+		defer replica.Close()
+
+		synced := func() bool { return dump(replica) == dump(primary) }
+		biff.AssertTrue(eventually(synced))
+
+		a.Alternative("Follow changes", func(a *biff.A) {
+			other, _ := primary.CreateQueue("other")
+			other.WriteMessage(&queue.Message{Payload: queue.JSON(`"a"`), Headers: map[string]string{"k": "v"}})
+			other.Write(queue.JSON(`"b"`))
+			other.Write(queue.JSON(`"c"`))
+
+			m1, _ := other.ReadMessage(context.Background())
+			m2, _ := other.ReadMessage(context.Background())
+			other.Unread(m1)
+			other.Unread(m2) // out of order
+			q.Purge()
+			q.Write(queue.JSON(`3`))
+
+			biff.AssertTrue(eventually(synced))
+
+			replicated, _ := replica.GetQueue("other")
+			biff.AssertEqual(replicated.Stats().Len, int64(3))
+
+			primary.DeleteQueue("existing")
+			biff.AssertTrue(eventually(synced))
+		})
+
+		a.Alternative("Read-only", func(a *biff.A) {
+			_, err := replica.CreateQueue("new")
+			biff.AssertEqual(err, ErrReadOnly)
+
+			replicated, _ := replica.GetQueue("existing")
+			biff.AssertEqual(replicated.Write(queue.JSON(`3`)), ErrReadOnly)
+			_, err = replicated.ReadMessage(context.Background())
+			biff.AssertEqual(err, ErrReadOnly)
+
+			messages, _ := replicated.Peek(0, 10)
+			biff.AssertEqual(len(messages), 2)
+		})
+
+		a.Alternative("Lag", func(a *biff.A) {
+			q.Write(queue.JSON(`3`))
+
+			biff.AssertTrue(eventually(func() bool {
+				s := replica.Status()
+				return s.Seq == primary.Status().Seq && s.Queues["existing"].Lag == 0
+			}))
+
+			s := replica.Status()
+			biff.AssertEqual(s.Role, "replica")
+			biff.AssertTrue(s.Connected)
+			biff.AssertEqual(s.Queues["existing"].Seq, s.Seq)
+			biff.AssertFalse(s.Queues["existing"].Time.IsZero())
+
+			biff.AssertEqual(len(primary.Status().Replicas), 1)
+		})
+
+		a.Alternative("Restore on primary", func(a *biff.A) {
+			other := queue.NewMemoryService()
+			oq, _ := other.CreateQueue("restored")
+			oq.Write(queue.JSON(`"r"`))
+			buf := &bytes.Buffer{}
+			other.Snapshot(buf)
+
+			_, err := primary.Restore(buf)
+			biff.AssertNil(err)
+
+			// Replicas sync again
+			biff.AssertTrue(eventually(synced))
+			_, err = replica.GetQueue("restored")
+			biff.AssertNil(err)
+		})
+
+		a.Alternative("Out of sync", func(a *biff.A) {
+			replica.Close()
+			primary.LogSize = 2
+			for i := 0; i < 5; i++ {
+				q.Write(queue.JSON(strconv.Itoa(i)))
+			}
+
+			replica.Start()
+			biff.AssertTrue(eventually(synced))
+		})
+
+		a.Alternative("Promote", func(a *biff.A) {
+			server.CloseClientConnections()
+			server.Close()
+			biff.AssertNil(replica.Promote())
+
+			biff.AssertEqual(replica.Status().Role, "primary")
+			promoted, _ := replica.GetQueue("existing")
+			biff.AssertNil(promoted.Write(queue.JSON(`3`)))
+			_, err := replica.CreateQueue("new")
+			biff.AssertNil(err)
+
+			// Others can follow the promoted one
+			server := newTestServer(replica)
+			defer server.Close()
+			follower := NewReplica(server.URL, queue.NewMemoryService())
+			follower.Start()
+			defer follower.Close()
+
+			biff.AssertTrue(eventually(func() bool { return dump(follower) == dump(replica) }))
+		})
+
+		a.Alternative("Primary down", func(a *biff.A) {
+			server.CloseClientConnections()
+			server.Close()
+
+			biff.AssertTrue(eventually(func() bool {
+				s := replica.Status()
+				return !s.Connected && s.Error != ""
+			}))
+
+			// Still serving what it has
+			replicated, err := replica.GetQueue("existing")
+			biff.AssertNil(err)
+			biff.AssertEqual(replicated.Stats().Len, int64(2))
+		})
+	})
+}
+
+func TestStreamOutOfSync(t *testing.T) {
+
+	primary := NewPrimary(queue.NewMemoryService())
+	primary.CreateQueue("a")
+
+	status := primary.Status()
+
+	err := primary.Stream(context.Background(), "invented", 0, "", nil, nil)
+	biff.AssertTrue(errors.Is(err, ErrOutOfSync))
+
+	err = primary.Stream(context.Background(), status.Id, status.Seq+1, "", nil, nil)
+	biff.AssertTrue(errors.Is(err, ErrOutOfSync))
+}
@@ -0,0 +1,493 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+type command struct {
+	// arity is the exact number of arguments including the command name,
+	// or the minimum if negative, as in Redis
+	arity int
+	f     func(c *conn, args [][]byte)
+}
+
+var commands = map[string]command{
+	"PING":    {-1, (*conn).ping},
+	"ECHO":    {2, (*conn).echo},
+	"QUIT":    {1, (*conn).quit},
+	"SELECT":  {2, (*conn).selectDb},
+	"COMMAND": {-1, (*conn).command},
+	"CLIENT":  {-2, (*conn).client},
+	"LPUSH":   {-3, (*conn).push},
+	"RPUSH":   {-3, (*conn).push},
+	"LPOP":    {-2, (*conn).pop},
+	"RPOP":    {-2, (*conn).pop},
+	"BLPOP":   {-3, (*conn).blockingPop},
+	"BRPOP":   {-3, (*conn).blockingPop},
+	"LLEN":    {2, (*conn).llen},
+	"DEL":     {-2, (*conn).del},
+	"KEYS":    {2, (*conn).keys},
+}
+
+type popped struct {
+	queue   queue.Queue
+	message *queue.Message
+}
+
+type conn struct {
+	server *Server
+	nc     net.Conn
+	reader *bufio.Reader
+	w      writer
+	id     string
+	closed bool
+
+	// undelivered are the messages popped since the last flush, they go
+	// back to the queue if it fails
+	undelivered []popped
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		server: s,
+		nc:     nc,
+		reader: bufio.NewReader(nc),
+		w:      writer{bufio.NewWriter(nc)},
+		id:     uuid.New().String(),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *conn) Serve() {
+
+	defer close(c.done)
+	defer c.nc.Close()
+	defer c.cancel()
+
+	// Cancel closes the connection, Drain and Close use it
+	go func() {
+		<-c.ctx.Done()
+		c.nc.Close()
+	}()
+
+	for !c.closed {
+		args, err := readCommand(c.reader, c.server.MaxBulkSize)
+		if errors.Is(err, ErrProtocol) {
+			c.w.error("ERR Protocol error: " + strings.TrimPrefix(err.Error(), ErrProtocol.Error()+": "))
+			c.flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		c.handle(args)
+
+		// Pipelined commands are answered together
+		if c.reader.Buffered() == 0 || c.closed {
+			if err := c.flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Close cancels the connection and waits for Serve to return
+func (c *conn) Close() {
+	c.cancel()
+	<-c.done
+}
+
+func (c *conn) handle(args [][]byte) {
+
+	name := strings.ToUpper(string(args[0]))
+	cmd, exists := commands[name]
+	if !exists {
+		c.w.error("ERR unknown command '" + string(args[0]) + "'")
+		return
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return
+	}
+
+	cmd.f(c, args)
+}
+
+// flush gives back the popped messages if they could not be sent
+func (c *conn) flush() error {
+
+	err := c.w.Flush()
+	if err != nil {
+		for i := len(c.undelivered) - 1; i >= 0; i-- {
+			c.undelivered[i].queue.Unread(c.undelivered[i].message)
+		}
+	}
+	c.undelivered = c.undelivered[:0]
+
+	return err
+}
+
+func (c *conn) replyError(err error) {
+	c.w.error("ERR " + err.Error())
+}
+
+func (c *conn) ping(args [][]byte) {
+	if len(args) > 1 {
+		c.w.bulk(args[1])
+		return
+	}
+	c.w.simple("PONG")
+}
+
+func (c *conn) echo(args [][]byte) {
+	c.w.bulk(args[1])
+}
+
+func (c *conn) quit(args [][]byte) {
+	c.w.simple("OK")
+	c.closed = true
+}
+
+func (c *conn) selectDb(args [][]byte) {
+	if string(args[1]) != "0" {
+		c.w.error("ERR DB index is out of range")
+		return
+	}
+	c.w.simple("OK")
+}
+
+// command is asked by redis-cli on start, an empty reply is enough
+func (c *conn) command(args [][]byte) {
+	c.w.array(0)
+}
+
+// client accepts the names and library info that clients send on connect
+func (c *conn) client(args [][]byte) {
+	switch strings.ToUpper(string(args[1])) {
+	case "SETNAME", "SETINFO":
+		c.w.simple("OK")
+	default:
+		c.w.error("ERR unknown subcommand '" + string(args[1]) + "'")
+	}
+}
+
+func (c *conn) getOrCreateQueue(name string) (queue.Queue, error) {
+	q, err := c.server.Queues.GetQueue(name)
+	if errors.Is(err, queue.ErrQueueNotFound) {
+		q, err = c.server.Queues.CreateQueue(name)
+		if errors.Is(err, queue.ErrQueueAlreadyExists) {
+			q, err = c.server.Queues.GetQueue(name)
+		}
+	}
+	return q, err
+}
+
+// push writes values in order and replies with the queue length, values
+// written before an error are kept
+func (c *conn) push(args [][]byte) {
+
+	q, err := c.getOrCreateQueue(string(args[1]))
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+
+	for _, value := range args[2:] {
+		message, err := encode(value)
+		if err == nil {
+			err = q.WriteMessage(message)
+		}
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+	}
+
+	c.w.integer(q.Stats().Len)
+}
+
+// pop does not block, missing queues are empty
+func (c *conn) pop(args [][]byte) {
+
+	if len(args) > 3 {
+		c.w.error("ERR syntax error")
+		return
+	}
+
+	count := -1 // no count, reply a single value
+	if len(args) == 3 {
+		n, err := strconv.Atoi(string(args[2]))
+		if err != nil || n < 0 {
+			c.w.error("ERR value is out of range, must be positive")
+			return
+		}
+		count = n
+	}
+
+	q, err := c.server.Queues.GetQueue(string(args[1]))
+	if errors.Is(err, queue.ErrQueueNotFound) {
+		if count < 0 {
+			c.w.null()
+		} else {
+			c.w.nullArray()
+		}
+		return
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+
+	// A canceled context reads only what is already there
+	now, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if count < 0 {
+		message, err := q.ReadMessage(now)
+		if err != nil {
+			c.w.null()
+			return
+		}
+		c.undelivered = append(c.undelivered, popped{q, message})
+		c.w.bulk(decode(message))
+		return
+	}
+
+	values := [][]byte{}
+	for len(values) < count {
+		message, err := q.ReadMessage(now)
+		if err != nil {
+			break
+		}
+		c.undelivered = append(c.undelivered, popped{q, message})
+		values = append(values, decode(message))
+	}
+
+	if len(values) == 0 && count > 0 {
+		c.w.nullArray()
+		return
+	}
+	c.w.array(len(values))
+	for _, value := range values {
+		c.w.bulk(value)
+	}
+}
+
+// blockingPop replies with the key and the value of the first queue with a
+// message, keys are checked in order
+func (c *conn) blockingPop(args [][]byte) {
+
+	seconds, err := strconv.ParseFloat(string(args[len(args)-1]), 64)
+	if err != nil {
+		c.w.error("ERR timeout is not a float or out of range")
+		return
+	}
+	if seconds < 0 {
+		c.w.error("ERR timeout is negative")
+		return
+	}
+
+	keys := make([]string, len(args)-2)
+	queues := make([]queue.Queue, len(keys))
+	for i, arg := range args[1 : len(args)-1] {
+		keys[i] = string(arg)
+		if queues[i], err = c.getOrCreateQueue(keys[i]); err != nil {
+			c.replyError(err)
+			return
+		}
+	}
+
+	now, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, q := range queues {
+		if message, err := q.ReadMessage(now); err == nil {
+			c.replyPopped(keys[i], q, message)
+			return
+		}
+	}
+
+	// Nothing there, send pending replies before waiting
+	if err := c.flush(); err != nil {
+		c.cancel()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	if seconds > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds*float64(time.Second)))
+		defer cancel()
+	}
+
+	// Drain closes the connection
+	client := api.NewClient(c.id, strings.Join(keys, ","), "resp."+strings.ToUpper(string(args[0])), c.nc.RemoteAddr().String(), c.cancel)
+	untrack := api.TrackClient(client)
+	defer untrack()
+
+	type result struct {
+		index   int
+		message *queue.Message
+		err     error
+	}
+	results := make(chan result, len(queues))
+	for i, q := range queues {
+		go func(i int, q queue.Queue) {
+			message, err := q.ReadMessage(ctx)
+			results <- result{i, message, err}
+		}(i, q)
+	}
+
+	// Messages read by the others after the first one are given back
+	var first *result
+	for range queues {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+		if first != nil {
+			queues[r.index].Unread(r.message)
+			continue
+		}
+		first = &r
+		cancel()
+	}
+
+	if first == nil || c.ctx.Err() != nil {
+		if first != nil {
+			queues[first.index].Unread(first.message)
+		}
+		c.w.nullArray()
+		return
+	}
+
+	client.Reads++
+	c.replyPopped(keys[first.index], queues[first.index], first.message)
+}
+
+func (c *conn) replyPopped(key string, q queue.Queue, message *queue.Message) {
+	c.undelivered = append(c.undelivered, popped{q, message})
+	c.w.array(2)
+	c.w.bulk([]byte(key))
+	c.w.bulk(decode(message))
+}
+
+func (c *conn) llen(args [][]byte) {
+
+	q, err := c.server.Queues.GetQueue(string(args[1]))
+	if errors.Is(err, queue.ErrQueueNotFound) {
+		c.w.integer(0)
+		return
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+
+	c.w.integer(q.Stats().Len)
+}
+
+func (c *conn) del(args [][]byte) {
+
+	deleted := int64(0)
+	for _, key := range args[1:] {
+		err := c.server.Queues.DeleteQueue(string(key))
+		if errors.Is(err, queue.ErrQueueNotFound) {
+			continue
+		}
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+		deleted++
+	}
+
+	c.w.integer(deleted)
+}
+
+// keys matches with path.Match, queue names have no slashes
+func (c *conn) keys(args [][]byte) {
+
+	pattern := string(args[1])
+	if _, err := path.Match(pattern, ""); err != nil {
+		c.w.error("ERR invalid pattern")
+		return
+	}
+
+	names, err := c.server.Queues.ListQueues()
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	sort.Strings(names)
+
+	matched := []string{}
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			matched = append(matched, name)
+		}
+	}
+
+	c.w.array(len(matched))
+	for _, name := range matched {
+		c.w.bulk([]byte(name))
+	}
+}
+
+var ErrInvalidValue = errors.New("value must be JSON or UTF-8 text")
+
+// encode stores JSON values as they are and text as a JSON string with a
+// text/plain content type, so other front-ends see the same text
+func encode(value []byte) (*queue.Message, error) {
+
+	if json.Valid(value) {
+		return &queue.Message{Payload: value}, nil
+	}
+
+	if !utf8.Valid(value) {
+		return nil, ErrInvalidValue
+	}
+
+	payload, _ := json.Marshal(string(value))
+	return &queue.Message{
+		Headers: map[string]string{"content-type": "text/plain"},
+		Payload: payload,
+	}, nil
+}
+
+func decode(message *queue.Message) []byte {
+
+	contentType := message.Headers["content-type"]
+	if contentType == "" || strings.HasPrefix(contentType, "application/json") {
+		return message.Payload
+	}
+
+	text := ""
+	if json.Unmarshal(message.Payload, &text) != nil {
+		return message.Payload
+	}
+	return []byte(text)
+}
@@ -0,0 +1,121 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// readCommand reads a multi bulk request, or an inline command as typed in
+// telnet. Empty inline lines are skipped.
+func readCommand(r *bufio.Reader, maxBulkSize int) ([][]byte, error) {
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(line, "*") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			args := make([][]byte, len(fields))
+			for i, field := range fields {
+				args[i] = []byte(field)
+			}
+			return args, nil
+		}
+
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > 1024*1024 {
+			return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+		}
+		if n <= 0 {
+			continue
+		}
+
+		args := make([][]byte, n)
+		for i := range args {
+			if args[i], err = readBulk(r, maxBulkSize); err != nil {
+				return nil, err
+			}
+		}
+		return args, nil
+	}
+}
+
+func readBulk(r *bufio.Reader, maxBulkSize int) ([]byte, error) {
+
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("%w: expected '$', got '%.1s'", ErrProtocol, line)
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || (maxBulkSize > 0 && n > maxBulkSize) {
+		return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk does not end with CRLF", ErrProtocol)
+	}
+
+	return b[:n], nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// writer buffers replies until flush
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) error(s string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) nullArray() {
+	w.WriteString("*-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
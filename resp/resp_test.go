@@ -0,0 +1,188 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// testClient sends commands as redis-cli does
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *testClient) do(args ...string) interface{} {
+	c.send(args...)
+	return c.receive()
+}
+
+func (c *testClient) send(args ...string) {
+	w := writer{bufio.NewWriter(c.conn)}
+	w.array(len(args))
+	for _, arg := range args {
+		w.bulk([]byte(arg))
+	}
+	biff.AssertNil(w.Flush())
+}
+
+// receive returns string, int64, nil, error or []interface{}
+func (c *testClient) receive() interface{} {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := readReply(c.reader)
+	biff.AssertNil(err)
+	return reply
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		if line == "$-1" {
+			return nil, nil
+		}
+		n, _ := strconv.Atoi(line[1:])
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		if line == "*-1" {
+			return nil, nil
+		}
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, errors.New("unexpected reply " + line)
+}
+
+func TestServer(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		biff.AssertNil(err)
+
+		s := NewServer(qs)
+		go s.Serve(l)
+		defer s.Close()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		biff.AssertNil(err)
+		c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+
+		a.Alternative("Ping", func(a *biff.A) {
+			biff.AssertEqual(c.do("PING"), "PONG")
+			biff.AssertEqual(c.do("ping", "hello"), "hello")
+		})
+
+		a.Alternative("Unknown command", func(a *biff.A) {
+			biff.AssertEqual(c.do("SET", "a", "b"), errors.New("ERR unknown command 'SET'"))
+		})
+
+		a.Alternative("Wrong number of arguments", func(a *biff.A) {
+			biff.AssertEqual(c.do("LPUSH", "a"), errors.New("ERR wrong number of arguments for 'lpush' command"))
+		})
+
+		a.Alternative("LPUSH and BRPOP", func(a *biff.A) {
+			biff.AssertEqual(c.do("LPUSH", "jobs", "1", "two", `{"n":3}`), int64(3))
+			biff.AssertEqual(c.do("LLEN", "jobs"), int64(3))
+
+			q, err := qs.GetQueue("jobs")
+			biff.AssertNil(err)
+			biff.AssertEqual(q.Stats().Len, int64(3))
+
+			biff.AssertEqual(c.do("BRPOP", "jobs", "0"), []interface{}{"jobs", "1"})
+			biff.AssertEqual(c.do("BRPOP", "jobs", "0"), []interface{}{"jobs", "two"})
+			biff.AssertEqual(c.do("RPOP", "jobs"), `{"n":3}`)
+			biff.AssertEqual(c.do("RPOP", "jobs"), nil)
+		})
+
+		a.Alternative("Text is stored as JSON string", func(a *biff.A) {
+			c.do("RPUSH", "jobs", "hello")
+
+			q, _ := qs.GetQueue("jobs")
+			payload, _ := q.Read()
+			biff.AssertEqual(string(payload), `"hello"`)
+		})
+
+		a.Alternative("LPOP with count", func(a *biff.A) {
+			c.do("RPUSH", "jobs", "1", "2", "3")
+
+			biff.AssertEqual(c.do("LPOP", "jobs", "2"), []interface{}{"1", "2"})
+			biff.AssertEqual(c.do("LPOP", "jobs", "2"), []interface{}{"3"})
+			biff.AssertEqual(c.do("LPOP", "jobs", "2"), nil)
+			biff.AssertEqual(c.do("LPOP", "missing"), nil)
+		})
+
+		a.Alternative("BRPOP timeout", func(a *biff.A) {
+			biff.AssertEqual(c.do("BRPOP", "jobs", "0.05"), nil)
+		})
+
+		a.Alternative("BRPOP waits", func(a *biff.A) {
+			c.send("BRPOP", "a", "b", "0")
+
+			for { // wait for queues to be created
+				if names, _ := qs.ListQueues(); len(names) == 2 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			q, _ := qs.GetQueue("b")
+			q.Write(queue.JSON(`"hi"`))
+
+			biff.AssertEqual(c.receive(), []interface{}{"b", `"hi"`})
+
+			other, _ := qs.GetQueue("a")
+			biff.AssertEqual(other.Stats().Len, int64(0))
+		})
+
+		a.Alternative("DEL and KEYS", func(a *biff.A) {
+			qs.CreateQueue("jobs-1")
+			qs.CreateQueue("jobs-2")
+			qs.CreateQueue("other")
+
+			biff.AssertEqual(c.do("KEYS", "jobs-*"), []interface{}{"jobs-1", "jobs-2"})
+			biff.AssertEqual(c.do("DEL", "jobs-1", "other", "missing"), int64(2))
+			biff.AssertEqual(c.do("KEYS", "*"), []interface{}{"jobs-2"})
+		})
+
+		a.Alternative("Pipeline", func(a *biff.A) {
+			_, err := conn.Write([]byte("*3\r\n$5\r\nRPUSH\r\n$1\r\nq\r\n$1\r\n1\r\nLLEN q\r\n"))
+			biff.AssertNil(err)
+
+			biff.AssertEqual(c.receive(), int64(1))
+			biff.AssertEqual(c.receive(), int64(1))
+		})
+	})
+}
@@ -0,0 +1,53 @@
+// Package resp speaks the Redis protocol (RESP2) so redis-cli and Redis
+// client libraries can produce and consume tailon queues with list
+// commands.
+//
+// Keys are queue names. Pushes append to the queue and pops take the
+// oldest message whatever the side, so LPUSH with BRPOP and RPUSH with
+// LPOP both behave as FIFO queues; using a list as a stack is not
+// supported. Pushes and blocking pops create missing queues, like Redis
+// keys appear when used.
+package resp
+
+import (
+	"net"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/tcpserver"
+)
+
+// DefaultMaxBulkSize limits the size of each argument received
+const DefaultMaxBulkSize = 16 << 20
+
+type Server struct {
+	Queues      queue.Service
+	MaxBulkSize int
+
+	tcp tcpserver.Server
+}
+
+func NewServer(qs queue.Service) *Server {
+	return &Server{
+		Queues:      qs,
+		MaxBulkSize: DefaultMaxBulkSize,
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	return s.tcp.ListenAndServe(addr, s.newConn)
+}
+
+// Serve returns net.ErrClosed after Close
+func (s *Server) Serve(l net.Listener) error {
+	return s.tcp.Serve(l, s.newConn)
+}
+
+func (s *Server) newConn(nc net.Conn) tcpserver.Conn {
+	return newConn(s, nc)
+}
+
+// Close stops listening and closes every connection, messages popped but
+// not sent go back to their queues.
+func (s *Server) Close() error {
+	return s.tcp.Close()
+}
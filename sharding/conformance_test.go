@@ -0,0 +1,153 @@
+package sharding_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/queue/queuetest"
+	"github.com/fulldump/tailon/sharding"
+)
+
+func TestRouter_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+		r, err := sharding.NewRouter(sharding.Config{Addr: "http://127.0.0.1:1"}, queue.NewMemoryService())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	})
+}
+
+// TestRouters_Conformance runs the suite on two nodes, through the one
+// that does not own "my-queue", the name most cases use
+func TestRouters_Conformance(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T) queue.Service {
+
+		nodes := []*sharding.Router{startNode(t), startNode(t)}
+		membership := &sharding.Membership{Version: 1, Nodes: []string{nodes[0].Addr(), nodes[1].Addr()}}
+		for _, r := range nodes {
+			if _, err := r.SetMembership(membership); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s := &sharded{front: nodes[0], nodes: nodes}
+		if _, self := nodes[0].Owner("my-queue"); self {
+			s.front = nodes[1]
+		}
+		return s
+	})
+}
+
+// startNode serves a router over HTTP, other nodes reach it there
+func startNode(t *testing.T) *sharding.Router {
+
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	router, err := sharding.NewRouter(sharding.Config{Addr: server.URL, Token: "secret"}, queue.NewMemoryService())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := api.Build("test version", "", router)
+	b.WithInterceptors(api.PrettyErrorInterceptor, api.InjectPeerToken("secret"))
+	handler = b
+
+	return router
+}
+
+// sharded creates, lists and deletes queues through front, which sends
+// them to their owner, and uses each queue at its owner, as the api does
+// by proxying the requests
+type sharded struct {
+	front *sharding.Router
+	nodes []*sharding.Router
+}
+
+func (s *sharded) owner(name string) *sharding.Router {
+	for _, r := range s.nodes {
+		if _, self := r.Owner(name); self {
+			return r
+		}
+	}
+	return s.front
+}
+
+func (s *sharded) GetQueue(name string) (queue.Queue, error) {
+	return s.owner(name).GetQueue(name)
+}
+
+func (s *sharded) ListQueues() ([]string, error) {
+	return s.front.ListQueues()
+}
+
+func (s *sharded) CreateQueue(name string) (queue.Queue, error) {
+	if _, err := s.front.CreateQueue(name); err != nil {
+		return nil, err
+	}
+	return s.owner(name).GetQueue(name)
+}
+
+func (s *sharded) DeleteQueue(name string) error {
+	return s.front.DeleteQueue(name)
+}
+
+// Snapshot joins the snapshots of every node
+func (s *sharded) Snapshot(w io.Writer) (*queue.SnapshotInfo, error) {
+	all := queue.NewMemoryService()
+	for _, r := range s.nodes {
+		buf := &bytes.Buffer{}
+		if _, err := r.Snapshot(buf); err != nil {
+			return nil, err
+		}
+		if _, err := all.Restore(buf); err != nil {
+			return nil, err
+		}
+	}
+	return all.Snapshot(w)
+}
+
+// Restore sends every node the queues it owns
+func (s *sharded) Restore(reader io.Reader) (*queue.SnapshotInfo, error) {
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var info *queue.SnapshotInfo
+	for _, r := range s.nodes {
+		part := queue.NewMemoryService()
+		info, err = part.Restore(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		names, _ := part.ListQueues()
+		for _, name := range names {
+			if _, self := r.Owner(name); !self {
+				part.DeleteQueue(name)
+			}
+		}
+		buf := &bytes.Buffer{}
+		if _, err := part.Snapshot(buf); err != nil {
+			return nil, err
+		}
+		if _, err := r.Restore(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
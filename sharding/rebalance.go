@@ -0,0 +1,201 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+func (r *Router) triggerRebalance() {
+	select {
+	case r.trigger <- struct{}{}:
+	default: // one is pending already
+	}
+}
+
+func (r *Router) run(ctx context.Context) {
+
+	ticker := time.NewTicker(r.config.RebalanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.trigger:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		r.rebalanceOnce(ctx)
+	}
+}
+
+// rebalanceOnce moves every queue kept here that another node owns,
+// failed ones are tried again next time
+func (r *Router) rebalanceOnce(ctx context.Context) {
+
+	r.mutex.Lock()
+	r.rebalance.Running = true
+	r.mutex.Unlock()
+
+	names, _ := r.local.ListQueues()
+
+	errs := []error{}
+	moved, messages := int64(0), int64(0)
+	for _, name := range names {
+		owner, self := r.Owner(name)
+		if self {
+			continue
+		}
+		n, err := r.move(ctx, name, owner)
+		messages += int64(n)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("move '%s' to %s: %w", name, owner, err))
+			continue
+		}
+		moved++
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rebalance.Running = false
+	r.rebalance.Moved += moved
+	r.rebalance.Messages += messages
+	r.rebalance.Last = time.Now()
+	r.rebalance.Error = ""
+	if err := errors.Join(errs...); err != nil {
+		r.rebalance.Error = err.Error()
+	}
+}
+
+// move hands a queue over to its owner and returns the messages it took.
+// The queue is deleted here first, so writers fail and retry through the
+// new owner, and then its pending messages are imported there. Messages
+// the owner did not take are put back here, and consumers that give
+// messages back later send them to the owner (see localQueue).
+func (r *Router) move(ctx context.Context, name, owner string) (int, error) {
+
+	q, err := r.local.GetQueue(name)
+	if err != nil {
+		return 0, nil // deleted meanwhile
+	}
+
+	err = r.createRemote(ctx, owner, name)
+	if err != nil && !errors.Is(err, queue.ErrQueueAlreadyExists) {
+		return 0, err
+	}
+
+	if err := r.local.DeleteQueue(name); err != nil {
+		return 0, nil // deleted meanwhile
+	}
+
+	// A deleted queue still hands out its pending messages
+	drained, cancel := context.WithCancel(context.Background())
+	cancel()
+	messages := []*queue.Message{}
+	for {
+		message, err := q.ReadMessage(drained)
+		if err != nil {
+			break
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	written, err := r.importRemote(ctx, owner, name, messages)
+	if err != nil {
+		return written, errors.Join(err, r.putBack(name, messages[written:]))
+	}
+
+	return written, nil
+}
+
+// importRemote returns how many messages the owner took, also on errors
+func (r *Router) importRemote(ctx context.Context, node, name string, messages []*queue.Message) (int, error) {
+
+	body := &bytes.Buffer{}
+	e := json.NewEncoder(body)
+	for _, message := range messages {
+		e.Encode(message)
+	}
+
+	res, err := r.send(ctx, "POST", node, "/v1/queues/"+url.PathEscape(name)+":import", "application/x-ndjson", body)
+	if err != nil {
+		var remote *RemoteError
+		if errors.As(err, &remote) && remote.Written > 0 {
+			return remote.Written, err
+		}
+		return 0, err
+	}
+	res.Body.Close()
+
+	return len(messages), nil
+}
+
+// putBack gives messages back to the queue here, created if needed, for
+// the next rebalance. Capacity is not checked, they were in a queue already.
+func (r *Router) putBack(name string, messages []*queue.Message) error {
+
+	for {
+		q, err := r.local.GetQueue(name)
+		if errors.Is(err, queue.ErrQueueNotFound) {
+			q, err = r.local.CreateQueue(name)
+		}
+		if errors.Is(err, queue.ErrQueueAlreadyExists) {
+			continue // created meanwhile
+		}
+		if err != nil {
+			return err
+		}
+
+		// Last first, so they are read in order
+		for len(messages) > 0 {
+			if err := q.Unread(messages[len(messages)-1]); err != nil {
+				break // deleted meanwhile
+			}
+			messages = messages[:len(messages)-1]
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+	}
+}
+
+// localQueue is a queue kept by this node. Once it moves to another node,
+// the messages consumers give back go to the new owner.
+type localQueue struct {
+	queue.Queue
+	name   string
+	router *Router
+}
+
+func (q *localQueue) Unread(message *queue.Message) error {
+
+	err := q.Queue.Unread(message)
+	if !errors.Is(err, queue.ErrQueueNotFound) {
+		return err
+	}
+
+	owner, self := q.router.Owner(q.name)
+	if self {
+		return err // deleted, not moved
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.router.config.Timeout)
+	defer cancel()
+
+	_, err = q.router.importRemote(ctx, owner, q.name, []*queue.Message{message})
+	if err == nil || errors.Is(err, queue.ErrQueueNotFound) {
+		return err // deleted at the owner
+	}
+
+	return q.router.putBack(q.name, []*queue.Message{message})
+}
@@ -0,0 +1,131 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// RemoteError is an error response of another node, errors of queues are
+// kept so errors.Is works
+type RemoteError struct {
+	Node       string
+	StatusCode int
+	Code       string
+	Message    string
+
+	// Written is the number of messages imported by a failed import, -1 if
+	// unknown
+	Written int
+}
+
+var remoteErrors = map[string]error{
+	"queue_not_found":      queue.ErrQueueNotFound,
+	"queue_already_exists": queue.ErrQueueAlreadyExists,
+	"invalid_queue_name":   queue.ErrInvalidQueueName,
+	"queue_full":           queue.ErrQueueFull,
+	"message_too_large":    queue.ErrMessageTooLarge,
+	"unauthorized":         queue.ErrUnauthorized,
+	"invalid_node":         ErrInvalidNode,
+	"node_not_found":       ErrNodeNotFound,
+	"last_node":            ErrLastNode,
+}
+
+// Error is the message of the node, so forwarded errors read the same
+func (e *RemoteError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: %d %s", e.Node, e.StatusCode, e.Code)
+	}
+	return e.Message
+}
+
+func (e *RemoteError) Unwrap() error {
+	return remoteErrors[e.Code]
+}
+
+// call sends input as JSON and decodes the response into output, if not
+// nil. Connection errors are ErrUnreachable.
+func (r *Router) call(ctx context.Context, method, node, path string, input, output any) error {
+
+	var body io.Reader
+	if input != nil {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	res, err := r.send(ctx, method, node, path, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if output == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(output)
+}
+
+// send returns a *RemoteError if the status is not 2xx, the caller closes
+// the body
+func (r *Router) send(ctx context.Context, method, node, path, contentType string, body io.Reader) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, method, node+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ForwardedHeader, r.config.Addr)
+	if r.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.config.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, err)
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, readError(node, res)
+	}
+
+	return res, nil
+}
+
+func readError(node string, res *http.Response) error {
+
+	e := &RemoteError{
+		Node:       node,
+		StatusCode: res.StatusCode,
+		Code:       "unexpected_status",
+		Written:    -1,
+	}
+
+	body := struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&body) == nil && body.Error.Code != "" {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+	}
+
+	if written, err := strconv.Atoi(res.Header.Get("Written")); err == nil {
+		e.Written = written
+	}
+
+	return e
+}
@@ -0,0 +1,94 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Points of every node in the ring, more points spread the queues more
+// evenly
+const Points = 128
+
+// Ring assigns keys to nodes by consistent hashing, adding or removing a
+// node only moves the keys of that node
+type Ring struct {
+	nodes  []string
+	points []point
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// NewRing ignores empty and repeated nodes
+func NewRing(nodes ...string) *Ring {
+
+	r := &Ring{}
+	for _, node := range nodes {
+		if node != "" && !slices.Contains(r.nodes, node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	sort.Strings(r.nodes)
+
+	for _, node := range r.nodes {
+		for i := 0; i < Points; i++ {
+			r.points = append(r.points, point{hash: hash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// Nodes are sorted
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+func (r *Ring) Contains(node string) bool {
+	_, found := slices.BinarySearch(r.nodes, node)
+	return found
+}
+
+// Owner is the node of the first point after the hash of key, empty if
+// the ring has no nodes
+func (r *Ring) Owner(key string) string {
+
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].node
+}
+
+// hash mixes the bits of FNV-1a, alone it spreads similar keys poorly
+func hash(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h := f.Sum64()
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
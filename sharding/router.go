@@ -0,0 +1,481 @@
+// Package sharding spreads queues across several tailon nodes.
+//
+// Every queue is kept by one node, its owner, chosen by consistent hashing
+// of the queue name over the nodes. Any node takes requests for any queue:
+// the api proxies them to the owner, lists aggregate the queues of every
+// node and creates and deletes are forwarded. When nodes join or leave,
+// each node moves the queues it no longer owns to their new owner.
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+type Config struct {
+	Addr              string        `usage:"Url other nodes reach this one at, sharding is disabled if empty"`
+	Nodes             string        `usage:"Comma separated urls of the nodes, this one is added if missing"`
+	Join              string        `usage:"Url of a node, this one asks to be added to its nodes"`
+	RebalanceInterval time.Duration `usage:"Time between checks for queues owned by other nodes"`
+	Timeout           time.Duration `usage:"Maximum time for requests to other nodes, except moving queues"`
+	Token             string        `usage:"Secret the nodes send each other, it protects changes of the nodes"`
+}
+
+var DefaultConfig = Config{
+	RebalanceInterval: 30 * time.Second,
+	Timeout:           10 * time.Second,
+}
+
+// ForwardedHeader marks requests from a node to another one, which serves
+// them with its own queues instead of routing them again. Nodes may
+// disagree on owners for a moment while the nodes change.
+const ForwardedHeader = "Sharding-Forwarded"
+
+var (
+	ErrNotOwner     = errors.New("queue kept by another node")
+	ErrInvalidNode  = errors.New("invalid node url")
+	ErrNodeNotFound = errors.New("node not found")
+	ErrLastNode     = errors.New("the last node can not be removed")
+	ErrUnreachable  = errors.New("node unreachable")
+)
+
+// Membership is the list of nodes, versions tell which one is newer
+type Membership struct {
+	Version uint64   `json:"version"`
+	Nodes   []string `json:"nodes"`
+}
+
+// newer breaks ties between changes made at the same time on different
+// nodes, so all of them end up with the same list
+func (m *Membership) newer(than *Membership) bool {
+	if m.Version != than.Version {
+		return m.Version > than.Version
+	}
+	return strings.Join(m.Nodes, ",") > strings.Join(than.Nodes, ",")
+}
+
+type Status struct {
+	Addr      string          `json:"addr"`
+	Version   uint64          `json:"version"`
+	Nodes     []string        `json:"nodes"`
+	Queues    int             `json:"queues"` // kept by this node
+	Rebalance RebalanceStatus `json:"rebalance"`
+}
+
+type RebalanceStatus struct {
+	Running  bool      `json:"running"`
+	Moved    int64     `json:"moved"`    // queues moved to other nodes
+	Messages int64     `json:"messages"` // moved with them
+	Last     time.Time `json:"last,omitzero"`
+	Error    string    `json:"error,omitempty"` // of the last rebalance
+}
+
+// Router is the queue service of a node, queues of other nodes are
+// reached over HTTP. Only the api routes requests for single queues,
+// other protocols are served with the queues of this node.
+type Router struct {
+	HTTPClient *http.Client
+
+	config Config
+	local  *queue.MemoryService
+
+	mutex      sync.RWMutex
+	membership *Membership
+	ring       *Ring
+	rebalance  RebalanceStatus
+
+	trigger chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// New returns a started Router
+func New(c Config, local *queue.MemoryService) (*Router, error) {
+	r, err := NewRouter(c, local)
+	if err != nil {
+		return nil, err
+	}
+	r.Start()
+	return r, nil
+}
+
+func NewRouter(c Config, local *queue.MemoryService) (*Router, error) {
+
+	if c.RebalanceInterval <= 0 {
+		c.RebalanceInterval = DefaultConfig.RebalanceInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultConfig.Timeout
+	}
+
+	addr, err := normalize(c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c.Addr = addr
+
+	nodes := []string{c.Addr}
+	for _, node := range strings.Split(c.Nodes, ",") {
+		if strings.TrimSpace(node) == "" {
+			continue
+		}
+		node, err := normalize(node)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	r := &Router{
+		HTTPClient: http.DefaultClient,
+		config:     c,
+		local:      local,
+		trigger:    make(chan struct{}, 1),
+	}
+	r.setMembership(&Membership{Nodes: nodes})
+
+	return r, nil
+}
+
+// normalize checks node is an absolute http url, without the trailing
+// slash so every node writes it the same
+func normalize(node string) (string, error) {
+	node = strings.TrimSuffix(strings.TrimSpace(node), "/")
+	u, err := url.Parse(node)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidNode, node)
+	}
+	return node, nil
+}
+
+// setMembership must be called with the mutex held
+func (r *Router) setMembership(m *Membership) {
+	r.ring = NewRing(m.Nodes...)
+	r.membership = &Membership{Version: m.Version, Nodes: r.ring.Nodes()}
+}
+
+// Start moves the queues of other nodes now, periodically and on
+// changes, and joins the nodes of config.Join
+func (r *Router) Start() {
+
+	r.triggerRebalance() // restored or left by a previous run
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.run(ctx)
+	}()
+	if r.config.Join != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.join(ctx, r.config.Join)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(r.done)
+	}()
+}
+
+func (r *Router) Close() error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	<-r.done
+	r.cancel = nil
+	return nil
+}
+
+func (r *Router) Addr() string {
+	return r.config.Addr
+}
+
+// Local has the queues kept by this node
+func (r *Router) Local() *queue.MemoryService {
+	return r.local
+}
+
+// Owner returns the node that keeps the queue name, self is true if it is
+// this one
+func (r *Router) Owner(name string) (owner string, self bool) {
+	r.mutex.RLock()
+	owner = r.ring.Owner(name)
+	r.mutex.RUnlock()
+	return owner, owner == r.config.Addr
+}
+
+func (r *Router) Membership() *Membership {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return &Membership{Version: r.membership.Version, Nodes: slices.Clone(r.membership.Nodes)}
+}
+
+func (r *Router) Status() *Status {
+
+	names, _ := r.local.ListQueues()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return &Status{
+		Addr:      r.config.Addr,
+		Version:   r.membership.Version,
+		Nodes:     slices.Clone(r.membership.Nodes),
+		Queues:    len(names),
+		Rebalance: r.rebalance,
+	}
+}
+
+// SetMembership replaces the nodes if m is newer, then this node moves
+// away the queues it no longer owns
+func (r *Router) SetMembership(m *Membership) (*Status, error) {
+
+	if len(m.Nodes) == 0 {
+		return nil, ErrLastNode
+	}
+	nodes := make([]string, len(m.Nodes))
+	for i, node := range m.Nodes {
+		var err error
+		if nodes[i], err = normalize(node); err != nil {
+			return nil, err
+		}
+	}
+	m = &Membership{Version: m.Version, Nodes: NewRing(nodes...).Nodes()}
+
+	r.mutex.Lock()
+	changed := m.newer(r.membership)
+	if changed {
+		r.setMembership(m)
+	}
+	r.mutex.Unlock()
+
+	if changed {
+		r.triggerRebalance()
+	}
+
+	return r.Status(), nil
+}
+
+// AddNode adds a running node and tells every node about it
+func (r *Router) AddNode(ctx context.Context, addr string) (*Status, error) {
+
+	addr, err := normalize(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sharding has to be enabled there
+	if err := r.call(ctx, "GET", addr, "/v1/sharding", nil, &Status{}); err != nil {
+		return nil, err
+	}
+
+	return r.change(ctx, func(nodes []string) ([]string, error) {
+		return append(nodes, addr), nil
+	})
+}
+
+// RemoveNode tells every node, the removed one too, so it hands over its
+// queues
+func (r *Router) RemoveNode(ctx context.Context, addr string) (*Status, error) {
+
+	addr, err := normalize(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.change(ctx, func(nodes []string) ([]string, error) {
+		i := slices.Index(nodes, addr)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: '%s'", ErrNodeNotFound, addr)
+		}
+		if len(nodes) == 1 {
+			return nil, ErrLastNode
+		}
+		return slices.Delete(nodes, i, i+1), nil
+	})
+}
+
+// change applies a new version of the nodes here and sends it to the old
+// and new nodes. A change is sent again when repeated, nodes that were not
+// reached get it then.
+func (r *Router) change(ctx context.Context, f func(nodes []string) ([]string, error)) (*Status, error) {
+
+	r.mutex.Lock()
+	old := r.membership
+	nodes, err := f(slices.Clone(old.Nodes))
+	if err != nil {
+		r.mutex.Unlock()
+		return nil, err
+	}
+	m := &Membership{Version: old.Version, Nodes: NewRing(nodes...).Nodes()}
+	if !slices.Equal(m.Nodes, old.Nodes) {
+		m.Version++
+		r.setMembership(m)
+	}
+	r.mutex.Unlock()
+
+	r.triggerRebalance()
+
+	targets := []string{}
+	for _, node := range append(slices.Clone(old.Nodes), m.Nodes...) {
+		if node != r.config.Addr && !slices.Contains(targets, node) {
+			targets = append(targets, node)
+		}
+	}
+
+	errs := make([]error, len(targets))
+	wg := &sync.WaitGroup{}
+	for i, node := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.call(ctx, "PUT", node, "/v1/sharding", m, &Status{})
+		}()
+	}
+	wg.Wait()
+
+	return r.Status(), errors.Join(errs...)
+}
+
+// join asks the node at addr to add this one, until it succeeds
+func (r *Router) join(ctx context.Context, addr string) {
+
+	delay := 100 * time.Millisecond
+	for ctx.Err() == nil {
+		err := r.call(ctx, "POST", addr, "/v1/sharding:add", map[string]string{"addr": r.config.Addr}, &Status{})
+		if err == nil {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay = min(delay*2, 10*time.Second)
+	}
+}
+
+// GetQueue fails with ErrNotOwner for queues of other nodes
+func (r *Router) GetQueue(name string) (queue.Queue, error) {
+	if owner, self := r.Owner(name); !self {
+		return nil, fmt.Errorf("%w: '%s' is at %s", ErrNotOwner, name, owner)
+	}
+
+	q, err := r.local.GetQueue(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localQueue{Queue: q, name: name, router: r}, nil
+}
+
+// ListQueues fails if a node can not be reached, partial lists could be
+// taken as complete
+func (r *Router) ListQueues() ([]string, error) {
+
+	names, err := r.local.ListQueues()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := r.Membership().Nodes
+	lists := make([][]string, len(nodes))
+	errs := make([]error, len(nodes))
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	for i, node := range nodes {
+		if node == r.config.Addr {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.call(ctx, "GET", node, "/v1/queues", nil, &lists[i])
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	// While moving, a queue may be in two nodes
+	for _, list := range lists {
+		names = append(names, list...)
+	}
+	sort.Strings(names)
+
+	return slices.Compact(names), nil
+}
+
+// CreateQueue returns a nil queue if another node keeps it
+func (r *Router) CreateQueue(name string) (queue.Queue, error) {
+
+	if err := queue.ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	owner, self := r.Owner(name)
+	if self {
+		q, err := r.local.CreateQueue(name)
+		if err != nil {
+			return nil, err
+		}
+		return &localQueue{Queue: q, name: name, router: r}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+
+	return nil, r.createRemote(ctx, owner, name)
+}
+
+func (r *Router) DeleteQueue(name string) error {
+
+	owner, self := r.Owner(name)
+	if self {
+		return r.local.DeleteQueue(name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+
+	return r.call(ctx, "DELETE", owner, "/v1/queues/"+url.PathEscape(name), nil, nil)
+}
+
+// Snapshot has the queues of this node only
+func (r *Router) Snapshot(w io.Writer) (*queue.SnapshotInfo, error) {
+	return r.local.Snapshot(w)
+}
+
+// Restore loads the snapshot here, queues of other nodes are moved to them
+// next
+func (r *Router) Restore(reader io.Reader) (*queue.SnapshotInfo, error) {
+	info, err := r.local.Restore(reader)
+	r.triggerRebalance()
+	return info, err
+}
+
+func (r *Router) createRemote(ctx context.Context, node, name string) error {
+	return r.call(ctx, "POST", node, "/v1/queues", map[string]string{"name": name}, nil)
+}
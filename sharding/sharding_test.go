@@ -0,0 +1,128 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+func TestRing(t *testing.T) {
+
+	nodes := []string{"http://a", "http://b", "http://c"}
+	ring := NewRing(nodes...)
+
+	owners := map[string]string{}
+	count := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := "queue-" + strconv.Itoa(i)
+		owners[key] = ring.Owner(key)
+		count[owners[key]]++
+	}
+
+	biff.AssertEqual(ring.Nodes(), nodes)
+	biff.AssertEqual(NewRing("http://c", "http://b", "http://a", "http://a", "").Owner("queue-1"), owners["queue-1"])
+	biff.AssertEqual(NewRing().Owner("queue-1"), "")
+
+	for _, node := range nodes {
+		if count[node] < 700 || count[node] > 1300 {
+			t.Errorf("%s owns %d of 3000 keys", node, count[node])
+		}
+	}
+
+	// Keys only move to the new node
+	ring = NewRing(append(nodes, "http://d")...)
+	moved := 0
+	for key, owner := range owners {
+		if newOwner := ring.Owner(key); newOwner != owner {
+			biff.AssertEqual(newOwner, "http://d")
+			moved++
+		}
+	}
+	if moved < 450 || moved > 1050 {
+		t.Errorf("%d of 3000 keys moved", moved)
+	}
+}
+
+func TestRouter(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		r, err := NewRouter(Config{Addr: "http://a/", Nodes: "http://b, http://a"}, queue.NewMemoryService())
+		biff.AssertNil(err)
+
+		biff.AssertEqual(r.Addr(), "http://a")
+		biff.AssertEqual(r.Membership().Nodes, []string{"http://a", "http://b"})
+
+		// A queue for each node
+		names := map[bool]string{}
+		for i := 0; len(names) < 2; i++ {
+			name := "queue-" + strconv.Itoa(i)
+			_, self := r.Owner(name)
+			if names[self] == "" {
+				names[self] = name
+			}
+		}
+
+		a.Alternative("Local queue", func(a *biff.A) {
+			_, err := r.CreateQueue(names[true])
+			biff.AssertNil(err)
+
+			_, err = r.GetQueue(names[true])
+			biff.AssertNil(err)
+		})
+
+		a.Alternative("Queue of another node", func(a *biff.A) {
+			r.Local().CreateQueue(names[false])
+
+			_, err := r.GetQueue(names[false])
+			biff.AssertTrue(errors.Is(err, ErrNotOwner))
+		})
+
+		a.Alternative("Invalid node", func(a *biff.A) {
+			_, err := NewRouter(Config{Addr: "a:8080"}, queue.NewMemoryService())
+			biff.AssertTrue(errors.Is(err, ErrInvalidNode))
+
+			_, err = r.SetMembership(&Membership{Version: 1, Nodes: []string{"http://a", "b"}})
+			biff.AssertTrue(errors.Is(err, ErrInvalidNode))
+		})
+
+		a.Alternative("Newer membership", func(a *biff.A) {
+			status, err := r.SetMembership(&Membership{Version: 2, Nodes: []string{"http://c/", "http://a"}})
+			biff.AssertNil(err)
+			biff.AssertEqual(status.Nodes, []string{"http://a", "http://c"})
+
+			status, _ = r.SetMembership(&Membership{Version: 1, Nodes: []string{"http://a"}})
+			biff.AssertEqual(status.Version, uint64(2))
+			biff.AssertEqual(status.Nodes, []string{"http://a", "http://c"})
+
+			// Ties are broken the same way by every node
+			status, _ = r.SetMembership(&Membership{Version: 2, Nodes: []string{"http://a", "http://b"}})
+			biff.AssertEqual(status.Nodes, []string{"http://a", "http://c"})
+		})
+
+		a.Alternative("Remove nodes", func(a *biff.A) {
+			_, err := r.RemoveNode(context.Background(), "http://c")
+			biff.AssertTrue(errors.Is(err, ErrNodeNotFound))
+
+			r.SetMembership(&Membership{Version: 1, Nodes: []string{"http://a"}})
+			_, err = r.RemoveNode(context.Background(), "http://a")
+			biff.AssertEqual(err, ErrLastNode)
+		})
+	})
+}
+
+func TestRemoteError(t *testing.T) {
+
+	var err error = &RemoteError{Code: "queue_not_found", Message: "queue not found: 'a'"}
+	biff.AssertTrue(errors.Is(err, queue.ErrQueueNotFound))
+	biff.AssertEqual(err.Error(), "queue not found: 'a'")
+
+	err = &RemoteError{Node: "http://a", StatusCode: 500, Code: "internal_error"}
+	biff.AssertEqual(errors.Unwrap(err), nil)
+	biff.AssertEqual(err.Error(), "http://a: 500 internal_error")
+}
@@ -0,0 +1,519 @@
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+var supportedVersions = []string{"1.2", "1.1", "1.0"}
+
+// Headers handled by the protocol, the rest are stored with the message
+var protocolHeaders = map[string]bool{
+	"destination":    true,
+	"content-length": true,
+	"content-type":   true,
+	"receipt":        true,
+	"transaction":    true,
+}
+
+type conn struct {
+	server  *Server
+	nc      net.Conn
+	reader  *bufio.Reader
+	id      string
+	version string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	writeMutex sync.Mutex
+
+	mutex         sync.Mutex
+	subscriptions map[string]*subscription
+	acks          map[string]*subscription // by ack id
+	lastAck       uint64
+	transactions  map[string][]*Frame
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		server:        s,
+		nc:            nc,
+		reader:        bufio.NewReader(nc),
+		id:            uuid.New().String(),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		subscriptions: map[string]*subscription{},
+		acks:          map[string]*subscription{},
+		transactions:  map[string][]*Frame{},
+	}
+}
+
+// errorFrame is a protocol error, the connection is closed after sending it
+type errorFrame struct {
+	message string
+	detail  string
+}
+
+func (e *errorFrame) Error() string {
+	return e.message
+}
+
+func protocolError(format string, a ...interface{}) error {
+	return &errorFrame{message: fmt.Sprintf(format, a...)}
+}
+
+func (c *conn) Serve() {
+
+	defer close(c.done)
+	defer c.cleanup()
+
+	// Cancel closes the connection, Drain and Close use it
+	go func() {
+		<-c.ctx.Done()
+		c.nc.Close()
+	}()
+
+	for {
+		f, err := readFrame(c.reader, c.version != "" && c.version != "1.0", c.server.MaxFrameSize)
+		if err != nil {
+			if c.ctx.Err() == nil && !errors.Is(err, net.ErrClosed) && err != io.EOF {
+				c.sendError(nil, protocolError("%s", err))
+			}
+			return
+		}
+
+		if err := c.handle(f); err != nil {
+			c.sendError(f, err)
+			return
+		}
+
+		if f.Command == "DISCONNECT" {
+			return
+		}
+	}
+}
+
+// Close cancels the connection and waits for Serve to return
+func (c *conn) Close() {
+	c.cancel()
+	<-c.done
+}
+
+func (c *conn) handle(f *Frame) error {
+
+	if c.version == "" && f.Command != "CONNECT" && f.Command != "STOMP" {
+		return protocolError("expected CONNECT, got %s", f.Command)
+	}
+
+	switch f.Command {
+	case "CONNECT", "STOMP":
+		return c.connect(f)
+	case "SEND", "ACK", "NACK":
+		if tx := f.Headers["transaction"]; tx != "" {
+			return c.buffer(tx, f)
+		}
+		return c.apply(f)
+	case "SUBSCRIBE":
+		err := c.subscribe(f)
+		if err == nil {
+			c.receipt(f)
+		}
+		return err
+	case "UNSUBSCRIBE":
+		err := c.unsubscribe(f)
+		if err == nil {
+			c.receipt(f)
+		}
+		return err
+	case "BEGIN", "COMMIT", "ABORT":
+		err := c.transaction(f)
+		if err == nil {
+			c.receipt(f)
+		}
+		return err
+	case "DISCONNECT":
+		c.receipt(f)
+		return nil
+	}
+
+	return protocolError("unknown command %s", f.Command)
+}
+
+// apply SEND, ACK and NACK outside of a transaction
+func (c *conn) apply(f *Frame) error {
+
+	var err error
+	switch f.Command {
+	case "SEND":
+		err = c.send(f)
+	case "ACK", "NACK":
+		err = c.ack(f)
+	}
+
+	if err == nil {
+		c.receipt(f)
+	}
+
+	return err
+}
+
+func (c *conn) connect(f *Frame) error {
+
+	if c.version != "" {
+		return protocolError("already connected")
+	}
+
+	version := "1.0"
+	if accept, exists := f.Headers["accept-version"]; exists {
+		version = ""
+		accepted := strings.Split(accept, ",")
+		for _, v := range supportedVersions {
+			if contains(accepted, v) {
+				version = v
+				break
+			}
+		}
+		if version == "" {
+			c.version = "1.2" // so the error frame is readable
+			return &errorFrame{
+				message: "unsupported protocol version",
+				detail:  "Supported protocol versions are " + strings.Join(supportedVersions, " "),
+			}
+		}
+	}
+	c.version = version
+
+	return c.write(NewFrame("CONNECTED",
+		"version", version,
+		"server", "tailon",
+		"session", c.id,
+		"heart-beat", "0,0",
+	))
+}
+
+func (c *conn) receipt(f *Frame) {
+	if receipt := f.Headers["receipt"]; receipt != "" {
+		c.write(NewFrame("RECEIPT", "receipt-id", receipt))
+	}
+}
+
+func (c *conn) write(f *Frame) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return f.writeTo(c.nc, c.version != "1.0")
+}
+
+func (c *conn) sendError(f *Frame, err error) {
+
+	e := &errorFrame{}
+	if !errors.As(err, &e) {
+		e = &errorFrame{message: err.Error()}
+	}
+
+	frame := NewFrame("ERROR", "message", e.message)
+	if f != nil && f.Headers["receipt"] != "" {
+		frame.Headers["receipt-id"] = f.Headers["receipt"]
+	}
+	if e.detail != "" {
+		frame.Headers["content-type"] = "text/plain"
+		frame.Body = []byte(e.detail)
+	}
+
+	c.write(frame)
+}
+
+// queueName maps a destination to a queue
+func queueName(destination string) string {
+	return strings.TrimPrefix(destination, "/queue/")
+}
+
+func (c *conn) send(f *Frame) error {
+
+	destination, exists := f.Headers["destination"]
+	if !exists {
+		return protocolError("missing destination header")
+	}
+
+	q, err := c.server.Queues.GetQueue(queueName(destination))
+	if err != nil {
+		return err
+	}
+
+	message := &queue.Message{Payload: f.Body}
+
+	// Queues hold JSON, other content is stored as a JSON string and
+	// restored when delivered
+	contentType := f.Headers["content-type"]
+	isJSON := strings.HasPrefix(contentType, "application/json") || (contentType == "" && json.Valid(f.Body))
+	if !isJSON {
+		if contentType == "" {
+			contentType = "text/plain"
+		}
+		message.Payload, _ = json.Marshal(string(f.Body))
+		message.Headers = map[string]string{"content-type": contentType}
+	} else if !json.Valid(f.Body) {
+		return protocolError("body is not valid JSON")
+	}
+
+	for k, v := range f.Headers {
+		if protocolHeaders[k] {
+			continue
+		}
+		if message.Headers == nil {
+			message.Headers = map[string]string{}
+		}
+		message.Headers[k] = v
+	}
+
+	return q.WriteMessage(message)
+}
+
+func (c *conn) buffer(tx string, f *Frame) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	frames, exists := c.transactions[tx]
+	if !exists {
+		return protocolError("unknown transaction '%s'", tx)
+	}
+	c.transactions[tx] = append(frames, f)
+
+	return nil
+}
+
+func (c *conn) transaction(f *Frame) error {
+
+	tx := f.Headers["transaction"]
+	if tx == "" {
+		return protocolError("missing transaction header")
+	}
+
+	c.mutex.Lock()
+	frames, exists := c.transactions[tx]
+	if f.Command == "BEGIN" {
+		if !exists {
+			c.transactions[tx] = []*Frame{}
+		}
+	} else {
+		delete(c.transactions, tx)
+	}
+	c.mutex.Unlock()
+
+	switch {
+	case f.Command == "BEGIN" && exists:
+		return protocolError("transaction '%s' already started", tx)
+	case f.Command != "BEGIN" && !exists:
+		return protocolError("unknown transaction '%s'", tx)
+	case f.Command == "COMMIT":
+		for _, frame := range frames {
+			delete(frame.Headers, "transaction")
+			if err := c.apply(frame); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *conn) subscribe(f *Frame) error {
+
+	destination, exists := f.Headers["destination"]
+	if !exists {
+		return protocolError("missing destination header")
+	}
+
+	id, exists := f.Headers["id"]
+	if !exists {
+		if c.version != "1.0" {
+			return protocolError("missing id header")
+		}
+		id = destination
+	}
+
+	ack := f.Headers["ack"]
+	switch ack {
+	case "":
+		ack = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return protocolError("invalid ack mode '%s'", ack)
+	}
+
+	prefetch := DefaultPrefetch
+	if p, exists := f.Headers["prefetch-count"]; exists {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 {
+			return protocolError("invalid prefetch-count '%s'", p)
+		}
+		prefetch = n
+	}
+
+	name := queueName(destination)
+	q, err := c.server.Queues.GetQueue(name)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, exists := c.subscriptions[id]; exists {
+		return protocolError("subscription '%s' already exists", id)
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	s := &subscription{
+		conn:        c,
+		id:          id,
+		destination: destination,
+		queue:       q,
+		ack:         ack,
+		slots:       make(chan struct{}, prefetch),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+
+	// Drain closes the whole connection
+	s.client = api.NewClient(c.id+"/"+id, name, "stomp.SUBSCRIBE", c.nc.RemoteAddr().String(), c.cancel)
+	untrack := api.TrackClient(s.client)
+
+	c.subscriptions[id] = s
+
+	go func() {
+		defer close(s.done)
+		defer untrack()
+		s.run()
+	}()
+
+	return nil
+}
+
+func (c *conn) unsubscribe(f *Frame) error {
+
+	id, exists := f.Headers["id"]
+	if !exists {
+		id, exists = f.Headers["destination"] // 1.0
+	}
+	if !exists {
+		return protocolError("missing id header")
+	}
+
+	c.mutex.Lock()
+	s, exists := c.subscriptions[id]
+	delete(c.subscriptions, id)
+	c.mutex.Unlock()
+
+	if !exists {
+		return protocolError("unknown subscription '%s'", id)
+	}
+
+	s.stop()
+
+	return nil
+}
+
+func (c *conn) ack(f *Frame) error {
+
+	c.mutex.Lock()
+
+	var s *subscription
+	var index int
+	if id, exists := f.Headers["id"]; exists {
+		s = c.acks[id]
+		if s != nil {
+			index = s.indexOf(func(d *delivery) bool { return d.ackId == id })
+		}
+	} else {
+		// 1.0 and 1.1 acknowledge by message-id and subscription
+		s = c.subscriptions[f.Headers["subscription"]]
+		if s == nil && len(c.subscriptions) == 1 {
+			for _, only := range c.subscriptions {
+				s = only
+			}
+		}
+		if s != nil {
+			messageId := f.Headers["message-id"]
+			index = s.indexOf(func(d *delivery) bool { return d.messageId == messageId })
+		}
+	}
+
+	if s == nil || index < 0 {
+		c.mutex.Unlock()
+		return protocolError("unknown message")
+	}
+
+	// client mode acknowledges every message up to this one
+	from := index
+	if s.ack == "client" {
+		from = 0
+	}
+	acked := append([]*delivery{}, s.pending[from:index+1]...)
+	s.pending = append(s.pending[:from], s.pending[index+1:]...)
+	for _, d := range acked {
+		delete(c.acks, d.ackId)
+	}
+
+	c.mutex.Unlock()
+
+	if f.Command == "NACK" {
+		for i := len(acked) - 1; i >= 0; i-- {
+			s.queue.Unread(acked[i].message)
+		}
+	}
+
+	for range acked {
+		<-s.slots
+	}
+
+	return nil
+}
+
+// cleanup gives back every unacknowledged message
+func (c *conn) cleanup() {
+
+	c.cancel()
+
+	c.mutex.Lock()
+	subscriptions := c.subscriptions
+	c.subscriptions = map[string]*subscription{}
+	c.mutex.Unlock()
+
+	for _, s := range subscriptions {
+		s.stop()
+	}
+
+	c.nc.Close()
+}
+
+func (c *conn) nextAckId() string {
+	c.lastAck++
+	return strconv.FormatUint(c.lastAck, 10)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.TrimSpace(item) == s {
+			return true
+		}
+	}
+	return false
+}
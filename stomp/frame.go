@@ -0,0 +1,207 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Frame is a STOMP frame. Repeated headers keep the first value, as the
+// spec says.
+type Frame struct {
+	Command string
+	Headers map[string]string
+	Body    []byte
+}
+
+func NewFrame(command string, headers ...string) *Frame {
+	f := &Frame{
+		Command: command,
+		Headers: map[string]string{},
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.Headers[headers[i]] = headers[i+1]
+	}
+	return f
+}
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// readFrame skips heart-beats (empty lines) between frames. Headers are
+// unescaped if escape is true, which is the case since STOMP 1.1 except
+// for CONNECT frames.
+func readFrame(r *bufio.Reader, escape bool, maxSize int) (*Frame, error) {
+
+	size := 0
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		size += len(line)
+		if err != nil {
+			return "", err
+		}
+		if maxSize > 0 && size > maxSize {
+			return "", ErrFrameTooLarge
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+	}
+
+	command := ""
+	for command == "" {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		command = line
+		size = 0
+	}
+
+	f := NewFrame(command)
+	unescape := escape && command != "CONNECT" && command != "STOMP"
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("malformed header '%s'", line)
+		}
+		if unescape {
+			if key, err = unescapeHeader(key); err != nil {
+				return nil, err
+			}
+			if value, err = unescapeHeader(value); err != nil {
+				return nil, err
+			}
+		}
+		if _, exists := f.Headers[key]; !exists {
+			f.Headers[key] = value
+		}
+	}
+
+	if contentLength, exists := f.Headers["content-length"]; exists {
+		n, err := strconv.Atoi(contentLength)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid content-length '%s'", contentLength)
+		}
+		if maxSize > 0 && size+n > maxSize {
+			return nil, ErrFrameTooLarge
+		}
+		f.Body = make([]byte, n+1)
+		if _, err := io.ReadFull(r, f.Body); err != nil {
+			return nil, err
+		}
+		if f.Body[n] != 0 {
+			return nil, errors.New("frame does not end with NULL")
+		}
+		f.Body = f.Body[:n]
+		return f, nil
+	}
+
+	body := []byte{}
+	for {
+		chunk, err := r.ReadSlice(0)
+		body = append(body, chunk...)
+		if maxSize > 0 && size+len(body) > maxSize {
+			return nil, ErrFrameTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	f.Body = body[:len(body)-1]
+
+	return f, nil
+}
+
+// writeTo escapes headers if escape is true, except for CONNECTED frames.
+// Headers are sorted to make frames predictable.
+func (f *Frame) writeTo(w io.Writer, escape bool) error {
+
+	escape = escape && f.Command != "CONNECTED"
+
+	b := &bytes.Buffer{}
+	b.WriteString(f.Command)
+	b.WriteByte('\n')
+
+	keys := make([]string, 0, len(f.Headers))
+	for k := range f.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := f.Headers[k]
+		if escape {
+			k, v = escapeHeader(k), escapeHeader(v)
+		}
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+
+	b.WriteByte('\n')
+	b.Write(f.Body)
+	b.WriteByte(0)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+var headerEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\r", "\\r",
+	"\n", "\\n",
+	":", "\\c",
+)
+
+func escapeHeader(s string) string {
+	return headerEscaper.Replace(s)
+}
+
+func unescapeHeader(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", errors.New("invalid escape at the end of header")
+		}
+		switch s[i] {
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			return "", fmt.Errorf("invalid escape '\\%c'", s[i])
+		}
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,56 @@
+// Package stomp is a STOMP 1.0, 1.1 and 1.2 front-end so off-the-shelf
+// clients can publish and consume tailon queues.
+//
+// Destinations are queue names, optionally prefixed by /queue/. Queues are
+// not created on demand. Subscriptions with ack client or
+// client-individual receive up to prefetch-count unacknowledged messages
+// (DefaultPrefetch) and the ones not acknowledged when the subscription
+// ends go back to the queue.
+package stomp
+
+import (
+	"net"
+
+	"github.com/fulldump/tailon/queue"
+	"github.com/fulldump/tailon/tcpserver"
+)
+
+// DefaultMaxFrameSize limits the frames received
+const DefaultMaxFrameSize = 16 << 20
+
+// DefaultPrefetch is the maximum of unacknowledged messages for a
+// subscription when the client does not set prefetch-count
+const DefaultPrefetch = 100
+
+type Server struct {
+	Queues       queue.Service
+	MaxFrameSize int
+
+	tcp tcpserver.Server
+}
+
+func NewServer(qs queue.Service) *Server {
+	return &Server{
+		Queues:       qs,
+		MaxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	return s.tcp.ListenAndServe(addr, s.newConn)
+}
+
+// Serve returns net.ErrClosed after Close
+func (s *Server) Serve(l net.Listener) error {
+	return s.tcp.Serve(l, s.newConn)
+}
+
+func (s *Server) newConn(nc net.Conn) tcpserver.Conn {
+	return newConn(s, nc)
+}
+
+// Close stops listening and closes every connection, unacknowledged
+// messages go back to their queues.
+func (s *Server) Close() error {
+	return s.tcp.Close()
+}
@@ -0,0 +1,167 @@
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+
+	"github.com/fulldump/tailon/queue"
+)
+
+// testClient is a bare STOMP 1.2 client
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	biff.AssertNil(err)
+
+	c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	c.send(NewFrame("CONNECT", "accept-version", "1.1,1.2", "host", "localhost"))
+
+	connected := c.receive()
+	biff.AssertEqual(connected.Command, "CONNECTED")
+	biff.AssertEqual(connected.Headers["version"], "1.2")
+
+	return c
+}
+
+func (c *testClient) send(f *Frame) {
+	biff.AssertNil(f.writeTo(c.conn, true))
+}
+
+func (c *testClient) receive() *Frame {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := readFrame(c.reader, true, 0)
+	biff.AssertNil(err)
+	return f
+}
+
+// nothing asserts no frame arrives in a short time
+func (c *testClient) nothing() {
+	c.conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := c.reader.Peek(1)
+	biff.AssertNotNil(err)
+	c.reader.Reset(c.conn) // the timeout is sticky in bufio
+}
+
+func TestServer(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		qs := queue.NewMemoryService()
+		q, _ := qs.CreateQueue("my-queue")
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		biff.AssertNil(err)
+
+		s := NewServer(qs)
+		go s.Serve(l)
+		defer s.Close()
+
+		c := dial(l.Addr().String())
+
+		a.Alternative("Send JSON", func(a *biff.A) {
+			c.send(&Frame{
+				Command: "SEND",
+				Headers: map[string]string{"destination": "/queue/my-queue", "receipt": "r1", "x-key": "a:b"},
+				Body:    []byte(`{"hello":"world"}`),
+			})
+
+			biff.AssertEqual(c.receive().Headers["receipt-id"], "r1")
+
+			message, _ := q.ReadMessage(context.Background())
+			biff.AssertEqual(string(message.Payload), `{"hello":"world"}`)
+			biff.AssertEqual(message.Headers, map[string]string{"x-key": "a:b"})
+		})
+
+		a.Alternative("Send text and subscribe", func(a *biff.A) {
+			c.send(&Frame{
+				Command: "SEND",
+				Headers: map[string]string{"destination": "my-queue", "content-type": "text/plain"},
+				Body:    []byte("hello"),
+			})
+			c.send(NewFrame("SUBSCRIBE", "id", "0", "destination", "/queue/my-queue"))
+
+			m := c.receive()
+			biff.AssertEqual(m.Command, "MESSAGE")
+			biff.AssertEqual(m.Headers["subscription"], "0")
+			biff.AssertEqual(m.Headers["message-id"], "1")
+			biff.AssertEqual(m.Headers["content-type"], "text/plain")
+			biff.AssertEqual(string(m.Body), "hello")
+		})
+
+		a.Alternative("Client individual ack", func(a *biff.A) {
+			q.Write(queue.JSON(`1`))
+			q.Write(queue.JSON(`2`))
+
+			c.send(NewFrame("SUBSCRIBE", "id", "s", "destination", "my-queue", "ack", "client-individual", "prefetch-count", "1"))
+
+			first := c.receive()
+			biff.AssertEqual(string(first.Body), "1")
+			c.nothing()
+
+			a.Alternative("Ack", func(a *biff.A) {
+				c.send(NewFrame("ACK", "id", first.Headers["ack"]))
+
+				biff.AssertEqual(string(c.receive().Body), "2")
+			})
+
+			a.Alternative("Nack", func(a *biff.A) {
+				c.send(NewFrame("NACK", "id", first.Headers["ack"]))
+
+				again := c.receive()
+				biff.AssertEqual(string(again.Body), "1")
+				biff.AssertEqual(again.Headers["message-id"], "1")
+			})
+
+			a.Alternative("Disconnect without ack", func(a *biff.A) {
+				c.send(NewFrame("DISCONNECT", "receipt", "bye"))
+				biff.AssertEqual(c.receive().Command, "RECEIPT")
+
+				for q.Stats().Len != 2 {
+					time.Sleep(time.Millisecond)
+				}
+				payload, _ := q.Read()
+				biff.AssertEqual(string(payload), "1")
+			})
+		})
+
+		a.Alternative("Transaction", func(a *biff.A) {
+			c.send(NewFrame("BEGIN", "transaction", "tx"))
+			c.send(&Frame{
+				Command: "SEND",
+				Headers: map[string]string{"destination": "my-queue", "transaction": "tx"},
+				Body:    []byte(`1`),
+			})
+			c.send(NewFrame("COMMIT", "transaction", "tx", "receipt", "done"))
+
+			biff.AssertEqual(c.receive().Headers["receipt-id"], "done")
+			biff.AssertEqual(q.Stats().Len, int64(1))
+		})
+
+		a.Alternative("Unknown destination", func(a *biff.A) {
+			c.send(NewFrame("SUBSCRIBE", "id", "0", "destination", "/queue/invented"))
+
+			e := c.receive()
+			biff.AssertEqual(e.Command, "ERROR")
+			biff.AssertEqual(e.Headers["message"], "queue not found: 'invented'")
+		})
+	})
+}
+
+func TestHeaderEscaping(t *testing.T) {
+
+	s, err := unescapeHeader(escapeHeader("a:b\nc\\d\r"))
+	biff.AssertNil(err)
+	biff.AssertEqual(s, "a:b\nc\\d\r")
+
+	_, err = unescapeHeader(`\t`)
+	biff.AssertNotNil(err)
+}
@@ -0,0 +1,142 @@
+package stomp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/fulldump/tailon/api"
+	"github.com/fulldump/tailon/queue"
+)
+
+type delivery struct {
+	ackId     string
+	messageId string
+	message   *queue.Message
+}
+
+type subscription struct {
+	conn        *conn
+	id          string
+	destination string
+	queue       queue.Queue
+	ack         string
+	client      *api.Client
+
+	pending []*delivery   // protected by conn.mutex
+	slots   chan struct{} // one per unacknowledged message
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (s *subscription) run() {
+	for {
+		if s.ack != "auto" {
+			select {
+			case s.slots <- struct{}{}:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		message, err := s.queue.ReadMessage(s.ctx)
+		if errors.Is(err, queue.ErrQueueNotFound) {
+			s.conn.sendError(nil, &errorFrame{
+				message: "queue deleted",
+				detail:  "Queue for destination " + s.destination + " has been deleted",
+			})
+			s.conn.cancel()
+			return
+		}
+		if err != nil {
+			return // unsubscribed or disconnected
+		}
+
+		d := &delivery{
+			messageId: strconv.FormatUint(message.Id, 10),
+			message:   message,
+		}
+		frame := s.frame(message, d.messageId)
+
+		if s.ack != "auto" {
+			s.conn.mutex.Lock()
+			d.ackId = s.conn.nextAckId()
+			s.pending = append(s.pending, d)
+			s.conn.acks[d.ackId] = s
+			s.conn.mutex.Unlock()
+
+			if s.conn.version == "1.2" {
+				frame.Headers["ack"] = d.ackId
+			}
+		}
+
+		if err := s.conn.write(frame); err != nil {
+			if s.ack == "auto" {
+				s.queue.Unread(message) // not delivered, give it back
+			}
+			return // pending ones are given back by stop
+		}
+
+		s.client.Reads++
+	}
+}
+
+// frame restores the content type of non JSON messages
+func (s *subscription) frame(message *queue.Message, messageId string) *Frame {
+
+	f := NewFrame("MESSAGE")
+	for k, v := range message.Headers {
+		f.Headers[k] = v
+	}
+	if f.Headers["content-type"] == "" {
+		f.Headers["content-type"] = "application/json"
+	}
+	f.Headers["subscription"] = s.id
+	f.Headers["message-id"] = messageId
+	f.Headers["destination"] = s.destination
+
+	f.Body = message.Payload
+	if contentType := message.Headers["content-type"]; contentType != "" && !strings.HasPrefix(contentType, "application/json") {
+		text := ""
+		if json.Unmarshal(message.Payload, &text) == nil {
+			f.Body = []byte(text)
+		}
+	}
+	f.Headers["content-length"] = strconv.Itoa(len(f.Body))
+
+	return f
+}
+
+// indexOf must be called with conn.mutex held
+func (s *subscription) indexOf(match func(d *delivery) bool) int {
+	for i, d := range s.pending {
+		if match(d) {
+			return i
+		}
+	}
+	return -1
+}
+
+// stop waits for the subscription to end and gives back unacknowledged
+// messages in reverse order so they keep their position
+func (s *subscription) stop() {
+
+	s.cancel()
+	<-s.done
+
+	s.conn.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	for _, d := range pending {
+		delete(s.conn.acks, d.ackId)
+	}
+	s.conn.mutex.Unlock()
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		s.queue.Unread(pending[i].message)
+	}
+}
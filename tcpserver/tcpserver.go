@@ -0,0 +1,101 @@
+// Package tcpserver keeps track of the listeners and connections of the TCP
+// front-ends (STOMP, Redis protocol and MQTT), each one only implements its
+// Conn.
+package tcpserver
+
+import (
+	"net"
+	"sync"
+)
+
+// Conn is a connection speaking a protocol
+type Conn interface {
+	// Serve returns when the connection ends
+	Serve()
+	// Close ends the connection and waits for Serve to return
+	Close()
+}
+
+// Server is ready to use as a zero value
+type Server struct {
+	listeners map[net.Listener]bool
+	conns     map[Conn]bool
+	closed    bool
+	mutex     sync.Mutex
+}
+
+func (s *Server) ListenAndServe(addr string, newConn func(net.Conn) Conn) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l, newConn)
+}
+
+// Serve returns net.ErrClosed after Close
+func (s *Server) Serve(l net.Listener, newConn func(net.Conn) Conn) error {
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]bool{}
+		s.conns = map[Conn]bool{}
+	}
+	s.listeners[l] = true
+	s.mutex.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			nc.Close()
+			continue
+		}
+		c := newConn(nc)
+		s.conns[c] = true
+		s.mutex.Unlock()
+
+		go func() {
+			c.Serve()
+			s.mutex.Lock()
+			delete(s.conns, c)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Close stops listening and closes every connection
+func (s *Server) Close() error {
+
+	s.mutex.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	conns := make([]Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mutex.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package tcpserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/fulldump/biff"
+)
+
+// echo writes back every byte until the connection is closed
+type echo struct {
+	nc   net.Conn
+	done chan struct{}
+}
+
+func (e *echo) Serve() {
+	defer close(e.done)
+	io.Copy(e.nc, e.nc)
+}
+
+func (e *echo) Close() {
+	e.nc.Close()
+	<-e.done
+}
+
+func newEcho(nc net.Conn) Conn {
+	return &echo{nc: nc, done: make(chan struct{})}
+}
+
+func TestServer(t *testing.T) {
+
+	s := &Server{}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	biff.AssertNil(err)
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l, newEcho) }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	biff.AssertNil(err)
+	defer c.Close()
+
+	c.Write([]byte("hello"))
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(c, buffer)
+	biff.AssertNil(err)
+	biff.AssertEqual(string(buffer), "hello")
+
+	biff.AssertNil(s.Close())
+	biff.AssertTrue(errors.Is(<-served, net.ErrClosed))
+
+	_, err = c.Read(buffer)
+	biff.AssertEqual(err, io.EOF) // closed by Close
+
+	l2, _ := net.Listen("tcp", "127.0.0.1:0")
+	biff.AssertTrue(errors.Is(s.Serve(l2, newEcho), net.ErrClosed))
+	_, err = net.Dial("tcp", l2.Addr().String())
+	biff.AssertNotNil(err)
+}
@@ -0,0 +1,112 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type Config struct {
+	Cert               string `usage:"TLS certificate file, enables HTTPS"`
+	Key                string `usage:"TLS private key file"`
+	ClientCA           string `usage:"CA file to verify client certificates, enables mutual TLS"`
+	ClientCertOptional bool   `usage:"Accept clients without certificate when mutual TLS is enabled"`
+}
+
+func (c Config) Enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
+// Reloader keeps the certificates loaded from disk and swaps them on Reload.
+// Connections already established are not affected by a reload.
+type Reloader struct {
+	Config Config
+
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	mutex    sync.RWMutex
+}
+
+func New(c Config) (*Reloader, error) {
+	if c.Cert == "" || c.Key == "" {
+		return nil, errors.New("both certificate and key files are required")
+	}
+
+	r := &Reloader{
+		Config: c,
+	}
+
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads again certificate, key and client CA files. On error the
+// previous ones are kept.
+func (r *Reloader) Reload() error {
+
+	cert, err := tls.LoadX509KeyPair(r.Config.Cert, r.Config.Key)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	var clientCA *x509.CertPool
+	if r.Config.ClientCA != "" {
+		pem, err := os.ReadFile(r.Config.ClientCA)
+		if err != nil {
+			return fmt.Errorf("read client CA: %w", err)
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client CA '%s' has no valid certificates", r.Config.ClientCA)
+		}
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.clientCA = clientCA
+	r.mutex.Unlock()
+
+	return nil
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// TLSConfig returns a config that always uses the last loaded certificates.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+
+			c := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: r.GetCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}
+
+			if r.clientCA != nil {
+				c.ClientCAs = r.clientCA
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+				if r.Config.ClientCertOptional {
+					c.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+
+			return c, nil
+		},
+	}
+}
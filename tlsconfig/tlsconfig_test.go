@@ -0,0 +1,156 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fulldump/biff"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	kpem []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parentCert, parentKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	kder, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		kpem: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}),
+	}
+}
+
+func (c *testCert) keyPair() tls.Certificate {
+	kp, _ := tls.X509KeyPair(c.pem, c.kpem)
+	return kp
+}
+
+func serve(t *testing.T, r *Reloader) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+
+	return "https://" + l.Addr().String()
+}
+
+func client(ca *testCert, cert *testCert) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	c := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		c.Certificates = []tls.Certificate{cert.keyPair()}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+}
+
+func TestReloader(t *testing.T) {
+
+	biff.Alternative("Setup", func(a *biff.A) {
+
+		dir := t.TempDir()
+
+		ca := newTestCert(t, "ca", 1, nil)
+		server1 := newTestCert(t, "server1", 2, ca)
+		server2 := newTestCert(t, "server2", 3, ca)
+		alice := newTestCert(t, "alice", 4, ca)
+
+		c := Config{
+			Cert:     path.Join(dir, "cert.pem"),
+			Key:      path.Join(dir, "key.pem"),
+			ClientCA: path.Join(dir, "ca.pem"),
+		}
+		os.WriteFile(c.Cert, server1.pem, 0600)
+		os.WriteFile(c.Key, server1.kpem, 0600)
+		os.WriteFile(c.ClientCA, ca.pem, 0600)
+
+		r, err := New(c)
+		biff.AssertNil(err)
+
+		base := serve(t, r)
+
+		a.Alternative("Client without certificate is rejected", func(a *biff.A) {
+			_, err := client(ca, nil).Get(base)
+			biff.AssertNotNil(err)
+		})
+
+		a.Alternative("Client with certificate", func(a *biff.A) {
+			res, err := client(ca, alice).Get(base)
+			biff.AssertNil(err)
+			biff.AssertEqual(res.TLS.PeerCertificates[0].Subject.CommonName, "server1")
+		})
+
+		a.Alternative("Reload", func(a *biff.A) {
+			os.WriteFile(c.Cert, server2.pem, 0600)
+			os.WriteFile(c.Key, server2.kpem, 0600)
+			biff.AssertNil(r.Reload())
+
+			res, err := client(ca, alice).Get(base)
+			biff.AssertNil(err)
+			biff.AssertEqual(res.TLS.PeerCertificates[0].Subject.CommonName, "server2")
+		})
+
+		a.Alternative("Reload broken files keeps previous certificate", func(a *biff.A) {
+			os.WriteFile(c.Key, []byte("garbage"), 0600)
+			biff.AssertNotNil(r.Reload())
+
+			res, err := client(ca, alice).Get(base)
+			biff.AssertNil(err)
+			biff.AssertEqual(res.TLS.PeerCertificates[0].Subject.CommonName, "server1")
+		})
+	})
+}
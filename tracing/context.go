@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// W3C trace context headers
+const (
+	Traceparent = "traceparent"
+	Tracestate  = "tracestate"
+)
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext is what travels between processes.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID.IsValid() && c.SpanID.IsValid()
+}
+
+func (c SpanContext) Sampled() bool {
+	return c.Flags&1 == 1
+}
+
+// Traceparent formats the context as a version 00 traceparent header.
+func (c SpanContext) Traceparent() string {
+	return "00-" + c.TraceID.String() + "-" + c.SpanID.String() + "-" + hex.EncodeToString([]byte{c.Flags})
+}
+
+// ParseTraceparent reads a traceparent header, tracestate is optional.
+func ParseTraceparent(traceparent, tracestate string) (SpanContext, error) {
+
+	c := SpanContext{
+		TraceState: tracestate,
+	}
+
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return c, ErrInvalidTraceparent
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff {
+		return c, ErrInvalidTraceparent
+	}
+	if version[0] == 0 && len(parts) != 4 {
+		return c, ErrInvalidTraceparent
+	}
+
+	if n, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil || n != 16 || len(parts[1]) != 32 {
+		return c, ErrInvalidTraceparent
+	}
+	if n, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil || n != 8 || len(parts[2]) != 16 {
+		return c, ErrInvalidTraceparent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return c, ErrInvalidTraceparent
+	}
+	c.Flags = flags[0]
+
+	if !c.IsValid() {
+		return c, ErrInvalidTraceparent
+	}
+
+	return c, nil
+}
+
+func newTraceID() (t TraceID) {
+	rand.Read(t[:])
+	return
+}
+
+func newSpanID() (s SpanID) {
+	rand.Read(s[:])
+	return
+}
@@ -0,0 +1,199 @@
+// Package tracing propagates W3C trace context through queues and reports
+// enqueue/dequeue spans to a pluggable exporter.
+package tracing
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+// Same values as OpenTelemetry
+const (
+	SpanKindProducer SpanKind = 4
+	SpanKindConsumer SpanKind = 5
+)
+
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string // empty if the operation succeeded
+
+	tracer *Tracer
+}
+
+// SetAttribute is safe to call on a nil span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span and queues it to be exported, it is safe to call on
+// a nil span
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.tracer.enqueue(s)
+}
+
+// Fail ends the span of an operation that failed with err, it is safe to
+// call on a nil span
+func (s *Span) Fail(err error) {
+	if s == nil {
+		return
+	}
+	s.Error = err.Error()
+	s.Finish()
+}
+
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// Tracer creates spans and exports them in batches in background. A nil
+// Tracer creates no spans.
+type Tracer struct {
+	Exporter Exporter
+
+	pending []*Span
+	mutex   sync.Mutex
+	flush   chan chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	closed  sync.Once
+}
+
+const (
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+func NewTracer(e Exporter) *Tracer {
+	t := &Tracer{
+		Exporter: e,
+		flush:    make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go t.loop()
+
+	return t
+}
+
+// StartSpan creates a child of parent, or a new trace if parent is not
+// valid.
+func (t *Tracer) StartSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{
+		Name: name,
+		Kind: kind,
+		Context: SpanContext{
+			TraceID:    parent.TraceID,
+			SpanID:     newSpanID(),
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		},
+		Parent:     parent.SpanID,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		tracer:     t,
+	}
+
+	if !parent.IsValid() {
+		s.Context.TraceID = newTraceID()
+		s.Context.Flags = 1 // sampled
+		s.Parent = SpanID{}
+	}
+
+	return s
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	if !s.Context.Sampled() {
+		return
+	}
+
+	t.mutex.Lock()
+	t.pending = append(t.pending, s)
+	full := len(t.pending) >= batchSize
+	t.mutex.Unlock()
+
+	if full {
+		go t.Flush()
+	}
+}
+
+func (t *Tracer) export() {
+	t.mutex.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mutex.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.Exporter.Export(spans); err != nil {
+		log.Println("tracing: export:", err)
+	}
+}
+
+func (t *Tracer) loop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	defer close(t.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+			t.export()
+		case done := <-t.flush:
+			t.export()
+			close(done)
+		case <-t.stop:
+			t.export()
+			return
+		}
+	}
+}
+
+// Flush blocks until pending spans are exported.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+		<-done
+	case <-t.stop:
+	}
+}
+
+// Close exports pending spans and stops the background loop.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.closed.Do(func() {
+		close(t.stop)
+	})
+	<-t.stopped
+	return nil
+}
@@ -0,0 +1,137 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fulldump/biff"
+)
+
+const testTraceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func TestParseTraceparent(t *testing.T) {
+
+	c, err := ParseTraceparent(testTraceparent, "vendor=value")
+	biff.AssertNil(err)
+	biff.AssertEqual(c.TraceID.String(), "0af7651916cd43dd8448eb211c80319c")
+	biff.AssertEqual(c.SpanID.String(), "b7ad6b7169203331")
+	biff.AssertEqual(c.Sampled(), true)
+	biff.AssertEqual(c.TraceState, "vendor=value")
+	biff.AssertEqual(c.Traceparent(), testTraceparent)
+}
+
+func TestParseTraceparent_Invalid(t *testing.T) {
+
+	invalid := []string{
+		"",
+		"garbage",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01",
+	}
+
+	for _, traceparent := range invalid {
+		_, err := ParseTraceparent(traceparent, "")
+		biff.AssertEqual(err, ErrInvalidTraceparent)
+	}
+}
+
+type memoryExporter struct {
+	spans []*Span
+}
+
+func (e *memoryExporter) Export(spans []*Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestTracer_StartSpan(t *testing.T) {
+
+	e := &memoryExporter{}
+	tracer := NewTracer(e)
+
+	parent, _ := ParseTraceparent(testTraceparent, "")
+
+	span := tracer.StartSpan("my-queue publish", SpanKindProducer, parent)
+	span.Finish()
+
+	root := tracer.StartSpan("root", SpanKindProducer, SpanContext{})
+	root.Finish()
+
+	tracer.Flush()
+
+	biff.AssertEqual(len(e.spans), 2)
+	biff.AssertEqual(e.spans[0].Context.TraceID, parent.TraceID)
+	biff.AssertEqual(e.spans[0].Parent, parent.SpanID)
+	biff.AssertNotEqual(e.spans[0].Context.SpanID, parent.SpanID)
+	biff.AssertTrue(e.spans[1].Context.TraceID.IsValid())
+	biff.AssertNotEqual(e.spans[1].Context.TraceID, parent.TraceID)
+
+	tracer.Close()
+}
+
+func TestTracer_Nil(t *testing.T) {
+
+	var tracer *Tracer
+
+	span := tracer.StartSpan("nothing", SpanKindConsumer, SpanContext{})
+	span.SetAttribute("key", "value")
+	span.Finish()
+	span.Fail(io.ErrClosedPipe)
+
+	biff.AssertNil(span)
+}
+
+func TestOTLPExporter(t *testing.T) {
+
+	received := make(chan map[string]interface{}, 1)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		biff.AssertEqual(r.URL.Path, "/v1/traces")
+		biff.AssertEqual(r.Header.Get("Content-Type"), "application/json")
+		body, _ := io.ReadAll(r.Body)
+		request := map[string]interface{}{}
+		json.Unmarshal(body, &request)
+		received <- request
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(NewOTLPExporter(collector.URL+"/v1/traces", "tailon-test"))
+
+	parent, _ := ParseTraceparent(testTraceparent, "")
+	span := tracer.StartSpan("my-queue publish", SpanKindProducer, parent)
+	span.SetAttribute("messaging.destination.name", "my-queue")
+	span.Finish()
+
+	failed := tracer.StartSpan("my-queue receive", SpanKindConsumer, parent)
+	failed.Fail(io.ErrClosedPipe)
+
+	tracer.Close()
+
+	request := <-received
+	resource := request["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	biff.AssertEqualJson(resource["resource"], map[string]interface{}{
+		"attributes": []interface{}{
+			map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "tailon-test"}},
+		},
+	})
+
+	spans := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	biff.AssertEqual(len(spans), 2)
+
+	s := spans[0].(map[string]interface{})
+	biff.AssertEqual(s["traceId"], "0af7651916cd43dd8448eb211c80319c")
+	biff.AssertEqual(s["parentSpanId"], "b7ad6b7169203331")
+	biff.AssertEqual(s["name"], "my-queue publish")
+	biff.AssertEqual(s["kind"], 4.0)
+	biff.AssertNil(s["status"])
+
+	s = spans[1].(map[string]interface{})
+	biff.AssertEqualJson(s["status"], map[string]interface{}{"code": 2, "message": "io: read/write on closed pipe"})
+}
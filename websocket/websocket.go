@@ -0,0 +1,328 @@
+// Package websocket implements the RFC 6455 protocol, enough for tailon to
+// stream messages in both directions over a single connection.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+// Close codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	maxControlPayloadLen = 125
+)
+
+// DefaultReadLimit is the maximum size of a received message
+const DefaultReadLimit = 16 << 20
+
+var (
+	ErrBadHandshake     = errors.New("bad websocket handshake")
+	ErrOriginNotAllowed = errors.New("websocket origin not allowed")
+	ErrClosed           = errors.New("websocket closed")
+)
+
+// CloseError is returned by ReadMessage when the peer closes the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is a websocket connection. ReadMessage must be called from a single
+// goroutine, writes can be concurrent.
+type Conn struct {
+	ReadLimit int64
+
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool // clients mask their frames
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		ReadLimit: DefaultReadLimit,
+		conn:      conn,
+		reader:    reader,
+		client:    client,
+	}
+}
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ReadMessage returns the next data message. Pings are answered and pongs
+// ignored. A close from the peer is answered and returned as *CloseError.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+
+	messageType := 0
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.Close(closeErr.Code, "")
+			return 0, nil, closeErr
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = opcode
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		if c.ReadLimit > 0 && int64(len(message)+len(payload)) > c.ReadLimit {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		message = append(message, payload...)
+
+		if fin {
+			break
+		}
+	}
+
+	if messageType == TextMessage && !utf8.Valid(message) {
+		return 0, nil, c.fail(CloseInvalidPayload, "invalid utf-8")
+	}
+
+	return messageType, message, nil
+}
+
+// ReadJSON reads the next data message into v
+func (c *Conn) ReadJSON(v interface{}) error {
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(message, v)
+}
+
+func (c *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+
+	header := make([]byte, 2, 8)
+	if _, err = io.ReadFull(c.reader, header); err != nil {
+		return
+	}
+
+	fin = header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		err = c.fail(CloseProtocolError, "reserved bits set")
+		return
+	}
+	opcode = int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if masked == c.client {
+		err = c.fail(CloseProtocolError, "wrong masking")
+		return
+	}
+
+	switch length {
+	case 126:
+		if _, err = io.ReadFull(c.reader, header[:2]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(header[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.reader, header[:8]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(header[:8])
+	}
+
+	if opcode >= CloseMessage && (!fin || length > maxControlPayloadLen) {
+		err = c.fail(CloseProtocolError, "invalid control frame")
+		return
+	}
+	if c.ReadLimit > 0 && length > uint64(c.ReadLimit) {
+		err = c.fail(CloseMessageTooBig, "message too big")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return
+}
+
+// fail closes the connection because of a protocol error
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// WriteMessage sends a text or binary message in a single frame
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	return c.writeFrame(messageType, data)
+}
+
+// WriteJSON sends v as a text message
+func (c *Conn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(TextMessage, data)
+}
+
+// Ping sends a ping, the peer answers with a pong
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(PingMessage, data)
+}
+
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|byte(opcode))
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// writeTimeout prevents a stalled peer from blocking writers forever
+var writeTimeout = 30 * time.Second
+
+// Close sends a close frame with code and reason, then closes the
+// connection. It is safe to call more than once.
+func (c *Conn) Close(code int, reason string) error {
+
+	payload := []byte{}
+	if code != CloseNoStatus {
+		if len(reason) > maxControlPayloadLen-2 {
+			reason = reason[:maxControlPayloadLen-2]
+		}
+		payload = binary.BigEndian.AppendUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+	}
+	c.writeFrame(CloseMessage, payload)
+
+	return c.conn.Close()
+}
+
+// SetReadDeadline applies to the underlying connection
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
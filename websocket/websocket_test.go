@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fulldump/biff"
+)
+
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conn.ReadLimit = 1 << 20
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(message) == "close" {
+				conn.Close(CloseGoingAway, "bye")
+				return
+			}
+			conn.WriteMessage(messageType, message)
+		}
+	}))
+}
+
+func dial(s *httptest.Server) *Conn {
+	conn, _, err := Dial(context.Background(), "ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	biff.AssertNil(err)
+	return conn
+}
+
+func TestEcho(t *testing.T) {
+
+	s := echoServer()
+	defer s.Close()
+
+	conn := dial(s)
+	defer conn.Close(CloseNormal, "")
+
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		sent := strings.Repeat("a", size)
+		biff.AssertNil(conn.WriteMessage(TextMessage, []byte(sent)))
+
+		messageType, received, err := conn.ReadMessage()
+		biff.AssertNil(err)
+		biff.AssertEqual(messageType, TextMessage)
+		biff.AssertEqual(len(received), size)
+	}
+}
+
+func TestJSON(t *testing.T) {
+
+	s := echoServer()
+	defer s.Close()
+
+	conn := dial(s)
+	defer conn.Close(CloseNormal, "")
+
+	biff.AssertNil(conn.WriteJSON(map[string]string{"hello": "world"}))
+
+	received := map[string]string{}
+	biff.AssertNil(conn.ReadJSON(&received))
+	biff.AssertEqual(received["hello"], "world")
+}
+
+func TestPing(t *testing.T) {
+
+	s := echoServer()
+	defer s.Close()
+
+	conn := dial(s)
+	defer conn.Close(CloseNormal, "")
+
+	// The pong is skipped by ReadMessage
+	biff.AssertNil(conn.Ping([]byte("ping")))
+	biff.AssertNil(conn.WriteMessage(BinaryMessage, []byte{1, 2, 3}))
+
+	messageType, received, err := conn.ReadMessage()
+	biff.AssertNil(err)
+	biff.AssertEqual(messageType, BinaryMessage)
+	biff.AssertEqual(received, []byte{1, 2, 3})
+}
+
+func TestCloseFromServer(t *testing.T) {
+
+	s := echoServer()
+	defer s.Close()
+
+	conn := dial(s)
+
+	conn.WriteMessage(TextMessage, []byte("close"))
+
+	_, _, err := conn.ReadMessage()
+	closeErr := &CloseError{}
+	biff.AssertTrue(errors.As(err, &closeErr))
+	biff.AssertEqual(closeErr.Code, CloseGoingAway)
+	biff.AssertEqual(closeErr.Reason, "bye")
+
+	biff.AssertEqual(conn.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+}
+
+func TestReadLimit(t *testing.T) {
+
+	s := echoServer()
+	defer s.Close()
+
+	conn := dial(s)
+
+	conn.WriteMessage(TextMessage, make([]byte, 1<<20+1))
+
+	_, _, err := conn.ReadMessage()
+	closeErr := &CloseError{}
+	biff.AssertTrue(errors.As(err, &closeErr))
+	biff.AssertEqual(closeErr.Code, CloseMessageTooBig)
+}
+
+func TestBadHandshake(t *testing.T) {
+
+	s := echoServer()
+	defer s.Close()
+
+	res, err := http.Get(s.URL)
+	biff.AssertNil(err)
+	biff.AssertEqual(res.StatusCode, http.StatusBadRequest)
+}
+
+func TestCheckOrigin(t *testing.T) {
+
+	r := httptest.NewRequest("GET", "http://tailon:8080/v1/queues/q:websocket", nil)
+	biff.AssertNil(CheckOrigin(r, nil)) // not a browser
+
+	r.Header.Set("Origin", "http://tailon:8080")
+	biff.AssertNil(CheckOrigin(r, nil))
+
+	r.Header.Set("Origin", "https://evil.example.com")
+	biff.AssertTrue(errors.Is(CheckOrigin(r, nil), ErrOriginNotAllowed))
+	biff.AssertTrue(errors.Is(CheckOrigin(r, []string{"https://app.example.com"}), ErrOriginNotAllowed))
+	biff.AssertNil(CheckOrigin(r, []string{"https://app.example.com", "https://evil.example.com/"}))
+	biff.AssertNil(CheckOrigin(r, []string{"*"}))
+
+	r.Header.Set("Origin", "null")
+	biff.AssertTrue(errors.Is(CheckOrigin(r, nil), ErrOriginNotAllowed))
+}